@@ -0,0 +1,435 @@
+// Package acmeclient implements an ACME client to get certificates using
+// the dns-01 or tls-alpn-01 challenges.
+//
+// Unlike Go's autocert package, it gets a single certificate for all the
+// configured hosts, and supports wildcards (with dns-01).
+package acmeclient
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"blitiri.com.ar/go/gofer/config"
+	"blitiri.com.ar/go/gofer/trace"
+	"blitiri.com.ar/go/log"
+	"golang.org/x/crypto/acme"
+)
+
+// How often to check if the certificate needs renewing.
+var RenewCheckInterval = 1 * time.Hour
+
+// How long to wait before retrying after a failure. It is doubled on each
+// consecutive failure, up to RenewCheckInterval.
+var retryInterval = 1 * time.Minute
+
+// Maximum time to spend getting a certificate.
+var obtainTimeout = 10 * time.Minute
+
+// Manager gets and renews a certificate for the given hosts.
+type Manager struct {
+	hosts     []string
+	challenge string
+	email     string
+	cacheDir  string
+
+	dns              DNSProvider
+	propagationDelay time.Duration
+
+	client *acme.Client
+	tr     *trace.Trace
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+
+	// Host -> certificate for the tls-alpn-01 challenges in progress.
+	alpnCerts map[string]*tls.Certificate
+
+	registered bool
+}
+
+// New creates a new Manager based on the configuration. The certificate is
+// loaded from the cache if possible; it will be obtained (or renewed) in
+// the background.
+func New(conf config.AutoCerts, cacheDir string) (*Manager, error) {
+	hosts := slices.Clone(conf.Hosts)
+	slices.Sort(hosts)
+
+	m := &Manager{
+		hosts:            hosts,
+		challenge:        conf.Challenge,
+		email:            conf.Email,
+		cacheDir:         cacheDir,
+		propagationDelay: conf.DNS.PropagationDelay,
+		alpnCerts:        map[string]*tls.Certificate{},
+		tr:               trace.New("acmeclient", strings.Join(hosts, ",")),
+	}
+	m.tr.SetMaxEvents(1000)
+
+	if m.challenge == "dns-01" {
+		var err error
+		m.dns, err = NewDNSProvider(conf.DNS)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := os.MkdirAll(cacheDir, 0700); err != nil {
+		return nil, err
+	}
+	key, err := m.accountKey()
+	if err != nil {
+		return nil, fmt.Errorf("error loading ACME account key: %v", err)
+	}
+	m.client = &acme.Client{
+		Key:          key,
+		DirectoryURL: conf.AcmeURL,
+		UserAgent:    "gofer",
+	}
+	if m.client.DirectoryURL == "" {
+		m.client.DirectoryURL = acme.LetsEncryptURL
+	}
+
+	m.loadCached()
+
+	go m.renewLoop()
+	return m, nil
+}
+
+// TLSConfig returns a TLS configuration which uses the manager's
+// certificate, and answers the tls-alpn-01 challenges.
+func (m *Manager) TLSConfig() *tls.Config {
+	conf := &tls.Config{
+		GetCertificate: m.GetCertificate,
+		NextProtos:     []string{"h2", "http/1.1"},
+	}
+	if m.challenge == "tls-alpn-01" {
+		conf.NextProtos = append(conf.NextProtos, acme.ALPNProto)
+	}
+	return conf
+}
+
+// GetCertificate returns the certificate to use for the given ClientHello.
+func (m *Manager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if slices.Contains(hello.SupportedProtos, acme.ALPNProto) {
+		cert, ok := m.alpnCerts[strings.ToLower(hello.ServerName)]
+		if !ok {
+			return nil, fmt.Errorf("no tls-alpn-01 challenge for %q",
+				hello.ServerName)
+		}
+		return cert, nil
+	}
+
+	if m.cert == nil {
+		return nil, errors.New("certificate not available yet")
+	}
+	return m.cert, nil
+}
+
+// accountKey loads the ACME account key from the cache, or creates a new one
+// if there isn't one.
+func (m *Manager) accountKey() (crypto.Signer, error) {
+	path := filepath.Join(m.cacheDir, "gofer-acme-account.key")
+	buf, err := os.ReadFile(path)
+	if err == nil {
+		block, _ := pem.Decode(buf)
+		if block == nil {
+			return nil, fmt.Errorf("%s: no PEM data found", path)
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	buf = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	return key, os.WriteFile(path, buf, 0600)
+}
+
+// certPath returns the path to the cached certificate. It depends on the
+// hosts, so changing them results in a new certificate.
+func (m *Manager) certPath() string {
+	h := sha256.Sum256([]byte(strings.Join(m.hosts, ",")))
+	return filepath.Join(m.cacheDir,
+		"gofer-acme-"+hex.EncodeToString(h[:8])+".pem")
+}
+
+// loadCached loads the certificate from the cache, if there is a valid one.
+func (m *Manager) loadCached() {
+	buf, err := os.ReadFile(m.certPath())
+	if err != nil {
+		m.tr.Printf("no cached certificate: %v", err)
+		return
+	}
+
+	// The file has both the key and the chain.
+	cert, err := tls.X509KeyPair(buf, buf)
+	if err != nil {
+		m.tr.Errorf("error loading cached certificate: %v", err)
+		return
+	}
+
+	names := slices.Clone(cert.Leaf.DNSNames)
+	slices.Sort(names)
+	if !slices.Equal(names, m.hosts) {
+		m.tr.Printf("cached certificate is for %q, ignoring", names)
+		return
+	}
+	if time.Now().After(cert.Leaf.NotAfter) {
+		m.tr.Printf("cached certificate expired at %v, ignoring",
+			cert.Leaf.NotAfter)
+		return
+	}
+
+	m.tr.Printf("loaded cached certificate, expires %s",
+		cert.Leaf.NotAfter.Format(time.DateTime))
+	m.mu.Lock()
+	m.cert = &cert
+	m.mu.Unlock()
+}
+
+// writeCache writes the key and certificate chain to the cache.
+func (m *Manager) writeCache(key *ecdsa.PrivateKey, chain [][]byte) error {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	buf := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	for _, c := range chain {
+		buf = append(buf,
+			pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c})...)
+	}
+
+	path := m.certPath()
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, buf, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// needsRenewal returns true if we don't have a certificate, or if it is in
+// the last third of its lifetime.
+func (m *Manager) needsRenewal(now time.Time) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.cert == nil {
+		return true
+	}
+	leaf := m.cert.Leaf
+	lifetime := leaf.NotAfter.Sub(leaf.NotBefore)
+	return now.After(leaf.NotAfter.Add(-lifetime / 3))
+}
+
+func (m *Manager) renewLoop() {
+	retry := retryInterval
+	for {
+		wait := RenewCheckInterval
+		if m.needsRenewal(time.Now()) {
+			err := m.obtain()
+			if err != nil {
+				log.Errorf("acme %q: error getting certificate: %v",
+					m.hosts, err)
+				m.tr.Errorf("error getting certificate: %v", err)
+				wait = retry
+				retry = min(retry*2, RenewCheckInterval)
+			} else {
+				retry = retryInterval
+			}
+		}
+		time.Sleep(wait)
+	}
+}
+
+// obtain a new certificate from the CA.
+func (m *Manager) obtain() error {
+	ctx, cancel := context.WithTimeout(context.Background(), obtainTimeout)
+	defer cancel()
+
+	if err := m.register(ctx); err != nil {
+		return fmt.Errorf("error registering account: %v", err)
+	}
+
+	m.tr.Printf("creating order")
+	order, err := m.client.AuthorizeOrder(ctx, acme.DomainIDs(m.hosts...))
+	if err != nil {
+		return fmt.Errorf("error creating order: %v", err)
+	}
+
+	for _, u := range order.AuthzURLs {
+		if err := m.authorize(ctx, u); err != nil {
+			return err
+		}
+	}
+
+	order, err = m.client.WaitOrder(ctx, order.URI)
+	if err != nil {
+		return fmt.Errorf("error waiting for order: %v", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader,
+		&x509.CertificateRequest{DNSNames: m.hosts}, key)
+	if err != nil {
+		return err
+	}
+
+	m.tr.Printf("finalizing order")
+	chain, _, err := m.client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return fmt.Errorf("error finalizing order: %v", err)
+	}
+
+	cert := &tls.Certificate{PrivateKey: key, Certificate: chain}
+	cert.Leaf, err = x509.ParseCertificate(chain[0])
+	if err != nil {
+		return fmt.Errorf("error parsing certificate: %v", err)
+	}
+
+	if err := m.writeCache(key, chain); err != nil {
+		// Not fatal, we can use the certificate anyway.
+		log.Errorf("acme %q: error writing certificate to cache: %v",
+			m.hosts, err)
+	}
+
+	m.mu.Lock()
+	m.cert = cert
+	m.mu.Unlock()
+
+	log.Infof("acme %q: got new certificate, expires %s",
+		m.hosts, cert.Leaf.NotAfter.Format(time.DateTime))
+	m.tr.Printf("got new certificate, expires %s",
+		cert.Leaf.NotAfter.Format(time.DateTime))
+	return nil
+}
+
+func (m *Manager) register(ctx context.Context) error {
+	if m.registered {
+		return nil
+	}
+
+	acct := &acme.Account{}
+	if m.email != "" {
+		acct.Contact = []string{"mailto:" + m.email}
+	}
+	_, err := m.client.Register(ctx, acct, acme.AcceptTOS)
+	if err != nil && err != acme.ErrAccountAlreadyExists {
+		return err
+	}
+	m.registered = true
+	return nil
+}
+
+// authorize completes the challenge for the given authorization.
+func (m *Manager) authorize(ctx context.Context, url string) error {
+	z, err := m.client.GetAuthorization(ctx, url)
+	if err != nil {
+		return fmt.Errorf("error getting authorization: %v", err)
+	}
+	host := z.Identifier.Value
+	if z.Status == acme.StatusValid {
+		m.tr.Printf("%q: already authorized", host)
+		return nil
+	}
+
+	var chal *acme.Challenge
+	for _, c := range z.Challenges {
+		if c.Type == m.challenge {
+			chal = c
+			break
+		}
+	}
+	if chal == nil {
+		return fmt.Errorf("%q: the CA does not offer the %s challenge",
+			host, m.challenge)
+	}
+
+	switch m.challenge {
+	case "dns-01":
+		// For wildcards, the identifier is the base domain, which is also
+		// where the record goes.
+		value, err := m.client.DNS01ChallengeRecord(chal.Token)
+		if err != nil {
+			return err
+		}
+		name := "_acme-challenge." + host + "."
+		m.tr.Printf("%q: setting TXT record %q", host, name)
+		if err := m.dns.Present(ctx, name, value); err != nil {
+			return fmt.Errorf("%q: error setting DNS record: %v", host, err)
+		}
+		defer func() {
+			if err := m.dns.CleanUp(ctx, name, value); err != nil {
+				m.tr.Errorf("%q: error removing DNS record: %v", host, err)
+			}
+		}()
+
+		if m.propagationDelay > 0 {
+			m.tr.Printf("waiting %v for the record to propagate",
+				m.propagationDelay)
+			select {
+			case <-time.After(m.propagationDelay):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+	case "tls-alpn-01":
+		cert, err := m.client.TLSALPN01ChallengeCert(chal.Token, host)
+		if err != nil {
+			return err
+		}
+		m.setALPNCert(host, &cert)
+		defer m.setALPNCert(host, nil)
+	}
+
+	m.tr.Printf("%q: accepting %s challenge", host, m.challenge)
+	if _, err := m.client.Accept(ctx, chal); err != nil {
+		return fmt.Errorf("%q: error accepting challenge: %v", host, err)
+	}
+	if _, err := m.client.WaitAuthorization(ctx, z.URI); err != nil {
+		return fmt.Errorf("%q: authorization failed: %v", host, err)
+	}
+	m.tr.Printf("%q: authorized", host)
+	return nil
+}
+
+func (m *Manager) setALPNCert(host string, cert *tls.Certificate) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	host = strings.ToLower(host)
+	if cert == nil {
+		delete(m.alpnCerts, host)
+	} else {
+		m.alpnCerts[host] = cert
+	}
+}
@@ -0,0 +1,199 @@
+package acmeclient
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"blitiri.com.ar/go/gofer/config"
+	"blitiri.com.ar/go/gofer/trace"
+	"golang.org/x/crypto/acme"
+)
+
+func newTestManager(t *testing.T, hosts ...string) *Manager {
+	return &Manager{
+		hosts:     hosts,
+		challenge: "tls-alpn-01",
+		cacheDir:  t.TempDir(),
+		alpnCerts: map[string]*tls.Certificate{},
+		tr:        trace.New("test", t.Name()),
+	}
+}
+
+// selfSigned returns a self-signed certificate chain and its key.
+func selfSigned(t *testing.T, notBefore, notAfter time.Time,
+	hosts ...string) ([][]byte, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: hosts[0]},
+		DNSNames:     hosts,
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return [][]byte{der}, key
+}
+
+func TestCache(t *testing.T) {
+	now := time.Now()
+	m := newTestManager(t, "*.a.com", "a.com")
+
+	// No cached certificate.
+	m.loadCached()
+	if m.cert != nil || !m.needsRenewal(now) {
+		t.Fatalf("unexpected certificate: %v", m.cert)
+	}
+
+	chain, key := selfSigned(t, now.Add(-time.Hour), now.Add(89*24*time.Hour),
+		"a.com", "*.a.com")
+	if err := m.writeCache(key, chain); err != nil {
+		t.Fatalf("error writing cache: %v", err)
+	}
+	m.loadCached()
+	if m.cert == nil {
+		t.Fatalf("cached certificate was not loaded")
+	}
+	if m.needsRenewal(now) {
+		t.Errorf("fresh certificate needs renewal")
+	}
+	if !m.needsRenewal(now.Add(70 * 24 * time.Hour)) {
+		t.Errorf("certificate in its last third does not need renewal")
+	}
+
+	// A manager for different hosts ignores it.
+	m2 := newTestManager(t, "a.com")
+	m2.cacheDir = m.cacheDir
+	m2.loadCached()
+	if m2.cert != nil {
+		t.Errorf("loaded certificate for different hosts")
+	}
+
+	// Expired certificates are ignored.
+	m3 := newTestManager(t, "b.com")
+	chain, key = selfSigned(t, now.Add(-2*time.Hour), now.Add(-time.Hour),
+		"b.com")
+	m3.writeCache(key, chain)
+	m3.loadCached()
+	if m3.cert != nil {
+		t.Errorf("loaded expired certificate")
+	}
+}
+
+func TestAccountKey(t *testing.T) {
+	m := newTestManager(t, "a.com")
+	k1, err := m.accountKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	k2, err := m.accountKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !k1.(*ecdsa.PrivateKey).Equal(k2) {
+		t.Errorf("account key was not persisted")
+	}
+
+	os.WriteFile(filepath.Join(m.cacheDir, "gofer-acme-account.key"),
+		[]byte("broken"), 0600)
+	if _, err := m.accountKey(); err == nil {
+		t.Errorf("expected error on broken key, got nil")
+	}
+}
+
+func TestGetCertificate(t *testing.T) {
+	m := newTestManager(t, "a.com")
+
+	_, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: "a.com"})
+	if err == nil {
+		t.Errorf("expected error without a certificate")
+	}
+
+	chain, key := selfSigned(t, time.Now(), time.Now().Add(time.Hour), "a.com")
+	m.cert = &tls.Certificate{Certificate: chain, PrivateKey: key}
+	alpn := &tls.Certificate{}
+	m.setALPNCert("A.com", alpn)
+
+	cert, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: "a.com"})
+	if err != nil || cert != m.cert {
+		t.Errorf("unexpected certificate: %v, %v", cert, err)
+	}
+
+	hello := &tls.ClientHelloInfo{
+		ServerName:      "a.com",
+		SupportedProtos: []string{acme.ALPNProto},
+	}
+	cert, err = m.GetCertificate(hello)
+	if err != nil || cert != alpn {
+		t.Errorf("expected challenge certificate, got %v, %v", cert, err)
+	}
+
+	m.setALPNCert("a.com", nil)
+	if _, err = m.GetCertificate(hello); err == nil {
+		t.Errorf("expected error after the challenge is done")
+	}
+
+	if p := m.TLSConfig().NextProtos; p[len(p)-1] != acme.ALPNProto {
+		t.Errorf("tls-alpn-01 protocol not offered: %v", p)
+	}
+	m.challenge = "dns-01"
+	if p := m.TLSConfig().NextProtos; p[len(p)-1] == acme.ALPNProto {
+		t.Errorf("tls-alpn-01 protocol offered with dns-01: %v", p)
+	}
+}
+
+func TestExecProvider(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(dir, "out")
+	script := filepath.Join(dir, "hook.sh")
+	os.WriteFile(script, []byte(`#!/bin/sh
+if [ "$3" = "fail" ]; then
+	echo "failing on purpose"
+	exit 1
+fi
+echo "$1 $2 $3" >> `+out+"\n"), 0700)
+
+	p, err := NewDNSProvider(config.DNSProvider{
+		Provider: "exec",
+		Command:  script,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	if err := p.Present(ctx, "_acme-challenge.a.com.", "v1"); err != nil {
+		t.Errorf("Present error: %v", err)
+	}
+	if err := p.CleanUp(ctx, "_acme-challenge.a.com.", "v1"); err != nil {
+		t.Errorf("CleanUp error: %v", err)
+	}
+	buf, _ := os.ReadFile(out)
+	expected := "present _acme-challenge.a.com. v1\n" +
+		"cleanup _acme-challenge.a.com. v1\n"
+	if string(buf) != expected {
+		t.Errorf("unexpected calls: %q", buf)
+	}
+
+	err = p.Present(ctx, "_acme-challenge.a.com.", "fail")
+	if err == nil || !strings.Contains(err.Error(), "failing on purpose") {
+		t.Errorf("expected error with the command output, got %v", err)
+	}
+}
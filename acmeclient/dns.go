@@ -0,0 +1,60 @@
+package acmeclient
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"blitiri.com.ar/go/gofer/config"
+)
+
+// DNSProvider sets and removes the TXT records needed for the dns-01
+// challenge.
+type DNSProvider interface {
+	// Present creates a TXT record with the given name and value. There can
+	// be more than one value for the same name (e.g. when getting a
+	// certificate for both "example.com" and "*.example.com"), so existing
+	// records must be kept.
+	Present(ctx context.Context, name, value string) error
+
+	// CleanUp removes the TXT record created by Present.
+	CleanUp(ctx context.Context, name, value string) error
+}
+
+// NewDNSProvider returns the DNS provider for the given configuration.
+func NewDNSProvider(conf config.DNSProvider) (DNSProvider, error) {
+	switch conf.Provider {
+	case "rfc2136":
+		return newRFC2136(conf)
+	case "exec":
+		return &execProvider{command: conf.Command}, nil
+	default:
+		return nil, fmt.Errorf("unknown dns provider %q", conf.Provider)
+	}
+}
+
+// execProvider runs a command to set and remove the records. It is called
+// as "<command> present <name> <value>" and "<command> cleanup <name>
+// <value>", and is expected to exit with 0 on success.
+type execProvider struct {
+	command string
+}
+
+func (p *execProvider) Present(ctx context.Context, name, value string) error {
+	return p.run(ctx, "present", name, value)
+}
+
+func (p *execProvider) CleanUp(ctx context.Context, name, value string) error {
+	return p.run(ctx, "cleanup", name, value)
+}
+
+func (p *execProvider) run(ctx context.Context, action, name, value string) error {
+	cmd := exec.CommandContext(ctx, p.command, action, name, value)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s %s: %v: %q", p.command, action, name, err,
+			strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,455 @@
+package acmeclient
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"blitiri.com.ar/go/gofer/config"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// DNS constants not defined by dnsmessage.
+const (
+	opCodeUpdate = dnsmessage.OpCode(5)
+	classNone    = dnsmessage.Class(254)
+	classAny     = dnsmessage.Class(255)
+	typeTSIG     = dnsmessage.Type(250)
+)
+
+// TTL for the records we create. They are short-lived anyway.
+const rfc2136TTL = 60
+
+// How long to wait for the DNS server, if the context has no deadline.
+var rfc2136Timeout = 30 * time.Second
+
+// rfc2136Provider sets the records using DNS dynamic updates (RFC 2136),
+// optionally authenticated with TSIG (RFC 8945).
+type rfc2136Provider struct {
+	server string
+	zone   string
+
+	// May be nil if the updates are not authenticated.
+	tsig *tsigKey
+}
+
+func newRFC2136(conf config.DNSProvider) (*rfc2136Provider, error) {
+	p := &rfc2136Provider{
+		server: conf.Server,
+		zone:   fqdn(conf.Zone),
+	}
+	if _, _, err := net.SplitHostPort(p.server); err != nil {
+		p.server = net.JoinHostPort(p.server, "53")
+	}
+
+	if conf.TSIGKey != "" {
+		alg, err := config.TSIGAlgorithm(conf.TSIGAlgorithm)
+		if err != nil {
+			return nil, err
+		}
+		secret, err := readTSIGSecret(conf.TSIGSecretFile)
+		if err != nil {
+			return nil, err
+		}
+		p.tsig = &tsigKey{
+			name:      fqdn(conf.TSIGKey),
+			algorithm: alg,
+			secret:    secret,
+		}
+	}
+	return p, nil
+}
+
+// readTSIGSecret reads the base64-encoded TSIG secret from the given file.
+func readTSIGSecret(path string) ([]byte, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := base64.StdEncoding.DecodeString(
+		strings.TrimSpace(string(buf)))
+	if err != nil {
+		return nil, fmt.Errorf("%s: invalid TSIG secret: %v", path, err)
+	}
+	return secret, nil
+}
+
+func (p *rfc2136Provider) Present(ctx context.Context, name, value string) error {
+	return p.update(ctx, name, value, true)
+}
+
+func (p *rfc2136Provider) CleanUp(ctx context.Context, name, value string) error {
+	return p.update(ctx, name, value, false)
+}
+
+// update adds or removes a TXT record with the given name and value.
+func (p *rfc2136Provider) update(ctx context.Context, name, value string,
+	add bool) error {
+	msg, err := updateMsg(p.zone, fqdn(name), value, add)
+	if err != nil {
+		return err
+	}
+
+	var reqMAC []byte
+	if p.tsig != nil {
+		msg, reqMAC, err = p.tsig.sign(msg, time.Now(), nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	resp, err := exchangeTCP(ctx, p.server, msg)
+	if err != nil {
+		return err
+	}
+
+	var parser dnsmessage.Parser
+	hdr, err := parser.Start(resp)
+	if err != nil {
+		return fmt.Errorf("error parsing response: %v", err)
+	}
+	if hdr.ID != binary.BigEndian.Uint16(msg) || !hdr.Response {
+		return fmt.Errorf("unexpected response (id %d)", hdr.ID)
+	}
+	if hdr.RCode != dnsmessage.RCodeSuccess {
+		return fmt.Errorf("update of %q rejected by %s: %v",
+			name, p.server, hdr.RCode)
+	}
+
+	if p.tsig != nil {
+		if _, err := p.tsig.verify(resp, time.Now(), reqMAC); err != nil {
+			return fmt.Errorf("invalid response from %s: %v", p.server, err)
+		}
+	}
+	return nil
+}
+
+// updateMsg builds an update message to add (or remove) the TXT record.
+func updateMsg(zone, name, value string, add bool) ([]byte, error) {
+	zoneName, err := dnsmessage.NewName(zone)
+	if err != nil {
+		return nil, err
+	}
+	rrName, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var id [2]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, err
+	}
+
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:     binary.BigEndian.Uint16(id[:]),
+		OpCode: opCodeUpdate,
+	})
+
+	// In update messages, the question section holds the zone.
+	b.StartQuestions()
+	b.Question(dnsmessage.Question{
+		Name:  zoneName,
+		Type:  dnsmessage.TypeSOA,
+		Class: dnsmessage.ClassINET,
+	})
+
+	// And the authority section holds the updates. Deletion of a specific
+	// record is done with class NONE (RFC 2136 section 2.5.4).
+	b.StartAuthorities()
+	rh := dnsmessage.ResourceHeader{
+		Name:  rrName,
+		Type:  dnsmessage.TypeTXT,
+		Class: dnsmessage.ClassINET,
+		TTL:   rfc2136TTL,
+	}
+	if !add {
+		rh.Class = classNone
+		rh.TTL = 0
+	}
+	err = b.TXTResource(rh, dnsmessage.TXTResource{TXT: []string{value}})
+	if err != nil {
+		return nil, err
+	}
+
+	return b.Finish()
+}
+
+// exchangeTCP sends the message to the server over TCP, and returns the
+// response.
+func exchangeTCP(ctx context.Context, server string, msg []byte) ([]byte, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(rfc2136Timeout)
+	}
+	conn.SetDeadline(deadline)
+
+	// Over TCP, messages are prefixed by their length.
+	buf := binary.BigEndian.AppendUint16(nil, uint16(len(msg)))
+	if _, err := conn.Write(append(buf, msg...)); err != nil {
+		return nil, err
+	}
+
+	return readTCPMsg(conn)
+}
+
+func readTCPMsg(r io.Reader) ([]byte, error) {
+	var l [2]byte
+	if _, err := io.ReadFull(r, l[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(l[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// tsigKey signs and verifies messages using TSIG (RFC 8945).
+type tsigKey struct {
+	name      string
+	algorithm string
+	secret    []byte
+}
+
+// Allowed time difference between the signer and the verifier.
+const tsigFudge = 300
+
+// tsigVars are the TSIG fields covered by the MAC.
+type tsigVars struct {
+	timeSigned uint64
+	fudge      uint16
+	err        uint16
+	other      []byte
+}
+
+func (k *tsigKey) hash() func() hash.Hash {
+	switch k.algorithm {
+	case "hmac-sha384.":
+		return sha512.New384
+	case "hmac-sha512.":
+		return sha512.New
+	default:
+		return sha256.New
+	}
+}
+
+// mac computes the MAC of the message (which must not include the TSIG
+// record). For responses, reqMAC is the MAC of the request.
+func (k *tsigKey) mac(msg []byte, v tsigVars, reqMAC []byte) []byte {
+	h := hmac.New(k.hash(), k.secret)
+	if reqMAC != nil {
+		h.Write(binary.BigEndian.AppendUint16(nil, uint16(len(reqMAC))))
+		h.Write(reqMAC)
+	}
+	h.Write(msg)
+
+	buf := nameWire(k.name)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(classAny))
+	buf = binary.BigEndian.AppendUint32(buf, 0) // TTL.
+	buf = append(buf, nameWire(k.algorithm)...)
+	buf = appendUint48(buf, v.timeSigned)
+	buf = binary.BigEndian.AppendUint16(buf, v.fudge)
+	buf = binary.BigEndian.AppendUint16(buf, v.err)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(v.other)))
+	buf = append(buf, v.other...)
+	h.Write(buf)
+
+	return h.Sum(nil)
+}
+
+// sign the message, returning it with the TSIG record appended, and the MAC.
+// For responses, reqMAC is the MAC of the request.
+func (k *tsigKey) sign(msg []byte, now time.Time, reqMAC []byte) (
+	[]byte, []byte, error) {
+	if len(msg) < 12 {
+		return nil, nil, errors.New("message too short")
+	}
+
+	v := tsigVars{timeSigned: uint64(now.Unix()), fudge: tsigFudge}
+	mac := k.mac(msg, v, reqMAC)
+
+	rdata := nameWire(k.algorithm)
+	rdata = appendUint48(rdata, v.timeSigned)
+	rdata = binary.BigEndian.AppendUint16(rdata, v.fudge)
+	rdata = binary.BigEndian.AppendUint16(rdata, uint16(len(mac)))
+	rdata = append(rdata, mac...)
+	rdata = append(rdata, msg[0:2]...) // Original ID.
+	rdata = binary.BigEndian.AppendUint16(rdata, 0)
+	rdata = binary.BigEndian.AppendUint16(rdata, 0)
+
+	signed := append([]byte{}, msg...)
+	signed = append(signed, nameWire(k.name)...)
+	signed = binary.BigEndian.AppendUint16(signed, uint16(typeTSIG))
+	signed = binary.BigEndian.AppendUint16(signed, uint16(classAny))
+	signed = binary.BigEndian.AppendUint32(signed, 0)
+	signed = binary.BigEndian.AppendUint16(signed, uint16(len(rdata)))
+	signed = append(signed, rdata...)
+
+	// Increment the additional records count.
+	arcount := binary.BigEndian.Uint16(signed[10:12])
+	binary.BigEndian.PutUint16(signed[10:12], arcount+1)
+
+	return signed, mac, nil
+}
+
+// verify the TSIG record of the message, which must be the last one.
+// For responses, reqMAC is the MAC of the request.
+// Returns the MAC of the message.
+func (k *tsigKey) verify(msg []byte, now time.Time, reqMAC []byte) (
+	[]byte, error) {
+	var p dnsmessage.Parser
+	if _, err := p.Start(msg); err != nil {
+		return nil, err
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return nil, err
+	}
+	if err := p.SkipAllAnswers(); err != nil {
+		return nil, err
+	}
+	if err := p.SkipAllAuthorities(); err != nil {
+		return nil, err
+	}
+	additionals, err := p.AllAdditionals()
+	if err != nil {
+		return nil, err
+	}
+	if len(additionals) == 0 ||
+		additionals[len(additionals)-1].Header.Type != typeTSIG {
+		return nil, errors.New("message is not signed")
+	}
+	rr := additionals[len(additionals)-1]
+	if !strings.EqualFold(rr.Header.Name.String(), k.name) {
+		return nil, fmt.Errorf("signed with unknown key %q", rr.Header.Name)
+	}
+	rdata := rr.Body.(*dnsmessage.UnknownResource).Data
+
+	alg, rdata, err := parseNameWire(rdata)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.EqualFold(alg, k.algorithm) {
+		return nil, fmt.Errorf("unexpected algorithm %q", alg)
+	}
+
+	if len(rdata) < 10 {
+		return nil, errors.New("TSIG record too short")
+	}
+	v := tsigVars{
+		timeSigned: uint48(rdata[0:6]),
+		fudge:      binary.BigEndian.Uint16(rdata[6:8]),
+	}
+	macLen := int(binary.BigEndian.Uint16(rdata[8:10]))
+	rdata = rdata[10:]
+	if len(rdata) < macLen+6 {
+		return nil, errors.New("TSIG record too short")
+	}
+	mac := rdata[:macLen]
+	origID := rdata[macLen : macLen+2]
+	v.err = binary.BigEndian.Uint16(rdata[macLen+2 : macLen+4])
+	otherLen := int(binary.BigEndian.Uint16(rdata[macLen+4 : macLen+6]))
+	if len(rdata) < macLen+6+otherLen {
+		return nil, errors.New("TSIG record too short")
+	}
+	v.other = rdata[macLen+6 : macLen+6+otherLen]
+
+	if v.err != 0 {
+		return nil, fmt.Errorf("TSIG error %d", v.err)
+	}
+
+	// Reconstruct the message as it was before signing: without the TSIG
+	// record, and with the original ID. We assume the key name in the TSIG
+	// record is not compressed; if it is, the MAC will not match.
+	rrLen := len(nameWire(k.name)) + 10 +
+		len(rr.Body.(*dnsmessage.UnknownResource).Data)
+	if rrLen > len(msg)-12 {
+		return nil, errors.New("invalid TSIG record")
+	}
+	orig := append([]byte{}, msg[:len(msg)-rrLen]...)
+	copy(orig[0:2], origID)
+	arcount := binary.BigEndian.Uint16(orig[10:12])
+	binary.BigEndian.PutUint16(orig[10:12], arcount-1)
+
+	if !hmac.Equal(mac, k.mac(orig, v, reqMAC)) {
+		return nil, errors.New("TSIG signature mismatch")
+	}
+
+	signed := time.Unix(int64(v.timeSigned), 0)
+	if d := now.Sub(signed).Abs(); d > time.Duration(v.fudge)*time.Second {
+		return nil, fmt.Errorf("TSIG time is off by %v", d)
+	}
+
+	return mac, nil
+}
+
+// nameWire returns the uncompressed, canonical wire format of the name.
+func nameWire(name string) []byte {
+	buf := []byte{}
+	for _, label := range strings.Split(strings.Trim(name, "."), ".") {
+		if label == "" {
+			continue
+		}
+		buf = append(buf, byte(len(label)))
+		buf = append(buf, strings.ToLower(label)...)
+	}
+	return append(buf, 0)
+}
+
+// parseNameWire parses an uncompressed name in wire format, and returns it
+// with the rest of the buffer.
+func parseNameWire(buf []byte) (string, []byte, error) {
+	labels := []string{}
+	for {
+		if len(buf) == 0 {
+			return "", nil, errors.New("truncated name")
+		}
+		l := int(buf[0])
+		buf = buf[1:]
+		if l == 0 {
+			break
+		}
+		if l > 63 || len(buf) < l {
+			return "", nil, errors.New("invalid name")
+		}
+		labels = append(labels, string(buf[:l]))
+		buf = buf[l:]
+	}
+	return strings.Join(labels, ".") + ".", buf, nil
+}
+
+func appendUint48(buf []byte, v uint64) []byte {
+	return append(buf, byte(v>>40), byte(v>>32),
+		byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func uint48(b []byte) uint64 {
+	return uint64(b[0])<<40 | uint64(b[1])<<32 | uint64(b[2])<<24 |
+		uint64(b[3])<<16 | uint64(b[4])<<8 | uint64(b[5])
+}
+
+// fqdn returns the name with a trailing dot.
+func fqdn(name string) string {
+	if strings.HasSuffix(name, ".") {
+		return name
+	}
+	return name + "."
+}
@@ -0,0 +1,248 @@
+package acmeclient
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"blitiri.com.ar/go/gofer/config"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// fakeDNS is a DNS server which accepts TSIG-signed updates for TXT records.
+type fakeDNS struct {
+	t    *testing.T
+	lis  net.Listener
+	key  *tsigKey
+	zone string
+
+	mu sync.Mutex
+
+	// Name -> TXT values.
+	txt map[string][]string
+}
+
+func newFakeDNS(t *testing.T, key *tsigKey, zone string) *fakeDNS {
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeDNS{t: t, lis: lis, key: key, zone: zone,
+		txt: map[string][]string{}}
+	go s.serve()
+	t.Cleanup(func() { lis.Close() })
+	return s
+}
+
+func (s *fakeDNS) serve() {
+	for {
+		conn, err := s.lis.Accept()
+		if err != nil {
+			return
+		}
+		req, err := readTCPMsg(conn)
+		if err == nil {
+			resp := s.handle(req)
+			buf := binary.BigEndian.AppendUint16(nil, uint16(len(resp)))
+			conn.Write(append(buf, resp...))
+		}
+		conn.Close()
+	}
+}
+
+func (s *fakeDNS) handle(req []byte) []byte {
+	var p dnsmessage.Parser
+	hdr, err := p.Start(req)
+	if err != nil {
+		return s.reply(hdr, dnsmessage.RCodeFormatError, nil)
+	}
+
+	reqMAC, err := s.key.verify(req, time.Now(), nil)
+	if err != nil {
+		s.t.Logf("fakeDNS: %v", err)
+		return s.reply(hdr, dnsmessage.RCode(9), nil) // NOTAUTH.
+	}
+
+	qs, err := p.AllQuestions()
+	if err != nil || hdr.OpCode != opCodeUpdate || len(qs) != 1 ||
+		qs[0].Name.String() != s.zone {
+		return s.reply(hdr, dnsmessage.RCodeRefused, reqMAC)
+	}
+	p.SkipAllAnswers()
+	updates, err := p.AllAuthorities()
+	if err != nil {
+		return s.reply(hdr, dnsmessage.RCodeFormatError, reqMAC)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, rr := range updates {
+		name := rr.Header.Name.String()
+		value := rr.Body.(*dnsmessage.TXTResource).TXT[0]
+		switch rr.Header.Class {
+		case dnsmessage.ClassINET:
+			s.txt[name] = append(s.txt[name], value)
+		case classNone:
+			s.txt[name] = slices.DeleteFunc(s.txt[name],
+				func(v string) bool { return v == value })
+		}
+	}
+	return s.reply(hdr, dnsmessage.RCodeSuccess, reqMAC)
+}
+
+func (s *fakeDNS) reply(req dnsmessage.Header, rcode dnsmessage.RCode,
+	reqMAC []byte) []byte {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:       req.ID,
+		Response: true,
+		OpCode:   req.OpCode,
+		RCode:    rcode,
+	})
+	msg, _ := b.Finish()
+	if reqMAC != nil {
+		msg, _, _ = s.key.sign(msg, time.Now(), reqMAC)
+	}
+	return msg
+}
+
+func (s *fakeDNS) values(name string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.txt[name])
+}
+
+func writeSecret(t *testing.T, secret []byte) string {
+	path := filepath.Join(t.TempDir(), "secret")
+	err := os.WriteFile(path,
+		[]byte(base64.StdEncoding.EncodeToString(secret)+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestRFC2136(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	key := &tsigKey{name: "gofer.", algorithm: "hmac-sha256.", secret: secret}
+	srv := newFakeDNS(t, key, "example.com.")
+
+	p, err := NewDNSProvider(config.DNSProvider{
+		Provider:       "rfc2136",
+		Server:         srv.lis.Addr().String(),
+		Zone:           "example.com",
+		TSIGKey:        "gofer",
+		TSIGSecretFile: writeSecret(t, secret),
+	})
+	if err != nil {
+		t.Fatalf("error creating provider: %v", err)
+	}
+
+	ctx := context.Background()
+	name := "_acme-challenge.example.com."
+	if err := p.Present(ctx, name, "v1"); err != nil {
+		t.Fatalf("Present error: %v", err)
+	}
+	if err := p.Present(ctx, name, "v2"); err != nil {
+		t.Fatalf("Present error: %v", err)
+	}
+	if vs := srv.values(name); !slices.Equal(vs, []string{"v1", "v2"}) {
+		t.Errorf("unexpected values after Present: %q", vs)
+	}
+
+	if err := p.CleanUp(ctx, name, "v1"); err != nil {
+		t.Fatalf("CleanUp error: %v", err)
+	}
+	if vs := srv.values(name); !slices.Equal(vs, []string{"v2"}) {
+		t.Errorf("unexpected values after CleanUp: %q", vs)
+	}
+
+	// Wrong zone, the server refuses it.
+	p.(*rfc2136Provider).zone = "example.net."
+	err = p.Present(ctx, name, "v3")
+	if err == nil || !strings.Contains(err.Error(), "Refused") {
+		t.Errorf("expected refusal, got %v", err)
+	}
+
+	// Wrong key, the server rejects it.
+	p, _ = NewDNSProvider(config.DNSProvider{
+		Provider:       "rfc2136",
+		Server:         srv.lis.Addr().String(),
+		Zone:           "example.com",
+		TSIGKey:        "gofer",
+		TSIGSecretFile: writeSecret(t, []byte("wrong")),
+	})
+	if err := p.Present(ctx, name, "v4"); err == nil {
+		t.Errorf("expected error with the wrong key, got nil")
+	}
+	if vs := srv.values(name); !slices.Equal(vs, []string{"v2"}) {
+		t.Errorf("unexpected values after failed updates: %q", vs)
+	}
+}
+
+func TestTSIG(t *testing.T) {
+	key := &tsigKey{name: "k.", algorithm: "hmac-sha512.",
+		secret: []byte("secret")}
+	msg, err := updateMsg("example.com.", "a.example.com.", "value", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	signed, mac, err := key.sign(msg, now, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := key.verify(signed, now, nil)
+	if err != nil {
+		t.Fatalf("verify error: %v", err)
+	}
+	if !slices.Equal(got, mac) {
+		t.Errorf("MAC mismatch: %x != %x", got, mac)
+	}
+
+	// Too far in the future.
+	if _, err := key.verify(signed, now.Add(time.Hour), nil); err == nil {
+		t.Errorf("expected time error, got nil")
+	}
+
+	// Tampered message.
+	tampered := slices.Clone(signed)
+	tampered[20] ^= 1
+	if _, err := key.verify(tampered, now, nil); err == nil {
+		t.Errorf("expected error on tampered message, got nil")
+	}
+
+	// Unsigned message.
+	if _, err := key.verify(msg, now, nil); err == nil {
+		t.Errorf("expected error on unsigned message, got nil")
+	}
+
+	// Other key.
+	other := &tsigKey{name: "k.", algorithm: "hmac-sha512.",
+		secret: []byte("other")}
+	if _, err := other.verify(signed, now, nil); err == nil {
+		t.Errorf("expected error with the wrong key, got nil")
+	}
+}
+
+func TestNameWire(t *testing.T) {
+	for _, name := range []string{"a.example.com.", "hmac-sha256.", "."} {
+		wire := nameWire(name)
+		got, rest, err := parseNameWire(append(wire, 1, 2))
+		if err != nil || got != name || len(rest) != 2 {
+			t.Errorf("%q: got %q, %v, %v", name, got, rest, err)
+		}
+	}
+
+	if _, _, err := parseNameWire([]byte{3, 'a'}); err == nil {
+		t.Errorf("expected error on truncated name")
+	}
+}
@@ -2,10 +2,15 @@
 package config
 
 import (
+	"crypto/tls"
 	"fmt"
+	"math"
+	"net"
+	"net/http"
 	"net/url"
 	"os"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -16,6 +21,9 @@ import (
 type Config struct {
 	ControlAddr string `yaml:"control_addr,omitempty"`
 
+	// How long before a certificate expires we start warning about it.
+	CertExpiryWarning time.Duration `yaml:"cert_expiry_warning,omitempty"`
+
 	// Map address -> config.
 	HTTP  map[string]HTTP  `yaml:",omitempty"`
 	HTTPS map[string]HTTPS `yaml:",omitempty"`
@@ -31,6 +39,8 @@ type HTTP struct {
 
 	Auth map[string]string `yaml:",omitempty"`
 
+	JWTAuth map[string]JWTAuth `yaml:"jwtauth,omitempty"`
+
 	SetHeader map[string]map[string]string `yaml:",omitempty"`
 
 	ReqLog map[string]string `yaml:",omitempty"`
@@ -38,6 +48,26 @@ type HTTP struct {
 	RateLimit map[string]string `yaml:",omitempty"`
 
 	Timeouts map[string]Timeout `yaml:",omitempty"`
+
+	// Cache the responses of these paths.
+	Cache map[string]Cache `yaml:",omitempty"`
+
+	// Limits on the size of the requests for these paths.
+	Limits map[string]Limits `yaml:",omitempty"`
+
+	// Accept the PROXY protocol on incoming connections.
+	ProxyProtocol *ProxyProtocol `yaml:"proxy_protocol,omitempty"`
+
+	// Proxies to trust the Forwarded and X-Forwarded-For headers from, as
+	// CIDRs or IP addresses.
+	TrustedProxies []string `yaml:"trusted_proxies,omitempty"`
+
+	// Permissions of the socket, for "unix:" addresses.
+	UnixSocket *UnixSocket `yaml:"unix_socket,omitempty"`
+
+	// Accept HTTP/2 over cleartext (h2c), with prior knowledge. Only for
+	// plain HTTP listeners.
+	H2C bool `yaml:"h2c,omitempty"`
 }
 
 type HTTPS struct {
@@ -45,8 +75,17 @@ type HTTPS struct {
 	Certs     string    `yaml:",omitempty"`
 	AutoCerts AutoCerts `yaml:"autocerts,omitempty"`
 
+	TLS TLS `yaml:"tls,omitempty"`
+
 	// Where to write key log files for debugging TLS.
 	InsecureKeyLogFile string `yaml:"insecure_key_log_file,omitempty"`
+
+	// Address of a plain HTTP listener which redirects to this one, and
+	// answers the ACME HTTP-01 challenges.
+	HTTPRedirect string `yaml:"http_redirect,omitempty"`
+
+	// Also serve HTTP/3 (QUIC), on the same port but over UDP.
+	HTTP3 bool `yaml:"http3,omitempty"`
 }
 
 type AutoCerts struct {
@@ -54,22 +93,258 @@ type AutoCerts struct {
 	CacheDir string   `yaml:",omitempty"`
 	Email    string   `yaml:",omitempty"`
 	AcmeURL  string   `yaml:",omitempty"`
+
+	// ACME challenge to use: "dns-01" or "tls-alpn-01". If empty, the
+	// certificates are managed by Go's autocert package.
+	Challenge string `yaml:",omitempty"`
+
+	// DNS provider, for the dns-01 challenge.
+	DNS DNSProvider `yaml:"dns,omitempty"`
+
+	// On-demand host policy: hosts not in Hosts are also allowed if they
+	// match the regexp, are listed in the file, or the ask URL returns 200
+	// for them.
+	HostsRegexp *Regexp `yaml:"hosts_regexp,omitempty"`
+	HostsFile   string  `yaml:"hosts_file,omitempty"`
+	Ask         *URL    `yaml:",omitempty"`
+
+	// Maximum number of on-demand hosts to allow per hour (0 = unlimited).
+	MaxPerHour int `yaml:"max_per_hour,omitempty"`
+}
+
+// OnDemand returns true if hosts can be allowed on demand.
+func (a AutoCerts) OnDemand() bool {
+	return a.HostsRegexp != nil || a.HostsFile != "" || a.Ask != nil
+}
+
+// DNSProvider configures how to set the DNS records needed for the ACME
+// dns-01 challenge.
+type DNSProvider struct {
+	// Provider type: "rfc2136" or "exec".
+	Provider string `yaml:",omitempty"`
+
+	// For "rfc2136": DNS server to send the updates to, and the zone to
+	// update.
+	Server string `yaml:",omitempty"`
+	Zone   string `yaml:",omitempty"`
+
+	// For "rfc2136": TSIG key name, algorithm, and file containing the
+	// base64-encoded secret.
+	TSIGKey        string `yaml:"tsig_key,omitempty"`
+	TSIGAlgorithm  string `yaml:"tsig_algorithm,omitempty"`
+	TSIGSecretFile string `yaml:"tsig_secret_file,omitempty"`
+
+	// For "exec": command to run to set and remove the records.
+	Command string `yaml:",omitempty"`
+
+	// How long to wait after setting the records, before asking the CA to
+	// validate them.
+	PropagationDelay time.Duration `yaml:"propagation_delay,omitempty"`
+}
+
+type JWTAuth struct {
+	// File containing the shared secret, for HS256 tokens.
+	SecretFile string `yaml:"secret_file,omitempty"`
+
+	// JWKS file containing the public keys, for RS256 and ES256 tokens.
+	JWKSFile string `yaml:"jwks_file,omitempty"`
+
+	// Expected values for the "iss" and "aud" claims, if set.
+	Issuer   string `yaml:",omitempty"`
+	Audience string `yaml:",omitempty"`
+
+	// Claims that must be present. If the value is not empty, the claim
+	// must match it (or contain it, if the claim is a list).
+	Require map[string]string `yaml:",omitempty"`
+
+	// Header to pass the token's subject to the upstream.
+	SubjectHeader string `yaml:"subject_header,omitempty"`
+
+	// Allowed clock skew when checking "exp" and "nbf".
+	Leeway time.Duration `yaml:",omitempty"`
+}
+
+// TLS options for a listener.
+type TLS struct {
+	MinVersion   string   `yaml:"min_version,omitempty"`
+	MaxVersion   string   `yaml:"max_version,omitempty"`
+	CipherSuites []string `yaml:"cipher_suites,omitempty"`
+	Curves       []string `yaml:",omitempty"`
+
+	// ALPN protocols to offer, in order of preference.
+	ALPN []string `yaml:"alpn,omitempty"`
+
+	// File with the session ticket keys, to share them between instances.
+	SessionTicketKeysFile string `yaml:"session_ticket_keys_file,omitempty"`
+
+	// How often to rotate the session ticket keys (when not using a file).
+	SessionTicketRotation time.Duration `yaml:"session_ticket_rotation,omitempty"`
 }
 
 type Timeout struct {
 	Read  time.Duration `yaml:",omitempty"`
 	Write time.Duration `yaml:",omitempty"`
+
+	// Idle timeout for upgraded connections (e.g. websockets), which are
+	// not subject to the read and write timeouts.
+	UpgradeIdle time.Duration `yaml:"upgrade_idle,omitempty"`
+}
+
+// Limits on the size of the requests.
+type Limits struct {
+	// Maximum size of the request body.
+	MaxBodySize ByteSize `yaml:"max_body_size,omitempty"`
+
+	// Maximum total size of the request headers.
+	MaxHeaderSize ByteSize `yaml:"max_header_size,omitempty"`
+
+	// Maximum length of the request URL (path and query).
+	MaxURLLength int `yaml:"max_url_length,omitempty"`
+}
+
+func (l Limits) Check(addr, path string) []error {
+	errs := []error{}
+
+	if l.MaxBodySize < 0 {
+		errs = append(errs, fmt.Errorf(
+			"%q: %q: limits: max_body_size can't be negative", addr, path))
+	}
+	if l.MaxHeaderSize < 0 {
+		errs = append(errs, fmt.Errorf(
+			"%q: %q: limits: max_header_size can't be negative", addr, path))
+	}
+	if l.MaxURLLength < 0 {
+		errs = append(errs, fmt.Errorf(
+			"%q: %q: limits: max_url_length can't be negative", addr, path))
+	}
+	return errs
+}
+
+// Cache configures the caching of HTTP responses.
+type Cache struct {
+	// Maximum size of the responses kept in memory, in total and for each
+	// one.
+	MaxSize      ByteSize `yaml:"max_size,omitempty"`
+	MaxEntrySize ByteSize `yaml:"max_entry_size,omitempty"`
+
+	// Also keep the responses in this directory, up to MaxDiskSize.
+	Dir         string   `yaml:",omitempty"`
+	MaxDiskSize ByteSize `yaml:"max_disk_size,omitempty"`
+
+	// How long to cache responses that don't say how long they are fresh
+	// for. By default, they are not cached.
+	DefaultTTL time.Duration `yaml:"default_ttl,omitempty"`
+
+	// How long after they expire responses can be served while they are
+	// revalidated in the background, unless they say otherwise.
+	StaleWhileRevalidate time.Duration `yaml:"stale_while_revalidate,omitempty"`
+
+	// How long requests wait for another one that is fetching the same
+	// response, before going to the backend themselves.
+	LockTimeout time.Duration `yaml:"lock_timeout,omitempty"`
+}
+
+func (c Cache) Check(addr, path string) []error {
+	errs := []error{}
+
+	if c.MaxSize < 0 {
+		errs = append(errs, fmt.Errorf(
+			"%q: %q: cache: max_size can't be negative", addr, path))
+	}
+	if c.MaxEntrySize < 0 {
+		errs = append(errs, fmt.Errorf(
+			"%q: %q: cache: max_entry_size can't be negative", addr, path))
+	}
+	if c.MaxDiskSize < 0 {
+		errs = append(errs, fmt.Errorf(
+			"%q: %q: cache: max_disk_size can't be negative", addr, path))
+	}
+	if c.DefaultTTL < 0 {
+		errs = append(errs, fmt.Errorf(
+			"%q: %q: cache: default_ttl can't be negative", addr, path))
+	}
+	if c.StaleWhileRevalidate < 0 {
+		errs = append(errs, fmt.Errorf(
+			"%q: %q: cache: stale_while_revalidate can't be negative",
+			addr, path))
+	}
+	if c.LockTimeout < 0 {
+		errs = append(errs, fmt.Errorf(
+			"%q: %q: cache: lock_timeout can't be negative", addr, path))
+	}
+
+	if c.MaxSize > 0 && c.MaxEntrySize > c.MaxSize {
+		errs = append(errs, fmt.Errorf(
+			"%q: %q: cache: max_entry_size is larger than max_size",
+			addr, path))
+	}
+	if c.MaxDiskSize != 0 && c.Dir == "" {
+		errs = append(errs, fmt.Errorf(
+			"%q: %q: cache: max_disk_size needs dir", addr, path))
+	}
+	return errs
 }
 
 type Route struct {
-	Dir        string   `yaml:",omitempty"`
-	File       string   `yaml:",omitempty"`
-	Proxy      *URL     `yaml:",omitempty"`
-	Redirect   *URL     `yaml:",omitempty"`
-	RedirectRe []RePair `yaml:"redirect_re,omitempty"`
-	CGI        []string `yaml:",omitempty"`
-	Status     int      `yaml:",omitempty"`
-	DirOpts    DirOpts  `yaml:",omitempty"`
+	Dir        string    `yaml:",omitempty"`
+	File       string    `yaml:",omitempty"`
+	Proxy      *URL      `yaml:",omitempty"`
+	Redirect   *URL      `yaml:",omitempty"`
+	RedirectRe []RePair  `yaml:"redirect_re,omitempty"`
+	CGI        []string  `yaml:",omitempty"`
+	FastCGI    *FastCGI  `yaml:"fastcgi,omitempty"`
+	Status     int       `yaml:",omitempty"`
+	DirOpts    DirOpts   `yaml:",omitempty"`
+	CGIOpts    CGIOpts   `yaml:",omitempty"`
+	ProxyOpts  ProxyOpts `yaml:",omitempty"`
+}
+
+// FastCGI configures routes served by a FastCGI server (like php-fpm).
+type FastCGI struct {
+	// Address of the server, as "host:port" or "unix:/path".
+	Addr string `yaml:",omitempty"`
+
+	// Document root, as seen by the FastCGI server. The script path is
+	// appended to it to build SCRIPT_FILENAME.
+	Root string `yaml:",omitempty"`
+
+	// Script to use for paths ending in "/" (e.g. "index.php").
+	Index string `yaml:",omitempty"`
+
+	// Split the path into the script and PATH_INFO, using a regexp with two
+	// groups, like nginx's fastcgi_split_path_info (e.g. "^(.+\.php)(/.*)$").
+	SplitPathInfo *Regexp `yaml:"split_path_info,omitempty"`
+
+	// Extra parameters to send, which override the default ones.
+	Params map[string]string `yaml:",omitempty"`
+
+	// Maximum number of idle connections to keep for reuse.
+	MaxIdle int `yaml:"max_idle,omitempty"`
+}
+
+func (f *FastCGI) Check(addr, path string) []error {
+	errs := []error{}
+	if f == nil {
+		return errs
+	}
+
+	if f.Addr == "" {
+		errs = append(errs, fmt.Errorf("%q: %q: fastcgi: missing addr",
+			addr, path))
+	} else if sock, ok := UnixPath(f.Addr); ok && sock == "" {
+		errs = append(errs, fmt.Errorf(
+			"%q: %q: fastcgi: missing unix socket path", addr, path))
+	}
+	if f.SplitPathInfo != nil && f.SplitPathInfo.NumSubexp() != 2 {
+		errs = append(errs, fmt.Errorf(
+			"%q: %q: fastcgi: split_path_info must have 2 groups",
+			addr, path))
+	}
+	if f.MaxIdle < 0 {
+		errs = append(errs, fmt.Errorf(
+			"%q: %q: fastcgi: max_idle can't be negative", addr, path))
+	}
+	return errs
 }
 
 type DirOpts struct {
@@ -77,12 +352,495 @@ type DirOpts struct {
 	Exclude []PathRegexp    `yaml:",omitempty"`
 }
 
+// ProxyOpts configures how requests are proxied.
+type ProxyOpts struct {
+	// Use HTTP/2 to talk to the backend: over TLS for https backends, and
+	// over cleartext (h2c, with prior knowledge) otherwise.
+	HTTP2 bool `yaml:"http2,omitempty"`
+
+	// TLS options for https backends.
+	TLS UpstreamTLS `yaml:"tls,omitempty"`
+
+	// Timeouts for connecting to the backend, and for waiting for the
+	// response headers once the request is sent.
+	DialTimeout           time.Duration `yaml:"dial_timeout,omitempty"`
+	ResponseHeaderTimeout time.Duration `yaml:"response_header_timeout,omitempty"`
+
+	// How many idle connections to keep for reuse, and for how long.
+	MaxIdleConns    int           `yaml:"max_idle_conns,omitempty"`
+	IdleConnTimeout time.Duration `yaml:"idle_conn_timeout,omitempty"`
+
+	// Interval between TCP keepalive probes, and whether to disable reusing
+	// connections (HTTP keep-alives) altogether.
+	KeepAlive         time.Duration `yaml:"keepalive,omitempty"`
+	DisableKeepAlives bool          `yaml:"disable_keepalives,omitempty"`
+
+	// Maximum number of connections to the backend (0 means no limit).
+	MaxConns int `yaml:"max_conns,omitempty"`
+
+	// How often to flush the response to the client while copying it, or
+	// disable the buffering entirely and flush after every write.
+	FlushInterval    time.Duration `yaml:"flush_interval,omitempty"`
+	DisableBuffering bool          `yaml:"disable_buffering,omitempty"`
+
+	// Copy some of the requests to a secondary backend, e.g. to try it out
+	// before migrating to it.
+	Shadow *Shadow `yaml:"shadow,omitempty"`
+}
+
+// Defaults for the proxy transport settings, which match Go's
+// http.DefaultTransport.
+const (
+	defaultProxyDialTimeout     = 30 * time.Second
+	defaultProxyKeepAlive       = 30 * time.Second
+	defaultProxyMaxIdleConns    = http.DefaultMaxIdleConnsPerHost
+	defaultProxyIdleConnTimeout = 90 * time.Second
+)
+
+func (o ProxyOpts) isSet() bool {
+	return nTrue(
+		o.HTTP2,
+		o.TLS.isSet(),
+		o.isTuned(),
+		o.Shadow != nil) > 0
+}
+
+// isTuned returns true if any of the transport settings is set.
+func (o ProxyOpts) isTuned() bool {
+	return nTrue(
+		o.DialTimeout != 0,
+		o.ResponseHeaderTimeout != 0,
+		o.MaxIdleConns != 0,
+		o.IdleConnTimeout != 0,
+		o.KeepAlive != 0,
+		o.DisableKeepAlives,
+		o.MaxConns != 0,
+		o.FlushInterval != 0,
+		o.DisableBuffering) > 0
+}
+
+// Effective returns the options with the defaults filled in, so they
+// reflect the settings that are actually used.
+func (o ProxyOpts) Effective() ProxyOpts {
+	if o.DialTimeout == 0 {
+		o.DialTimeout = defaultProxyDialTimeout
+	}
+	if o.KeepAlive == 0 {
+		o.KeepAlive = defaultProxyKeepAlive
+	}
+	if o.MaxIdleConns == 0 {
+		o.MaxIdleConns = defaultProxyMaxIdleConns
+	}
+	if o.IdleConnTimeout == 0 {
+		o.IdleConnTimeout = defaultProxyIdleConnTimeout
+	}
+	return o
+}
+
+func (o ProxyOpts) Check(addr, path string) []error {
+	errs := []error{}
+
+	if o.DialTimeout < 0 {
+		errs = append(errs, fmt.Errorf(
+			"%q: %q: proxyopts: dial_timeout can't be negative", addr, path))
+	}
+	if o.ResponseHeaderTimeout < 0 {
+		errs = append(errs, fmt.Errorf(
+			"%q: %q: proxyopts: response_header_timeout can't be negative",
+			addr, path))
+	}
+	if o.MaxIdleConns < 0 {
+		errs = append(errs, fmt.Errorf(
+			"%q: %q: proxyopts: max_idle_conns can't be negative", addr, path))
+	}
+	if o.IdleConnTimeout < 0 {
+		errs = append(errs, fmt.Errorf(
+			"%q: %q: proxyopts: idle_conn_timeout can't be negative",
+			addr, path))
+	}
+	if o.KeepAlive < 0 {
+		errs = append(errs, fmt.Errorf(
+			"%q: %q: proxyopts: keepalive can't be negative", addr, path))
+	}
+	if o.MaxConns < 0 {
+		errs = append(errs, fmt.Errorf(
+			"%q: %q: proxyopts: max_conns can't be negative", addr, path))
+	}
+	if o.FlushInterval < 0 {
+		errs = append(errs, fmt.Errorf(
+			"%q: %q: proxyopts: flush_interval can't be negative", addr, path))
+	}
+
+	if o.FlushInterval != 0 && o.DisableBuffering {
+		errs = append(errs, fmt.Errorf(
+			"%q: %q: proxyopts: flush_interval and disable_buffering "+
+				"can't be used together", addr, path))
+	}
+
+	errs = append(errs, o.TLS.Check(
+		fmt.Sprintf("%q: %q: proxyopts: tls", addr, path))...)
+	if o.Shadow != nil {
+		errs = append(errs, o.Shadow.Check(
+			fmt.Sprintf("%q: %q: proxyopts: shadow", addr, path))...)
+	}
+	return errs
+}
+
+// Shadow configures copying requests to a secondary ("shadow") backend.
+// The copies are sent asynchronously, and their responses are discarded;
+// only the differences with the primary backend are recorded.
+type Shadow struct {
+	// Backend to send the copies to.
+	URL *URL `yaml:"url"`
+
+	// Percentage of the requests to copy (default: 100).
+	Percent float64 `yaml:"percent,omitempty"`
+
+	// Requests with larger bodies are not copied (default: 64k).
+	MaxBody ByteSize `yaml:"max_body,omitempty"`
+
+	// How to talk to the shadow backend, like the ones in ProxyOpts.
+	HTTP2 bool        `yaml:"http2,omitempty"`
+	TLS   UpstreamTLS `yaml:"tls,omitempty"`
+}
+
+func (s Shadow) Check(where string) []error {
+	errs := []error{}
+	if s.URL == nil {
+		errs = append(errs, fmt.Errorf("%s: missing url", where))
+	} else if u := s.URL.URL(); u.Scheme != "http" && u.Scheme != "https" {
+		errs = append(errs, fmt.Errorf(
+			"%s: url must be http or https, not %q", where, u.Scheme))
+	}
+	if s.Percent < 0 || s.Percent > 100 {
+		errs = append(errs, fmt.Errorf(
+			"%s: percent must be between 0 and 100", where))
+	}
+	if s.MaxBody < 0 {
+		errs = append(errs, fmt.Errorf(
+			"%s: max_body can't be negative", where))
+	}
+	if s.TLS.isSet() && (s.URL == nil || s.URL.Scheme != "https") {
+		errs = append(errs, fmt.Errorf(
+			"%s: tls is set on non-https url", where))
+	}
+	errs = append(errs, s.TLS.Check(where+": tls")...)
+	return errs
+}
+
+// UpstreamTLS configures the TLS connections we make to the backends.
+type UpstreamTLS struct {
+	// File with the CA certificates to verify the backend against, instead
+	// of the system ones.
+	CA string `yaml:"ca,omitempty"`
+
+	// Server name to send (SNI), and to verify the certificate against,
+	// instead of the host of the backend address.
+	ServerName string `yaml:"server_name,omitempty"`
+
+	// Client certificate and key to present to the backend.
+	Cert string `yaml:"cert,omitempty"`
+	Key  string `yaml:"key,omitempty"`
+
+	// Don't verify the backend's certificate. Insecure, use with care.
+	InsecureSkipVerify bool `yaml:"insecure_skip_verify,omitempty"`
+}
+
+func (u UpstreamTLS) isSet() bool {
+	return nTrue(
+		u.CA != "",
+		u.ServerName != "",
+		u.Cert != "",
+		u.Key != "",
+		u.InsecureSkipVerify) > 0
+}
+
+func (u UpstreamTLS) Check(where string) []error {
+	errs := []error{}
+	if (u.Cert == "") != (u.Key == "") {
+		errs = append(errs, fmt.Errorf(
+			"%s: cert and key must be set together", where))
+	}
+	if u.InsecureSkipVerify && u.CA != "" {
+		errs = append(errs, fmt.Errorf(
+			"%s: ca is set, but insecure_skip_verify disables verification",
+			where))
+	}
+	return errs
+}
+
+// CGIOpts configures how CGI processes are run.
+type CGIOpts struct {
+	// Extra environment variables to set, and variables to inherit from
+	// our own environment.
+	Env        map[string]string `yaml:",omitempty"`
+	InheritEnv []string          `yaml:"inherit_env,omitempty"`
+
+	// Working directory. By default, the directory of the command.
+	Dir string `yaml:",omitempty"`
+
+	// Run as this user, given as "user", "user:group", or ":group".
+	User string `yaml:",omitempty"`
+
+	// Resource limits for each process: CPU time, address space, and
+	// wall-clock time. The process is killed when they're exceeded.
+	MaxCPU    time.Duration `yaml:"max_cpu,omitempty"`
+	MaxMemory ByteSize      `yaml:"max_memory,omitempty"`
+	Timeout   time.Duration `yaml:",omitempty"`
+
+	// Maximum number of processes running at the same time. Other requests
+	// wait for their turn, up to MaxQueue of them (0 means no limit); the
+	// rest get a 503.
+	MaxConcurrent int `yaml:"max_concurrent,omitempty"`
+	MaxQueue      int `yaml:"max_queue,omitempty"`
+}
+
+func (o CGIOpts) isSet() bool {
+	return nTrue(
+		len(o.Env) > 0,
+		len(o.InheritEnv) > 0,
+		o.Dir != "",
+		o.User != "",
+		o.MaxCPU != 0,
+		o.MaxMemory != 0,
+		o.Timeout != 0,
+		o.MaxConcurrent != 0,
+		o.MaxQueue != 0) > 0
+}
+
+func (o CGIOpts) Check(addr, path string) []error {
+	errs := []error{}
+
+	if o.MaxCPU < 0 {
+		errs = append(errs, fmt.Errorf(
+			"%q: %q: cgiopts: max_cpu can't be negative", addr, path))
+	}
+	if o.MaxMemory < 0 {
+		errs = append(errs, fmt.Errorf(
+			"%q: %q: cgiopts: max_memory can't be negative", addr, path))
+	}
+	if o.Timeout < 0 {
+		errs = append(errs, fmt.Errorf(
+			"%q: %q: cgiopts: timeout can't be negative", addr, path))
+	}
+	if o.MaxConcurrent < 0 {
+		errs = append(errs, fmt.Errorf(
+			"%q: %q: cgiopts: max_concurrent can't be negative", addr, path))
+	}
+	if o.MaxQueue < 0 {
+		errs = append(errs, fmt.Errorf(
+			"%q: %q: cgiopts: max_queue can't be negative", addr, path))
+	}
+
+	if o.MaxQueue != 0 && o.MaxConcurrent == 0 {
+		errs = append(errs, fmt.Errorf(
+			"%q: %q: cgiopts: max_queue needs max_concurrent", addr, path))
+	}
+	return errs
+}
+
 type Raw struct {
 	Certs     string `yaml:",omitempty"`
+	TLS       TLS    `yaml:"tls,omitempty"`
 	To        string `yaml:",omitempty"`
 	ToTLS     bool   `yaml:"to_tls,omitempty"`
 	ReqLog    string `yaml:",omitempty"`
 	RateLimit string `yaml:",omitempty"`
+
+	// TLS options for the connections to the backends, when using to_tls.
+	UpstreamTLS UpstreamTLS `yaml:"upstream_tls,omitempty"`
+
+	// Backends to proxy to, instead of the single To address. They are
+	// selected according to Balance ("roundrobin", the default, or
+	// "first"), and if dialing one fails, the next one is tried.
+	Backends []string `yaml:",omitempty"`
+	Balance  string   `yaml:",omitempty"`
+
+	// Timeout for connecting to each backend.
+	ConnectTimeout time.Duration `yaml:"connect_timeout,omitempty"`
+
+	// Periodically check that the backends accept connections, and skip
+	// the ones that don't.
+	HealthCheck *HealthCheck `yaml:"health_check,omitempty"`
+
+	// Permissions of the socket, for "unix:" addresses.
+	UnixSocket *UnixSocket `yaml:"unix_socket,omitempty"`
+
+	// Accept the PROXY protocol on incoming connections.
+	ProxyProtocol *ProxyProtocol `yaml:"proxy_protocol,omitempty"`
+
+	// Send a PROXY protocol header of this version (1 or 2) to the backend.
+	ToProxyProtocol int `yaml:"to_proxy_protocol,omitempty"`
+
+	// Route TLS connections by SNI, without terminating them: host ->
+	// backend address. Connections for other hosts go to To (terminating
+	// TLS if Certs is set).
+	SNI map[string]string `yaml:"sni,omitempty"`
+
+	// Forward UDP instead of TCP. Each client address gets its own session
+	// to the backend.
+	UDP bool `yaml:",omitempty"`
+
+	// Maximum number of concurrent connections (or UDP sessions), in total
+	// and per client IP.
+	MaxConns      int `yaml:"max_conns,omitempty"`
+	MaxConnsPerIP int `yaml:"max_conns_per_ip,omitempty"`
+
+	// Close connections after this long without traffic, or after this
+	// long in total.
+	IdleTimeout time.Duration `yaml:"idle_timeout,omitempty"`
+	MaxDuration time.Duration `yaml:"max_duration,omitempty"`
+}
+
+// hasUnix returns true if the listener or any of the backends are unix
+// sockets.
+func (r Raw) hasUnix(addr string) bool {
+	for _, a := range append([]string{addr}, r.Addrs()...) {
+		if _, ok := UnixPath(a); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Addrs returns the addresses of the backends.
+func (r Raw) Addrs() []string {
+	if r.To != "" {
+		return []string{r.To}
+	}
+	return r.Backends
+}
+
+// UnixPath returns the path of a "unix:/path" address, and true; or false if
+// the address is not a unix socket.
+func UnixPath(addr string) (string, bool) {
+	return strings.CutPrefix(addr, "unix:")
+}
+
+// UnixSocket configures the permissions of unix socket listeners.
+type UnixSocket struct {
+	// File mode, in octal (e.g. "0660").
+	Mode string `yaml:",omitempty"`
+
+	// Owner, as "user", "user:group", or ":group".
+	Owner string `yaml:",omitempty"`
+}
+
+// FileMode returns the parsed mode, or 0 if it is not set.
+func (u UnixSocket) FileMode() (os.FileMode, error) {
+	if u.Mode == "" {
+		return 0, nil
+	}
+	m, err := strconv.ParseUint(u.Mode, 8, 32)
+	if err != nil || m > 0777 {
+		return 0, fmt.Errorf("invalid mode %q", u.Mode)
+	}
+	return os.FileMode(m), nil
+}
+
+func (u *UnixSocket) Check(addr string) []error {
+	errs := []error{}
+	if u == nil {
+		return errs
+	}
+
+	if _, ok := UnixPath(addr); !ok {
+		errs = append(errs, fmt.Errorf(
+			"%q: unix_socket is only valid for unix: addresses", addr))
+	}
+	if _, err := u.FileMode(); err != nil {
+		errs = append(errs, fmt.Errorf("%q: unix_socket: %v", addr, err))
+	}
+	return errs
+}
+
+// HealthCheck configures the health checks of raw backends.
+type HealthCheck struct {
+	// How often to check, and how long to wait for the connection.
+	Interval time.Duration `yaml:",omitempty"`
+	Timeout  time.Duration `yaml:",omitempty"`
+}
+
+func (h *HealthCheck) Check(addr string) []error {
+	errs := []error{}
+	if h == nil {
+		return errs
+	}
+
+	if h.Interval < 0 {
+		errs = append(errs, fmt.Errorf(
+			"%q: health_check: interval can't be negative", addr))
+	}
+	if h.Timeout < 0 {
+		errs = append(errs, fmt.Errorf(
+			"%q: health_check: timeout can't be negative", addr))
+	}
+	return errs
+}
+
+// ProxyProtocol configures the PROXY protocol on incoming connections.
+type ProxyProtocol struct {
+	// Networks to accept the PROXY header from, as CIDRs or IP addresses.
+	// Connections from them must send it; connections from other sources
+	// are used as-is.
+	Trusted []string `yaml:",omitempty"`
+
+	// How long to wait for the PROXY header.
+	Timeout time.Duration `yaml:",omitempty"`
+}
+
+// Networks returns the parsed trusted networks.
+func (p ProxyProtocol) Networks() ([]*net.IPNet, error) {
+	return ParseNetworks(p.Trusted)
+}
+
+// ParseNetworks parses a list of networks, in CIDR notation. Plain IP
+// addresses are also accepted, as networks containing only them.
+func ParseNetworks(ss []string) ([]*net.IPNet, error) {
+	nets := []*net.IPNet{}
+	for _, s := range ss {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid network %q", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			nets = append(nets,
+				&net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q", s)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func (p *ProxyProtocol) Check(addr string) []error {
+	errs := []error{}
+	if p == nil {
+		return errs
+	}
+
+	if len(p.Trusted) == 0 {
+		errs = append(errs, fmt.Errorf(
+			"%q: proxy_protocol: trusted networks must be set", addr))
+	}
+	if _, err := p.Networks(); err != nil {
+		errs = append(errs, fmt.Errorf("%q: proxy_protocol: %v", addr, err))
+	}
+	if p.Timeout < 0 {
+		errs = append(errs, fmt.Errorf(
+			"%q: proxy_protocol: timeout can't be negative", addr))
+	}
+	return errs
 }
 
 type ReqLog struct {
@@ -114,24 +872,180 @@ func (c Config) String() string {
 	return string(d)
 }
 
+// hasListener returns true if the address is used by a listener.
+func (c Config) hasListener(addr string) bool {
+	_, http := c.HTTP[addr]
+	_, https := c.HTTPS[addr]
+	_, raw := c.Raw[addr]
+	return http || https || raw
+}
+
 func (c Config) Check() []error {
 	errs := []error{}
+	if c.CertExpiryWarning < 0 {
+		errs = append(errs,
+			fmt.Errorf("cert_expiry_warning can't be negative"))
+	}
+
 	for addr, h := range c.HTTP {
 		errs = append(errs, h.Check(c, addr)...)
 
 	}
 
+	// Each cache needs its own directory.
+	cacheDirs := map[string]string{}
+	checkCacheDirs := func(addr string, h HTTP) {
+		for path, cache := range h.Cache {
+			if cache.Dir == "" {
+				continue
+			}
+			where := fmt.Sprintf("%q: %q", addr, path)
+			if other, ok := cacheDirs[cache.Dir]; ok {
+				errs = append(errs, fmt.Errorf(
+					"%s: cache: dir %q is also used by %s",
+					where, cache.Dir, other))
+			}
+			cacheDirs[cache.Dir] = where
+		}
+	}
+	for addr, h := range c.HTTP {
+		checkCacheDirs(addr, h)
+	}
+	for addr, h := range c.HTTPS {
+		checkCacheDirs(addr, h.HTTP)
+	}
+
+	redirects := map[string]bool{}
 	for addr, h := range c.HTTPS {
 		errs = append(errs, h.Check(c, addr)...)
 
 		// For HTTPS, either Certs or AutoCerts must be set.
-		if h.Certs == "" && len(h.AutoCerts.Hosts) == 0 {
+		if h.Certs == "" && len(h.AutoCerts.Hosts) == 0 &&
+			!h.AutoCerts.OnDemand() {
 			errs = append(errs,
 				fmt.Errorf("%q: certs or autocerts must be set", addr))
 		}
+
+		errs = append(errs, h.TLS.Check(addr)...)
+		errs = append(errs, h.AutoCerts.Check(addr)...)
+
+		if h.H2C {
+			errs = append(errs, fmt.Errorf(
+				"%q: h2c is only supported on http listeners", addr))
+		}
+
+		if h.HTTP3 {
+			if _, unix := UnixPath(addr); unix {
+				errs = append(errs, fmt.Errorf(
+					"%q: http3 is not supported on unix sockets", addr))
+			}
+			if v, _ := TLSVersion(h.TLS.MaxVersion); v != 0 &&
+				v < tls.VersionTLS13 {
+				errs = append(errs, fmt.Errorf(
+					"%q: http3 requires tls max_version 1.3", addr))
+			}
+		}
+
+		if _, unix := UnixPath(addr); unix && h.HTTPRedirect != "" {
+			errs = append(errs, fmt.Errorf(
+				"%q: http_redirect is not supported on unix sockets", addr))
+		}
+		if h.HTTPRedirect != "" {
+			if c.hasListener(h.HTTPRedirect) || redirects[h.HTTPRedirect] {
+				errs = append(errs, fmt.Errorf(
+					"%q: http_redirect %q is already in use",
+					addr, h.HTTPRedirect))
+			}
+			redirects[h.HTTPRedirect] = true
+		}
 	}
 
 	for addr, r := range c.Raw {
+		if r.Certs == "" && r.TLS.isSet() {
+			errs = append(errs,
+				fmt.Errorf("%q: tls options set without certs", addr))
+		}
+		errs = append(errs, r.TLS.Check(addr)...)
+		errs = append(errs, r.ProxyProtocol.Check(addr)...)
+		if r.UpstreamTLS.isSet() && !r.ToTLS {
+			errs = append(errs, fmt.Errorf(
+				"%q: upstream_tls is set without to_tls", addr))
+		}
+		errs = append(errs, r.UpstreamTLS.Check(
+			fmt.Sprintf("%q: upstream_tls", addr))...)
+
+		if r.To == "" && len(r.Backends) == 0 && len(r.SNI) == 0 {
+			errs = append(errs, fmt.Errorf("%q: missing to", addr))
+		}
+		if r.To != "" && len(r.Backends) > 0 {
+			errs = append(errs, fmt.Errorf(
+				"%q: to and backends can't be used together", addr))
+		}
+		for _, b := range r.Backends {
+			if b == "" {
+				errs = append(errs, fmt.Errorf(
+					"%q: backends: empty entry", addr))
+			}
+		}
+		if r.Balance != "" && r.Balance != "roundrobin" &&
+			r.Balance != "first" {
+			errs = append(errs, fmt.Errorf(
+				"%q: unknown balance %q", addr, r.Balance))
+		}
+		if r.ConnectTimeout < 0 {
+			errs = append(errs, fmt.Errorf(
+				"%q: connect_timeout can't be negative", addr))
+		}
+		errs = append(errs, r.HealthCheck.Check(addr)...)
+		errs = append(errs, r.UnixSocket.Check(addr)...)
+		if r.UDP && r.hasUnix(addr) {
+			errs = append(errs, fmt.Errorf(
+				"%q: udp is not compatible with unix sockets", addr))
+		}
+		if r.UDP && r.HealthCheck != nil {
+			errs = append(errs, fmt.Errorf(
+				"%q: health_check is not supported with udp", addr))
+		}
+		for host, to := range r.SNI {
+			if host == "" || to == "" {
+				errs = append(errs, fmt.Errorf(
+					"%q: sni: invalid entry %q: %q", addr, host, to))
+			}
+		}
+		if len(r.SNI) > 0 && r.ToTLS && r.Certs == "" {
+			// Without certs, all connections are passed through, and they
+			// can't be wrapped in TLS again.
+			errs = append(errs, fmt.Errorf(
+				"%q: to_tls with sni needs certs", addr))
+		}
+		if r.ToProxyProtocol != 0 && r.ToProxyProtocol != 1 &&
+			r.ToProxyProtocol != 2 {
+			errs = append(errs, fmt.Errorf(
+				"%q: to_proxy_protocol must be 1 or 2", addr))
+		}
+		if r.UDP && (r.Certs != "" || r.ToTLS || len(r.SNI) > 0 ||
+			r.ProxyProtocol != nil || r.ToProxyProtocol != 0) {
+			errs = append(errs, fmt.Errorf(
+				"%q: udp is not compatible with certs, to_tls, sni, "+
+					"proxy_protocol or to_proxy_protocol", addr))
+		}
+		if r.MaxConns < 0 {
+			errs = append(errs, fmt.Errorf(
+				"%q: max_conns can't be negative", addr))
+		}
+		if r.MaxConnsPerIP < 0 {
+			errs = append(errs, fmt.Errorf(
+				"%q: max_conns_per_ip can't be negative", addr))
+		}
+		if r.IdleTimeout < 0 {
+			errs = append(errs, fmt.Errorf(
+				"%q: idle_timeout can't be negative", addr))
+		}
+		if r.MaxDuration < 0 {
+			errs = append(errs, fmt.Errorf(
+				"%q: max_duration can't be negative", addr))
+		}
+
 		if _, ok := c.ReqLog[r.ReqLog]; r.ReqLog != "" && !ok {
 			errs = append(errs,
 				fmt.Errorf("%q: unknown reqlog %q", addr, r.ReqLog))
@@ -145,6 +1059,43 @@ func (c Config) Check() []error {
 	return errs
 }
 
+// Warnings returns the problems with the configuration which are not severe
+// enough to refuse it, like insecure settings.
+func (c Config) Warnings() []string {
+	warns := []string{}
+	insecure := func(where string) {
+		warns = append(warns, fmt.Sprintf(
+			"%s: insecure_skip_verify is set, "+
+				"the backend's certificate is not verified", where))
+	}
+
+	routes := func(addr string, h HTTP) {
+		for path, r := range h.Routes {
+			if r.ProxyOpts.TLS.InsecureSkipVerify {
+				insecure(fmt.Sprintf("%q: %q: proxyopts: tls", addr, path))
+			}
+			if sh := r.ProxyOpts.Shadow; sh != nil && sh.TLS.InsecureSkipVerify {
+				insecure(fmt.Sprintf(
+					"%q: %q: proxyopts: shadow: tls", addr, path))
+			}
+		}
+	}
+	for addr, h := range c.HTTP {
+		routes(addr, h)
+	}
+	for addr, h := range c.HTTPS {
+		routes(addr, h.HTTP)
+	}
+	for addr, r := range c.Raw {
+		if r.UpstreamTLS.InsecureSkipVerify {
+			insecure(fmt.Sprintf("%q: upstream_tls", addr))
+		}
+	}
+
+	sort.Strings(warns)
+	return warns
+}
+
 func (h HTTP) Check(c Config, addr string) []error {
 	errs := []error{}
 
@@ -159,6 +1110,26 @@ func (h HTTP) Check(c Config, addr string) []error {
 					addr, path))
 		}
 
+		if r.CGIOpts.isSet() && len(r.CGI) == 0 {
+			errs = append(errs,
+				fmt.Errorf("%q: %q: cgiopts is set on non-cgi route",
+					addr, path))
+		}
+		errs = append(errs, r.CGIOpts.Check(addr, path)...)
+
+		if r.ProxyOpts.isSet() && r.Proxy == nil {
+			errs = append(errs,
+				fmt.Errorf("%q: %q: proxyopts is set on non-proxy route",
+					addr, path))
+		}
+		if r.ProxyOpts.TLS.isSet() && r.Proxy != nil &&
+			r.Proxy.Scheme != "https" {
+			errs = append(errs,
+				fmt.Errorf("%q: %q: proxyopts: tls is set on non-https proxy",
+					addr, path))
+		}
+		errs = append(errs, r.ProxyOpts.Check(addr, path)...)
+
 		nSet := nTrue(
 			r.Dir != "",
 			r.File != "",
@@ -166,6 +1137,7 @@ func (h HTTP) Check(c Config, addr string) []error {
 			r.Redirect != nil,
 			len(r.RedirectRe) > 0,
 			len(r.CGI) > 0,
+			r.FastCGI != nil,
 			r.Status > 0)
 		if nSet > 1 {
 			errs = append(errs,
@@ -174,6 +1146,32 @@ func (h HTTP) Check(c Config, addr string) []error {
 			errs = append(errs,
 				fmt.Errorf("%q: %q: action missing", addr, path))
 		}
+
+		if r.Proxy != nil {
+			if sock, _, ok := UnixProxyTarget(r.Proxy.URL()); ok && sock == "" {
+				errs = append(errs, fmt.Errorf(
+					"%q: %q: missing unix socket path in proxy", addr, path))
+			}
+		}
+
+		errs = append(errs, r.FastCGI.Check(addr, path)...)
+	}
+
+	for path, cache := range h.Cache {
+		errs = append(errs, cache.Check(addr, path)...)
+	}
+
+	for path, j := range h.JWTAuth {
+		if nTrue(j.SecretFile != "", j.JWKSFile != "") != 1 {
+			errs = append(errs,
+				fmt.Errorf("%q: %q: jwtauth needs one of secret_file or jwks_file",
+					addr, path))
+		}
+		if j.Leeway < 0 {
+			errs = append(errs,
+				fmt.Errorf("%q: %q: jwtauth leeway can't be negative",
+					addr, path))
+		}
 	}
 
 	for path, name := range h.ReqLog {
@@ -188,6 +1186,11 @@ func (h HTTP) Check(c Config, addr string) []error {
 				fmt.Errorf("%q: %q: unknown ratelimit %q", addr, path, name))
 		}
 	}
+	if _, unix := UnixPath(addr); unix && len(h.RateLimit) > 0 {
+		// The clients don't have an IP address to limit by.
+		errs = append(errs, fmt.Errorf(
+			"%q: ratelimit is not supported on unix sockets", addr))
+	}
 
 	// Verify timeouts are positive.
 	for path, timeout := range h.Timeouts {
@@ -199,11 +1202,221 @@ func (h HTTP) Check(c Config, addr string) []error {
 			errs = append(errs,
 				fmt.Errorf("%q: %q: write timeout must be positive", addr, path))
 		}
+		if timeout.UpgradeIdle < 0 {
+			errs = append(errs, fmt.Errorf(
+				"%q: %q: upgrade_idle timeout must be positive", addr, path))
+		}
+	}
+
+	for path, limits := range h.Limits {
+		errs = append(errs, limits.Check(addr, path)...)
+	}
+
+	errs = append(errs, h.ProxyProtocol.Check(addr)...)
+	errs = append(errs, h.UnixSocket.Check(addr)...)
+	if _, err := ParseNetworks(h.TrustedProxies); err != nil {
+		errs = append(errs, fmt.Errorf("%q: trusted_proxies: %v", addr, err))
+	}
+
+	return errs
+}
+
+func (a AutoCerts) Check(addr string) []error {
+	errs := []error{}
+	switch a.Challenge {
+	case "", "tls-alpn-01", "dns-01":
+	default:
+		errs = append(errs, fmt.Errorf(
+			"%q: autocerts: unknown challenge %q", addr, a.Challenge))
+	}
+
+	for _, host := range a.Hosts {
+		if strings.HasPrefix(host, "*.") && a.Challenge != "dns-01" {
+			errs = append(errs, fmt.Errorf(
+				"%q: autocerts: wildcard %q needs the dns-01 challenge",
+				addr, host))
+		}
+	}
+
+	if a.OnDemand() && a.Challenge != "" {
+		errs = append(errs, fmt.Errorf(
+			"%q: autocerts: on-demand hosts are not supported with challenge %q",
+			addr, a.Challenge))
+	}
+	if a.MaxPerHour < 0 {
+		errs = append(errs, fmt.Errorf(
+			"%q: autocerts: max_per_hour can't be negative", addr))
+	}
+
+	d := a.DNS
+	if a.Challenge != "dns-01" {
+		if d.Provider != "" {
+			errs = append(errs, fmt.Errorf(
+				"%q: autocerts: dns is only used with the dns-01 challenge",
+				addr))
+		}
+		return errs
+	}
+
+	switch d.Provider {
+	case "rfc2136":
+		if d.Server == "" || d.Zone == "" {
+			errs = append(errs, fmt.Errorf(
+				"%q: autocerts: rfc2136 needs server and zone", addr))
+		}
+		if (d.TSIGKey == "") != (d.TSIGSecretFile == "") {
+			errs = append(errs, fmt.Errorf("%q: autocerts: "+
+				"tsig_key and tsig_secret_file must be set together", addr))
+		}
+		if _, err := TSIGAlgorithm(d.TSIGAlgorithm); err != nil {
+			errs = append(errs, fmt.Errorf("%q: autocerts: %v", addr, err))
+		}
+	case "exec":
+		if d.Command == "" {
+			errs = append(errs, fmt.Errorf(
+				"%q: autocerts: exec needs a command", addr))
+		}
+	case "":
+		errs = append(errs, fmt.Errorf(
+			"%q: autocerts: dns-01 needs a dns provider", addr))
+	default:
+		errs = append(errs, fmt.Errorf(
+			"%q: autocerts: unknown dns provider %q", addr, d.Provider))
+	}
+
+	if d.PropagationDelay < 0 {
+		errs = append(errs, fmt.Errorf(
+			"%q: autocerts: propagation_delay can't be negative", addr))
+	}
+
+	return errs
+}
+
+// TSIGAlgorithm returns the DNS name of the given TSIG algorithm (defaults to
+// hmac-sha256).
+func TSIGAlgorithm(name string) (string, error) {
+	switch strings.ToLower(strings.TrimSuffix(name, ".")) {
+	case "", "hmac-sha256":
+		return "hmac-sha256.", nil
+	case "hmac-sha384":
+		return "hmac-sha384.", nil
+	case "hmac-sha512":
+		return "hmac-sha512.", nil
+	default:
+		return "", fmt.Errorf("unknown TSIG algorithm %q", name)
+	}
+}
+
+func (t TLS) Check(addr string) []error {
+	errs := []error{}
+
+	min, err := TLSVersion(t.MinVersion)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("%q: tls: min_version: %v", addr, err))
+	}
+	max, err := TLSVersion(t.MaxVersion)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("%q: tls: max_version: %v", addr, err))
+	}
+	if min != 0 && max != 0 && min > max {
+		errs = append(errs, fmt.Errorf(
+			"%q: tls: min_version is greater than max_version", addr))
+	}
+
+	for _, name := range t.CipherSuites {
+		if _, err := CipherSuite(name); err != nil {
+			errs = append(errs, fmt.Errorf("%q: tls: %v", addr, err))
+		}
+	}
+
+	for _, name := range t.Curves {
+		if _, err := Curve(name); err != nil {
+			errs = append(errs, fmt.Errorf("%q: tls: %v", addr, err))
+		}
+	}
+
+	if t.SessionTicketKeysFile != "" && t.SessionTicketRotation != 0 {
+		errs = append(errs, fmt.Errorf("%q: tls: session_ticket_keys_file "+
+			"and session_ticket_rotation are mutually exclusive", addr))
+	}
+	if t.SessionTicketRotation < 0 {
+		errs = append(errs, fmt.Errorf(
+			"%q: tls: session_ticket_rotation can't be negative", addr))
 	}
 
 	return errs
 }
 
+func (t TLS) isSet() bool {
+	return nTrue(
+		t.MinVersion != "",
+		t.MaxVersion != "",
+		len(t.CipherSuites) > 0,
+		len(t.Curves) > 0,
+		len(t.ALPN) > 0,
+		t.SessionTicketKeysFile != "",
+		t.SessionTicketRotation != 0) > 0
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// TLSVersion returns the TLS version for the given name (e.g. "1.2").
+// An empty name returns 0, which means the library's default.
+func TLSVersion(name string) (uint16, error) {
+	if name == "" {
+		return 0, nil
+	}
+	v, ok := tlsVersions[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown TLS version %q", name)
+	}
+	return v, nil
+}
+
+// CipherSuite returns the ID of the cipher suite with the given name (e.g.
+// "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256").
+func CipherSuite(name string) (uint16, error) {
+	for _, cs := range tls.CipherSuites() {
+		if cs.Name != name {
+			continue
+		}
+		if len(cs.SupportedVersions) == 1 &&
+			cs.SupportedVersions[0] == tls.VersionTLS13 {
+			return 0, fmt.Errorf(
+				"cipher suite %q is TLS 1.3 only, and not configurable", name)
+		}
+		return cs.ID, nil
+	}
+	for _, cs := range tls.InsecureCipherSuites() {
+		if cs.Name == name {
+			return 0, fmt.Errorf("cipher suite %q is insecure", name)
+		}
+	}
+	return 0, fmt.Errorf("unknown cipher suite %q", name)
+}
+
+var tlsCurves = map[string]tls.CurveID{
+	"X25519":         tls.X25519,
+	"P-256":          tls.CurveP256,
+	"P-384":          tls.CurveP384,
+	"P-521":          tls.CurveP521,
+	"X25519MLKEM768": tls.X25519MLKEM768,
+}
+
+// Curve returns the ID of the curve with the given name (e.g. "P-256").
+func Curve(name string) (tls.CurveID, error) {
+	c, ok := tlsCurves[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown curve %q", name)
+	}
+	return c, nil
+}
+
 // Count how many true values are in a series of bools.
 func nTrue(bs ...bool) int {
 	n := 0
@@ -306,6 +1519,21 @@ func (u *URL) MarshalYAML() (interface{}, error) {
 	return u.String(), nil
 }
 
+// UnixProxyTarget parses proxy URLs which point to a unix socket, in the
+// style of nginx: "http://unix:/path/to/socket:/base/path".
+// It returns the socket path, the base path, and true; or false if the URL
+// is not for a unix socket.
+func UnixProxyTarget(u url.URL) (string, string, bool) {
+	if u.Host != "unix:" {
+		return "", "", false
+	}
+	sock, path, _ := strings.Cut(u.Path, ":")
+	if path == "" {
+		path = "/"
+	}
+	return sock, path, true
+}
+
 func (u *URL) URL() url.URL {
 	return url.URL(*u)
 }
@@ -356,3 +1584,66 @@ func (r *Rate) UnmarshalYAML(unmarshal func(interface{}) error) error {
 func (r Rate) MarshalYAML() (interface{}, error) {
 	return fmt.Sprintf("%d/%s", r.Requests, r.Period), nil
 }
+
+// ByteSize is a size in bytes, which can be given with a unit suffix: "k",
+// "m", "g" or "t" (powers of 1024, case-insensitive, optionally followed by
+// "b" or "ib"). For example: "512", "64k", "1.5GiB".
+type ByteSize int64
+
+var byteSizeUnits = []struct {
+	suffix string
+	size   ByteSize
+}{
+	{"t", 1 << 40},
+	{"g", 1 << 30},
+	{"m", 1 << 20},
+	{"k", 1 << 10},
+}
+
+// ParseByteSize parses a size in bytes, with an optional unit suffix.
+func ParseByteSize(s string) (ByteSize, error) {
+	num := strings.ToLower(strings.TrimSpace(s))
+	num = strings.TrimSuffix(num, "b")
+	num = strings.TrimSuffix(num, "i")
+
+	mult := ByteSize(1)
+	for _, u := range byteSizeUnits {
+		if n, ok := strings.CutSuffix(num, u.suffix); ok {
+			num, mult = n, u.size
+			break
+		}
+	}
+
+	f, err := strconv.ParseFloat(strings.TrimSpace(num), 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return ByteSize(f * float64(mult)), nil
+}
+
+func (b *ByteSize) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+
+	size, err := ParseByteSize(s)
+	if err != nil {
+		return err
+	}
+	*b = size
+	return nil
+}
+
+func (b ByteSize) MarshalYAML() (interface{}, error) {
+	return b.String(), nil
+}
+
+func (b ByteSize) String() string {
+	for _, u := range byteSizeUnits {
+		if b != 0 && b%u.size == 0 {
+			return fmt.Sprintf("%d%s", b/u.size, strings.ToUpper(u.suffix))
+		}
+	}
+	return strconv.FormatInt(int64(b), 10)
+}
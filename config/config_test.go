@@ -227,7 +227,7 @@ raw:
 	expectErrs(t, `":1234": unknown ratelimit "lalala"`,
 		loadAndCheck(t, contents))
 
-	// Negative read and write timeouts.
+	// Negative timeouts.
 	contents = `
 http:
   ":http":
@@ -238,10 +238,596 @@ http:
       "/":
         read: "-1s"
         write: "-1s"
+        upgrade_idle: "-1s"
 `
 	got := loadAndCheck(t, contents)
 	expectErrs(t, `":http": "/": read timeout must be positive`, got)
 	expectErrs(t, `":http": "/": write timeout must be positive`, got)
+	expectErrs(t, `":http": "/": upgrade_idle timeout must be positive`, got)
+
+	// jwtauth needs exactly one source of keys.
+	contents = `
+http:
+  ":http":
+    routes:
+      "/":
+        file: "/dev/null"
+    jwtauth:
+      "/a/":
+        issuer: "me"
+      "/b/":
+        secret_file: "/dev/null"
+        jwks_file: "/dev/null"
+        leeway: "-1s"
+`
+	got = loadAndCheck(t, contents)
+	expectErrs(t,
+		`":http": "/a/": jwtauth needs one of secret_file or jwks_file`, got)
+	expectErrs(t,
+		`":http": "/b/": jwtauth needs one of secret_file or jwks_file`, got)
+	expectErrs(t, `":http": "/b/": jwtauth leeway can't be negative`, got)
+
+	// Invalid TLS options.
+	contents = `
+https:
+  ":https":
+    certs: "/dev/null"
+    routes:
+      "/":
+        file: "/dev/null"
+    tls:
+      min_version: "1.3"
+      max_version: "1.2"
+      cipher_suites: ["TLS_AES_128_GCM_SHA256", "TLS_RSA_WITH_RC4_128_SHA",
+                      "unknown"]
+      curves: ["P-256", "P-1"]
+      session_ticket_keys_file: "/dev/null"
+      session_ticket_rotation: "-1h"
+raw:
+  ":1234":
+    to: "localhost:1235"
+    tls:
+      min_version: "1.1.1"
+`
+	got = loadAndCheck(t, contents)
+	expectErrs(t, `":https": tls: min_version is greater than max_version`, got)
+	expectErrs(t, `":https": tls: cipher suite "TLS_AES_128_GCM_SHA256" is TLS 1.3 only`, got)
+	expectErrs(t, `":https": tls: cipher suite "TLS_RSA_WITH_RC4_128_SHA" is insecure`, got)
+	expectErrs(t, `":https": tls: unknown cipher suite "unknown"`, got)
+	expectErrs(t, `":https": tls: unknown curve "P-1"`, got)
+	expectErrs(t, `":https": tls: session_ticket_keys_file and session_ticket_rotation are mutually exclusive`, got)
+	expectErrs(t, `":https": tls: session_ticket_rotation can't be negative`, got)
+	expectErrs(t, `":1234": tls options set without certs`, got)
+	expectErrs(t, `":1234": tls: min_version: unknown TLS version "1.1.1"`, got)
+	if len(got) != 9 {
+		t.Errorf("expected 9 errors, got %d: %v", len(got), got)
+	}
+
+	// Invalid ACME challenges and DNS providers.
+	contents = `
+https:
+  ":1":
+    autocerts:
+      hosts: ["*.a.com"]
+      challenge: "http-01"
+    routes:
+      "/":
+        file: "/dev/null"
+  ":2":
+    autocerts:
+      hosts: ["b.com"]
+      challenge: "tls-alpn-01"
+      dns:
+        provider: "exec"
+    routes:
+      "/":
+        file: "/dev/null"
+  ":3":
+    autocerts:
+      hosts: ["c.com"]
+      challenge: "dns-01"
+      dns:
+        provider: "rfc2136"
+        tsig_key: "gofer"
+        tsig_algorithm: "hmac-md5"
+        propagation_delay: "-1s"
+    routes:
+      "/":
+        file: "/dev/null"
+  ":4":
+    autocerts:
+      hosts: ["d.com"]
+      challenge: "dns-01"
+      dns:
+        provider: "exec"
+    routes:
+      "/":
+        file: "/dev/null"
+  ":5":
+    autocerts:
+      hosts: ["e.com"]
+      challenge: "dns-01"
+    routes:
+      "/":
+        file: "/dev/null"
+  ":6":
+    autocerts:
+      hosts: ["f.com"]
+      challenge: "dns-01"
+      dns:
+        provider: "lalala"
+    routes:
+      "/":
+        file: "/dev/null"
+`
+	got = loadAndCheck(t, contents)
+	expectErrs(t, `":1": autocerts: unknown challenge "http-01"`, got)
+	expectErrs(t, `":1": autocerts: wildcard "*.a.com" needs the dns-01 challenge`, got)
+	expectErrs(t, `":2": autocerts: dns is only used with the dns-01 challenge`, got)
+	expectErrs(t, `":3": autocerts: rfc2136 needs server and zone`, got)
+	expectErrs(t, `":3": autocerts: tsig_key and tsig_secret_file must be set together`, got)
+	expectErrs(t, `":3": autocerts: unknown TSIG algorithm "hmac-md5"`, got)
+	expectErrs(t, `":3": autocerts: propagation_delay can't be negative`, got)
+	expectErrs(t, `":4": autocerts: exec needs a command`, got)
+	expectErrs(t, `":5": autocerts: dns-01 needs a dns provider`, got)
+	expectErrs(t, `":6": autocerts: unknown dns provider "lalala"`, got)
+	if len(got) != 10 {
+		t.Errorf("expected 10 errors, got %d: %v", len(got), got)
+	}
+
+	// On-demand autocerts.
+	contents = `
+https:
+  ":1":
+    autocerts:
+      hosts_regexp: '.*\.a\.com'
+    routes:
+      "/":
+        file: "/dev/null"
+  ":2":
+    autocerts:
+      hosts: ["b.com"]
+      hosts_file: "/dev/null"
+      challenge: "tls-alpn-01"
+      max_per_hour: -1
+    routes:
+      "/":
+        file: "/dev/null"
+`
+	got = loadAndCheck(t, contents)
+	expectErrs(t, `":2": autocerts: on-demand hosts are not supported with challenge "tls-alpn-01"`, got)
+	expectErrs(t, `":2": autocerts: max_per_hour can't be negative`, got)
+	if len(got) != 2 {
+		t.Errorf("expected 2 errors, got %d: %v", len(got), got)
+	}
+
+	// http_redirect on an address already in use.
+	contents = `
+http:
+  ":80":
+    routes:
+      "/":
+        file: "/dev/null"
+https:
+  ":443":
+    certs: "/dev/null"
+    http_redirect: ":80"
+    routes:
+      "/":
+        file: "/dev/null"
+`
+	got = loadAndCheck(t, contents)
+	expectErrs(t, `":443": http_redirect ":80" is already in use`, got)
+
+	// Invalid unix socket settings.
+	contents = `
+http:
+  ":80":
+    unix_socket:
+      mode: "0660"
+    routes:
+      "/":
+        proxy: "http://unix:"
+  "unix:/run/gofer.sock":
+    unix_socket:
+      mode: "rw-rw----"
+    routes:
+      "/":
+        proxy: "http://unix:/run/app.sock:/base/"
+    ratelimit:
+      "/": "rl"
+https:
+  "unix:/run/gofer-https.sock":
+    certs: "/dev/null"
+    http_redirect: ":8080"
+    routes:
+      "/":
+        file: "/dev/null"
+raw:
+  "unix:/run/raw.sock":
+    to: "localhost:53"
+    udp: true
+  ":5353":
+    backends: ["unix:/run/dns.sock"]
+    udp: true
+ratelimit:
+  "rl":
+    rate: "1/1s"
+`
+	got = loadAndCheck(t, contents)
+	expectErrs(t, `":80": unix_socket is only valid for unix: addresses`, got)
+	expectErrs(t, `":80": "/": missing unix socket path in proxy`, got)
+	expectErrs(t, `"unix:/run/gofer.sock": unix_socket: invalid mode "rw-rw----"`, got)
+	expectErrs(t, `"unix:/run/gofer-https.sock": http_redirect is not supported on unix sockets`, got)
+	expectErrs(t, `"unix:/run/raw.sock": udp is not compatible with unix sockets`, got)
+	expectErrs(t, `":5353": udp is not compatible with unix sockets`, got)
+	expectErrs(t, `"unix:/run/gofer.sock": ratelimit is not supported on unix sockets`, got)
+	if len(got) != 7 {
+		t.Errorf("expected 7 errors, got %d: %v", len(got), got)
+	}
+
+	// Invalid PROXY protocol and raw settings.
+	contents = `
+http:
+  ":1":
+    routes:
+      "/":
+        file: "/dev/null"
+    proxy_protocol:
+      timeout: "-1s"
+  ":2":
+    routes:
+      "/":
+        file: "/dev/null"
+    proxy_protocol:
+      trusted: ["10.0.0.0/8", "1.2.3.4", "::1", "10.0.0.0/33", "lalala"]
+    trusted_proxies: ["10.0.0.0/8", "lalala"]
+raw:
+  ":3":
+    to: "localhost:1235"
+    to_proxy_protocol: 3
+  ":4":
+    ratelimit: ""
+  ":5":
+    sni:
+      "a.com": ""
+  ":6":
+    to: "localhost:1236"
+    udp: true
+    to_tls: true
+    idle_timeout: "-1s"
+  ":7":
+    to: "localhost:1237"
+    max_conns: -1
+    max_conns_per_ip: -1
+    max_duration: "-1s"
+  ":8":
+    to: "localhost:1238"
+    backends: ["localhost:1", ""]
+    balance: "random"
+    connect_timeout: "-1s"
+    health_check:
+      interval: "-1s"
+      timeout: "-1s"
+  ":9":
+    backends: ["localhost:1239"]
+    udp: true
+    health_check: {}
+  ":10":
+    sni:
+      "a.com": "localhost:443"
+    to: "localhost:1240"
+    to_tls: true
+`
+	got = loadAndCheck(t, contents)
+	expectErrs(t, `":1": proxy_protocol: trusted networks must be set`, got)
+	expectErrs(t, `":1": proxy_protocol: timeout can't be negative`, got)
+	expectErrs(t, `":2": proxy_protocol: invalid network "10.0.0.0/33"`, got)
+	expectErrs(t, `":3": to_proxy_protocol must be 1 or 2`, got)
+	expectErrs(t, `":2": trusted_proxies: invalid network "lalala"`, got)
+	expectErrs(t, `":4": missing to`, got)
+	expectErrs(t, `":5": sni: invalid entry "a.com": ""`, got)
+	expectErrs(t, `":6": udp is not compatible with certs, to_tls, sni, `+
+		`proxy_protocol or to_proxy_protocol`, got)
+	expectErrs(t, `":6": idle_timeout can't be negative`, got)
+	expectErrs(t, `":7": max_conns can't be negative`, got)
+	expectErrs(t, `":7": max_conns_per_ip can't be negative`, got)
+	expectErrs(t, `":7": max_duration can't be negative`, got)
+	expectErrs(t, `":8": to and backends can't be used together`, got)
+	expectErrs(t, `":8": backends: empty entry`, got)
+	expectErrs(t, `":8": unknown balance "random"`, got)
+	expectErrs(t, `":8": connect_timeout can't be negative`, got)
+	expectErrs(t, `":8": health_check: interval can't be negative`, got)
+	expectErrs(t, `":8": health_check: timeout can't be negative`, got)
+	expectErrs(t, `":9": health_check is not supported with udp`, got)
+	expectErrs(t, `":10": to_tls with sni needs certs`, got)
+	if len(got) != 20 {
+		t.Errorf("expected 20 errors, got %d: %v", len(got), got)
+	}
+
+	// Invalid fastcgi settings.
+	contents = `
+http:
+  ":80":
+    routes:
+      "/a/":
+        fastcgi:
+          root: "/srv/www"
+      "/b/":
+        fastcgi:
+          addr: "unix:"
+          split_path_info: "^(.+\\.php)$"
+          max_idle: -1
+      "/c/":
+        cgi: ["/bin/true"]
+        fastcgi:
+          addr: "localhost:9000"
+`
+	got = loadAndCheck(t, contents)
+	expectErrs(t, `":80": "/a/": fastcgi: missing addr`, got)
+	expectErrs(t, `":80": "/b/": fastcgi: missing unix socket path`, got)
+	expectErrs(t, `":80": "/b/": fastcgi: split_path_info must have 2 groups`, got)
+	expectErrs(t, `":80": "/b/": fastcgi: max_idle can't be negative`, got)
+	expectErrs(t, `":80": "/c/": too many actions set`, got)
+	if len(got) != 5 {
+		t.Errorf("expected 5 errors, got %d: %v", len(got), got)
+	}
+
+	// Invalid cgiopts settings.
+	contents = `
+http:
+  ":80":
+    routes:
+      "/a/":
+        file: "/dev/null"
+        cgiopts:
+          dir: "/tmp"
+      "/b/":
+        cgi: ["/bin/true"]
+        cgiopts:
+          max_cpu: "-1s"
+          max_memory: "-1k"
+          timeout: "-1s"
+          max_concurrent: -1
+          max_queue: -1
+      "/c/":
+        cgi: ["/bin/true"]
+        cgiopts:
+          max_queue: 10
+`
+	got = loadAndCheck(t, contents)
+	expectErrs(t, `":80": "/a/": cgiopts is set on non-cgi route`, got)
+	expectErrs(t, `":80": "/b/": cgiopts: max_cpu can't be negative`, got)
+	expectErrs(t, `":80": "/b/": cgiopts: max_memory can't be negative`, got)
+	expectErrs(t, `":80": "/b/": cgiopts: timeout can't be negative`, got)
+	expectErrs(t, `":80": "/b/": cgiopts: max_concurrent can't be negative`, got)
+	expectErrs(t, `":80": "/b/": cgiopts: max_queue can't be negative`, got)
+	expectErrs(t, `":80": "/c/": cgiopts: max_queue needs max_concurrent`, got)
+	if len(got) != 7 {
+		t.Errorf("expected 7 errors, got %d: %v", len(got), got)
+	}
+
+	// proxyopts on a non-proxy route, and h2c on an https server.
+	contents = `
+https:
+  ":443":
+    certs: "/dev/null"
+    h2c: true
+    routes:
+      "/":
+        file: "/dev/null"
+        proxyopts:
+          http2: true
+`
+	got = loadAndCheck(t, contents)
+	expectErrs(t, `":443": "/": proxyopts is set on non-proxy route`, got)
+	expectErrs(t, `":443": h2c is only supported on http listeners`, got)
+	if len(got) != 2 {
+		t.Errorf("expected 2 errors, got %d: %v", len(got), got)
+	}
+
+	// http3 on a unix socket, and without TLS 1.3.
+	contents = `
+https:
+  "unix:/run/gofer.sock":
+    certs: "/dev/null"
+    http3: true
+    routes:
+      "/":
+        file: "/dev/null"
+  ":443":
+    certs: "/dev/null"
+    http3: true
+    tls:
+      max_version: "1.2"
+    routes:
+      "/":
+        file: "/dev/null"
+`
+	got = loadAndCheck(t, contents)
+	expectErrs(t,
+		`"unix:/run/gofer.sock": http3 is not supported on unix sockets`, got)
+	expectErrs(t, `":443": http3 requires tls max_version 1.3`, got)
+	if len(got) != 2 {
+		t.Errorf("expected 2 errors, got %d: %v", len(got), got)
+	}
+
+	// Invalid upstream tls options.
+	contents = `
+http:
+  ":80":
+    routes:
+      "/a/":
+        proxy: "http://localhost:8080/"
+        proxyopts:
+          tls:
+            ca: "/etc/ca.pem"
+      "/b/":
+        proxy: "https://localhost:8080/"
+        proxyopts:
+          tls:
+            cert: "/etc/cert.pem"
+raw:
+  ":995":
+    to: "localhost:1995"
+    upstream_tls:
+      key: "/etc/key.pem"
+  ":996":
+    to: "localhost:1996"
+    to_tls: true
+    upstream_tls:
+      ca: "/etc/ca.pem"
+      insecure_skip_verify: true
+`
+	got = loadAndCheck(t, contents)
+	expectErrs(t, `":80": "/a/": proxyopts: tls is set on non-https proxy`, got)
+	expectErrs(t,
+		`":80": "/b/": proxyopts: tls: cert and key must be set together`, got)
+	expectErrs(t, `":995": upstream_tls is set without to_tls`, got)
+	expectErrs(t,
+		`":995": upstream_tls: cert and key must be set together`, got)
+	expectErrs(t, `":996": upstream_tls: ca is set, `+
+		`but insecure_skip_verify disables verification`, got)
+	if len(got) != 5 {
+		t.Errorf("expected 5 errors, got %d: %v", len(got), got)
+	}
+
+	// Invalid proxy transport settings.
+	contents = `
+http:
+  ":80":
+    routes:
+      "/":
+        proxy: "http://localhost:8080/"
+        proxyopts:
+          dial_timeout: "-1s"
+          response_header_timeout: "-1s"
+          max_idle_conns: -1
+          idle_conn_timeout: "-1s"
+          keepalive: "-1s"
+          max_conns: -1
+      "/b/":
+        proxy: "http://localhost:8080/"
+        proxyopts:
+          flush_interval: "1s"
+          disable_buffering: true
+`
+	got = loadAndCheck(t, contents)
+	for _, name := range []string{"dial_timeout", "response_header_timeout",
+		"max_idle_conns", "idle_conn_timeout", "keepalive", "max_conns"} {
+		expectErrs(t, `":80": "/": proxyopts: `+name+` can't be negative`, got)
+	}
+	expectErrs(t, `":80": "/b/": proxyopts: flush_interval and `+
+		`disable_buffering can't be used together`, got)
+	if len(got) != 7 {
+		t.Errorf("expected 7 errors, got %d: %v", len(got), got)
+	}
+
+	// Invalid shadow settings.
+	contents = `
+http:
+  ":80":
+    routes:
+      "/":
+        proxy: "http://localhost:8080/"
+        proxyopts:
+          shadow:
+            percent: 101
+            max_body: "-1"
+      "/b/":
+        proxy: "http://localhost:8080/"
+        proxyopts:
+          shadow:
+            url: "ftp://localhost:8081/"
+            percent: -1
+            tls:
+              cert: "/dev/null"
+`
+	got = loadAndCheck(t, contents)
+	expectErrs(t, `":80": "/": proxyopts: shadow: missing url`, got)
+	expectErrs(t, `":80": "/": proxyopts: shadow: `+
+		`percent must be between 0 and 100`, got)
+	expectErrs(t, `":80": "/": proxyopts: shadow: max_body can't be negative`,
+		got)
+	expectErrs(t, `":80": "/b/": proxyopts: shadow: `+
+		`url must be http or https, not "ftp"`, got)
+	expectErrs(t, `":80": "/b/": proxyopts: shadow: `+
+		`percent must be between 0 and 100`, got)
+	expectErrs(t, `":80": "/b/": proxyopts: shadow: `+
+		`tls is set on non-https url`, got)
+	expectErrs(t, `":80": "/b/": proxyopts: shadow: tls: `+
+		`cert and key must be set together`, got)
+	if len(got) != 7 {
+		t.Errorf("expected 7 errors, got %d: %v", len(got), got)
+	}
+
+	// Invalid cache settings.
+	contents = `
+http:
+  ":80":
+    routes:
+      "/":
+        file: "/dev/null"
+    cache:
+      "/a/":
+        max_size: "-1"
+        max_entry_size: "-1k"
+        max_disk_size: "1G"
+        default_ttl: "-1s"
+        stale_while_revalidate: "-1s"
+        lock_timeout: "-1s"
+      "/b/":
+        max_size: "1M"
+        max_entry_size: "2M"
+        dir: "/var/cache/x"
+  ":81":
+    routes:
+      "/":
+        file: "/dev/null"
+    cache:
+      "/":
+        dir: "/var/cache/x"
+`
+	got = loadAndCheck(t, contents)
+	expectErrs(t, `":80": "/a/": cache: max_size can't be negative`, got)
+	expectErrs(t, `":80": "/a/": cache: max_entry_size can't be negative`, got)
+	expectErrs(t, `":80": "/a/": cache: default_ttl can't be negative`, got)
+	expectErrs(t, `":80": "/a/": cache: stale_while_revalidate can't be negative`, got)
+	expectErrs(t, `":80": "/a/": cache: lock_timeout can't be negative`, got)
+	expectErrs(t, `":80": "/a/": cache: max_disk_size needs dir`, got)
+	expectErrs(t, `":80": "/b/": cache: max_entry_size is larger than max_size`, got)
+	expectErrs(t, `cache: dir "/var/cache/x" is also used by`, got)
+	if len(got) != 8 {
+		t.Errorf("expected 8 errors, got %d: %v", len(got), got)
+	}
+
+	// Invalid limits.
+	contents = `
+http:
+  ":80":
+    routes:
+      "/":
+        file: "/dev/null"
+    limits:
+      "/":
+        max_body_size: "-1"
+        max_header_size: "-1k"
+        max_url_length: -1
+`
+	got = loadAndCheck(t, contents)
+	expectErrs(t, `":80": "/": limits: max_body_size can't be negative`, got)
+	expectErrs(t, `":80": "/": limits: max_header_size can't be negative`, got)
+	expectErrs(t, `":80": "/": limits: max_url_length can't be negative`, got)
+	if len(got) != 3 {
+		t.Errorf("expected 3 errors, got %d: %v", len(got), got)
+	}
+
+	// Invalid certificate expiry warning.
+	contents = `
+cert_expiry_warning: "-24h"
+`
+	got = loadAndCheck(t, contents)
+	expectErrs(t, `cert_expiry_warning can't be negative`, got)
 }
 
 func loadAndCheck(t *testing.T, contents string) []error {
@@ -271,6 +857,89 @@ func expectErrs(t *testing.T, want string, got []error) {
 	}
 }
 
+func TestProxyOptsEffective(t *testing.T) {
+	got := ProxyOpts{}.Effective()
+	expected := ProxyOpts{
+		DialTimeout:     30 * time.Second,
+		MaxIdleConns:    2,
+		IdleConnTimeout: 90 * time.Second,
+		KeepAlive:       30 * time.Second,
+	}
+	if diff := cmp.Diff(expected, got); diff != "" {
+		t.Errorf("unexpected defaults (-want +got):\n%s", diff)
+	}
+
+	// Values that are set are kept.
+	opts := ProxyOpts{
+		HTTP2:                 true,
+		DialTimeout:           time.Second,
+		ResponseHeaderTimeout: 2 * time.Second,
+		MaxIdleConns:          10,
+		IdleConnTimeout:       time.Minute,
+		KeepAlive:             5 * time.Second,
+		MaxConns:              3,
+		DisableBuffering:      true,
+	}
+	if diff := cmp.Diff(opts, opts.Effective()); diff != "" {
+		t.Errorf("unexpected changes (-want +got):\n%s", diff)
+	}
+}
+
+func TestWarnings(t *testing.T) {
+	conf, err := LoadString(`
+http:
+  ":80":
+    routes:
+      "/a/":
+        proxy: "https://localhost:8080/"
+        proxyopts:
+          tls:
+            insecure_skip_verify: true
+      "/b/":
+        proxy: "https://localhost:8080/"
+        proxyopts:
+          shadow:
+            url: "https://localhost:8081/"
+            tls:
+              insecure_skip_verify: true
+raw:
+  ":995":
+    to: "localhost:1995"
+    to_tls: true
+    upstream_tls:
+      insecure_skip_verify: true
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs := conf.Check(); len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	expected := []string{
+		`":80": "/a/": proxyopts: tls: insecure_skip_verify is set, ` +
+			`the backend's certificate is not verified`,
+		`":80": "/b/": proxyopts: shadow: tls: insecure_skip_verify is set, ` +
+			`the backend's certificate is not verified`,
+		`":995": upstream_tls: insecure_skip_verify is set, ` +
+			`the backend's certificate is not verified`,
+	}
+	if diff := cmp.Diff(expected, conf.Warnings()); diff != "" {
+		t.Errorf("unexpected warnings (-want +got):\n%s", diff)
+	}
+
+	conf, _ = LoadString(`
+http:
+  ":80":
+    routes:
+      "/":
+        proxy: "https://localhost:8080/"
+`)
+	if w := conf.Warnings(); len(w) != 0 {
+		t.Errorf("unexpected warnings: %v", w)
+	}
+}
+
 func TestRegexp(t *testing.T) {
 	re := Regexp{}
 	err := yaml.Unmarshal([]byte(`"ab.d"`), &re)
@@ -422,3 +1091,79 @@ func TestRate(t *testing.T) {
 }
 
 var unmarshalErr = fmt.Errorf("error unmarshalling for testing")
+
+func TestByteSize(t *testing.T) {
+	cases := []struct {
+		s    string
+		size ByteSize
+	}{
+		{"0", 0},
+		{"512", 512},
+		{"512b", 512},
+		{"64k", 64 << 10},
+		{"64KB", 64 << 10},
+		{" 2 m", 2 << 20},
+		{"1.5GiB", 3 << 29},
+		{"1t", 1 << 40},
+	}
+	for _, c := range cases {
+		var b ByteSize
+		err := yaml.Unmarshal([]byte(`"`+c.s+`"`), &b)
+		if err != nil || b != c.size {
+			t.Errorf("%q: got %d, %v; expected %d", c.s, b, err, c.size)
+		}
+	}
+
+	// Plain integers work too.
+	var b ByteSize
+	if err := yaml.Unmarshal([]byte(`1024`), &b); err != nil || b != 1024 {
+		t.Errorf("1024: got %d, %v", b, err)
+	}
+
+	for _, s := range []string{"", "k", "12x", "1kk", "NaN"} {
+		if _, err := ParseByteSize(s); err == nil {
+			t.Errorf("%q: expected error, got nil", s)
+		}
+	}
+
+	strs := map[ByteSize]string{
+		0:             "0",
+		1000:          "1000",
+		2048:          "2K",
+		3 << 29:       "1536M",
+		5 << 40:       "5T",
+		(1 << 20) + 1: "1048577",
+	}
+	for b, s := range strs {
+		if b.String() != s {
+			t.Errorf("%d: got %q, expected %q", b, b.String(), s)
+		}
+	}
+
+	err := b.UnmarshalYAML(func(interface{}) error { return unmarshalErr })
+	if err != unmarshalErr {
+		t.Errorf("expected unmarshalErr, got %v", err)
+	}
+}
+
+func TestParseNetworks(t *testing.T) {
+	nets, err := ParseNetworks([]string{"10.0.0.0/8", "1.2.3.4", "::1"})
+	if err != nil {
+		t.Fatalf("error parsing networks: %v", err)
+	}
+	expected := []string{"10.0.0.0/8", "1.2.3.4/32", "::1/128"}
+	if len(nets) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, nets)
+	}
+	for i, n := range nets {
+		if n.String() != expected[i] {
+			t.Errorf("%d: expected %q, got %q", i, expected[i], n)
+		}
+	}
+
+	for _, s := range []string{"", "lalala", "1.2.3.4/", "::1/129"} {
+		if _, err := ParseNetworks([]string{s}); err == nil {
+			t.Errorf("%q: expected error, got nil", s)
+		}
+	}
+}
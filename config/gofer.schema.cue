@@ -11,6 +11,8 @@ import (
 
 control_addr?: string
 
+cert_expiry_warning?: time.Duration
+
 reqlog?:
 	[string]: close({
 		file:     string
@@ -29,17 +31,39 @@ ratelimit?:
 	})
 
 http?:
-	[string]: close(#http)
+	[string]: close(#http & {
+		h2c?: bool
+	})
 
 https?:
 	[string]: close(#http & {
-		certs?: string
+		certs?:         string
+		tls?:           #tls
+		http_redirect?: string
+		http3?:         bool
 
 		autocerts?: {
-			hosts: [string, ...string]
+			hosts?: [string, ...string]
 			cachedir?: string
 			email?:    string
 			acmeurl?:  string
+
+			hosts_regexp?: string
+			hosts_file?:   string
+			ask?:          string
+			max_per_hour?: int
+
+			challenge?: "dns-01" | "tls-alpn-01"
+			dns?: {
+				provider:           "rfc2136" | "exec"
+				server?:            string
+				zone?:              string
+				tsig_key?:          string
+				tsig_algorithm?:    "hmac-sha256" | "hmac-sha384" | "hmac-sha512"
+				tsig_secret_file?:  string
+				command?:           string
+				propagation_delay?: time.Duration
+			}
 		}
 	})
 
@@ -50,6 +74,14 @@ https?:
 		proxy?:    string
 		redirect?: string
 		cgi?: [string, ...string]
+		fastcgi?: close({
+			addr:             string
+			root?:            string
+			index?:           string
+			split_path_info?: string
+			params?: [string]: string
+			max_idle?: int
+		})
 		status?: int
 		redirect_re?: [#redirect_re, ...#redirect_re]
 
@@ -64,10 +96,70 @@ https?:
 		if diropts != _|_ {
 			dir: string
 		}
+
+		cgiopts?: close({
+			env?: [string]: string
+			inherit_env?: [...string]
+			dir?:            string
+			user?:           string
+			max_cpu?:        time.Duration
+			max_memory?:     #bytesize
+			timeout?:        time.Duration
+			max_concurrent?: int
+			max_queue?:      int
+		})
+
+		// If cgiopts is set, then cgi must be set too.
+		if cgiopts != _|_ {
+			cgi: [string, ...string]
+		}
+
+		proxyopts?: close({
+			http2?: bool
+			tls?:   #upstream_tls
+
+			dial_timeout?:            time.Duration
+			response_header_timeout?: time.Duration
+			max_idle_conns?:          int
+			idle_conn_timeout?:       time.Duration
+			keepalive?:               time.Duration
+			disable_keepalives?:      bool
+			max_conns?:               int
+			flush_interval?:          time.Duration
+			disable_buffering?:       bool
+
+			// flush_interval and disable_buffering are exclusive.
+			if flush_interval != _|_ {
+				disable_buffering?: false
+			}
+
+			shadow?: close({
+				url:       =~"^https?://"
+				percent?:  number & >=0 & <=100
+				max_body?: #bytesize
+				http2?:    bool
+				tls?:      #upstream_tls
+			})
+		})
+
+		// If proxyopts is set, then proxy must be set too.
+		if proxyopts != _|_ {
+			proxy: string
+		}
 	}
 
 	auth?: [string]: string
 
+	jwtauth?: [string]: close({
+		secret_file?: string
+		jwks_file?:   string
+		issuer?:      string
+		audience?:    string
+		require?: [string]: string
+		subject_header?: string
+		leeway?:         time.Duration
+	})
+
 	setheader?: [string]: [string]: string
 
 	reqlog?: [string]: string
@@ -77,8 +169,29 @@ https?:
 	timeouts?: [string]: {
 		read?: time.Duration
 		write?: time.Duration
+		upgrade_idle?: time.Duration
 	}
 
+	limits?: [string]: close({
+		max_body_size?:   #bytesize
+		max_header_size?: #bytesize
+		max_url_length?:  int
+	})
+
+	cache?: [string]: close({
+		max_size?:               #bytesize
+		max_entry_size?:         #bytesize
+		dir?:                    string
+		max_disk_size?:          #bytesize
+		default_ttl?:            time.Duration
+		stale_while_revalidate?: time.Duration
+		lock_timeout?:           time.Duration
+	})
+
+	proxy_protocol?: #proxy_protocol
+	trusted_proxies?: [...string]
+	unix_socket?:    #unix_socket
+
 	...
 }
 
@@ -88,11 +201,73 @@ https?:
 	status?: int
 }
 
+#tls: close({
+	min_version?: "1.0" | "1.1" | "1.2" | "1.3"
+	max_version?: "1.0" | "1.1" | "1.2" | "1.3"
+	cipher_suites?: [...string]
+	curves?: [..."X25519MLKEM768" | "X25519" | "P-256" | "P-384" | "P-521"]
+	alpn?: [...string]
+	session_ticket_keys_file?: string
+	session_ticket_rotation?:  time.Duration
+})
+
+#upstream_tls: close({
+	ca?:                   string
+	server_name?:          string
+	cert?:                 string
+	key?:                  string
+	insecure_skip_verify?: bool
+
+	// cert and key must be set together.
+	if cert != _|_ {
+		key: string
+	}
+	if key != _|_ {
+		cert: string
+	}
+})
+
+#unix_socket: close({
+	mode?:  string
+	owner?: string
+})
+
+// Size in bytes, optionally with a unit suffix (e.g. 1024, "64k", "1.5GiB").
+#bytesize: int | =~"^[0-9. ]+([kKmMgGtT]([iI]?[bB])?|[bB])?$"
+
+#proxy_protocol: close({
+	trusted: [string, ...string]
+	timeout?: time.Duration
+})
+
 raw?:
 	[string]: close({
 		certs?:  string
-		to:      string
+		tls?:    #tls
+		to?:     string
 		to_tls?: bool
 		reqlog?: string
 		ratelimit?: string
+		sni?: [string]: string
+
+		upstream_tls?: #upstream_tls
+
+		backends?: [...string]
+		balance?:         "roundrobin" | "first"
+		connect_timeout?: time.Duration
+		health_check?:    close({
+			interval?: time.Duration
+			timeout?:  time.Duration
+		})
+
+		proxy_protocol?:    #proxy_protocol
+		to_proxy_protocol?: 1 | 2
+		unix_socket?:       #unix_socket
+
+		udp?: bool
+
+		max_conns?:        int
+		max_conns_per_ip?: int
+		idle_timeout?:     time.Duration
+		max_duration?:     time.Duration
 	})
@@ -7,14 +7,19 @@ import (
 	"os"
 	"runtime"
 	"runtime/debug"
+	"sort"
+	"strings"
 	"time"
 
 	// Remote profiling support.
 	_ "net/http/pprof"
 
 	"blitiri.com.ar/go/gofer/config"
+	"blitiri.com.ar/go/gofer/httpcache"
 	"blitiri.com.ar/go/gofer/nettrace"
 	"blitiri.com.ar/go/gofer/ratelimit"
+	"blitiri.com.ar/go/gofer/server"
+	"blitiri.com.ar/go/gofer/util"
 	"blitiri.com.ar/go/log"
 )
 
@@ -74,6 +79,9 @@ func ServeDebugging(addr string, conf *config.Config) error {
 
 	http.HandleFunc("/debug/config", DumpConfigFunc(conf))
 	http.HandleFunc("/debug/ratelimit", ratelimit.DebugHandler)
+	http.HandleFunc("/debug/certs", util.CertsDebugHandler)
+	http.HandleFunc("/debug/cache", httpcache.DebugHandler)
+	http.HandleFunc("/debug/shadow", server.ShadowDebugHandler)
 	nettrace.RegisterHandler(http.DefaultServeMux)
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		if r.URL.Path != "/" {
@@ -94,9 +102,76 @@ func DumpConfigFunc(conf *config.Config) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 		w.Write([]byte(conf.String()))
+		w.Write([]byte(effectiveProxySettings(conf)))
 	})
 }
 
+// effectiveProxySettings describes the settings used by each proxy route,
+// including the defaults. They are YAML comments, so the output is still a
+// valid configuration.
+func effectiveProxySettings(conf *config.Config) string {
+	type proxyRoute struct {
+		addr, path string
+		opts       config.ProxyOpts
+	}
+	routes := []proxyRoute{}
+	add := func(addr string, h config.HTTP) {
+		for path, r := range h.Routes {
+			if r.Proxy != nil {
+				routes = append(routes, proxyRoute{addr, path, r.ProxyOpts})
+			}
+		}
+	}
+	for addr, h := range conf.HTTP {
+		add(addr, h)
+	}
+	for addr, h := range conf.HTTPS {
+		add(addr, h.HTTP)
+	}
+	if len(routes) == 0 {
+		return ""
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		if routes[i].addr != routes[j].addr {
+			return routes[i].addr < routes[j].addr
+		}
+		return routes[i].path < routes[j].path
+	})
+
+	durationOr := func(d time.Duration, zero string) string {
+		if d == 0 {
+			return zero
+		}
+		return d.String()
+	}
+
+	sb := &strings.Builder{}
+	sb.WriteString("\n# Effective proxy settings, including the defaults:\n")
+	for _, r := range routes {
+		e := r.opts.Effective()
+		maxConns := "unlimited"
+		if e.MaxConns > 0 {
+			maxConns = fmt.Sprint(e.MaxConns)
+		}
+		flush := durationOr(e.FlushInterval, "default")
+		if e.DisableBuffering {
+			flush = "every write"
+		}
+
+		fmt.Fprintf(sb, "#\n# %q %q:\n", r.addr, r.path)
+		fmt.Fprintf(sb, "#   dial_timeout: %v\n", e.DialTimeout)
+		fmt.Fprintf(sb, "#   response_header_timeout: %s\n",
+			durationOr(e.ResponseHeaderTimeout, "none"))
+		fmt.Fprintf(sb, "#   max_idle_conns: %d\n", e.MaxIdleConns)
+		fmt.Fprintf(sb, "#   idle_conn_timeout: %v\n", e.IdleConnTimeout)
+		fmt.Fprintf(sb, "#   keepalive: %v\n", e.KeepAlive)
+		fmt.Fprintf(sb, "#   disable_keepalives: %v\n", e.DisableKeepAlives)
+		fmt.Fprintf(sb, "#   max_conns: %s\n", maxConns)
+		fmt.Fprintf(sb, "#   flush_interval: %s\n", flush)
+	}
+	return sb.String()
+}
+
 // Functions available inside the templates.
 var tmplFuncs = template.FuncMap{
 	"since": time.Since,
@@ -146,6 +221,9 @@ var htmlIndex = template.Must(
     <li><a href="/debug/config">configuration</a>
     <li><a href="/debug/traces">traces</a>
     <li><a href="/debug/ratelimit">ratelimit</a>
+    <li><a href="/debug/certs">certificates</a>
+    <li><a href="/debug/cache">cache</a>
+    <li><a href="/debug/shadow">shadow</a>
     <li><a href="/debug/pprof">pprof</a>
         <small><a href="https://golang.org/pkg/net/http/pprof/">
           (ref)</a></small>
@@ -0,0 +1,374 @@
+// Package fastcgi implements a FastCGI client, to send HTTP requests to
+// FastCGI servers (like php-fpm) in the responder role.
+//
+// Reference: https://fastcgi-archives.github.io/FastCGI_Specification.html
+package fastcgi
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Record types.
+const (
+	typeBeginRequest = 1
+	typeEndRequest   = 3
+	typeParams       = 4
+	typeStdin        = 5
+	typeStdout       = 6
+	typeStderr       = 7
+)
+
+const (
+	roleResponder = 1
+	flagKeepConn  = 1
+
+	// We only have one request per connection at a time, so we always use
+	// the same id.
+	requestID = 1
+
+	maxContent = 65535
+)
+
+var errProtocol = errors.New("fastcgi protocol error")
+
+// Default timeout for connecting to the server.
+var DialTimeout = 10 * time.Second
+
+// Client sends requests to a FastCGI server, reusing the connections.
+type Client struct {
+	network, addr string
+
+	// Idle connections, ready to be reused.
+	idle chan net.Conn
+}
+
+// NewClient returns a client for the server at the given network and
+// address, keeping up to maxIdle idle connections for reuse.
+func NewClient(network, addr string, maxIdle int) *Client {
+	return &Client{
+		network: network,
+		addr:    addr,
+		idle:    make(chan net.Conn, maxIdle),
+	}
+}
+
+// Response from the FastCGI server.
+type Response struct {
+	Status int
+	Header http.Header
+
+	// Body of the response. It must be closed, so the connection can be
+	// reused.
+	Body io.ReadCloser
+}
+
+// get an idle connection, or a new one if there are none. Returns true if
+// the connection was reused.
+func (c *Client) get(ctx context.Context) (net.Conn, bool, error) {
+	select {
+	case conn := <-c.idle:
+		return conn, true, nil
+	default:
+	}
+
+	conn, err := c.dial(ctx)
+	return conn, false, err
+}
+
+func (c *Client) dial(ctx context.Context) (net.Conn, error) {
+	d := net.Dialer{Timeout: DialTimeout}
+	return d.DialContext(ctx, c.network, c.addr)
+}
+
+func (c *Client) put(conn net.Conn) {
+	select {
+	case c.idle <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+// Do sends a request with the given parameters and body (which can be nil),
+// and returns the response. The server's stderr output is written to
+// stderr.
+func (c *Client) Do(ctx context.Context, params map[string]string,
+	body io.Reader, stderr io.Writer) (*Response, error) {
+	if stderr == nil {
+		stderr = io.Discard
+	}
+
+	conn, reused, err := c.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.do(ctx, conn, params, body, stderr)
+	if err != nil && reused && (body == nil || body == http.NoBody) {
+		// The idle connection may have been closed by the server, so retry
+		// on a new one. We can't do this if there is a body, since it was
+		// already (maybe partially) sent.
+		conn, err = c.dial(ctx)
+		if err == nil {
+			resp, err = c.do(ctx, conn, params, body, stderr)
+		}
+	}
+	return resp, err
+}
+
+func (c *Client) do(ctx context.Context, conn net.Conn,
+	params map[string]string, body io.Reader, stderr io.Writer) (
+	*Response, error) {
+	// Abort the I/O if the context is done.
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+
+	r := &bodyReader{
+		c:      c,
+		conn:   conn,
+		br:     bufio.NewReader(conn),
+		stderr: stderr,
+		stop:   stop,
+	}
+
+	err := writeRequest(conn, params, body)
+	if err != nil {
+		r.fail()
+		return nil, err
+	}
+
+	resp, err := readResponse(r)
+	if err != nil {
+		r.fail()
+		return nil, err
+	}
+	return resp, nil
+}
+
+func writeRequest(conn net.Conn, params map[string]string,
+	body io.Reader) error {
+	w := bufio.NewWriter(conn)
+
+	begin := []byte{0, roleResponder, flagKeepConn, 0, 0, 0, 0, 0}
+	writeRecord(w, typeBeginRequest, begin)
+
+	var buf []byte
+	for k, v := range params {
+		buf = appendLen(buf, len(k))
+		buf = appendLen(buf, len(v))
+		buf = append(buf, k...)
+		buf = append(buf, v...)
+	}
+	for len(buf) > maxContent {
+		writeRecord(w, typeParams, buf[:maxContent])
+		buf = buf[maxContent:]
+	}
+	if len(buf) > 0 {
+		writeRecord(w, typeParams, buf)
+	}
+	writeRecord(w, typeParams, nil)
+
+	if body != nil {
+		chunk := make([]byte, maxContent)
+		for {
+			n, err := body.Read(chunk)
+			if n > 0 {
+				writeRecord(w, typeStdin, chunk[:n])
+			}
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return fmt.Errorf("error reading request body: %w", err)
+			}
+		}
+	}
+	writeRecord(w, typeStdin, nil)
+
+	return w.Flush()
+}
+
+func writeRecord(w *bufio.Writer, typ byte, content []byte) {
+	padding := (8 - len(content)%8) % 8
+	hdr := []byte{1, typ, 0, requestID, 0, 0, byte(padding), 0}
+	binary.BigEndian.PutUint16(hdr[4:], uint16(len(content)))
+	w.Write(hdr)
+	w.Write(content)
+	w.Write(make([]byte, padding))
+}
+
+// appendLen appends a name-value pair length, which uses 1 byte if it is
+// less than 128, and 4 bytes (with the high bit set) otherwise.
+func appendLen(buf []byte, n int) []byte {
+	if n < 128 {
+		return append(buf, byte(n))
+	}
+	return binary.BigEndian.AppendUint32(buf, uint32(n)|1<<31)
+}
+
+// readResponse reads the CGI response headers from the server's stdout.
+func readResponse(r *bodyReader) (*Response, error) {
+	tp := textproto.NewReader(bufio.NewReader(r))
+	mh, err := tp.ReadMIMEHeader()
+	if err != nil {
+		return nil, fmt.Errorf("error reading response headers: %w", err)
+	}
+	header := http.Header(mh)
+
+	status := http.StatusOK
+	if s := header.Get("Status"); s != "" {
+		code, _, _ := strings.Cut(s, " ")
+		status, err = strconv.Atoi(code)
+		if err != nil || status < 100 || status > 999 {
+			return nil, fmt.Errorf("invalid status %q", s)
+		}
+		header.Del("Status")
+	} else if header.Get("Location") != "" {
+		status = http.StatusFound
+	}
+
+	// The body is read through the textproto reader, which may have some
+	// of it buffered already.
+	return &Response{
+		Status: status,
+		Header: header,
+		Body: &responseBody{
+			r: tp.R,
+			c: r,
+		},
+	}, nil
+}
+
+type responseBody struct {
+	r io.Reader
+	c io.Closer
+}
+
+func (b *responseBody) Read(p []byte) (int, error) {
+	return b.r.Read(p)
+}
+
+func (b *responseBody) Close() error {
+	return b.c.Close()
+}
+
+// bodyReader reads the stdout stream of a request, writing the stderr
+// stream as it comes.
+type bodyReader struct {
+	c      *Client
+	conn   net.Conn
+	br     *bufio.Reader
+	stderr io.Writer
+	stop   func() bool
+
+	// Bytes left of the current stdout record, and its padding.
+	left, padding int
+
+	done   bool
+	closed sync.Once
+
+	// First error found, returned on all subsequent reads.
+	err error
+}
+
+func (r *bodyReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	for r.left == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if r.err = r.next(); r.err != nil {
+			return 0, r.err
+		}
+	}
+
+	if len(p) > r.left {
+		p = p[:r.left]
+	}
+	n, err := r.br.Read(p)
+	r.left -= n
+	if r.left == 0 && err == nil {
+		_, err = r.br.Discard(r.padding)
+	}
+	if err == io.EOF {
+		// The connection ended in the middle of a record.
+		err = io.ErrUnexpectedEOF
+	}
+	r.err = err
+	return n, err
+}
+
+// next reads records until there's stdout content, or the request ends.
+func (r *bodyReader) next() error {
+	var hdr [8]byte
+	if _, err := io.ReadFull(r.br, hdr[:]); err == io.EOF {
+		// The connection ended before the end of the request.
+		return io.ErrUnexpectedEOF
+	} else if err != nil {
+		return err
+	}
+	if hdr[0] != 1 {
+		return errProtocol
+	}
+	typ := hdr[1]
+	length := int(binary.BigEndian.Uint16(hdr[4:]))
+	padding := int(hdr[6])
+
+	switch typ {
+	case typeStdout:
+		r.left, r.padding = length, padding
+		if length == 0 {
+			_, err := r.br.Discard(padding)
+			return err
+		}
+		return nil
+	case typeStderr:
+		_, err := io.CopyN(r.stderr, r.br, int64(length))
+		if err == nil {
+			_, err = r.br.Discard(padding)
+		}
+		return err
+	case typeEndRequest:
+		_, err := r.br.Discard(length + padding)
+		r.done = true
+		return err
+	default:
+		_, err := r.br.Discard(length + padding)
+		return err
+	}
+}
+
+// Close the stream. If it was read completely, the connection is reused;
+// otherwise, it is closed.
+func (r *bodyReader) Close() error {
+	r.closed.Do(func() {
+		// If the deadline was set, the connection can't be reused.
+		stopped := r.stop()
+		if r.done && stopped && r.br.Buffered() == 0 {
+			r.c.put(r.conn)
+		} else {
+			r.conn.Close()
+		}
+	})
+	return nil
+}
+
+func (r *bodyReader) fail() {
+	r.closed.Do(func() {
+		r.stop()
+		r.conn.Close()
+	})
+}
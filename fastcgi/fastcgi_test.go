@@ -0,0 +1,231 @@
+package fastcgi
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/fcgi"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// countingListener counts the accepted connections.
+type countingListener struct {
+	net.Listener
+	n atomic.Int32
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err == nil {
+		l.n.Add(1)
+	}
+	return c, err
+}
+
+func params(method, uri string) map[string]string {
+	return map[string]string{
+		"REQUEST_METHOD":  method,
+		"REQUEST_URI":     uri,
+		"SERVER_PROTOCOL": "HTTP/1.1",
+		"SCRIPT_NAME":     uri,
+		"HTTP_HOST":       "example.com",
+	}
+}
+
+func TestClient(t *testing.T) {
+	tcpLis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lis := &countingListener{Listener: tcpLis}
+	defer lis.Close()
+
+	go fcgi.Serve(lis, http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			env := fcgi.ProcessEnv(r)
+			w.Header().Set("X-Long", env["LONG"])
+			if r.URL.Path == "/missing" {
+				w.WriteHeader(http.StatusNotFound)
+			}
+			fmt.Fprintf(w, "%s %s %s %s", r.Method, r.URL.Path, r.Host, body)
+		}))
+
+	c := NewClient("tcp", lis.Addr().String(), 2)
+	ctx := context.Background()
+
+	do := func(p map[string]string, body io.Reader) (*Response, string) {
+		t.Helper()
+		resp, err := c.Do(ctx, p, body, nil)
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+		b, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("error reading body: %v", err)
+		}
+		resp.Body.Close()
+		return resp, string(b)
+	}
+
+	for i := 0; i < 3; i++ {
+		resp, body := do(params("GET", "/path"), nil)
+		if resp.Status != 200 || body != "GET /path example.com " {
+			t.Errorf("%d: got %d %q", i, resp.Status, body)
+		}
+	}
+
+	// Connections are reused.
+	if n := lis.n.Load(); n != 1 {
+		t.Errorf("expected 1 connection, got %d", n)
+	}
+
+	p := params("POST", "/missing")
+	p["CONTENT_LENGTH"] = "4"
+	p["LONG"] = strings.Repeat("x", 300)
+	resp, body := do(p, strings.NewReader("hola"))
+	if resp.Status != 404 || body != "POST /missing example.com hola" {
+		t.Errorf("got %d %q", resp.Status, body)
+	}
+	if resp.Header.Get("X-Long") != p["LONG"] {
+		t.Errorf("long param was not sent correctly")
+	}
+
+	// A large body, over the maximum record size.
+	big := strings.Repeat("abcdefgh", 20000)
+	p = params("POST", "/big")
+	p["CONTENT_LENGTH"] = fmt.Sprint(len(big))
+	_, body = do(p, strings.NewReader(big))
+	if body != "POST /big example.com "+big {
+		t.Errorf("big body was not sent correctly (got %d bytes)", len(body))
+	}
+
+	// Not closing the body (or not reading it completely) means the
+	// connection can't be reused.
+	before := lis.n.Load()
+	resp, err = c.Do(ctx, params("GET", "/path"), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	do(params("GET", "/path"), nil)
+	if n := lis.n.Load(); n != before+1 {
+		t.Errorf("expected a new connection, got %d -> %d", before, n)
+	}
+}
+
+// fakeServer reads a request from the connection, and replies with the
+// given records.
+func fakeServer(conn net.Conn, records func(w *bufio.Writer)) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+
+	// Read until the empty stdin record.
+	hdr := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(br, hdr); err != nil {
+			return
+		}
+		length := int(hdr[4])<<8 | int(hdr[5])
+		br.Discard(length + int(hdr[6]))
+		if hdr[1] == typeStdin && length == 0 {
+			break
+		}
+	}
+
+	w := bufio.NewWriter(conn)
+	records(w)
+	w.Flush()
+	io.Copy(io.Discard, br)
+}
+
+func TestStreams(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		fakeServer(conn, func(w *bufio.Writer) {
+			writeRecord(w, typeStderr, []byte("oops\n"))
+			writeRecord(w, typeStdout, []byte("Status: 418 I'm a teapot\r\n"))
+			writeRecord(w, typeStdout, []byte("Content-Type: text/plain\r\n\r\nte"))
+			writeRecord(w, typeStderr, []byte("again\n"))
+			writeRecord(w, typeStdout, []byte("apot"))
+			writeRecord(w, typeStdout, nil)
+			writeRecord(w, typeEndRequest, make([]byte, 8))
+		})
+	}()
+
+	stderr := &bytes.Buffer{}
+	c := NewClient("tcp", lis.Addr().String(), 1)
+	resp, err := c.Do(context.Background(), params("GET", "/"), nil, stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if err != nil || resp.Status != 418 || string(body) != "teapot" {
+		t.Errorf("got %d %q, %v", resp.Status, body, err)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "text/plain" {
+		t.Errorf("unexpected content type %q", ct)
+	}
+	if resp.Header.Get("Status") != "" {
+		t.Errorf("status header was not removed")
+	}
+	if stderr.String() != "oops\nagain\n" {
+		t.Errorf("unexpected stderr %q", stderr.String())
+	}
+}
+
+func TestBadResponses(t *testing.T) {
+	cases := []func(w *bufio.Writer){
+		// Invalid status.
+		func(w *bufio.Writer) {
+			writeRecord(w, typeStdout, []byte("Status: lala\r\n\r\n"))
+			writeRecord(w, typeEndRequest, make([]byte, 8))
+		},
+		// Ends before the headers.
+		func(w *bufio.Writer) {
+			writeRecord(w, typeStdout, []byte("Content-Type: text/plain\r\n"))
+			writeRecord(w, typeEndRequest, make([]byte, 8))
+		},
+		// Bad version.
+		func(w *bufio.Writer) {
+			w.Write([]byte{9, 9, 9, 9, 9, 9, 9, 9})
+		},
+	}
+
+	for i, records := range cases {
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			conn, err := lis.Accept()
+			if err == nil {
+				fakeServer(conn, records)
+			}
+		}()
+
+		c := NewClient("tcp", lis.Addr().String(), 1)
+		_, err = c.Do(context.Background(), params("GET", "/"), nil, nil)
+		if err == nil {
+			t.Errorf("%d: expected error, got nil", i)
+		}
+		lis.Close()
+	}
+}
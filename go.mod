@@ -6,11 +6,14 @@ require (
 	blitiri.com.ar/go/log v1.1.0
 	blitiri.com.ar/go/systemd v1.1.0
 	github.com/google/go-cmp v0.4.1
+	github.com/quic-go/quic-go v0.59.1
 	golang.org/x/crypto v0.48.0
+	golang.org/x/net v0.51.0
 	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
-	golang.org/x/net v0.51.0 // indirect
+	github.com/quic-go/qpack v0.6.0 // indirect
+	golang.org/x/sys v0.41.0 // indirect
 	golang.org/x/text v0.34.0 // indirect
 )
@@ -13,6 +13,7 @@ import (
 	"blitiri.com.ar/go/gofer/ratelimit"
 	"blitiri.com.ar/go/gofer/reqlog"
 	"blitiri.com.ar/go/gofer/server"
+	"blitiri.com.ar/go/gofer/util"
 	"blitiri.com.ar/go/log"
 )
 
@@ -43,6 +44,9 @@ func main() {
 		}
 		log.Fatalf("invalid configuration")
 	}
+	for _, w := range conf.Warnings() {
+		log.Infof("warning: %s", w)
+	}
 	if *configPrint {
 		fmt.Print(conf.String())
 		return
@@ -54,6 +58,10 @@ func main() {
 
 	go signalHandler()
 
+	if conf.CertExpiryWarning > 0 {
+		util.CertExpiryWarning = conf.CertExpiryWarning
+	}
+
 	for name, rlog := range conf.ReqLog {
 		err := reqlog.FromConfig(name, rlog)
 		if err != nil {
@@ -0,0 +1,673 @@
+// Package httpcache implements a cache of HTTP responses.
+//
+// It is meant to be put in front of a handler (typically a proxy or a CGI),
+// and follows the caching semantics of RFC 9111 for shared caches.
+package httpcache
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"html/template"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"blitiri.com.ar/go/gofer/config"
+	"blitiri.com.ar/go/gofer/trace"
+	"blitiri.com.ar/go/log"
+)
+
+// Defaults for the configuration values that are not set.
+const (
+	defaultMaxSize      = 64 << 20
+	defaultMaxEntrySize = 4 << 20
+	defaultMaxDiskSize  = 1 << 30
+	defaultLockTimeout  = 5 * time.Second
+)
+
+// How long background revalidations can take.
+var revalidateTimeout = time.Minute
+
+// Headers used in conditional requests. We handle them ourselves, so they
+// are not sent to the backend.
+var conditionalHeaders = []string{
+	"If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since",
+}
+
+// Cache is an http.Handler that caches the responses of another one.
+type Cache struct {
+	name string
+	conf config.Cache
+	next http.Handler
+
+	mem  *memStore
+	disk *diskStore // nil if there is no disk store.
+
+	// Requests to the backend in progress, by primary key, so concurrent
+	// misses for the same resource can wait for a single one.
+	mu       sync.Mutex
+	inflight map[string]chan struct{}
+
+	stats stats
+	tr    *trace.Trace
+}
+
+type stats struct {
+	hits, stale, misses, revalidated, bypass atomic.Int64
+	coalesced, stores, evictions, errors     atomic.Int64
+}
+
+// Global registry of caches, for the debug handler.
+var (
+	registryMu sync.Mutex
+	registry   = map[string]*Cache{}
+)
+
+// New returns a cache with the given configuration, in front of next.
+func New(name string, conf config.Cache, next http.Handler) (*Cache, error) {
+	if conf.MaxSize == 0 {
+		conf.MaxSize = defaultMaxSize
+	}
+	if conf.MaxEntrySize == 0 {
+		conf.MaxEntrySize = min(defaultMaxEntrySize, conf.MaxSize)
+	}
+	if conf.Dir != "" && conf.MaxDiskSize == 0 {
+		conf.MaxDiskSize = defaultMaxDiskSize
+	}
+	if conf.LockTimeout == 0 {
+		conf.LockTimeout = defaultLockTimeout
+	}
+
+	c := &Cache{
+		name:     name,
+		conf:     conf,
+		next:     next,
+		mem:      newMemStore(int64(conf.MaxSize)),
+		inflight: map[string]chan struct{}{},
+		tr:       trace.New("httpcache", name),
+	}
+	c.tr.SetMaxEvents(1000)
+
+	if conf.Dir != "" {
+		var err error
+		c.disk, err = newDiskStore(conf.Dir, int64(conf.MaxDiskSize))
+		if err != nil {
+			return nil, fmt.Errorf("error opening cache dir %q: %v",
+				conf.Dir, err)
+		}
+		n, size := c.disk.usage()
+		c.tr.Printf("loaded %d entries (%s) from %q",
+			n, config.ByteSize(size), conf.Dir)
+	}
+
+	registryMu.Lock()
+	registry[name] = c
+	registryMu.Unlock()
+
+	return c, nil
+}
+
+func (c *Cache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	tr, _ := trace.FromContext(r.Context())
+
+	if reason := bypassReason(r); reason != "" {
+		c.stats.bypass.Add(1)
+		tr.Printf("cache bypass: %s", reason)
+		w.Header().Set("X-Cache", "BYPASS")
+		c.next.ServeHTTP(w, r)
+		return
+	}
+
+	now := time.Now()
+	e := c.lookup(r)
+	if e != nil && !wantsRevalidation(r) {
+		if now.Before(e.Expires) {
+			c.serve(w, r, e, "HIT", now)
+			return
+		}
+		if now.Before(e.StaleUntil) {
+			c.revalidateInBackground(r, e)
+			c.serve(w, r, e, "STALE", now)
+			return
+		}
+	}
+
+	// We don't store the responses to HEAD requests, as they have no body.
+	if r.Method == "HEAD" {
+		c.stats.misses.Add(1)
+		w.Header().Set("X-Cache", "MISS")
+		c.next.ServeHTTP(w, r)
+		return
+	}
+
+	key := primaryKey(r)
+	c.mu.Lock()
+	done, ok := c.inflight[key]
+	if !ok {
+		done = make(chan struct{})
+		c.inflight[key] = done
+	}
+	c.mu.Unlock()
+
+	if !ok {
+		// The waiters are released when we're done, or earlier if we
+		// find out the response can't be stored.
+		release := sync.OnceFunc(func() { c.finished(key, done) })
+		defer release()
+		c.fetch(w, r, e, release)
+		return
+	}
+
+	// Someone else is already fetching it; wait for them and then try
+	// again. If the response couldn't be stored (or is for a different
+	// variant), or it's taking too long, go to the backend ourselves.
+	c.stats.coalesced.Add(1)
+	tr.Printf("cache: waiting for in-flight request")
+	timer := time.NewTimer(c.conf.LockTimeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+		tr.Printf("cache: timed out waiting for in-flight request")
+	case <-r.Context().Done():
+		return
+	}
+	now = time.Now()
+	if e := c.lookup(r); e != nil && now.Before(e.Expires) {
+		c.serve(w, r, e, "HIT", now)
+		return
+	}
+	c.fetch(w, r, e, nil)
+}
+
+func (c *Cache) finished(key string, done chan struct{}) {
+	c.mu.Lock()
+	delete(c.inflight, key)
+	c.mu.Unlock()
+	close(done)
+}
+
+// lookup the entry for the request, following Vary markers.
+func (c *Cache) lookup(r *http.Request) *entry {
+	key := primaryKey(r)
+	e := c.get(key)
+	if e != nil && len(e.Vary) > 0 {
+		e = c.get(varyKey(key, e.Vary, r))
+	}
+	return e
+}
+
+func (c *Cache) get(key string) *entry {
+	if e := c.mem.get(key); e != nil || c.disk == nil {
+		return e
+	}
+
+	e, err := c.disk.get(key)
+	if err != nil {
+		c.stats.errors.Add(1)
+		c.tr.Errorf("error reading from disk: %v", err)
+		c.disk.remove(key)
+		return nil
+	}
+	if e != nil && int64(len(e.Body)) <= int64(c.conf.MaxEntrySize) {
+		c.stats.evictions.Add(int64(c.mem.put(e)))
+	}
+	return e
+}
+
+func (c *Cache) put(e *entry) {
+	if int64(len(e.Body)) <= int64(c.conf.MaxEntrySize) {
+		c.stats.evictions.Add(int64(c.mem.put(e)))
+	} else {
+		c.mem.remove(e.Key)
+	}
+
+	if c.disk != nil {
+		evicted, err := c.disk.put(e)
+		if err != nil {
+			c.stats.errors.Add(1)
+			c.tr.Errorf("error writing to disk: %v", err)
+			c.disk.remove(e.Key)
+		}
+		c.stats.evictions.Add(int64(evicted))
+	}
+}
+
+func (c *Cache) remove(key string) {
+	c.mem.remove(key)
+	if c.disk != nil {
+		c.disk.remove(key)
+	}
+}
+
+// serve the response from the entry.
+func (c *Cache) serve(w http.ResponseWriter, r *http.Request, e *entry,
+	status string, now time.Time) {
+	tr, _ := trace.FromContext(r.Context())
+	tr.Printf("cache %s, age %v", status, now.Sub(e.Date).Round(time.Second))
+
+	switch status {
+	case "HIT":
+		c.stats.hits.Add(1)
+	case "STALE":
+		c.stats.stale.Add(1)
+	case "REVALIDATED":
+		c.stats.revalidated.Add(1)
+	}
+
+	h := w.Header()
+	for k, vs := range e.Header {
+		h[k] = slices.Clone(vs)
+	}
+	h.Set("X-Cache", status)
+	h.Set("Age", strconv.FormatInt(int64(now.Sub(e.Date)/time.Second), 10))
+
+	if notModified(r, e) {
+		h.Del("Content-Length")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.WriteHeader(e.Status)
+	if r.Method != "HEAD" {
+		w.Write(e.Body)
+	}
+}
+
+// notModified returns true if the request is conditional, and the entry
+// matches its conditions, so we can reply with a 304 Not Modified.
+func notModified(r *http.Request, e *entry) bool {
+	if e.Status != http.StatusOK {
+		return false
+	}
+
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		etag := trimWeak(e.Header.Get("ETag"))
+		if etag == "" {
+			return false
+		}
+		for _, t := range splitList(inm) {
+			if t == "*" || trimWeak(t) == etag {
+				return true
+			}
+		}
+		return false
+	}
+
+	ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lm, err := http.ParseTime(e.Header.Get("Last-Modified"))
+	return err == nil && !lm.After(ims)
+}
+
+// fetch the response from the backend, sending it to the client and storing
+// it. If we have a previous entry, it is revalidated with a conditional
+// request.
+// If release is not nil, it is called as soon as we know the response can't
+// be stored, so the requests waiting for it can go ahead.
+func (c *Cache) fetch(w http.ResponseWriter, r *http.Request, old *entry,
+	release func()) {
+	req := r.Clone(r.Context())
+	for _, h := range conditionalHeaders {
+		req.Header.Del(h)
+	}
+	if old != nil {
+		if etag := old.Header.Get("ETag"); etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		if lm := old.Header.Get("Last-Modified"); lm != "" {
+			req.Header.Set("If-Modified-Since", lm)
+		}
+	}
+	conditional := req.Header.Get("If-None-Match") != "" ||
+		req.Header.Get("If-Modified-Since") != ""
+
+	tw := &teeWriter{
+		w:       w,
+		h:       http.Header{},
+		conf:    c.conf,
+		ok:      true,
+		hold304: conditional,
+		release: release,
+	}
+	c.next.ServeHTTP(tw, req)
+	if tw.status == 0 {
+		tw.WriteHeader(http.StatusOK)
+	}
+	now := time.Now()
+
+	tr, _ := trace.FromContext(r.Context())
+	if tw.held {
+		c.serve(w, r, c.refresh(old, tw.header, now, tr), "REVALIDATED", now)
+		return
+	}
+	c.stats.misses.Add(1)
+	c.store(r, tw, now, tr)
+}
+
+// refresh the entry with the headers of a 304 response, and store it.
+// Returns the entry to serve.
+func (c *Cache) refresh(old *entry, h http.Header, now time.Time,
+	tr *trace.Trace) *entry {
+	header := old.Header.Clone()
+	for k, vs := range h {
+		if k != "Content-Length" {
+			header[k] = vs
+		}
+	}
+
+	e, reason := newEntry(old.Status, header, now, c.conf)
+	if e == nil {
+		// The response was validated, so we can still serve it this time.
+		tr.Printf("cache: not storing revalidated response: %s", reason)
+		c.remove(old.Key)
+		return old
+	}
+	e.Key = old.Key
+	e.Body = old.Body
+	c.put(e)
+	return e
+}
+
+func (c *Cache) store(r *http.Request, tw *teeWriter, now time.Time,
+	tr *trace.Trace) {
+	if !tw.ok {
+		tr.Printf("cache: not storing: body too large or incomplete")
+		return
+	}
+	e, reason := newEntry(tw.status, tw.header, now, c.conf)
+	if e == nil {
+		tr.Printf("cache: not storing: %s", reason)
+		return
+	}
+	e.Body = tw.body.Bytes()
+	if cl := e.Header.Get("Content-Length"); cl != "" &&
+		cl != strconv.Itoa(len(e.Body)) {
+		tr.Printf("cache: not storing: incomplete body")
+		return
+	}
+
+	key := primaryKey(r)
+	e.Key = key
+	if names, _ := varyNames(e.Header); len(names) > 0 {
+		c.put(&entry{
+			Key:        key,
+			Date:       e.Date,
+			Expires:    e.Expires,
+			StaleUntil: e.StaleUntil,
+			Vary:       names,
+		})
+		e.Key = varyKey(key, names, r)
+	}
+	c.put(e)
+	c.stats.stores.Add(1)
+
+	tr.Printf("cache: stored %d bytes, fresh for %v",
+		len(e.Body), e.Expires.Sub(now).Round(time.Second))
+}
+
+// revalidateInBackground fetches the response again and updates the entry,
+// unless there's already a request in progress for it.
+func (c *Cache) revalidateInBackground(r *http.Request, e *entry) {
+	key := primaryKey(r)
+	c.mu.Lock()
+	if _, ok := c.inflight[key]; ok {
+		c.mu.Unlock()
+		return
+	}
+	done := make(chan struct{})
+	c.inflight[key] = done
+	c.mu.Unlock()
+
+	tr := trace.New("httpcache", "revalidate "+key)
+	ctx, cancel := context.WithTimeout(
+		trace.NewContext(context.WithoutCancel(r.Context()), tr),
+		revalidateTimeout)
+	req := r.Clone(ctx)
+	req.Body = http.NoBody
+	req.ContentLength = 0
+
+	release := sync.OnceFunc(func() { c.finished(key, done) })
+	go func() {
+		defer tr.Finish()
+		defer cancel()
+		defer release()
+		defer func() {
+			if err := recover(); err != nil {
+				tr.Errorf("panic during revalidation: %v", err)
+			}
+		}()
+		c.fetch(&discardWriter{h: http.Header{}}, req, e, release)
+	}()
+}
+
+// teeWriter sends the response to the client, and captures it so it can be
+// stored.
+type teeWriter struct {
+	w http.ResponseWriter
+
+	// The backend writes the headers here, so we have them separate from
+	// whatever our callers set.
+	h http.Header
+
+	// Status and headers of the response, and as much of the body as we can
+	// keep (up to the conf's max_entry_size). If ok is false, the response
+	// can't be stored.
+	status int
+	header http.Header
+	body   bytes.Buffer
+	conf   config.Cache
+	ok     bool
+
+	// Called (if not nil) as soon as we know the response can't be stored.
+	release func()
+
+	// If hold304 is set, 304 responses are not sent to the client, and held
+	// is set instead.
+	hold304 bool
+	held    bool
+}
+
+func (t *teeWriter) Header() http.Header {
+	// Once the headers are sent, changes to them are trailers, which need
+	// to reach the client's writer.
+	if t.status != 0 && !t.held {
+		return t.w.Header()
+	}
+	return t.h
+}
+
+func (t *teeWriter) WriteHeader(status int) {
+	// Informational responses are not forwarded, as they would be mixed up
+	// with the cached ones.
+	if t.status != 0 || status < 200 {
+		return
+	}
+	t.status = status
+	t.header = t.h.Clone()
+
+	if status == http.StatusNotModified && t.hold304 {
+		t.held = true
+		return
+	}
+	if !t.storable() {
+		t.releaseWaiters()
+	}
+
+	h := t.w.Header()
+	for k, vs := range t.header {
+		h[k] = vs
+	}
+	h.Set("X-Cache", "MISS")
+	t.w.WriteHeader(status)
+}
+
+// storable returns false if we can tell from the status and headers that
+// the response won't be stored.
+func (t *teeWriter) storable() bool {
+	if e, _ := newEntry(t.status, t.header, time.Now(), t.conf); e == nil {
+		return false
+	}
+	cl, err := strconv.ParseInt(t.header.Get("Content-Length"), 10, 64)
+	return err != nil || cl <= int64(t.conf.MaxEntrySize)
+}
+
+// releaseWaiters lets the requests waiting for this response go ahead,
+// once we know it won't be stored.
+func (t *teeWriter) releaseWaiters() {
+	if t.release != nil {
+		t.release()
+	}
+}
+
+func (t *teeWriter) Write(b []byte) (int, error) {
+	if t.status == 0 {
+		t.WriteHeader(http.StatusOK)
+	}
+	if t.held {
+		return len(b), nil
+	}
+
+	n, err := t.w.Write(b)
+	tooLarge := int64(t.body.Len()+n) > int64(t.conf.MaxEntrySize)
+	if t.ok && (err != nil || tooLarge) {
+		t.ok = false
+		t.body = bytes.Buffer{}
+		t.releaseWaiters()
+	}
+	if t.ok {
+		t.body.Write(b[:n])
+	}
+	return n, err
+}
+
+func (t *teeWriter) Flush() {
+	if t.status == 0 {
+		t.WriteHeader(http.StatusOK)
+	}
+	if f, ok := t.w.(http.Flusher); ok && !t.held {
+		f.Flush()
+	}
+}
+
+// discardWriter is an http.ResponseWriter that discards everything, used
+// for background revalidations.
+type discardWriter struct {
+	h http.Header
+}
+
+func (d *discardWriter) Header() http.Header         { return d.h }
+func (d *discardWriter) WriteHeader(int)             {}
+func (d *discardWriter) Write(b []byte) (int, error) { return len(b), nil }
+
+// DebugHandler shows the caches and their statistics.
+func DebugHandler(w http.ResponseWriter, r *http.Request) {
+	type row struct {
+		Name                              string
+		MemEntries, DiskEntries           int
+		MemSize, DiskSize                 config.ByteSize
+		MaxSize, MaxDiskSize              config.ByteSize
+		Dir                               string
+		Hits, Stale, Misses, Revalidated  int64
+		Bypass, Coalesced, Stores, Evicts int64
+		Errors                            int64
+	}
+
+	registryMu.Lock()
+	rows := []row{}
+	for name, c := range registry {
+		rw := row{
+			Name:        name,
+			MaxSize:     c.conf.MaxSize,
+			MaxDiskSize: c.conf.MaxDiskSize,
+			Dir:         c.conf.Dir,
+			Hits:        c.stats.hits.Load(),
+			Stale:       c.stats.stale.Load(),
+			Misses:      c.stats.misses.Load(),
+			Revalidated: c.stats.revalidated.Load(),
+			Bypass:      c.stats.bypass.Load(),
+			Coalesced:   c.stats.coalesced.Load(),
+			Stores:      c.stats.stores.Load(),
+			Evicts:      c.stats.evictions.Load(),
+			Errors:      c.stats.errors.Load(),
+		}
+		var size int64
+		rw.MemEntries, size = c.mem.usage()
+		rw.MemSize = config.ByteSize(size)
+		if c.disk != nil {
+			rw.DiskEntries, size = c.disk.usage()
+			rw.DiskSize = config.ByteSize(size)
+		}
+		rows = append(rows, rw)
+	}
+	registryMu.Unlock()
+
+	sort.Slice(rows, func(i, j int) bool { return rows[i].Name < rows[j].Name })
+
+	if err := htmlDebug.Execute(w, rows); err != nil {
+		log.Infof("cache debug handler error: %v", err)
+	}
+}
+
+var htmlDebug = template.Must(template.New("cache").Parse(
+	`<!DOCTYPE html>
+<html>
+
+<head>
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>cache</title>
+<style type="text/css">
+  body {
+    font-family: sans-serif;
+  }
+  @media (prefers-color-scheme: dark) {
+    body {
+      background: #121212;
+      color: #c9d1d9;
+    }
+    a { color: #44b4ec; }
+  }
+  table {
+    text-align: right;
+  }
+  td, th {
+    padding: 0.15em 0.5em;
+  }
+  th {
+    text-align: left;
+  }
+</style>
+</head>
+
+<body>
+{{range .}}
+<h1>{{.Name}}</h1>
+
+<table>
+<tr><th>memory</th>
+  <td>{{.MemEntries}} entries</td><td>{{.MemSize}} / {{.MaxSize}}</td></tr>
+{{if .Dir}}
+<tr><th>disk ({{.Dir}})</th>
+  <td>{{.DiskEntries}} entries</td><td>{{.DiskSize}} / {{.MaxDiskSize}}</td></tr>
+{{end}}
+<tr><th>hits</th><td>{{.Hits}}</td></tr>
+<tr><th>stale hits</th><td>{{.Stale}}</td></tr>
+<tr><th>misses</th><td>{{.Misses}}</td></tr>
+<tr><th>revalidated</th><td>{{.Revalidated}}</td></tr>
+<tr><th>bypassed</th><td>{{.Bypass}}</td></tr>
+<tr><th>coalesced</th><td>{{.Coalesced}}</td></tr>
+<tr><th>stores</th><td>{{.Stores}}</td></tr>
+<tr><th>evictions</th><td>{{.Evicts}}</td></tr>
+<tr><th>errors</th><td>{{.Errors}}</td></tr>
+</table>
+{{end}}
+</body>
+</html>
+`))
@@ -0,0 +1,345 @@
+package httpcache
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"blitiri.com.ar/go/gofer/config"
+	"blitiri.com.ar/go/gofer/trace"
+)
+
+// backend is a test handler that counts its requests, and replies with the
+// given headers and a body that includes the count.
+type backend struct {
+	count  atomic.Int64
+	header http.Header
+	delay  time.Duration
+
+	// If set, reply 304 to conditional requests.
+	notModified bool
+}
+
+func (b *backend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	n := b.count.Add(1)
+	time.Sleep(b.delay)
+	for k, vs := range b.header {
+		w.Header()[k] = vs
+	}
+	if b.notModified && r.Header.Get("If-None-Match") != "" {
+		w.Header().Set("X-Count", fmt.Sprint(n))
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	fmt.Fprintf(w, "response %d %s", n, r.Header.Get("Accept"))
+}
+
+func newTestCache(t *testing.T, conf config.Cache, b http.Handler) (
+	*Cache, *httptest.Server) {
+	t.Helper()
+	c, err := New(t.Name(), conf, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			tr := trace.New("test", r.URL.String())
+			defer tr.Finish()
+			c.ServeHTTP(w, r.WithContext(trace.NewContext(r.Context(), tr)))
+		}))
+	t.Cleanup(srv.Close)
+	return c, srv
+}
+
+// get the path, and check the X-Cache header and the body.
+func get(t *testing.T, srv *httptest.Server, path, xcache, body string,
+	hdrs ...string) *http.Response {
+	t.Helper()
+	method := "GET"
+	if strings.HasPrefix(path, "HEAD ") {
+		method, path = "HEAD", strings.TrimPrefix(path, "HEAD ")
+	}
+	req, _ := http.NewRequest(method, srv.URL+path, nil)
+	for i := 0; i+1 < len(hdrs); i += 2 {
+		req.Header.Set(hdrs[i], hdrs[i+1])
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if x := resp.Header.Get("X-Cache"); x != xcache || string(b) != body {
+		t.Errorf("%s %s: got %q %q, expected %q %q",
+			method, path, x, b, xcache, body)
+	}
+	return resp
+}
+
+func TestCache(t *testing.T) {
+	b := &backend{header: http.Header{"Cache-Control": {"max-age=60"}}}
+	c, srv := newTestCache(t, config.Cache{}, b)
+
+	get(t, srv, "/a", "MISS", "response 1 ")
+	resp := get(t, srv, "/a", "HIT", "response 1 ")
+	if resp.Header.Get("Cache-Control") != "max-age=60" ||
+		resp.Header.Get("Age") != "0" {
+		t.Errorf("unexpected headers: %v", resp.Header)
+	}
+	get(t, srv, "HEAD /a", "HIT", "")
+
+	// Different query, different entry.
+	get(t, srv, "/a?x", "MISS", "response 2 ")
+
+	// Requests that skip the cache.
+	get(t, srv, "/a", "BYPASS", "response 3 ", "Authorization", "x")
+	get(t, srv, "/a", "MISS", "response 4 ", "Cache-Control", "no-cache")
+	get(t, srv, "/a", "HIT", "response 4 ")
+
+	// HEAD misses are not stored.
+	get(t, srv, "HEAD /b", "MISS", "")
+	get(t, srv, "/b", "MISS", "response 6 ")
+
+	if c.stats.hits.Load() != 3 || c.stats.misses.Load() != 5 ||
+		c.stats.bypass.Load() != 1 || c.stats.stores.Load() != 4 {
+		t.Errorf("unexpected stats: %d hits, %d misses, %d bypass, %d stores",
+			c.stats.hits.Load(), c.stats.misses.Load(),
+			c.stats.bypass.Load(), c.stats.stores.Load())
+	}
+
+	// Debug handler.
+	w := httptest.NewRecorder()
+	DebugHandler(w, httptest.NewRequest("GET", "/debug/cache", nil))
+	if !strings.Contains(w.Body.String(), "<h1>TestCache</h1>") {
+		t.Errorf("cache not in the debug page: %s", w.Body.String())
+	}
+}
+
+func TestNotCacheable(t *testing.T) {
+	b := &backend{header: http.Header{"Cache-Control": {"private"}}}
+	_, srv := newTestCache(t, config.Cache{}, b)
+	get(t, srv, "/", "MISS", "response 1 ")
+	get(t, srv, "/", "MISS", "response 2 ")
+
+	// Too big.
+	b = &backend{header: http.Header{"Cache-Control": {"max-age=60"}}}
+	_, srv = newTestCache(t, config.Cache{MaxEntrySize: 5}, b)
+	get(t, srv, "/", "MISS", "response 1 ")
+	get(t, srv, "/", "MISS", "response 2 ")
+
+	// Event streams.
+	b = &backend{header: http.Header{
+		"Cache-Control": {"max-age=60"},
+		"Content-Type":  {"text/event-stream"},
+	}}
+	_, srv = newTestCache(t, config.Cache{}, b)
+	get(t, srv, "/", "MISS", "response 1 ")
+	get(t, srv, "/", "MISS", "response 2 ")
+}
+
+func TestVary(t *testing.T) {
+	b := &backend{header: http.Header{
+		"Cache-Control": {"max-age=60"},
+		"Vary":          {"Accept"},
+	}}
+	_, srv := newTestCache(t, config.Cache{}, b)
+
+	get(t, srv, "/", "MISS", "response 1 a", "Accept", "a")
+	get(t, srv, "/", "MISS", "response 2 b", "Accept", "b")
+	get(t, srv, "/", "HIT", "response 1 a", "Accept", "a")
+	get(t, srv, "/", "HIT", "response 2 b", "Accept", "b")
+	get(t, srv, "/", "MISS", "response 3 ")
+}
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	b := &backend{header: http.Header{
+		"Cache-Control": {"max-age=1, stale-while-revalidate=60"},
+	}}
+	c, srv := newTestCache(t, config.Cache{}, b)
+
+	get(t, srv, "/", "MISS", "response 1 ")
+	time.Sleep(1100 * time.Millisecond)
+	get(t, srv, "/", "STALE", "response 1 ")
+
+	// Wait for the background revalidation to finish.
+	inflight := func() int {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return len(c.inflight)
+	}
+	for b.count.Load() != 2 || inflight() != 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	get(t, srv, "/", "HIT", "response 2 ")
+}
+
+func TestRevalidate(t *testing.T) {
+	b := &backend{
+		header: http.Header{
+			"Cache-Control": {"max-age=1"},
+			"Etag":          {`"v1"`},
+		},
+		notModified: true,
+	}
+	_, srv := newTestCache(t, config.Cache{}, b)
+
+	get(t, srv, "/", "MISS", "response 1 ")
+	time.Sleep(1100 * time.Millisecond)
+	resp := get(t, srv, "/", "REVALIDATED", "response 1 ")
+	if resp.Header.Get("X-Count") != "2" {
+		t.Errorf("headers were not updated: %v", resp.Header)
+	}
+	get(t, srv, "/", "HIT", "response 1 ")
+
+	// Conditional requests from the client are answered by us.
+	resp = get(t, srv, "/", "HIT", "", "If-None-Match", `W/"v1"`)
+	if resp.StatusCode != http.StatusNotModified {
+		t.Errorf("expected 304, got %d", resp.StatusCode)
+	}
+	get(t, srv, "/", "HIT", "response 1 ", "If-None-Match", `"v2"`)
+}
+
+func TestCoalescing(t *testing.T) {
+	b := &backend{
+		header: http.Header{"Cache-Control": {"max-age=60"}},
+		delay:  200 * time.Millisecond,
+	}
+	c, srv := newTestCache(t, config.Cache{}, b)
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := http.Get(srv.URL + "/")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if string(body) != "response 1 " {
+				t.Errorf("unexpected body %q", body)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if b.count.Load() != 1 || c.stats.coalesced.Load() != 4 {
+		t.Errorf("expected 1 backend request and 4 coalesced, got %d %d",
+			b.count.Load(), c.stats.coalesced.Load())
+	}
+}
+
+// TestCoalescingRelease checks that requests waiting for an in-flight one
+// go to the backend themselves once it's clear the response won't be
+// stored, or after the lock timeout, instead of waiting for it to finish.
+func TestCoalescingRelease(t *testing.T) {
+	cases := []struct {
+		name   string
+		header http.Header
+		body   bool
+	}{
+		{"no-store", http.Header{"Cache-Control": {"no-store"}}, false},
+		{"content-length", http.Header{
+			"Cache-Control":  {"max-age=60"},
+			"Content-Length": {"100"}}, false},
+		{"body too large", http.Header{"Cache-Control": {"max-age=60"}}, true},
+		{"lock timeout", nil, false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// The first request blocks until unblock is closed: after
+			// sending the headers (and a big body, if requested), or
+			// before sending anything if there are no headers.
+			count := atomic.Int64{}
+			unblock := make(chan struct{})
+			b := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if count.Add(1) > 1 {
+					w.Write([]byte("other"))
+					return
+				}
+				if tc.header != nil {
+					for k, vs := range tc.header {
+						w.Header()[k] = vs
+					}
+					w.WriteHeader(http.StatusOK)
+					if tc.body {
+						w.Write([]byte(strings.Repeat("x", 20)))
+					}
+					w.(http.Flusher).Flush()
+				}
+				<-unblock
+			})
+			conf := config.Cache{MaxEntrySize: 10, LockTimeout: time.Minute}
+			if tc.header == nil {
+				conf.LockTimeout = 100 * time.Millisecond
+			}
+			c, srv := newTestCache(t, conf, b)
+			defer close(unblock)
+
+			go func() {
+				resp, err := http.Get(srv.URL + "/")
+				if err == nil {
+					io.Copy(io.Discard, resp.Body)
+					resp.Body.Close()
+				}
+			}()
+			for count.Load() != 1 {
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			start := time.Now()
+			get(t, srv, "/", "MISS", "other")
+			if d := time.Since(start); d > time.Second {
+				t.Errorf("second request took %v", d)
+			}
+			// Once released, later requests don't wait at all; but with
+			// the timeout, it had to.
+			if tc.header == nil && c.stats.coalesced.Load() != 1 {
+				t.Errorf("expected 1 coalesced, got %d",
+					c.stats.coalesced.Load())
+			}
+		})
+	}
+}
+
+func TestDisk(t *testing.T) {
+	dir := t.TempDir()
+	b := &backend{header: http.Header{"Cache-Control": {"max-age=60"}}}
+	serve := func(c *Cache, xcache string) {
+		t.Helper()
+		tr := trace.New("test", "/")
+		defer tr.Finish()
+		r := httptest.NewRequest("GET", "/", nil)
+		w := httptest.NewRecorder()
+		c.ServeHTTP(w, r.WithContext(trace.NewContext(r.Context(), tr)))
+		if x := w.Header().Get("X-Cache"); x != xcache ||
+			w.Body.String() != "response 1 " {
+			t.Errorf("got %q %q, expected %q", x, w.Body.String(), xcache)
+		}
+	}
+
+	c, err := New("disk-1", config.Cache{Dir: dir}, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serve(c, "MISS")
+
+	// A new cache on the same directory finds the response.
+	c, err = New("disk-2", config.Cache{Dir: dir}, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serve(c, "HIT")
+	serve(c, "HIT")
+	if b.count.Load() != 1 {
+		t.Errorf("expected 1 backend request, got %d", b.count.Load())
+	}
+}
@@ -0,0 +1,214 @@
+package httpcache
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"blitiri.com.ar/go/gofer/config"
+)
+
+// cacheControl holds the Cache-Control directives, as name -> value. The
+// value is empty for directives without an argument.
+type cacheControl map[string]string
+
+func parseCacheControl(h http.Header) cacheControl {
+	cc := cacheControl{}
+	for _, v := range h.Values("Cache-Control") {
+		for _, d := range strings.Split(v, ",") {
+			name, val, _ := strings.Cut(strings.TrimSpace(d), "=")
+			if name == "" {
+				continue
+			}
+			cc[strings.ToLower(name)] = strings.Trim(val, `"`)
+		}
+	}
+	return cc
+}
+
+func (cc cacheControl) has(name string) bool {
+	_, ok := cc[name]
+	return ok
+}
+
+// seconds returns the value of a directive which is a number of seconds.
+func (cc cacheControl) seconds(name string) (time.Duration, bool) {
+	v, ok := cc[name]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(v, 10, 32)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+// Statuses that can be cached, as per RFC 9110 section 15.1.
+var cacheableStatus = map[int]bool{
+	200: true, 203: true, 204: true, 300: true, 301: true, 308: true,
+	404: true, 405: true, 410: true, 414: true, 501: true,
+}
+
+// bypassReason returns why the request can't be served from the cache, or
+// "" if it can.
+func bypassReason(r *http.Request) string {
+	switch {
+	case r.Method != "GET" && r.Method != "HEAD":
+		return "method " + r.Method
+	case r.Header.Get("Authorization") != "":
+		return "authorization"
+	case r.Header.Get("Range") != "":
+		return "range request"
+	case r.Header.Get("Upgrade") != "":
+		return "upgrade"
+	case parseCacheControl(r.Header).has("no-store"):
+		return "request no-store"
+	}
+	return ""
+}
+
+// wantsRevalidation returns true if the request asks not to be served from
+// the cache without checking with the backend first.
+func wantsRevalidation(r *http.Request) bool {
+	cc := parseCacheControl(r.Header)
+	maxAge, ok := cc.seconds("max-age")
+	return cc.has("no-cache") || (ok && maxAge == 0) ||
+		r.Header.Get("Pragma") == "no-cache"
+}
+
+// newEntry returns an entry for the response received at the given time,
+// with its freshness computed from the headers and the configuration. If
+// the response can't be stored, it returns nil and the reason.
+func newEntry(status int, h http.Header, now time.Time, conf config.Cache) (
+	*entry, string) {
+	if !cacheableStatus[status] {
+		return nil, "status " + strconv.Itoa(status)
+	}
+
+	cc := parseCacheControl(h)
+	switch {
+	case cc.has("no-store"):
+		return nil, "no-store"
+	case cc.has("private"):
+		return nil, "private"
+	case cc.has("no-cache"):
+		return nil, "no-cache"
+	case h.Get("Set-Cookie") != "":
+		return nil, "set-cookie"
+	case strings.HasPrefix(h.Get("Content-Type"), "text/event-stream"):
+		return nil, "event stream"
+	}
+	if _, ok := varyNames(h); !ok {
+		return nil, "vary *"
+	}
+
+	// The time the response was generated: when we got it, minus how long
+	// it has been in other caches.
+	date := now
+	if age, err := strconv.Atoi(h.Get("Age")); err == nil && age > 0 {
+		date = now.Add(-time.Duration(age) * time.Second)
+	}
+
+	lifetime, ok := cc.seconds("s-maxage")
+	if !ok {
+		lifetime, ok = cc.seconds("max-age")
+	}
+	if !ok && h.Get("Expires") != "" {
+		// An invalid Expires means it's already expired.
+		expires, err := http.ParseTime(h.Get("Expires"))
+		served, derr := http.ParseTime(h.Get("Date"))
+		if derr != nil {
+			served = now
+		}
+		if err == nil {
+			lifetime = expires.Sub(served)
+		}
+		ok = true
+	}
+	if !ok {
+		lifetime = conf.DefaultTTL
+	}
+	if lifetime <= 0 {
+		return nil, "not fresh"
+	}
+
+	swr, explicit := cc.seconds("stale-while-revalidate")
+	if !explicit {
+		swr = conf.StaleWhileRevalidate
+	}
+
+	// For shared caches like us, s-maxage implies proxy-revalidate, so we
+	// only serve stale responses if they explicitly allow it.
+	if cc.has("must-revalidate") || cc.has("proxy-revalidate") ||
+		(cc.has("s-maxage") && !explicit) {
+		swr = 0
+	}
+
+	e := &entry{
+		Status:     status,
+		Header:     h,
+		Date:       date,
+		Expires:    date.Add(lifetime),
+		StaleUntil: date.Add(lifetime + swr),
+	}
+	return e, ""
+}
+
+// varyNames returns the request headers the response varies on, in
+// canonical form and sorted. Returns false if it varies on "*", which means
+// it can't be cached.
+func varyNames(h http.Header) ([]string, bool) {
+	names := []string{}
+	for _, v := range h.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			name = strings.TrimSpace(name)
+			if name == "*" {
+				return nil, false
+			}
+			if name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	sort.Strings(names)
+	return names, true
+}
+
+// primaryKey returns the key for the request, without considering Vary.
+func primaryKey(r *http.Request) string {
+	return r.Host + r.URL.RequestURI()
+}
+
+// varyKey returns the key for the variant of the response selected by the
+// request, given the headers it varies on.
+func varyKey(primary string, names []string, r *http.Request) string {
+	var sb strings.Builder
+	sb.WriteString(primary)
+	for _, name := range names {
+		sb.WriteString("\x00")
+		sb.WriteString(name)
+		sb.WriteString("=")
+		sb.WriteString(strings.Join(r.Header.Values(name), ","))
+	}
+	return sb.String()
+}
+
+// splitList splits a comma-separated header value.
+func splitList(v string) []string {
+	l := []string{}
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			l = append(l, s)
+		}
+	}
+	return l
+}
+
+// trimWeak removes the weak indicator from an entity tag, for weak
+// comparison (RFC 9110 section 8.8.3.2).
+func trimWeak(etag string) string {
+	return strings.TrimPrefix(etag, "W/")
+}
@@ -0,0 +1,132 @@
+package httpcache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"blitiri.com.ar/go/gofer/config"
+)
+
+func TestNewEntry(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	date := now.Format(http.TimeFormat)
+	conf := config.Cache{StaleWhileRevalidate: time.Minute}
+
+	cases := []struct {
+		status       int
+		header       map[string]string
+		fresh, stale time.Duration
+		reason       string
+	}{
+		{200, map[string]string{"Cache-Control": "max-age=10"},
+			10 * time.Second, 70 * time.Second, ""},
+		{200, map[string]string{"Cache-Control": "max-age=10, s-maxage=20"},
+			20 * time.Second, 20 * time.Second, ""},
+		{200, map[string]string{
+			"Cache-Control": "s-maxage=20, stale-while-revalidate=5"},
+			20 * time.Second, 25 * time.Second, ""},
+		{200, map[string]string{
+			"Cache-Control": "max-age=10, must-revalidate"},
+			10 * time.Second, 10 * time.Second, ""},
+		{200, map[string]string{"Cache-Control": "max-age=10", "Age": "4"},
+			6 * time.Second, 66 * time.Second, ""},
+		{200, map[string]string{
+			"Date":    date,
+			"Expires": now.Add(time.Hour).Format(http.TimeFormat)},
+			time.Hour, time.Hour + time.Minute, ""},
+		{200, map[string]string{"Date": date, "Expires": "0"},
+			0, 0, "not fresh"},
+		{200, map[string]string{}, 0, 0, "not fresh"},
+		{200, map[string]string{"Cache-Control": "max-age=0"},
+			0, 0, "not fresh"},
+		{500, map[string]string{"Cache-Control": "max-age=10"},
+			0, 0, "status 500"},
+		{200, map[string]string{"Cache-Control": "max-age=10, private"},
+			0, 0, "private"},
+		{200, map[string]string{"Cache-Control": "no-store"},
+			0, 0, "no-store"},
+		{200, map[string]string{"Cache-Control": "No-Cache, max-age=10"},
+			0, 0, "no-cache"},
+		{200, map[string]string{
+			"Cache-Control": "max-age=10", "Set-Cookie": "a=b"},
+			0, 0, "set-cookie"},
+		{200, map[string]string{"Cache-Control": "max-age=10", "Vary": "*"},
+			0, 0, "vary *"},
+	}
+	for i, c := range cases {
+		h := http.Header{}
+		for k, v := range c.header {
+			h.Set(k, v)
+		}
+		e, reason := newEntry(c.status, h, now, conf)
+		if reason != c.reason {
+			t.Errorf("%d: got reason %q, expected %q", i, reason, c.reason)
+			continue
+		}
+		if e == nil {
+			continue
+		}
+		fresh, stale := e.Expires.Sub(now), e.StaleUntil.Sub(now)
+		if fresh != c.fresh || stale != c.stale {
+			t.Errorf("%d: got %v %v, expected %v %v",
+				i, fresh, stale, c.fresh, c.stale)
+		}
+	}
+
+	// Default TTL, when the response doesn't say anything.
+	conf.DefaultTTL = time.Hour
+	e, _ := newEntry(200, http.Header{}, now, conf)
+	if e == nil || e.Expires != now.Add(time.Hour) {
+		t.Errorf("default ttl not applied: %v", e)
+	}
+}
+
+func TestBypass(t *testing.T) {
+	cases := map[string]string{
+		"GET":  "",
+		"HEAD": "",
+		"POST": "method POST",
+	}
+	for method, reason := range cases {
+		r := httptest.NewRequest(method, "/", nil)
+		if got := bypassReason(r); got != reason {
+			t.Errorf("%s: got %q, expected %q", method, got, reason)
+		}
+	}
+
+	headers := map[string]string{
+		"Authorization": "authorization",
+		"Range":         "range request",
+		"Upgrade":       "upgrade",
+		"Cache-Control": "request no-store",
+	}
+	for k, reason := range headers {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set(k, "no-store")
+		if got := bypassReason(r); got != reason {
+			t.Errorf("%s: got %q, expected %q", k, got, reason)
+		}
+	}
+}
+
+func TestVaryKey(t *testing.T) {
+	h := http.Header{}
+	h.Add("Vary", "accept-encoding, Accept")
+	h.Add("Vary", "X-Lala")
+	names, ok := varyNames(h)
+	if !ok || len(names) != 3 || names[0] != "Accept" ||
+		names[1] != "Accept-Encoding" || names[2] != "X-Lala" {
+		t.Fatalf("unexpected vary names: %v %v", names, ok)
+	}
+
+	r1 := httptest.NewRequest("GET", "/a?b", nil)
+	r1.Header.Set("Accept-Encoding", "gzip")
+	r2 := httptest.NewRequest("GET", "/a?b", nil)
+	k1 := varyKey(primaryKey(r1), names, r1)
+	k2 := varyKey(primaryKey(r2), names, r2)
+	if primaryKey(r1) != "example.com/a?b" || k1 == k2 {
+		t.Errorf("unexpected keys: %q %q", k1, k2)
+	}
+}
@@ -0,0 +1,343 @@
+package httpcache
+
+import (
+	"bufio"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// entry is a cached response.
+type entry struct {
+	Key    string
+	Status int
+	Header http.Header
+	Body   []byte `json:"-"`
+
+	// When the response was generated, until when it is fresh, and until
+	// when it can be served stale while we revalidate it.
+	Date       time.Time
+	Expires    time.Time
+	StaleUntil time.Time
+
+	// If set, this entry is only a marker saying that the responses for the
+	// key vary on these request headers, and are stored under their own
+	// keys (see varyKey).
+	Vary []string `json:",omitempty"`
+}
+
+// size returns an approximation of the memory used by the entry.
+func (e *entry) size() int64 {
+	n := len(e.Key) + len(e.Body)
+	for k, vs := range e.Header {
+		n += len(k)
+		for _, v := range vs {
+			n += len(v)
+		}
+	}
+	for _, v := range e.Vary {
+		n += len(v)
+	}
+	return int64(n)
+}
+
+// memStore keeps entries in memory, evicting the least recently used ones
+// to stay under the maximum size.
+type memStore struct {
+	max int64
+
+	mu    sync.Mutex
+	size  int64
+	ll    *list.List // Of *entry, most recently used first.
+	items map[string]*list.Element
+}
+
+func newMemStore(max int64) *memStore {
+	return &memStore{
+		max:   max,
+		ll:    list.New(),
+		items: map[string]*list.Element{},
+	}
+}
+
+func (s *memStore) get(key string) *entry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	el, ok := s.items[key]
+	if !ok {
+		return nil
+	}
+	s.ll.MoveToFront(el)
+	return el.Value.(*entry)
+}
+
+// put the entry in the store, replacing any previous one with the same key.
+// Returns how many entries were evicted to make room for it.
+func (s *memStore) put(e *entry) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.removeLocked(e.Key)
+	if e.size() > s.max {
+		return 0
+	}
+	s.items[e.Key] = s.ll.PushFront(e)
+	s.size += e.size()
+
+	evicted := 0
+	for s.size > s.max {
+		s.removeLocked(s.ll.Back().Value.(*entry).Key)
+		evicted++
+	}
+	return evicted
+}
+
+func (s *memStore) remove(key string) {
+	s.mu.Lock()
+	s.removeLocked(key)
+	s.mu.Unlock()
+}
+
+func (s *memStore) removeLocked(key string) {
+	el, ok := s.items[key]
+	if !ok {
+		return
+	}
+	s.ll.Remove(el)
+	delete(s.items, key)
+	s.size -= el.Value.(*entry).size()
+}
+
+// usage returns the number of entries and their total size.
+func (s *memStore) usage() (int, int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.items), s.size
+}
+
+// diskStore keeps entries in files inside a directory, evicting the least
+// recently used ones to stay under the maximum size.
+//
+// Each file is named after the hash of the key, and contains the entry
+// encoded as JSON in a single line, followed by the body.
+type diskStore struct {
+	dir string
+	max int64
+
+	mu    sync.Mutex
+	size  int64
+	ll    *list.List // Of *diskItem, most recently used first.
+	items map[string]*list.Element
+}
+
+type diskItem struct {
+	name string
+	size int64
+}
+
+// Prefix of the temporary files, which are renamed once complete.
+const tmpPrefix = ".tmp-"
+
+// newDiskStore returns a store for the directory, indexing the entries
+// already present in it.
+func newDiskStore(dir string, max int64) (*diskStore, error) {
+	s := &diskStore{
+		dir:   dir,
+		max:   max,
+		ll:    list.New(),
+		items: map[string]*list.Element{},
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	des, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	// Use the modification time to find out which ones were used most
+	// recently; get() updates it.
+	type file struct {
+		item  *diskItem
+		mtime time.Time
+	}
+	files := []file{}
+	for _, de := range des {
+		if !de.Type().IsRegular() {
+			continue
+		}
+		if strings.HasPrefix(de.Name(), tmpPrefix) {
+			// Leftover from an interrupted write.
+			os.Remove(filepath.Join(dir, de.Name()))
+			continue
+		}
+		info, err := de.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, file{
+			item:  &diskItem{name: de.Name(), size: info.Size()},
+			mtime: info.ModTime(),
+		})
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].mtime.Before(files[j].mtime)
+	})
+	for _, f := range files {
+		s.items[f.item.name] = s.ll.PushFront(f.item)
+		s.size += f.item.size
+	}
+
+	s.mu.Lock()
+	s.evictLocked()
+	s.mu.Unlock()
+	return s, nil
+}
+
+func fileName(key string) string {
+	h := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(h[:])
+}
+
+func (s *diskStore) get(key string) (*entry, error) {
+	name := fileName(key)
+	s.mu.Lock()
+	el, ok := s.items[name]
+	if ok {
+		s.ll.MoveToFront(el)
+	}
+	s.mu.Unlock()
+	if !ok {
+		return nil, nil
+	}
+
+	path := filepath.Join(s.dir, name)
+	e, err := readEntry(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		// Removed behind our back.
+		s.remove(key)
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if e.Key != key {
+		// Very unlikely, but it's cheap to check.
+		return nil, nil
+	}
+
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	return e, nil
+}
+
+func readEntry(path string) (*entry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		return nil, fmt.Errorf("%s: error reading metadata: %v", path, err)
+	}
+	e := &entry{}
+	if err := json.Unmarshal(line, e); err != nil {
+		return nil, fmt.Errorf("%s: error parsing metadata: %v", path, err)
+	}
+	e.Body, err = io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("%s: error reading body: %v", path, err)
+	}
+	return e, nil
+}
+
+// put the entry in the store, replacing any previous one with the same key.
+// Returns how many entries were evicted to make room for it.
+func (s *diskStore) put(e *entry) (int, error) {
+	meta, err := json.Marshal(e)
+	if err != nil {
+		return 0, err
+	}
+	size := int64(len(meta) + 1 + len(e.Body))
+	if size > s.max {
+		return 0, nil
+	}
+
+	// Write to a temporary file and then rename it, so readers never see
+	// partial entries.
+	f, err := os.CreateTemp(s.dir, tmpPrefix+"*")
+	if err != nil {
+		return 0, err
+	}
+	_, err = f.Write(append(meta, '\n'))
+	if err == nil {
+		_, err = f.Write(e.Body)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	name := fileName(e.Key)
+	if err == nil {
+		err = os.Rename(f.Name(), filepath.Join(s.dir, name))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return 0, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if el, ok := s.items[name]; ok {
+		s.ll.Remove(el)
+		s.size -= el.Value.(*diskItem).size
+	}
+	s.items[name] = s.ll.PushFront(&diskItem{name: name, size: size})
+	s.size += size
+	return s.evictLocked(), nil
+}
+
+func (s *diskStore) evictLocked() int {
+	evicted := 0
+	for s.size > s.max {
+		item := s.ll.Remove(s.ll.Back()).(*diskItem)
+		delete(s.items, item.name)
+		s.size -= item.size
+		os.Remove(filepath.Join(s.dir, item.name))
+		evicted++
+	}
+	return evicted
+}
+
+func (s *diskStore) remove(key string) {
+	name := fileName(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if el, ok := s.items[name]; ok {
+		s.ll.Remove(el)
+		delete(s.items, name)
+		s.size -= el.Value.(*diskItem).size
+		os.Remove(filepath.Join(s.dir, name))
+	}
+}
+
+// usage returns the number of entries and their total size.
+func (s *diskStore) usage() (int, int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.items), s.size
+}
@@ -0,0 +1,123 @@
+package httpcache
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testEntry(key string, size int) *entry {
+	return &entry{
+		Key:     key,
+		Status:  200,
+		Header:  http.Header{"X-Key": {key}},
+		Body:    []byte(strings.Repeat("x", size)),
+		Expires: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+}
+
+func TestMemStore(t *testing.T) {
+	s := newMemStore(1000)
+	for _, k := range []string{"a", "b", "c"} {
+		if n := s.put(testEntry(k, 300)); n != 0 {
+			t.Errorf("%s: unexpected evictions: %d", k, n)
+		}
+	}
+
+	// Use "a", so "b" is the least recently used.
+	if e := s.get("a"); e == nil || e.Header.Get("X-Key") != "a" {
+		t.Errorf("unexpected entry: %v", e)
+	}
+	if n := s.put(testEntry("d", 300)); n != 1 {
+		t.Errorf("expected 1 eviction, got %d", n)
+	}
+	if s.get("b") != nil || s.get("a") == nil || s.get("d") == nil {
+		t.Errorf("wrong entry evicted")
+	}
+
+	// Replacing an entry updates the size.
+	s.put(testEntry("a", 10))
+	n, size := s.usage()
+	if n != 3 || size != testEntry("a", 10).size()+2*testEntry("c", 300).size() {
+		t.Errorf("unexpected usage: %d %d", n, size)
+	}
+
+	// Too big entries are not stored.
+	s.put(testEntry("big", 2000))
+	if s.get("big") != nil {
+		t.Errorf("big entry was stored")
+	}
+
+	s.remove("a")
+	if s.get("a") != nil {
+		t.Errorf("entry was not removed")
+	}
+}
+
+func TestDiskStore(t *testing.T) {
+	dir := t.TempDir()
+	s, err := newDiskStore(dir, 2000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, k := range []string{"a", "b", "c"} {
+		if _, err := s.put(testEntry(k, 500)); err != nil {
+			t.Fatal(err)
+		}
+		// So the modification times are different.
+		past := time.Now().Add(-time.Duration(len(s.items)) * time.Minute)
+		os.Chtimes(filepath.Join(dir, fileName(k)), past, past)
+	}
+
+	e, err := s.get("a")
+	if err != nil || e == nil {
+		t.Fatalf("get: %v %v", e, err)
+	}
+	expected := testEntry("a", 500)
+	if e.Key != "a" || string(e.Body) != string(expected.Body) ||
+		e.Header.Get("X-Key") != "a" || !e.Expires.Equal(expected.Expires) {
+		t.Errorf("unexpected entry: %v", e)
+	}
+	if e, err := s.get("x"); e != nil || err != nil {
+		t.Errorf("unexpected result for missing key: %v %v", e, err)
+	}
+
+	// Reload, and check the index was loaded in the right order: "a" was
+	// used most recently, then "b", then "c".
+	s, err = newDiskStore(dir, 2000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := s.usage(); n != 3 {
+		t.Errorf("expected 3 entries, got %d", n)
+	}
+	if n, err := s.put(testEntry("d", 500)); n != 1 || err != nil {
+		t.Errorf("expected 1 eviction, got %d %v", n, err)
+	}
+	for k, ok := range map[string]bool{"a": true, "b": true, "c": false} {
+		if e, _ := s.get(k); (e != nil) != ok {
+			t.Errorf("%s: expected present=%v, got %v", k, ok, e)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, fileName("c"))); err == nil {
+		t.Errorf("evicted file was not removed")
+	}
+
+	// Temporary files are cleaned up, and corrupted ones are reported.
+	os.WriteFile(filepath.Join(dir, tmpPrefix+"lala"), nil, 0600)
+	os.WriteFile(filepath.Join(dir, fileName("a")), []byte("lala\n"), 0600)
+	s, err = newDiskStore(dir, 2000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, tmpPrefix+"lala")); err == nil {
+		t.Errorf("temporary file was not removed")
+	}
+	if _, err := s.get("a"); err == nil {
+		t.Errorf("expected error reading corrupted entry")
+	}
+}
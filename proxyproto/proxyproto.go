@@ -0,0 +1,364 @@
+// Package proxyproto implements the PROXY protocol (versions 1 and 2), used
+// by load balancers and proxies to pass on the original addresses of the
+// connections they forward.
+//
+// Reference: https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Signature at the beginning of version 2 headers.
+var sigV2 = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// Maximum length of a version 1 header, including the CRLF.
+const maxV1Len = 107
+
+var (
+	errNoHeader = errors.New("no PROXY header")
+	errInvalid  = errors.New("invalid PROXY header")
+)
+
+// Listener wraps a net.Listener, and reads the PROXY header from the
+// connections coming from trusted networks. The other connections are
+// returned unmodified.
+type Listener struct {
+	net.Listener
+
+	trusted []*net.IPNet
+	timeout time.Duration
+}
+
+// Default time to wait for the PROXY header.
+const DefaultTimeout = 5 * time.Second
+
+// NewListener returns a listener which expects the PROXY header on
+// connections from the trusted networks, waiting at most timeout for it (or
+// DefaultTimeout, if it is 0).
+func NewListener(lis net.Listener, trusted []*net.IPNet,
+	timeout time.Duration) *Listener {
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	return &Listener{
+		Listener: lis,
+		trusted:  trusted,
+		timeout:  timeout,
+	}
+}
+
+// Accept the next connection. The PROXY header is not read here, but on the
+// first call to Read, RemoteAddr or LocalAddr on the returned connection, so
+// slow clients do not block the caller.
+func (l *Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	if !IsTrusted(conn.RemoteAddr(), l.trusted) {
+		return conn, nil
+	}
+	return &Conn{Conn: conn, timeout: l.timeout}, nil
+}
+
+// IsTrusted returns true if the address is in one of the networks.
+func IsTrusted(addr net.Addr, nets []*net.IPNet) bool {
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	default:
+		return false
+	}
+
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Conn is a connection which begins with a PROXY header.
+// The addresses it returns are the ones from the header.
+type Conn struct {
+	net.Conn
+
+	timeout time.Duration
+
+	once   sync.Once
+	r      *bufio.Reader
+	remote net.Addr
+	local  net.Addr
+	err    error
+
+	// Read deadline set by the user, to restore it after reading the header.
+	mu           sync.Mutex
+	readDeadline time.Time
+}
+
+func (c *Conn) readHeader() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+		c.r = bufio.NewReader(c.Conn)
+		c.remote, c.local, c.err = ReadHeader(c.r)
+
+		c.mu.Lock()
+		c.Conn.SetReadDeadline(c.readDeadline)
+		c.mu.Unlock()
+	})
+}
+
+// Read from the connection, after the PROXY header.
+func (c *Conn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+// RemoteAddr returns the source address from the PROXY header. If the header
+// did not have it (or could not be read), it returns the address of the
+// underlying connection.
+func (c *Conn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr returns the destination address from the PROXY header. If the
+// header did not have it (or could not be read), it returns the address of
+// the underlying connection.
+func (c *Conn) LocalAddr() net.Addr {
+	c.readHeader()
+	if c.local != nil {
+		return c.local
+	}
+	return c.Conn.LocalAddr()
+}
+
+// HeaderErr returns the error reading the PROXY header, if any.
+func (c *Conn) HeaderErr() error {
+	c.readHeader()
+	return c.err
+}
+
+// NetConn returns the underlying connection.
+func (c *Conn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	return c.Conn.SetReadDeadline(t)
+}
+
+// ReadHeader reads a PROXY header (version 1 or 2) from r, and returns the
+// source and destination addresses in it.
+// The addresses are nil if the header does not have them (e.g. for LOCAL
+// connections, or unknown protocols).
+func ReadHeader(r *bufio.Reader) (src, dst net.Addr, err error) {
+	b, err := r.Peek(1)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading PROXY header: %w", err)
+	}
+
+	switch b[0] {
+	case 'P':
+		return readV1(r)
+	case sigV2[0]:
+		return readV2(r)
+	default:
+		return nil, nil, errNoHeader
+	}
+}
+
+func readV1(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	// Note the client may be waiting for us after sending the header, so we
+	// can't read more than the line.
+	b, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull || len(b) > maxV1Len {
+		return nil, nil, errInvalid
+	} else if err != nil {
+		return nil, nil, fmt.Errorf("error reading PROXY header: %w", err)
+	}
+	line, ok := strings.CutSuffix(string(b), "\r\n")
+	if !ok {
+		return nil, nil, errInvalid
+	}
+
+	fields := strings.Split(line, " ")
+	if fields[0] != "PROXY" || len(fields) < 2 {
+		return nil, nil, errInvalid
+	}
+	if fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, errInvalid
+	}
+
+	src, err := parseV1Addr(fields[1], fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+	dst, err := parseV1Addr(fields[1], fields[3], fields[5])
+	if err != nil {
+		return nil, nil, err
+	}
+	return src, dst, nil
+}
+
+func parseV1Addr(proto, ipS, portS string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(ipS)
+	if ip == nil || (proto == "TCP6") != strings.Contains(ipS, ":") {
+		return nil, errInvalid
+	}
+	port, err := strconv.ParseUint(portS, 10, 16)
+	if err != nil {
+		return nil, errInvalid
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readV2(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, nil, fmt.Errorf("error reading PROXY header: %w", err)
+	}
+	if !bytes.Equal(hdr[:12], sigV2) || hdr[12]>>4 != 2 {
+		return nil, nil, errInvalid
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, nil, fmt.Errorf("error reading PROXY header: %w", err)
+	}
+
+	switch hdr[12] & 0xf {
+	case 0:
+		// LOCAL: the connection was not proxied (e.g. health checks).
+		return nil, nil, nil
+	case 1:
+		// PROXY.
+	default:
+		return nil, nil, errInvalid
+	}
+
+	var ipLen int
+	switch hdr[13] >> 4 {
+	case 1:
+		ipLen = net.IPv4len
+	case 2:
+		ipLen = net.IPv6len
+	default:
+		// Unix sockets or unspecified, we ignore the addresses.
+		return nil, nil, nil
+	}
+
+	if len(payload) < 2*ipLen+4 {
+		return nil, nil, errInvalid
+	}
+	srcIP := net.IP(payload[:ipLen])
+	dstIP := net.IP(payload[ipLen : 2*ipLen])
+	srcPort := int(binary.BigEndian.Uint16(payload[2*ipLen:]))
+	dstPort := int(binary.BigEndian.Uint16(payload[2*ipLen+2:]))
+
+	switch hdr[13] & 0xf {
+	case 1:
+		return &net.TCPAddr{IP: srcIP, Port: srcPort},
+			&net.TCPAddr{IP: dstIP, Port: dstPort}, nil
+	case 2:
+		return &net.UDPAddr{IP: srcIP, Port: srcPort},
+			&net.UDPAddr{IP: dstIP, Port: dstPort}, nil
+	default:
+		return nil, nil, nil
+	}
+}
+
+// Header returns a PROXY header of the given version (1 or 2), for a
+// connection between the given addresses.
+// If the addresses are not TCP, the header does not include them.
+func Header(version int, src, dst net.Addr) ([]byte, error) {
+	s, sok := src.(*net.TCPAddr)
+	d, dok := dst.(*net.TCPAddr)
+	ok := sok && dok
+
+	v4 := ok && s.IP.To4() != nil && d.IP.To4() != nil
+
+	switch version {
+	case 1:
+		if !ok {
+			return []byte("PROXY UNKNOWN\r\n"), nil
+		}
+		proto := "TCP6"
+		if v4 {
+			proto = "TCP4"
+		}
+		return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n",
+			proto, v1IP(s.IP, v4), v1IP(d.IP, v4), s.Port, d.Port)), nil
+	case 2:
+		buf := append([]byte{}, sigV2...)
+		if !ok {
+			// LOCAL command, no addresses.
+			return append(buf, 0x20, 0x00, 0, 0), nil
+		}
+
+		var addrs []byte
+		if v4 {
+			buf = append(buf, 0x21, 0x11)
+			addrs = append(addrs, s.IP.To4()...)
+			addrs = append(addrs, d.IP.To4()...)
+		} else {
+			buf = append(buf, 0x21, 0x21)
+			addrs = append(addrs, s.IP.To16()...)
+			addrs = append(addrs, d.IP.To16()...)
+		}
+		addrs = binary.BigEndian.AppendUint16(addrs, uint16(s.Port))
+		addrs = binary.BigEndian.AppendUint16(addrs, uint16(d.Port))
+
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(addrs)))
+		return append(buf, addrs...), nil
+	default:
+		return nil, fmt.Errorf("unknown PROXY protocol version %d", version)
+	}
+}
+
+// v1IP returns the textual representation of the IP address for version 1
+// headers, which need both addresses to be of the same family.
+func v1IP(ip net.IP, v4 bool) string {
+	if v4 {
+		return ip.To4().String()
+	}
+	if ip.To4() != nil {
+		// IPv4-mapped IPv6 address.
+		return "::ffff:" + ip.To4().String()
+	}
+	return ip.String()
+}
@@ -0,0 +1,164 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func tcpAddr(s string) *net.TCPAddr {
+	a, err := net.ResolveTCPAddr("tcp", s)
+	if err != nil {
+		panic(err)
+	}
+	return a
+}
+
+func TestRoundTrip(t *testing.T) {
+	cases := []struct {
+		src, dst *net.TCPAddr
+		v1       string
+	}{
+		{tcpAddr("1.2.3.4:1000"), tcpAddr("5.6.7.8:443"),
+			"PROXY TCP4 1.2.3.4 5.6.7.8 1000 443\r\n"},
+		{tcpAddr("[2001:db8::1]:1000"), tcpAddr("[2001:db8::2]:443"),
+			"PROXY TCP6 2001:db8::1 2001:db8::2 1000 443\r\n"},
+		{tcpAddr("1.2.3.4:1000"), tcpAddr("[2001:db8::2]:443"),
+			"PROXY TCP6 ::ffff:1.2.3.4 2001:db8::2 1000 443\r\n"},
+	}
+	for _, c := range cases {
+		for _, version := range []int{1, 2} {
+			hdr, err := Header(version, c.src, c.dst)
+			if err != nil {
+				t.Fatalf("v%d %v: %v", version, c.src, err)
+			}
+			if version == 1 && string(hdr) != c.v1 {
+				t.Errorf("v1 header: got %q, expected %q", hdr, c.v1)
+			}
+
+			r := bufio.NewReader(
+				io.MultiReader(bytes.NewReader(hdr), strings.NewReader("data")))
+			src, dst, err := ReadHeader(r)
+			if err != nil {
+				t.Fatalf("v%d %q: error reading: %v", version, hdr, err)
+			}
+			if !src.(*net.TCPAddr).IP.Equal(c.src.IP) ||
+				src.(*net.TCPAddr).Port != c.src.Port ||
+				!dst.(*net.TCPAddr).IP.Equal(c.dst.IP) ||
+				dst.(*net.TCPAddr).Port != c.dst.Port {
+				t.Errorf("v%d: got %v -> %v, expected %v -> %v",
+					version, src, dst, c.src, c.dst)
+			}
+			if rest, _ := io.ReadAll(r); string(rest) != "data" {
+				t.Errorf("v%d: data after header: %q", version, rest)
+			}
+		}
+	}
+}
+
+func TestNoAddresses(t *testing.T) {
+	unix := &net.UnixAddr{Name: "/sock", Net: "unix"}
+	for _, version := range []int{1, 2} {
+		hdr, err := Header(version, unix, unix)
+		if err != nil {
+			t.Fatalf("v%d: %v", version, err)
+		}
+		src, dst, err := ReadHeader(bufio.NewReader(bytes.NewReader(hdr)))
+		if src != nil || dst != nil || err != nil {
+			t.Errorf("v%d: got %v, %v, %v", version, src, dst, err)
+		}
+	}
+
+	if _, err := Header(3, unix, unix); err == nil {
+		t.Errorf("expected error on unknown version, got nil")
+	}
+}
+
+func TestInvalid(t *testing.T) {
+	cases := []string{
+		"",
+		"GET / HTTP/1.1\r\n",
+		"PROXY\r\n",
+		"PROXY TCP4 1.2.3.4 5.6.7.8 1000\r\n",
+		"PROXY TCP4 1.2.3.4 5.6.7.8 1000 443\n",
+		"PROXY TCP4 ::1 5.6.7.8 1000 443\r\n",
+		"PROXY TCP4 1.2.3.4 5.6.7.8 1000 99999\r\n",
+		"PROXY TCP5 1.2.3.4 5.6.7.8 1000 443\r\n",
+		"PROXY UNKNOWN " + strings.Repeat("x", 120) + "\r\n",
+		"\r\n\r\n\x00\r\nQUIT\n\x31\x11\x00\x00",
+		"\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x04abcd",
+		"\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x0c",
+	}
+	for _, c := range cases {
+		_, _, err := ReadHeader(bufio.NewReader(strings.NewReader(c)))
+		if err == nil {
+			t.Errorf("%q: expected error, got nil", c)
+		}
+	}
+}
+
+func TestListener(t *testing.T) {
+	tcpLis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcpLis.Close()
+
+	_, local, _ := net.ParseCIDR("127.0.0.0/8")
+	_, other, _ := net.ParseCIDR("10.0.0.0/8")
+
+	check := func(nets []*net.IPNet, send, expectedAddr, expectedData string) {
+		t.Helper()
+		lis := NewListener(tcpLis, nets, 100*time.Millisecond)
+
+		c, err := net.Dial("tcp", tcpLis.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		c.Write([]byte(send))
+
+		conn, err := lis.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		if expectedAddr == "" {
+			// The address of the underlying connection.
+			expectedAddr = c.LocalAddr().String()
+		}
+		if a := conn.RemoteAddr().String(); a != expectedAddr {
+			t.Errorf("%q: remote address %q, expected %q",
+				send, a, expectedAddr)
+		}
+		buf := make([]byte, 4)
+		n, _ := io.ReadFull(conn, buf)
+		if string(buf[:n]) != expectedData {
+			t.Errorf("%q: read %q, expected %q",
+				send, buf[:n], expectedData)
+		}
+	}
+
+	hdr := "PROXY TCP4 1.2.3.4 5.6.7.8 1000 443\r\n"
+
+	// Trusted source: the header is used.
+	check([]*net.IPNet{local}, hdr+"data", "1.2.3.4:1000", "data")
+
+	// Untrusted source: the connection is left alone.
+	check([]*net.IPNet{other}, hdr, "", "PROX")
+
+	// Trusted source which does not send the header.
+	check([]*net.IPNet{local}, "data", "", "")
+
+	// Trusted source which does not send anything, times out.
+	start := time.Now()
+	check([]*net.IPNet{local}, "", "", "")
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("took too long to time out: %v", d)
+	}
+}
@@ -33,23 +33,40 @@ type Event struct {
 	Status int
 	Length int64
 
+	// For raw requests and upgraded HTTP connections: bytes sent by the
+	// client, and by the backend. Length is their sum.
+	BytesUp   int64
+	BytesDown int64
+
+	// For upgraded HTTP connections, the protocol (e.g. "websocket").
+	Upgrade string
+
+	// For gRPC requests, the status code.
+	GRPCStatus string
+
+	// Authenticated user (or token subject), if any.
+	User string
+
 	Latency time.Duration
 }
 
 type RawRequest struct {
 	RemoteAddr net.Addr
 	LocalAddr  net.Addr
+
+	// Backend the request was forwarded to, if any.
+	Backend string
 }
 
 // Common log format, used by many servers.
 // https://en.wikipedia.org/wiki/Common_Log_Format
 // https://httpd.apache.org/docs/2.4/logs.html#common
-const commonFormat = "{{.H.RemoteAddr}} - - [{{.T.Format \"02/Jan/2006:15:04:05 -0700\"}}] \"{{.H.Method}} {{.H.URL}} {{.H.Proto}}\" {{.Status}} {{.Length}}\n"
+const commonFormat = "{{.H.RemoteAddr}} - {{if .User}}{{.User}}{{else}}-{{end}} [{{.T.Format \"02/Jan/2006:15:04:05 -0700\"}}] \"{{.H.Method}} {{.H.URL}} {{.H.Proto}}\" {{.Status}} {{.Length}}\n"
 
 // Combined log format, extension of the Common Log Format, and used by a lot
 // of servers (e.g. Apache).
 // https://httpd.apache.org/docs/2.4/logs.html#combined
-const combinedFormat = "{{.H.RemoteAddr}} - - [{{.T.Format \"02/Jan/2006:15:04:05 -0700\"}}] \"{{.H.Method}} {{.H.URL}} {{.H.Proto}}\" {{.Status}} {{.Length}} {{.H.Header.Referer|q}} {{index .H.Header \"User-Agent\"|q}}\n"
+const combinedFormat = "{{.H.RemoteAddr}} - {{if .User}}{{.User}}{{else}}-{{end}} [{{.T.Format \"02/Jan/2006:15:04:05 -0700\"}}] \"{{.H.Method}} {{.H.URL}} {{.H.Proto}}\" {{.Status}} {{.Length}} {{.H.Header.Referer|q}} {{index .H.Header \"User-Agent\"|q}}\n"
 
 // Extension of the combined log format, prepending the virtual host.
 // https://httpd.apache.org/docs/2.4/logs.html#virtualhost
@@ -57,15 +74,20 @@ const combinedVHFormat = "{{.H.Host}} " + combinedFormat
 
 // lighttpd log is like combined, but the virtual host is put instead of the
 // ident field.
-const lighttpdFormat = "{{.H.RemoteAddr}} {{.H.Host}} - [{{.T.Format \"02/Jan/2006:15:04:05 -0700\"}}] \"{{.H.Method}} {{.H.URL}} {{.H.Proto}}\" {{.Status}} {{.Length}}\n"
+const lighttpdFormat = "{{.H.RemoteAddr}} {{.H.Host}} {{if .User}}{{.User}}{{else}}-{{end}} [{{.T.Format \"02/Jan/2006:15:04:05 -0700\"}}] \"{{.H.Method}} {{.H.URL}} {{.H.Proto}}\" {{.Status}} {{.Length}}\n"
 
 // gofer format, this is the default, and can handle both raw and HTTP events.
 const goferFormat = "{{.T.Format \"2006-01-02 15:04:05.000\"}}" +
 	"{{if .H}} {{.H.RemoteAddr}} {{.H.Proto}}" +
 	" {{if .H.Host}}{{.H.Host}}{{else}}-{{end}} {{.H.Method}}" +
 	" {{.H.URL}} {{.H.Header.Referer|q}} {{index .H.Header \"User-Agent\"|q}}{{end}}" +
-	"{{if .R}} {{.R.RemoteAddr}} raw {{.R.LocalAddr}}{{end}}" +
-	" = {{.Status}} {{.Length}}b {{.Latency.Milliseconds}}ms\n"
+	"{{if .User}} user:{{.User|q}}{{end}}" +
+	"{{if .R}} {{.R.RemoteAddr}} raw {{.R.LocalAddr}}" +
+	"{{if .R.Backend}} -> {{.R.Backend}}{{end}}{{end}}" +
+	" = {{.Status}} {{.Length}}b {{.Latency.Milliseconds}}ms" +
+	"{{if .GRPCStatus}} grpc:{{.GRPCStatus}}{{end}}" +
+	"{{if .Upgrade}} upgrade:{{.Upgrade|q}}{{end}}" +
+	"{{if or .R .Upgrade}} up:{{.BytesUp}}b down:{{.BytesDown}}b{{end}}\n"
 
 var knownFormats = map[string]string{
 	"<common>":     commonFormat,
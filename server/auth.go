@@ -1,6 +1,7 @@
 package server
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"math/rand"
@@ -44,6 +45,7 @@ func (a *AuthWrapper) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if dbPass, ok := a.users.Plain[user]; ok {
 		if pass == dbPass {
 			tr.Printf("auth for %q successful", user)
+			setAuthUser(r, user)
 			a.handler.ServeHTTP(w, r)
 		} else {
 			tr.Printf("incorrect password (plain) for %q", user)
@@ -58,6 +60,7 @@ func (a *AuthWrapper) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		shaPass := hex.EncodeToString(buf[:])
 		if shaPass == dbPass {
 			tr.Printf("auth for %q successful", user)
+			setAuthUser(r, user)
 			a.handler.ServeHTTP(w, r)
 		} else {
 			tr.Printf("incorrect password (sha256) for %q", user)
@@ -91,3 +94,22 @@ func LoadAuthFile(path string) (*AuthDB, error) {
 	err = yaml.Unmarshal(buf, &db)
 	return db, err
 }
+
+// The authenticated user is stored in the request context, so the
+// authentication handlers can make it available to the logging wrapper which
+// sits above them (see WithLogging).
+type authUserKeyT string
+
+const authUserKey = authUserKeyT("authuser")
+
+func withAuthUser(r *http.Request) (*http.Request, *string) {
+	user := new(string)
+	return r.WithContext(context.WithValue(r.Context(), authUserKey, user)),
+		user
+}
+
+func setAuthUser(r *http.Request, name string) {
+	if user, ok := r.Context().Value(authUserKey).(*string); ok {
+		*user = name
+	}
+}
@@ -0,0 +1,167 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"blitiri.com.ar/go/gofer/config"
+	"blitiri.com.ar/go/gofer/trace"
+)
+
+// Defaults for connecting to the backends, and checking their health.
+var (
+	connectTimeout      = 10 * time.Second
+	healthCheckInterval = 10 * time.Second
+	healthCheckTimeout  = 2 * time.Second
+)
+
+var errNoBackends = errors.New("no backends")
+
+// backendPool selects which backends to use for each connection.
+type backendPool struct {
+	addrs          []string
+	first          bool
+	connectTimeout time.Duration
+
+	// Round-robin position.
+	next atomic.Uint64
+
+	// Backends that failed their last health check.
+	down []atomic.Bool
+}
+
+func newBackendPool(addr string, conf config.Raw) *backendPool {
+	b := &backendPool{
+		addrs:          conf.Addrs(),
+		first:          conf.Balance == "first",
+		connectTimeout: conf.ConnectTimeout,
+	}
+	b.down = make([]atomic.Bool, len(b.addrs))
+	if b.connectTimeout == 0 {
+		b.connectTimeout = connectTimeout
+	}
+
+	if conf.HealthCheck != nil {
+		go b.healthCheckLoop(addr, *conf.HealthCheck)
+	}
+	return b
+}
+
+// order returns the backends in the order they should be tried for a new
+// connection. The ones that are down go last, in case the health checks are
+// wrong.
+func (b *backendPool) order() []string {
+	if len(b.addrs) == 0 {
+		return nil
+	}
+
+	start := 0
+	if !b.first {
+		start = int((b.next.Add(1) - 1) % uint64(len(b.addrs)))
+	}
+
+	up := make([]string, 0, len(b.addrs))
+	down := []string{}
+	for i := range b.addrs {
+		j := (start + i) % len(b.addrs)
+		if b.down[j].Load() {
+			down = append(down, b.addrs[j])
+		} else {
+			up = append(up, b.addrs[j])
+		}
+	}
+	return append(up, down...)
+}
+
+// dial the backends in order, returning the first connection that succeeds,
+// and the address of the backend it is connected to.
+// If prefix is not empty, it is sent first on the connections (before the
+// TLS handshake, if any); this is used for PROXY headers.
+// If tlsConf is not nil, the connections use TLS with that configuration.
+func (b *backendPool) dial(tr *trace.Trace, network string, addrs []string,
+	prefix []byte, tlsConf *tls.Config) (net.Conn, string, error) {
+	err := errNoBackends
+	for _, addr := range addrs {
+		var conn net.Conn
+		conn, err = b.dialOne(network, addr, prefix, tlsConf)
+		if err == nil {
+			tr.Printf("dial complete: %v -> %v (%s)",
+				conn.LocalAddr(), conn.RemoteAddr(), addr)
+			return conn, addr, nil
+		}
+		tr.Errorf("error dialing %s: %v", addr, err)
+	}
+	return nil, "", err
+}
+
+func (b *backendPool) dialOne(network, addr string, prefix []byte,
+	tlsConf *tls.Config) (net.Conn, error) {
+	netw, a := dialAddr(network, addr)
+	conn, err := net.DialTimeout(netw, a, b.connectTimeout)
+	if err != nil || (len(prefix) == 0 && tlsConf == nil) {
+		return conn, err
+	}
+
+	// Sending the prefix and the handshake are bound by the connect timeout
+	// too.
+	conn.SetDeadline(time.Now().Add(b.connectTimeout))
+	if len(prefix) > 0 {
+		if _, err = conn.Write(prefix); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if tlsConf != nil {
+		if tlsConf.ServerName == "" {
+			// Like tls.Dial, verify against the host we are dialing.
+			tlsConf = tlsConf.Clone()
+			tlsConf.ServerName = a
+			if i := strings.LastIndex(a, ":"); i >= 0 {
+				tlsConf.ServerName = a[:i]
+			}
+		}
+		tconn := tls.Client(conn, tlsConf)
+		if err = tconn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tconn
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+func (b *backendPool) healthCheckLoop(addr string, conf config.HealthCheck) {
+	interval, timeout := conf.Interval, conf.Timeout
+	if interval == 0 {
+		interval = healthCheckInterval
+	}
+	if timeout == 0 {
+		timeout = healthCheckTimeout
+	}
+
+	tr := trace.New("raw", fmt.Sprintf("%s health checks", addr))
+	tr.SetMaxEvents(1000)
+
+	for ; ; time.Sleep(interval) {
+		for i, backend := range b.addrs {
+			netw, a := dialAddr("tcp", backend)
+			conn, err := net.DialTimeout(netw, a, timeout)
+			if err == nil {
+				conn.Close()
+			}
+
+			wasDown := b.down[i].Swap(err != nil)
+			if err != nil && !wasDown {
+				tr.Errorf("%s is down: %v", backend, err)
+			} else if err == nil && wasDown {
+				tr.Printf("%s is up", backend)
+			}
+		}
+	}
+}
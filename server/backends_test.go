@@ -0,0 +1,125 @@
+package server
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"blitiri.com.ar/go/gofer/config"
+	"blitiri.com.ar/go/gofer/trace"
+)
+
+func TestBackendOrder(t *testing.T) {
+	check := func(b *backendPool, expected ...string) {
+		t.Helper()
+		if got := b.order(); !reflect.DeepEqual(got, expected) {
+			t.Errorf("got %v, expected %v", got, expected)
+		}
+	}
+
+	b := newBackendPool("test", config.Raw{Backends: []string{"a", "b", "c"}})
+	check(b, "a", "b", "c")
+	check(b, "b", "c", "a")
+	check(b, "c", "a", "b")
+	check(b, "a", "b", "c")
+
+	// The backends that are down go last.
+	b.down[1].Store(true)
+	check(b, "c", "a", "b")
+	check(b, "c", "a", "b")
+	check(b, "a", "c", "b")
+
+	b = newBackendPool("test", config.Raw{
+		Backends: []string{"a", "b", "c"}, Balance: "first"})
+	check(b, "a", "b", "c")
+	check(b, "a", "b", "c")
+	b.down[0].Store(true)
+	check(b, "b", "c", "a")
+
+	b = newBackendPool("test", config.Raw{To: "x"})
+	check(b, "x")
+
+	b = newBackendPool("test", config.Raw{})
+	if got := b.order(); got != nil {
+		t.Errorf("expected no backends, got %v", got)
+	}
+}
+
+// closedAddr returns an address where nothing is listening.
+func closedAddr(t *testing.T) string {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := lis.Addr().String()
+	lis.Close()
+	return addr
+}
+
+func TestBackendFailover(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+
+	bad := closedAddr(t)
+	good := lis.Addr().String()
+	b := newBackendPool("test", config.Raw{
+		Backends:       []string{bad, good},
+		Balance:        "first",
+		ConnectTimeout: time.Second,
+	})
+
+	tr := trace.New("test", "failover")
+	defer tr.Finish()
+
+	conn, addr, err := b.dial(tr, "tcp", b.order(), nil, nil)
+	if err != nil {
+		t.Fatalf("error dialing: %v", err)
+	}
+	conn.Close()
+	if addr != good {
+		t.Errorf("connected to %q, expected %q", addr, good)
+	}
+
+	if _, _, err := b.dial(tr, "tcp", []string{bad}, nil, nil); err == nil {
+		t.Errorf("expected error dialing %q", bad)
+	}
+	if _, _, err := b.dial(tr, "tcp", nil, nil, nil); err != errNoBackends {
+		t.Errorf("expected errNoBackends, got %v", err)
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+
+	bad := closedAddr(t)
+	good := lis.Addr().String()
+	b := newBackendPool("test", config.Raw{
+		Backends: []string{bad, good},
+		Balance:  "first",
+		HealthCheck: &config.HealthCheck{
+			Interval: 10 * time.Millisecond,
+			Timeout:  time.Second,
+		},
+	})
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !b.down[0].Load() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !b.down[0].Load() || b.down[1].Load() {
+		t.Errorf("unexpected health: %v down, %v down",
+			b.down[0].Load(), b.down[1].Load())
+	}
+	if got := b.order(); got[0] != good {
+		t.Errorf("expected %q first, got %v", good, got)
+	}
+}
@@ -0,0 +1,368 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"blitiri.com.ar/go/gofer/config"
+	"blitiri.com.ar/go/gofer/trace"
+)
+
+// How long to wait for the CGI's output to be closed after it exits, or
+// after it was killed.
+var cgiWaitDelay = time.Second
+
+// Environment variables that are always inherited, if set.
+var cgiDefaultInheritEnv = []string{"PATH", "LD_LIBRARY_PATH"}
+
+// Default PATH for the CGIs, when we don't have one.
+const cgiDefaultPath = "/bin:/usr/bin:/usr/local/bin"
+
+var errCGIQueueFull = errors.New("too many requests queued")
+
+// cgiHandler runs a CGI program for each request.
+type cgiHandler struct {
+	path string
+	cmd  []string
+	opts config.CGIOpts
+
+	// Environment that is the same for all requests.
+	env []string
+
+	// User and group to run as; -1 to leave them unchanged.
+	uid, gid int
+
+	lim *cgiLimiter
+}
+
+func makeCGI(path string, cmd []string, opts config.CGIOpts) (
+	http.Handler, error) {
+	h := &cgiHandler{
+		path: strings.TrimSuffix(stripDomain(path), "/"),
+		cmd:  slices.Clone(cmd),
+		opts: opts,
+		uid:  -1,
+		gid:  -1,
+		lim:  newCGILimiter(opts.MaxConcurrent, opts.MaxQueue),
+	}
+
+	// The command is relative to our working directory, not the CGI's.
+	var err error
+	h.cmd[0], err = filepath.Abs(cmd[0])
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.User != "" {
+		h.uid, h.gid, err = lookupCGIUser(opts.User)
+		if err != nil {
+			return nil, fmt.Errorf("error looking up user %q: %v",
+				opts.User, err)
+		}
+	}
+
+	env := map[string]string{"PATH": cgiDefaultPath}
+	for _, name := range slices.Concat(cgiDefaultInheritEnv, opts.InheritEnv) {
+		if v, ok := os.LookupEnv(name); ok {
+			env[name] = v
+		}
+	}
+	for k, v := range opts.Env {
+		env[k] = v
+	}
+	h.env = envList(env)
+
+	return h, nil
+}
+
+func (h *cgiHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	tr, _ := trace.FromContext(r.Context())
+
+	// The whole request, including the time waiting in the queue, is
+	// bounded by the timeout.
+	ctx := r.Context()
+	if h.opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.opts.Timeout)
+		defer cancel()
+	}
+
+	if err := h.lim.acquire(ctx, tr); err != nil {
+		tr.Printf("not running cgi: %v", err)
+		if err == errCGIQueueFull {
+			tr.SetError()
+			http.Error(w, "too many requests", http.StatusServiceUnavailable)
+		} else {
+			http.Error(w, "timeout", http.StatusServiceUnavailable)
+		}
+		return
+	}
+	defer h.lim.release()
+
+	// If the context is done (the client went away, or the timeout
+	// expired), the process is killed.
+	cmd := exec.CommandContext(ctx, h.cmd[0], h.cmd[1:]...)
+	cmd.Dir = h.opts.Dir
+	if cmd.Dir == "" {
+		cmd.Dir = filepath.Dir(h.cmd[0])
+	}
+	cmd.Env = slices.Concat(h.env, h.requestEnv(r))
+	cmd.Stderr = tr
+	cmd.WaitDelay = cgiWaitDelay
+	if r.ContentLength != 0 {
+		cmd.Stdin = r.Body
+	}
+	if err := setProcAttr(cmd, h.uid, h.gid); err != nil {
+		tr.Errorf("error setting process attributes: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if h.opts.MaxCPU > 0 || h.opts.MaxMemory > 0 {
+		err := setRlimits(cmd, h.opts.MaxCPU, h.opts.MaxMemory)
+		if err != nil {
+			tr.Errorf("error setting limits: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err == nil {
+		err = cmd.Start()
+	}
+	if err != nil {
+		tr.Errorf("error starting cgi: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	start := time.Now()
+	tr.Printf("exec %q, pid %d", h.cmd, cmd.Process.Pid)
+
+	err = h.copyResponse(ctx, w, stdout, tr)
+	if err != nil {
+		cmd.Cancel()
+	}
+
+	err = cmd.Wait()
+	if err != nil && ctx.Err() != nil {
+		tr.Errorf("cgi killed: %v", ctx.Err())
+	} else if err != nil {
+		tr.Errorf("cgi exited with error: %v", err)
+	}
+	if cmd.ProcessState != nil {
+		tr.Printf("cgi finished after %v (user %v, sys %v)",
+			time.Since(start).Round(time.Millisecond),
+			cmd.ProcessState.UserTime(), cmd.ProcessState.SystemTime())
+	}
+}
+
+// copyResponse reads the CGI response headers from its output, and writes
+// the response.
+func (h *cgiHandler) copyResponse(ctx context.Context, w http.ResponseWriter,
+	stdout io.Reader, tr *trace.Trace) error {
+	tp := textproto.NewReader(bufio.NewReader(stdout))
+	mh, err := tp.ReadMIMEHeader()
+	if err != nil {
+		tr.Errorf("error reading cgi headers: %v", err)
+		if ctx.Err() == context.DeadlineExceeded {
+			http.Error(w, "timeout", http.StatusGatewayTimeout)
+		} else {
+			http.Error(w, "internal error", http.StatusInternalServerError)
+		}
+		return err
+	}
+	header := http.Header(mh)
+
+	status := http.StatusOK
+	if s := header.Get("Status"); s != "" {
+		code, _, _ := strings.Cut(s, " ")
+		status, err = strconv.Atoi(code)
+		if err != nil || status < 100 || status > 999 {
+			tr.Errorf("invalid cgi status %q", s)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return fmt.Errorf("invalid status %q", s)
+		}
+		header.Del("Status")
+	} else if header.Get("Location") != "" {
+		status = http.StatusFound
+	}
+
+	for k, vs := range header {
+		w.Header()[k] = vs
+	}
+	w.WriteHeader(status)
+
+	_, err = io.Copy(w, tp.R)
+	if err != nil {
+		tr.Printf("error copying body: %v", err)
+	}
+	return err
+}
+
+// requestEnv returns the environment variables for the request.
+func (h *cgiHandler) requestEnv(r *http.Request) []string {
+	p := cgiParams(r)
+	p["SCRIPT_NAME"] = h.path
+	p["SCRIPT_FILENAME"] = h.cmd[0]
+	p["PATH_INFO"] = strings.TrimPrefix(r.URL.Path, h.path)
+	return envList(p)
+}
+
+// cgiParams returns the request meta-variables, as per RFC 3875, which are
+// common to CGI and FastCGI. The script-related ones are left to the
+// caller.
+func cgiParams(r *http.Request) map[string]string {
+	p := map[string]string{
+		"GATEWAY_INTERFACE": "CGI/1.1",
+		"SERVER_SOFTWARE":   "gofer",
+		"SERVER_PROTOCOL":   r.Proto,
+		"REQUEST_METHOD":    r.Method,
+		"REQUEST_URI":       r.URL.RequestURI(),
+		"QUERY_STRING":      r.URL.RawQuery,
+		"REQUEST_SCHEME":    "http",
+	}
+	if r.TLS != nil {
+		p["HTTPS"] = "on"
+		p["REQUEST_SCHEME"] = "https"
+	}
+
+	if host, port, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		p["REMOTE_ADDR"] = host
+		p["REMOTE_PORT"] = port
+	} else {
+		p["REMOTE_ADDR"] = r.RemoteAddr
+	}
+
+	p["SERVER_NAME"] = r.Host
+	if host, _, err := net.SplitHostPort(r.Host); err == nil {
+		p["SERVER_NAME"] = host
+	}
+	if a, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		if _, port, err := net.SplitHostPort(a.String()); err == nil {
+			p["SERVER_PORT"] = port
+		}
+	}
+
+	if r.ContentLength >= 0 {
+		p["CONTENT_LENGTH"] = strconv.FormatInt(r.ContentLength, 10)
+	}
+	if ct := r.Header.Get("Content-Type"); ct != "" {
+		p["CONTENT_TYPE"] = ct
+	}
+
+	p["HTTP_HOST"] = r.Host
+	for k, vs := range r.Header {
+		// Don't pass the Proxy header, it could set HTTP_PROXY in the
+		// environment of the scripts (https://httpoxy.org).
+		if k == "Proxy" || k == "Content-Type" || k == "Content-Length" {
+			continue
+		}
+		k = "HTTP_" + strings.ToUpper(strings.ReplaceAll(k, "-", "_"))
+		p[k] = strings.Join(vs, ", ")
+	}
+
+	return p
+}
+
+// envList returns the variables in the map as a sorted "k=v" list.
+func envList(m map[string]string) []string {
+	env := make([]string, 0, len(m))
+	for k, v := range m {
+		env = append(env, k+"="+v)
+	}
+	sort.Strings(env)
+	return env
+}
+
+// lookupCGIUser returns the uid and gid to run as, for a user given as
+// "user", "user:group" or ":group". If the group is not given, the user's
+// primary group is used; if the user is not given, our own.
+func lookupCGIUser(owner string) (int, int, error) {
+	uid, gid, err := lookupOwner(owner)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if uid == -1 {
+		uid = os.Getuid()
+	}
+	if gid == -1 {
+		u, err := user.LookupId(strconv.Itoa(uid))
+		if err != nil {
+			return 0, 0, err
+		}
+		gid, _ = strconv.Atoi(u.Gid)
+	}
+	return uid, gid, nil
+}
+
+// cgiLimiter limits how many CGI processes run at the same time, and how
+// many requests can wait for their turn. A nil limiter has no limits.
+type cgiLimiter struct {
+	slots    chan struct{}
+	maxQueue int32
+	queued   atomic.Int32
+}
+
+func newCGILimiter(max, maxQueue int) *cgiLimiter {
+	if max == 0 {
+		return nil
+	}
+	return &cgiLimiter{
+		slots:    make(chan struct{}, max),
+		maxQueue: int32(maxQueue),
+	}
+}
+
+// acquire a slot, waiting for one if necessary. Returns an error if the
+// queue is full, or the context is done while waiting.
+func (l *cgiLimiter) acquire(ctx context.Context, tr *trace.Trace) error {
+	if l == nil {
+		return nil
+	}
+
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	n := l.queued.Add(1)
+	defer l.queued.Add(-1)
+	if l.maxQueue > 0 && n > l.maxQueue {
+		return errCGIQueueFull
+	}
+
+	tr.Printf("waiting for a cgi slot (%d queued)", n)
+	start := time.Now()
+	select {
+	case l.slots <- struct{}{}:
+		tr.Printf("got cgi slot after %v", time.Since(start))
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l *cgiLimiter) release() {
+	if l == nil {
+		return
+	}
+	<-l.slots
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"blitiri.com.ar/go/gofer/config"
+)
+
+// setProcAttr makes the command run in its own process group, so it is
+// killed along with its children; and as the given user and group, unless
+// uid is -1.
+func setProcAttr(cmd *exec.Cmd, uid, gid int) error {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if uid != -1 {
+		cmd.SysProcAttr.Credential = &syscall.Credential{
+			Uid: uint32(uid),
+			Gid: uint32(gid),
+		}
+	}
+
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	return nil
+}
+
+// Environment variable that tells our own binary to run as the rlimit
+// helper. Its value is "<cpu seconds>:<memory bytes>".
+const rlimitHelperEnv = "GOFER_CGI_RLIMITS"
+
+// setRlimits makes the command run with the given CPU time and address
+// space limits. Limits that are 0 are left unchanged.
+//
+// The limits have to be in place before the command starts running, so
+// instead of running it directly, we run our own binary as a helper that
+// sets them on itself, and then executes the command (see rlimitHelper).
+func setRlimits(cmd *exec.Cmd, cpu time.Duration, mem config.ByteSize) error {
+	// RLIMIT_CPU is in seconds, round up so it's never 0.
+	secs := uint64((cpu + time.Second - 1) / time.Second)
+
+	cmd.Env = append(cmd.Env,
+		fmt.Sprintf("%s=%d:%d", rlimitHelperEnv, secs, mem))
+	cmd.Args = append([]string{"gofer-cgi-rlimits", cmd.Path}, cmd.Args...)
+	cmd.Path = "/proc/self/exe"
+	return nil
+}
+
+func init() {
+	if spec, ok := os.LookupEnv(rlimitHelperEnv); ok {
+		err := rlimitHelper(spec)
+		fmt.Fprintf(os.Stderr, "gofer cgi rlimit helper: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// rlimitHelper sets the limits given in spec, and then executes the
+// command given in os.Args[1:] (path, and then the arguments).
+// It only returns on errors.
+func rlimitHelper(spec string) error {
+	os.Unsetenv(rlimitHelperEnv)
+
+	var cpu, mem uint64
+	_, err := fmt.Sscanf(spec, "%d:%d", &cpu, &mem)
+	if err != nil {
+		return fmt.Errorf("invalid limits %q: %v", spec, err)
+	}
+	if len(os.Args) < 3 {
+		return errors.New("missing command")
+	}
+
+	if cpu > 0 {
+		err = syscall.Setrlimit(syscall.RLIMIT_CPU,
+			&syscall.Rlimit{Cur: cpu, Max: cpu})
+		if err != nil {
+			return fmt.Errorf("error setting cpu limit: %v", err)
+		}
+	}
+	if mem > 0 {
+		err = syscall.Setrlimit(syscall.RLIMIT_AS,
+			&syscall.Rlimit{Cur: mem, Max: mem})
+		if err != nil {
+			return fmt.Errorf("error setting memory limit: %v", err)
+		}
+	}
+
+	return syscall.Exec(os.Args[1], os.Args[2:], os.Environ())
+}
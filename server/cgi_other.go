@@ -0,0 +1,24 @@
+//go:build !linux
+
+package server
+
+import (
+	"errors"
+	"os/exec"
+	"time"
+
+	"blitiri.com.ar/go/gofer/config"
+)
+
+var errCGIUnsupported = errors.New("not supported on this platform")
+
+func setProcAttr(cmd *exec.Cmd, uid, gid int) error {
+	if uid != -1 {
+		return errCGIUnsupported
+	}
+	return nil
+}
+
+func setRlimits(cmd *exec.Cmd, cpu time.Duration, mem config.ByteSize) error {
+	return errCGIUnsupported
+}
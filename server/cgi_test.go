@@ -0,0 +1,253 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"blitiri.com.ar/go/gofer/config"
+)
+
+// writeScript writes a shell script to a temporary directory, and returns
+// its path.
+func writeScript(t *testing.T, body string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "script.sh")
+	err := os.WriteFile(path, []byte("#!/bin/sh\n"+body), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func cgiServer(t *testing.T, path string, cmd []string,
+	opts config.CGIOpts) *httptest.Server {
+	t.Helper()
+	h, err := makeCGI(path, cmd, opts)
+	if err != nil {
+		t.Fatalf("error making cgi: %v", err)
+	}
+	srv := httptest.NewServer(WithTrace("test", h))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func cgiGet(t *testing.T, url string, body string) (*http.Response, string) {
+	t.Helper()
+	method := "GET"
+	if body != "" {
+		method = "POST"
+	}
+	req, _ := http.NewRequest(method, url, strings.NewReader(body))
+	req.Header.Set("X-Test", "test")
+	req.Header.Set("Proxy", "http://evil/")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	return resp, string(b)
+}
+
+func TestCGI(t *testing.T) {
+	script := writeScript(t, `
+echo "Status: 201 Created"
+echo "X-Args: $*"
+echo
+env
+echo "PWD=$(pwd)"
+echo "BODY=$(cat)"
+`)
+	t.Setenv("GOFER_TEST_INHERITED", "inherited")
+	t.Setenv("GOFER_TEST_NOT_INHERITED", "oops")
+
+	opts := config.CGIOpts{
+		Env:        map[string]string{"EXTRA": "extra"},
+		InheritEnv: []string{"GOFER_TEST_INHERITED"},
+		Dir:        "/",
+	}
+	srv := cgiServer(t, "example.com/cgi/", []string{script, "a", "b"}, opts)
+
+	resp, body := cgiGet(t, srv.URL+"/cgi/x/y?q=1", "hola")
+	if resp.StatusCode != 201 || resp.Header.Get("X-Args") != "a b" {
+		t.Errorf("unexpected response: %d %v", resp.StatusCode, resp.Header)
+	}
+	if resp.Header.Get("Status") != "" {
+		t.Errorf("status header was not removed")
+	}
+
+	env := map[string]string{}
+	for _, l := range strings.Split(body, "\n") {
+		k, v, _ := strings.Cut(l, "=")
+		env[k] = v
+	}
+	expected := map[string]string{
+		"SCRIPT_NAME":          "/cgi",
+		"SCRIPT_FILENAME":      script,
+		"PATH_INFO":            "/x/y",
+		"QUERY_STRING":         "q=1",
+		"REQUEST_METHOD":       "POST",
+		"REQUEST_URI":          "/cgi/x/y?q=1",
+		"CONTENT_LENGTH":       "4",
+		"HTTP_X_TEST":          "test",
+		"HTTP_PROXY":           "",
+		"EXTRA":                "extra",
+		"GOFER_TEST_INHERITED": "inherited",
+		"PATH":                 os.Getenv("PATH"),
+		"PWD":                  "/",
+		"BODY":                 "hola",
+	}
+	for k, v := range expected {
+		if env[k] != v {
+			t.Errorf("%s: got %q, expected %q", k, env[k], v)
+		}
+	}
+	if _, ok := env["GOFER_TEST_NOT_INHERITED"]; ok {
+		t.Errorf("environment variable was inherited")
+	}
+
+	// By default, the working directory is the one of the script.
+	srv = cgiServer(t, "/", []string{script}, config.CGIOpts{})
+	_, body = cgiGet(t, srv.URL+"/", "")
+	if !strings.Contains(body, "PWD="+filepath.Dir(script)+"\n") {
+		t.Errorf("unexpected working directory: %q", body)
+	}
+}
+
+func TestCGIBadOutput(t *testing.T) {
+	cases := map[string]int{
+		`echo "Location: /x"; echo`:            http.StatusFound,
+		`echo "Status: lala"; echo`:            http.StatusInternalServerError,
+		`echo "Content-Type: text/plain"`:      http.StatusInternalServerError,
+		`exit 1`:                               http.StatusInternalServerError,
+		`echo "Content-Type: x"; echo; exit 1`: http.StatusOK,
+	}
+	for script, status := range cases {
+		srv := cgiServer(t, "/", []string{writeScript(t, script)},
+			config.CGIOpts{})
+		resp, err := noRedirects.Get(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != status {
+			t.Errorf("%q: got %d, expected %d", script, resp.StatusCode, status)
+		}
+	}
+
+	// Missing command.
+	srv := cgiServer(t, "/", []string{"/doesnotexist"}, config.CGIOpts{})
+	resp, _ := cgiGet(t, srv.URL, "")
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("missing command: got %d", resp.StatusCode)
+	}
+
+	// Unknown user.
+	_, err := makeCGI("/", []string{"/bin/true"},
+		config.CGIOpts{User: "doesnotexist-lalala"})
+	if err == nil {
+		t.Errorf("expected error with unknown user")
+	}
+}
+
+var noRedirects = &http.Client{
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+func TestCGITimeout(t *testing.T) {
+	script := writeScript(t, `echo "Content-Type: text/plain"; echo; sleep 10`)
+	srv := cgiServer(t, "/", []string{script},
+		config.CGIOpts{Timeout: 100 * time.Millisecond})
+	start := time.Now()
+	resp, _ := cgiGet(t, srv.URL, "")
+	if resp.StatusCode != 200 || time.Since(start) > cgiWaitDelay {
+		t.Errorf("got %d after %v", resp.StatusCode, time.Since(start))
+	}
+
+	// Timeout before the headers are sent.
+	script = writeScript(t, `sleep 10`)
+	srv = cgiServer(t, "/", []string{script},
+		config.CGIOpts{Timeout: 100 * time.Millisecond})
+	resp, _ = cgiGet(t, srv.URL, "")
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("expected 504, got %d", resp.StatusCode)
+	}
+}
+
+func TestCGILimits(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("rlimits are only supported on linux")
+	}
+
+	// The script gets the limits from the start, and can't tell it was run
+	// via the rlimit helper.
+	script := writeScript(t, `echo "Content-Type: text/plain"; echo
+		ulimit -t; ulimit -v; echo "$0 ${GOFER_CGI_RLIMITS-unset}"`)
+	opts := config.CGIOpts{
+		MaxCPU:    1500 * time.Millisecond,
+		MaxMemory: 512 << 20,
+	}
+	srv := cgiServer(t, "/", []string{script}, opts)
+	_, body := cgiGet(t, srv.URL, "")
+	if body != "2\n524288\n"+script+" unset\n" {
+		t.Errorf("unexpected limits: %q", body)
+	}
+}
+
+func TestCGIConcurrency(t *testing.T) {
+	// The script waits until the file exists, so we can control when they
+	// finish.
+	dir := t.TempDir()
+	done := filepath.Join(dir, "done")
+	script := writeScript(t, `
+while ! test -e `+done+`; do sleep 0.01; done
+echo "Content-Type: text/plain"; echo; echo ok`)
+
+	opts := config.CGIOpts{MaxConcurrent: 1, MaxQueue: 1}
+	h, err := makeCGI("/", []string{script}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lim := h.(*cgiHandler).lim
+	srv := httptest.NewServer(WithTrace("test", h))
+	defer srv.Close()
+
+	// One running, one queued.
+	wg := sync.WaitGroup{}
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, body := cgiGet(t, srv.URL, "")
+			if resp.StatusCode != 200 || body != "ok\n" {
+				t.Errorf("unexpected response: %d %q", resp.StatusCode, body)
+			}
+		}()
+	}
+	for len(lim.slots) != 1 || lim.queued.Load() != 1 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The queue is full.
+	resp, _ := cgiGet(t, srv.URL, "")
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected 503, got %d", resp.StatusCode)
+	}
+
+	os.WriteFile(done, nil, 0600)
+	wg.Wait()
+	if len(lim.slots) != 0 || lim.queued.Load() != 0 {
+		t.Errorf("limiter not released: %d %d",
+			len(lim.slots), lim.queued.Load())
+	}
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"net"
+	"sync"
+)
+
+// connLimiter limits the number of concurrent connections, in total and per
+// IP. A limit of 0 means no limit.
+type connLimiter struct {
+	max, maxPerIP int
+
+	mu    sync.Mutex
+	total int
+	perIP map[string]int
+}
+
+func newConnLimiter(max, maxPerIP int) *connLimiter {
+	return &connLimiter{
+		max:      max,
+		maxPerIP: maxPerIP,
+		perIP:    map[string]int{},
+	}
+}
+
+// acquire a connection slot for the IP. Returns false if a limit was
+// reached; otherwise, the caller must call release when done.
+func (l *connLimiter) acquire(ip net.IP) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.max > 0 && l.total >= l.max {
+		return false
+	}
+	key := ip.String()
+	if l.maxPerIP > 0 && l.perIP[key] >= l.maxPerIP {
+		return false
+	}
+
+	l.total++
+	l.perIP[key]++
+	return true
+}
+
+func (l *connLimiter) release(ip net.IP) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.total--
+	key := ip.String()
+	l.perIP[key]--
+	if l.perIP[key] <= 0 {
+		delete(l.perIP, key)
+	}
+}
@@ -0,0 +1,49 @@
+package server
+
+import (
+	"net"
+	"testing"
+)
+
+func TestConnLimiter(t *testing.T) {
+	ip1 := net.IPv4(1, 1, 1, 1)
+	ip2 := net.IPv4(2, 2, 2, 2)
+	ip3 := net.IPv4(3, 3, 3, 3)
+
+	l := newConnLimiter(3, 2)
+	for _, ip := range []net.IP{ip1, ip1, ip2} {
+		if !l.acquire(ip) {
+			t.Fatalf("%v: expected to acquire", ip)
+		}
+	}
+
+	// Per-IP limit.
+	if l.acquire(ip1) {
+		t.Errorf("%v: acquired over the per-IP limit", ip1)
+	}
+
+	// Total limit.
+	if l.acquire(ip3) {
+		t.Errorf("%v: acquired over the total limit", ip3)
+	}
+
+	l.release(ip1)
+	if !l.acquire(ip3) {
+		t.Errorf("%v: could not acquire after release", ip3)
+	}
+
+	l.release(ip1)
+	l.release(ip2)
+	l.release(ip3)
+	if l.total != 0 || len(l.perIP) != 0 {
+		t.Errorf("leftover state: %d total, %v", l.total, l.perIP)
+	}
+
+	// No limits.
+	l = newConnLimiter(0, 0)
+	for i := 0; i < 100; i++ {
+		if !l.acquire(ip1) {
+			t.Fatalf("could not acquire with no limits")
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"strings"
+
+	"blitiri.com.ar/go/gofer/config"
+	"blitiri.com.ar/go/gofer/fastcgi"
+	"blitiri.com.ar/go/gofer/trace"
+)
+
+// Default number of idle connections to keep to each FastCGI server.
+var fastCGIMaxIdle = 8
+
+func makeFastCGI(path string, conf config.FastCGI) http.Handler {
+	path = stripDomain(path)
+
+	netw, addr := dialAddr("tcp", conf.Addr)
+	maxIdle := conf.MaxIdle
+	if maxIdle == 0 {
+		maxIdle = fastCGIMaxIdle
+	}
+	client := fastcgi.NewClient(netw, addr, maxIdle)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tr, _ := trace.FromContext(r.Context())
+
+		params := fastCGIParams(path, conf, r)
+		tr.Printf("fastcgi to %s: %q", conf.Addr, params["SCRIPT_FILENAME"])
+
+		resp, err := client.Do(r.Context(), params, r.Body, tr)
+		if err != nil {
+			proxyErrorHandler(w, r, err)
+			return
+		}
+		defer resp.Body.Close()
+
+		for k, vs := range resp.Header {
+			w.Header()[k] = vs
+		}
+		w.WriteHeader(resp.Status)
+
+		_, err = io.Copy(w, resp.Body)
+		if err != nil {
+			tr.Printf("error copying body: %v", err)
+		}
+	})
+}
+
+// fastCGIParams returns the parameters for the request, which are the CGI
+// ones plus the script location.
+func fastCGIParams(path string, conf config.FastCGI,
+	r *http.Request) map[string]string {
+	// The script path, relative to the route.
+	script := strings.TrimPrefix(r.URL.Path, path)
+	if script == "" || script[0] != '/' {
+		script = "/" + script
+	}
+
+	pathInfo := ""
+	if conf.SplitPathInfo != nil {
+		m := conf.SplitPathInfo.FindStringSubmatch(script)
+		if m != nil {
+			script, pathInfo = m[1], m[2]
+		}
+	}
+	if conf.Index != "" && strings.HasSuffix(script, "/") {
+		script += conf.Index
+	}
+
+	p := cgiParams(r)
+	p["SCRIPT_NAME"] = joinPath(path, script)
+	p["SCRIPT_FILENAME"] = joinPath(conf.Root, script)
+	p["PATH_INFO"] = pathInfo
+	p["DOCUMENT_ROOT"] = conf.Root
+	if pathInfo != "" {
+		p["PATH_TRANSLATED"] = joinPath(conf.Root, pathInfo)
+	}
+
+	for k, v := range conf.Params {
+		p[k] = v
+	}
+	return p
+}
@@ -0,0 +1,168 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/fcgi"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"blitiri.com.ar/go/gofer/config"
+)
+
+func fcgiServer(t *testing.T, network, addr string) net.Listener {
+	t.Helper()
+	lis, err := net.Listen(network, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go fcgi.Serve(lis, http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			env := fcgi.ProcessEnv(r)
+			body, _ := io.ReadAll(r.Body)
+			w.Header().Set("X-Script", env["SCRIPT_FILENAME"])
+			if r.URL.Path == "/php/missing.php" {
+				w.WriteHeader(http.StatusNotFound)
+			}
+			fmt.Fprintf(w, "%s %s %s %q %q %s %s", r.Method, r.URL.RequestURI(),
+				r.Host, r.Header.Get("X-Test"), r.Header.Get("Proxy"),
+				env["EXTRA"], body)
+		}))
+	return lis
+}
+
+func TestFastCGI(t *testing.T) {
+	lis := fcgiServer(t, "tcp", "127.0.0.1:0")
+	defer lis.Close()
+
+	conf := config.FastCGI{
+		Addr:          lis.Addr().String(),
+		Root:          "/srv/www",
+		Index:         "index.php",
+		SplitPathInfo: &config.Regexp{Regexp: regexp.MustCompile(`^(.+\.php)(/.*)$`)},
+		Params:        map[string]string{"EXTRA": "extra"},
+	}
+	srv := httptest.NewServer(WithTrace("test", makeFastCGI("/php/", conf)))
+	defer srv.Close()
+
+	get := func(method, path, body string) (*http.Response, string) {
+		t.Helper()
+		req, _ := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		req.Header.Set("X-Test", "test")
+		req.Header.Set("Proxy", "http://evil/")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp, string(b)
+	}
+
+	resp, body := get("GET", "/php/a/b.php/x/y?q=1", "")
+	expected := `GET /php/a/b.php/x/y?q=1 ` + srv.Listener.Addr().String() +
+		` "test" "" extra `
+	if resp.StatusCode != 200 || body != expected {
+		t.Errorf("unexpected response: %d %q", resp.StatusCode, body)
+	}
+	if s := resp.Header.Get("X-Script"); s != "/srv/www/a/b.php" {
+		t.Errorf("unexpected script filename %q", s)
+	}
+
+	// Index.
+	resp, _ = get("GET", "/php/", "")
+	if s := resp.Header.Get("X-Script"); s != "/srv/www/index.php" {
+		t.Errorf("unexpected script filename %q", s)
+	}
+
+	// Status and body.
+	resp, body = get("POST", "/php/missing.php", "hola")
+	if resp.StatusCode != 404 || !strings.HasSuffix(body, "extra hola") {
+		t.Errorf("unexpected response: %d %q", resp.StatusCode, body)
+	}
+
+	// Backend down.
+	lis.Close()
+	conf.Addr = "unix:" + filepath.Join(t.TempDir(), "nothing")
+	down := httptest.NewServer(WithTrace("test", makeFastCGI("/", conf)))
+	defer down.Close()
+	resp, err := http.Get(down.URL + "/x.php")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("expected 502, got %d", resp.StatusCode)
+	}
+}
+
+func TestFastCGIParams(t *testing.T) {
+	conf := config.FastCGI{
+		Root:          "/srv/www",
+		Index:         "index.php",
+		SplitPathInfo: &config.Regexp{Regexp: regexp.MustCompile(`^(.+\.php)(/.*)$`)},
+	}
+
+	cases := []struct {
+		path, url                    string
+		name, filename, info, xlated string
+	}{
+		{"/php/", "/php/a/b.php/x/y", "/php/a/b.php", "/srv/www/a/b.php",
+			"/x/y", "/srv/www/x/y"},
+		{"/php/", "/php/a/b.php", "/php/a/b.php", "/srv/www/a/b.php", "", ""},
+		{"/php/", "/php/", "/php/index.php", "/srv/www/index.php", "", ""},
+		{"/", "/c.php/", "/c.php", "/srv/www/c.php", "/", "/srv/www/"},
+		{"example.com/", "/d/", "/d/index.php", "/srv/www/d/index.php", "", ""},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", c.url+"?q=1", nil)
+		r.Header.Set("Content-Type", "text/plain")
+		r.Header.Add("Accept", "a")
+		r.Header.Add("Accept", "b")
+		r.Header.Set("Proxy", "http://evil/")
+		p := fastCGIParams(stripDomain(c.path), conf, r)
+
+		if p["SCRIPT_NAME"] != c.name || p["SCRIPT_FILENAME"] != c.filename ||
+			p["PATH_INFO"] != c.info || p["PATH_TRANSLATED"] != c.xlated {
+			t.Errorf("%q %q: got %q %q %q %q", c.path, c.url,
+				p["SCRIPT_NAME"], p["SCRIPT_FILENAME"], p["PATH_INFO"],
+				p["PATH_TRANSLATED"])
+		}
+		if p["QUERY_STRING"] != "q=1" || p["REQUEST_URI"] != c.url+"?q=1" ||
+			p["CONTENT_TYPE"] != "text/plain" || p["HTTP_ACCEPT"] != "a, b" ||
+			p["SERVER_NAME"] != "example.com" || p["REMOTE_ADDR"] != "192.0.2.1" {
+			t.Errorf("%q %q: unexpected params %v", c.path, c.url, p)
+		}
+		if _, ok := p["HTTP_PROXY"]; ok {
+			t.Errorf("%q %q: HTTP_PROXY was set", c.path, c.url)
+		}
+		if _, ok := p["HTTP_CONTENT_TYPE"]; ok {
+			t.Errorf("%q %q: HTTP_CONTENT_TYPE was set", c.path, c.url)
+		}
+	}
+}
+
+func TestFastCGIUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sock")
+	lis := fcgiServer(t, "unix", path)
+	defer lis.Close()
+
+	conf := config.FastCGI{Addr: "unix:" + path}
+	srv := httptest.NewServer(WithTrace("test", makeFastCGI("/", conf)))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/x.php")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if s := resp.Header.Get("X-Script"); resp.StatusCode != 200 || s != "/x.php" {
+		t.Errorf("unexpected response: %d %q", resp.StatusCode, s)
+	}
+}
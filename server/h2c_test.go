@@ -0,0 +1,146 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"blitiri.com.ar/go/gofer/config"
+	"blitiri.com.ar/go/gofer/reqlog"
+)
+
+// h2cServer starts a test server that speaks HTTP/2 over cleartext, and
+// optionally HTTP/1.
+func h2cServer(t *testing.T, h http.Handler, http1 bool) *httptest.Server {
+	srv := httptest.NewUnstartedServer(h)
+	srv.Config.Protocols = new(http.Protocols)
+	srv.Config.Protocols.SetHTTP1(http1)
+	srv.Config.Protocols.SetUnencryptedHTTP2(true)
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func h2cClient() *http.Client {
+	tr := &http.Transport{Protocols: new(http.Protocols)}
+	tr.Protocols.SetUnencryptedHTTP2(true)
+	return &http.Client{Transport: tr}
+}
+
+// grpcLikeBackend echoes each line of the request as soon as it gets it,
+// and then replies with gRPC-style trailers. It only speaks HTTP/2.
+func grpcLikeBackend(t *testing.T) *httptest.Server {
+	return h2cServer(t, http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/grpc")
+			w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+
+			scanner := bufio.NewScanner(r.Body)
+			for scanner.Scan() {
+				fmt.Fprintf(w, "%s %s\n", r.Proto, scanner.Text())
+				w.(http.Flusher).Flush()
+			}
+
+			w.Header().Set("Grpc-Status", "5")
+			w.Header().Set("Grpc-Message", "not found")
+		}), false)
+}
+
+func TestProxyHTTP2(t *testing.T) {
+	be := grpcLikeBackend(t)
+	beURL, _ := url.Parse(be.URL)
+
+	logPath := filepath.Join(t.TempDir(), "requests.log")
+	rl, err := reqlog.New(logPath, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxy := mustProxy(t, "/", *beURL, config.ProxyOpts{HTTP2: true})
+	fe := h2cServer(t,
+		WithTrace("test", WithReqLog(WithLogging(proxy), rl)), true)
+
+	// Stream the request, checking we get each response line before we send
+	// the next one.
+	pr, pw := io.Pipe()
+	req, _ := http.NewRequest("POST", fe.URL+"/svc/Method", pr)
+	req.Header.Set("Content-Type", "application/grpc")
+	resp, err := h2cClient().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Errorf("expected HTTP/2 from the frontend, got %s", resp.Proto)
+	}
+
+	br := bufio.NewReader(resp.Body)
+	for _, msg := range []string{"a", "b"} {
+		fmt.Fprintf(pw, "%s\n", msg)
+		line, err := br.ReadString('\n')
+		if err != nil || line != "HTTP/2.0 "+msg+"\n" {
+			t.Fatalf("unexpected line: %q %v", line, err)
+		}
+	}
+	pw.Close()
+
+	if _, err := io.ReadAll(br); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Trailer.Get("Grpc-Status") != "5" ||
+		resp.Trailer.Get("Grpc-Message") != "not found" {
+		t.Errorf("unexpected trailers: %v", resp.Trailer)
+	}
+
+	// The gRPC status is in the request log.
+	if !waitFor(func() bool {
+		b, _ := os.ReadFile(logPath)
+		return strings.Contains(string(b), " = 200 ") &&
+			strings.Contains(string(b), " grpc:5\n")
+	}) {
+		b, _ := os.ReadFile(logPath)
+		t.Errorf("grpc status not in the log: %q", b)
+	}
+
+	// Without http2, the backend can't be reached.
+	proxy = mustProxy(t, "/", *beURL, config.ProxyOpts{})
+	fe = httptest.NewServer(WithTrace("test", proxy))
+	defer fe.Close()
+	resp, err = http.Get(fe.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("expected 502 without http2, got %d", resp.StatusCode)
+	}
+}
+
+func TestGRPCStatus(t *testing.T) {
+	cases := []struct {
+		h         http.Header
+		code, msg string
+	}{
+		{http.Header{}, "", ""},
+		{http.Header{"Grpc-Status": {"0"}}, "0", ""},
+		{http.Header{"Grpc-Status": {"3"}, "Grpc-Message": {"bad"}},
+			"3", "bad"},
+		{http.Header{http.TrailerPrefix + "Grpc-Status": {"14"}}, "14", ""},
+	}
+	for _, c := range cases {
+		code, msg := grpcStatus(c.h)
+		if code != c.code || msg != c.msg {
+			t.Errorf("%v: got %q %q, expected %q %q",
+				c.h, code, msg, c.code, c.msg)
+		}
+	}
+}
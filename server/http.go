@@ -1,6 +1,7 @@
 package server
 
 import (
+	"bufio"
 	"context"
 	"crypto/tls"
 	"errors"
@@ -9,13 +10,13 @@ import (
 	golog "log"
 	"net"
 	"net/http"
-	"net/http/cgi"
 	"net/http/httputil"
 	"net/url"
 	"strings"
 	"time"
 
 	"blitiri.com.ar/go/gofer/config"
+	"blitiri.com.ar/go/gofer/httpcache"
 	"blitiri.com.ar/go/gofer/ipratelimit"
 	"blitiri.com.ar/go/gofer/ratelimit"
 	"blitiri.com.ar/go/gofer/reqlog"
@@ -23,6 +24,7 @@ import (
 	"blitiri.com.ar/go/gofer/util"
 	"blitiri.com.ar/go/log"
 	"blitiri.com.ar/go/systemd"
+	"golang.org/x/crypto/acme/autocert"
 )
 
 func httpServer(addr string, conf config.HTTP) (*http.Server, error) {
@@ -51,7 +53,19 @@ func httpServer(addr string, conf config.HTTP) (*http.Server, error) {
 			mux.Handle(path, makeFile(path, r.File))
 		} else if r.Proxy != nil {
 			log.Infof("%s route %q -> proxy %s", srv.Addr, path, r.Proxy)
-			mux.Handle(path, makeProxy(path, r.Proxy.URL()))
+			h, err := makeProxy(path, r.Proxy.URL(), r.ProxyOpts)
+			if err != nil {
+				return nil, log.Errorf("%s route %q: %v", srv.Addr, path, err)
+			}
+			if sconf := r.ProxyOpts.Shadow; sconf != nil {
+				log.Infof("%s route %q -> shadow %s", srv.Addr, path, sconf.URL)
+				h, err = newShadow(srv.Addr+path, path, *sconf, h)
+				if err != nil {
+					return nil, log.Errorf("%s route %q: shadow: %v",
+						srv.Addr, path, err)
+				}
+			}
+			mux.Handle(path, h)
 		} else if r.Redirect != nil {
 			log.Infof("%s route %q -> redirect %s", srv.Addr, path, r.Redirect)
 			mux.Handle(path, makeRedirect(path, r.Redirect.URL()))
@@ -61,13 +75,41 @@ func httpServer(addr string, conf config.HTTP) (*http.Server, error) {
 			mux.Handle(path, makeRedirectRe(r.RedirectRe))
 		} else if len(r.CGI) > 0 {
 			log.Infof("%s route %q -> cgi %q", srv.Addr, path, r.CGI)
-			mux.Handle(path, makeCGI(path, r.CGI))
+			h, err := makeCGI(path, r.CGI, r.CGIOpts)
+			if err != nil {
+				return nil, log.Errorf("%s route %q: %v", srv.Addr, path, err)
+			}
+			mux.Handle(path, h)
+		} else if r.FastCGI != nil {
+			log.Infof("%s route %q -> fastcgi %s",
+				srv.Addr, path, r.FastCGI.Addr)
+			mux.Handle(path, makeFastCGI(path, *r.FastCGI))
 		} else if r.Status > 0 {
 			log.Infof("%s route %q -> status %d", srv.Addr, path, r.Status)
 			mux.Handle(path, makeStatus(path, r.Status))
 		}
 	}
 
+	// Response caching. This goes right after the routes, so the cache is
+	// only used once the request is authorized.
+	if len(conf.Cache) > 0 {
+		cacheMux := http.NewServeMux()
+		for path, cconf := range conf.Cache {
+			c, err := httpcache.New(srv.Addr+path, cconf, srv.Handler)
+			if err != nil {
+				return nil, log.Errorf("%s cache %q: %v", srv.Addr, path, err)
+			}
+			cacheMux.Handle(path, c)
+			log.Infof("%s cache %q -> max_size:%s dir:%q",
+				srv.Addr, path, cconf.MaxSize, cconf.Dir)
+		}
+
+		if _, ok := conf.Cache["/"]; !ok {
+			cacheMux.Handle("/", srv.Handler)
+		}
+		srv.Handler = cacheMux
+	}
+
 	// Wrap the authentication handlers.
 	if len(conf.Auth) > 0 {
 		authMux := http.NewServeMux()
@@ -92,6 +134,32 @@ func httpServer(addr string, conf config.HTTP) (*http.Server, error) {
 		srv.Handler = authMux
 	}
 
+	// Wrap the JWT authentication handlers.
+	if len(conf.JWTAuth) > 0 {
+		jwtMux := http.NewServeMux()
+		for path, jconf := range conf.JWTAuth {
+			keys, err := LoadJWTKeys(jconf)
+			if err != nil {
+				return nil, log.Errorf(
+					"failed to load jwt keys for %q: %v", path, err)
+			}
+			jwtMux.Handle(path,
+				&JWTWrapper{
+					handler: srv.Handler,
+					keys:    keys,
+					conf:    jconf,
+				})
+
+			log.Infof("%s jwtauth %q -> iss:%q aud:%q",
+				srv.Addr, path, jconf.Issuer, jconf.Audience)
+		}
+
+		if _, ok := conf.JWTAuth["/"]; !ok {
+			jwtMux.Handle("/", srv.Handler)
+		}
+		srv.Handler = jwtMux
+	}
+
 	// Extra headers.
 	if len(conf.SetHeader) > 0 {
 		hdrMux := http.NewServeMux()
@@ -111,8 +179,9 @@ func httpServer(addr string, conf config.HTTP) (*http.Server, error) {
 		timeoutMux := http.NewServeMux()
 		for path, timeout := range conf.Timeouts {
 			timeoutMux.Handle(path, WithTimeout(srv.Handler, timeout))
-			log.Infof("%s timeout %q -> read:%s write:%s",
-				srv.Addr, path, timeout.Read, timeout.Write)
+			log.Infof("%s timeout %q -> read:%s write:%s upgrade_idle:%s",
+				srv.Addr, path, timeout.Read, timeout.Write,
+				timeout.UpgradeIdle)
 		}
 
 		if _, ok := conf.Timeouts["/"]; !ok {
@@ -121,6 +190,30 @@ func httpServer(addr string, conf config.HTTP) (*http.Server, error) {
 		srv.Handler = timeoutMux
 	}
 
+	// Request limits.
+	if len(conf.Limits) > 0 {
+		limitsMux := http.NewServeMux()
+		for path, limits := range conf.Limits {
+			limitsMux.Handle(path, WithLimits(srv.Handler, limits))
+			log.Infof("%s limits %q -> max_body_size:%s "+
+				"max_header_size:%s max_url_length:%d",
+				srv.Addr, path, limits.MaxBodySize, limits.MaxHeaderSize,
+				limits.MaxURLLength)
+
+			// The server rejects headers bigger than MaxHeaderBytes before
+			// they get to us, so raise it if needed.
+			if limits.MaxHeaderSize > http.DefaultMaxHeaderBytes &&
+				int(limits.MaxHeaderSize) > srv.MaxHeaderBytes {
+				srv.MaxHeaderBytes = int(limits.MaxHeaderSize)
+			}
+		}
+
+		if _, ok := conf.Limits["/"]; !ok {
+			limitsMux.Handle("/", srv.Handler)
+		}
+		srv.Handler = limitsMux
+	}
+
 	// Logging for all entries.
 	// Because this will use the request logs if available, it needs to be
 	// wrapped by it.
@@ -161,6 +254,18 @@ func httpServer(addr string, conf config.HTTP) (*http.Server, error) {
 		srv.Handler = rlMux
 	}
 
+	// Take the client address from the forwarding headers, if they come from
+	// a trusted proxy. This goes outside of everything else, so they all see
+	// the client address.
+	if len(conf.TrustedProxies) > 0 {
+		nets, err := config.ParseNetworks(conf.TrustedProxies)
+		if err != nil {
+			return nil, log.Errorf("%s trusted_proxies: %v", srv.Addr, err)
+		}
+		srv.Handler = WithTrustedProxies(srv.Handler, nets)
+		log.Infof("%s trusted proxies: %q", srv.Addr, conf.TrustedProxies)
+	}
+
 	return srv, nil
 }
 
@@ -169,10 +274,19 @@ func HTTP(addr string, conf config.HTTP) error {
 	if err != nil {
 		return err
 	}
-	lis, err := systemd.Listen("tcp", addr)
+	lis, err := listen(addr, conf.UnixSocket)
 	if err != nil {
 		return log.Errorf("%s error listening: %v", addr, err)
 	}
+	lis, err = withProxyProtocol(addr, lis, conf.ProxyProtocol)
+	if err != nil {
+		return err
+	}
+	if conf.H2C {
+		srv.Protocols = new(http.Protocols)
+		srv.Protocols.SetHTTP1(true)
+		srv.Protocols.SetUnencryptedHTTP2(true)
+	}
 	log.Infof("%s http starting on %q", addr, lis.Addr())
 	err = srv.Serve(lis)
 	return log.Errorf("%s http exited: %v", addr, err)
@@ -184,16 +298,37 @@ func HTTPS(addr string, conf config.HTTPS) error {
 		return err
 	}
 
-	srv.TLSConfig, err = util.LoadCertsForHTTPS(conf)
+	var m *autocert.Manager
+	srv.TLSConfig, m, err = util.LoadCertsForHTTPS(addr, conf)
 	if err != nil {
 		return log.Errorf("%s error loading certs: %v", addr, err)
 	}
 
-	rawLis, err := systemd.Listen("tcp", addr)
+	rawLis, err := listen(addr, conf.UnixSocket)
 	if err != nil {
 		return log.Errorf("%s error listening: %v", addr, err)
 	}
 
+	if conf.HTTPRedirect != "" {
+		_, port, _ := net.SplitHostPort(rawLis.Addr().String())
+		err = httpRedirect(conf.HTTPRedirect, port, m)
+		if err != nil {
+			return err
+		}
+	}
+
+	rawLis, err = withProxyProtocol(addr, rawLis, conf.ProxyProtocol)
+	if err != nil {
+		return err
+	}
+
+	if conf.HTTP3 {
+		srv.Handler, err = serveHTTP3(addr, srv)
+		if err != nil {
+			return err
+		}
+	}
+
 	lis := tls.NewListener(rawLis, srv.TLSConfig)
 
 	log.Infof("%s https starting on %q", addr, lis.Addr())
@@ -201,6 +336,75 @@ func HTTPS(addr string, conf config.HTTPS) error {
 	return log.Errorf("%s https exited: %v", addr, err)
 }
 
+// httpRedirect starts a plain HTTP server on the given address, which
+// redirects all requests to HTTPS on the given port.
+// If m is not nil, it also answers autocert's HTTP-01 challenges.
+func httpRedirect(addr, port string, m *autocert.Manager) error {
+	tr := trace.New("httpserver", addr)
+	tr.SetMaxEvents(1000)
+
+	var h http.Handler = makeHTTPSRedirect(port)
+	if m != nil {
+		h = m.HTTPHandler(h)
+	}
+
+	srv := &http.Server{
+		Addr:    addr,
+		Handler: WithTrace("http@"+addr, WithLogging(h)),
+
+		ReadTimeout:  60 * time.Second,
+		WriteTimeout: 60 * time.Second,
+
+		ErrorLog: golog.New(tr, "", golog.Lshortfile),
+	}
+
+	lis, err := systemd.Listen("tcp", addr)
+	if err != nil {
+		return log.Errorf("%s error listening: %v", addr, err)
+	}
+
+	log.Infof("%s http redirect to https:%s starting on %q",
+		addr, port, lis.Addr())
+	go func() {
+		err := srv.Serve(lis)
+		log.Errorf("%s http redirect exited: %v", addr, err)
+	}()
+	return nil
+}
+
+// makeHTTPSRedirect returns a handler which redirects to the same URL over
+// HTTPS, on the given port.
+func makeHTTPSRedirect(port string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tr, _ := trace.FromContext(r.Context())
+
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.Trim(host, "[]")
+		if port != "443" {
+			host = net.JoinHostPort(host, port)
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+
+		target := *r.URL
+		target.Scheme = "https"
+		target.Host = host
+
+		// Use 301 for GET and HEAD, and 308 for the rest so clients don't
+		// change the method or drop the body.
+		status := http.StatusPermanentRedirect
+		if r.Method == "GET" || r.Method == "HEAD" {
+			status = http.StatusMovedPermanently
+		}
+
+		tr.Printf("redirect to %q", target.String())
+		http.Redirect(w, r, target.String(), status)
+	})
+}
+
 // joinPath joins to HTTP paths. We can't use path.Join because it strips the
 // final "/", which may have meaning in URLs.
 func joinPath(a, b string) string {
@@ -283,22 +487,6 @@ func makeFile(path string, file string) http.Handler {
 	})
 }
 
-func makeCGI(path string, cmd []string) http.Handler {
-	path = stripDomain(path)
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		tr, _ := trace.FromContext(r.Context())
-		tr.Printf("exec %q", cmd)
-		h := cgi.Handler{
-			Path:   cmd[0],
-			Args:   cmd[1:],
-			Root:   path,
-			Logger: golog.New(tr, "", golog.Lshortfile),
-			Stderr: tr,
-		}
-		h.ServeHTTP(w, r)
-	})
-}
-
 func makeRedirect(path string, to url.URL) http.Handler {
 	path = stripDomain(path)
 
@@ -348,7 +536,8 @@ func makeStatus(from string, status int) http.Handler {
 	})
 }
 
-func makeProxy(path string, to url.URL) http.Handler {
+func makeProxy(path string, to url.URL, opts config.ProxyOpts) (
+	http.Handler, error) {
 	proxy := &httputil.ReverseProxy{}
 	proxy.ErrorHandler = proxyErrorHandler
 
@@ -366,6 +555,58 @@ func makeProxy(path string, to url.URL) http.Handler {
 	// router, but to us is irrelevant.
 	path = stripDomain(path)
 
+	// Each route has its own transport, so its settings can be tuned
+	// independently.
+	eff := opts.Effective()
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	dialer := &net.Dialer{
+		Timeout:   eff.DialTimeout,
+		KeepAlive: eff.KeepAlive,
+	}
+	transport.DialContext = dialer.DialContext
+	transport.ResponseHeaderTimeout = eff.ResponseHeaderTimeout
+	transport.MaxIdleConnsPerHost = eff.MaxIdleConns
+	transport.MaxIdleConns = max(transport.MaxIdleConns, eff.MaxIdleConns)
+	transport.IdleConnTimeout = eff.IdleConnTimeout
+	transport.DisableKeepAlives = eff.DisableKeepAlives
+	transport.MaxConnsPerHost = eff.MaxConns
+
+	// For unix sockets, connect to the socket, and use "localhost" as the
+	// host.
+	if sock, base, ok := config.UnixProxyTarget(to); ok {
+		transport.DialContext = unixDialer(dialer, sock)
+		to.Host = "localhost"
+		to.Path = base
+	}
+
+	// HTTP/2 to the backend, which is needed for gRPC. Over TLS it would be
+	// negotiated anyway, but this way we don't fall back to HTTP/1.1.
+	if opts.HTTP2 {
+		transport.Protocols = new(http.Protocols)
+		if to.Scheme == "https" {
+			transport.Protocols.SetHTTP2(true)
+		} else {
+			transport.Protocols.SetUnencryptedHTTP2(true)
+		}
+	}
+
+	// TLS options for https backends.
+	if to.Scheme == "https" && opts.TLS != (config.UpstreamTLS{}) {
+		tlsConf, err := util.UpstreamTLSConfig(opts.TLS)
+		if err != nil {
+			return nil, fmt.Errorf("error loading upstream tls config: %v", err)
+		}
+		transport.TLSClientConfig = tlsConf
+	}
+
+	proxy.Transport = transport
+
+	// A negative interval makes the proxy flush after every write.
+	proxy.FlushInterval = eff.FlushInterval
+	if eff.DisableBuffering {
+		proxy.FlushInterval = -1
+	}
+
 	proxy.Rewrite = func(r *httputil.ProxyRequest) {
 		// This sets the Forwarded-For, X-Forwarded-Host, and
 		// X-Forwarded-Proto headers of the outbound request.
@@ -400,7 +641,7 @@ func makeProxy(path string, to url.URL) http.Handler {
 			r.Out.Proto, r.Out.Method, r.Out.URL.String())
 	}
 
-	return proxy
+	return proxy, nil
 }
 
 func proxyErrorHandler(w http.ResponseWriter, r *http.Request, err error) {
@@ -413,6 +654,18 @@ func proxyErrorHandler(w http.ResponseWriter, r *http.Request, err error) {
 		tr.SetError()
 	}
 
+	// Timeouts talking to the backend (e.g. response_header_timeout) get a
+	// 504, request bodies over the limit a 413, and the rest a 502.
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		w.WriteHeader(http.StatusGatewayTimeout)
+		return
+	}
+	var mbErr *http.MaxBytesError
+	if errors.As(err, &mbErr) {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
 	w.WriteHeader(http.StatusBadGateway)
 }
 
@@ -421,6 +674,11 @@ type statusWriter struct {
 	http.ResponseWriter
 	status int
 	length int64
+
+	// Set if the connection was hijacked for a protocol upgrade.
+	upgraded    *upgradedConn
+	upgradeIdle *time.Duration
+	tr          *trace.Trace
 }
 
 func (w *statusWriter) WriteHeader(status int) {
@@ -457,6 +715,27 @@ func (w *statusWriter) Unwrap() http.ResponseWriter {
 	return w.ResponseWriter
 }
 
+// Hijack is used for protocol upgrades (e.g. websockets). We wrap the
+// connection so we can account for it, and keep it open as long as it's in
+// use.
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The switching protocols response is written directly to the
+	// connection, so we don't see it.
+	if w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+
+	// The handshake response is usually written to brw, which goes directly
+	// to the connection, so we only count the traffic after it.
+	w.upgraded = newUpgradedConn(conn, *w.upgradeIdle, w.tr)
+	return w.upgraded, brw, nil
+}
+
 func SetHeader(parent http.Handler, hdrs map[string]string) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		tr, _ := trace.FromContext(r.Context())
@@ -491,29 +770,59 @@ func WithLogging(parent http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		tr, _ := trace.FromContext(r.Context())
 
+		// Give the timeout handlers a place to store the idle timeout for
+		// upgraded connections.
+		r, idle := withUpgradeIdle(r)
+
 		// Wrap the writer so we can get output information.
-		sw := statusWriter{ResponseWriter: w}
+		sw := statusWriter{ResponseWriter: w, upgradeIdle: idle, tr: tr}
 
 		// Save the URL, since some of the callers will change it (e.g.
 		// makeDir).
 		origURL := *r.URL
 
+		// Give the authentication handlers a place to store the user.
+		r, user := withAuthUser(r)
+
 		start := time.Now()
 		parent.ServeHTTP(&sw, r)
 		lat := time.Since(start)
 
 		tr.Printf("%d %s", sw.status, http.StatusText(sw.status))
-		tr.Printf("%d bytes", sw.length)
+		if sw.upgraded != nil {
+			// For upgraded connections, the handler returns once they're
+			// closed.
+			tr.Printf("upgraded to %q, closed after %v: %d bytes in, %d out",
+				r.Header.Get("Upgrade"), lat.Round(time.Millisecond),
+				sw.upgraded.in.Load(), sw.upgraded.out.Load())
+		} else {
+			tr.Printf("%d bytes", sw.length)
+		}
+		if code, msg := grpcStatus(sw.Header()); code != "" {
+			tr.Printf("grpc status %s %q", code, msg)
+		}
 
 		if sw.status >= 400 && sw.status != 404 {
 			tr.SetError()
 		}
 
 		r.URL = &origURL
-		reqLog(r, sw.status, sw.length, lat)
+		reqLog(r, &sw, *user, lat)
 	})
 }
 
+// grpcStatus returns the gRPC status code and message of the response, if
+// any. They are usually sent as trailers, but can also be in the headers for
+// responses without a body.
+func grpcStatus(h http.Header) (string, string) {
+	for _, prefix := range []string{"", http.TrailerPrefix} {
+		if code := h.Get(prefix + "Grpc-Status"); code != "" {
+			return code, h.Get(prefix + "Grpc-Message")
+		}
+	}
+	return "", ""
+}
+
 func WithReqLog(parent http.Handler, rl *reqlog.Log) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Associate the log with this request. Actual logging will be
@@ -524,18 +833,28 @@ func WithReqLog(parent http.Handler, rl *reqlog.Log) http.Handler {
 	})
 }
 
-func reqLog(r *http.Request, status int, length int64, latency time.Duration) {
+func reqLog(r *http.Request, sw *statusWriter, user string,
+	latency time.Duration) {
 	rlog := reqlog.FromContext(r.Context())
 	if rlog == nil {
 		return
 	}
-	rlog.Log(&reqlog.Event{
+	ev := &reqlog.Event{
 		T:       time.Now(),
 		H:       r,
-		Status:  status,
-		Length:  length,
+		Status:  sw.status,
+		Length:  sw.length,
+		User:    user,
 		Latency: latency,
-	})
+	}
+	ev.GRPCStatus, _ = grpcStatus(sw.Header())
+	if sw.upgraded != nil {
+		ev.Upgrade = r.Header.Get("Upgrade")
+		ev.BytesUp = sw.upgraded.in.Load()
+		ev.BytesDown = sw.upgraded.out.Load()
+		ev.Length = ev.BytesUp + ev.BytesDown
+	}
+	rlog.Log(ev)
 }
 
 func WithRateLimit(parent http.Handler, rl *ipratelimit.Limiter) http.Handler {
@@ -568,6 +887,109 @@ func WithRateLimit(parent http.Handler, rl *ipratelimit.Limiter) http.Handler {
 	})
 }
 
+// WithTrustedProxies replaces the request's RemoteAddr with the client
+// address taken from the Forwarded or X-Forwarded-For headers, when the
+// request comes from one of the trusted proxies.
+// The headers don't include the client port, so it is set to 0.
+func WithTrustedProxies(parent http.Handler, trusted []*net.IPNet) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ip := clientIP(r, trusted); ip != nil {
+			r.RemoteAddr = net.JoinHostPort(ip.String(), "0")
+		}
+		parent.ServeHTTP(w, r)
+	})
+}
+
+// clientIP returns the IP address of the client, taken from the forwarding
+// headers. It returns nil if the request does not come from a trusted proxy,
+// or the forwarding headers don't have a usable address.
+func clientIP(r *http.Request, trusted []*net.IPNet) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !inNetworks(ip, trusted) {
+		return nil
+	}
+
+	// The Forwarded header is preferred, since it is standard.
+	hops := forwardedFor(r.Header.Values("Forwarded"))
+	if len(hops) == 0 {
+		hops = xForwardedFor(r.Header.Values("X-Forwarded-For"))
+	}
+	if len(hops) == 0 {
+		return nil
+	}
+
+	// Each proxy appends the address it got the request from, so walk the
+	// list from the end, skipping our trusted proxies.
+	var client net.IP
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(hops[i])
+		if hop == nil {
+			// Unknown or obfuscated, we can't go further.
+			break
+		}
+		client = hop
+		if !inNetworks(hop, trusted) {
+			break
+		}
+	}
+	return client
+}
+
+// forwardedFor returns the addresses in the "for" parameters of the
+// Forwarded headers (RFC 7239), without the ports. Elements without it are
+// returned as empty strings.
+func forwardedFor(values []string) []string {
+	hops := []string{}
+	for _, v := range values {
+		for _, elem := range strings.Split(v, ",") {
+			hop := ""
+			for _, pair := range strings.Split(elem, ";") {
+				k, v, _ := strings.Cut(strings.TrimSpace(pair), "=")
+				if strings.EqualFold(k, "for") {
+					hop = forwardedHost(strings.Trim(v, `"`))
+				}
+			}
+			hops = append(hops, hop)
+		}
+	}
+	return hops
+}
+
+// forwardedHost returns the host of a Forwarded node, which can be an IPv4
+// address or a bracketed IPv6 address, optionally followed by a port.
+func forwardedHost(node string) string {
+	if strings.HasPrefix(node, "[") {
+		host, _, _ := strings.Cut(node[1:], "]")
+		return host
+	}
+	host, _, _ := strings.Cut(node, ":")
+	return host
+}
+
+// xForwardedFor returns the addresses in the X-Forwarded-For headers.
+func xForwardedFor(values []string) []string {
+	hops := []string{}
+	for _, v := range values {
+		for _, hop := range strings.Split(v, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+	return hops
+}
+
+func inNetworks(ip net.IP, nets []*net.IPNet) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
 func WithTimeout(parent http.Handler, timeout config.Timeout) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		tr, _ := trace.FromContext(r.Context())
@@ -584,6 +1006,10 @@ func WithTimeout(parent http.Handler, timeout config.Timeout) http.Handler {
 			rc.SetWriteDeadline(time.Now().Add(timeout.Write))
 		}
 
+		if timeout.UpgradeIdle > 0 {
+			setUpgradeIdle(r, timeout.UpgradeIdle)
+		}
+
 		parent.ServeHTTP(w, r)
 	})
 }
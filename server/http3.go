@@ -0,0 +1,60 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+
+	"blitiri.com.ar/go/log"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// serveHTTP3 starts an HTTP/3 server on the UDP port with the same address
+// as the given server, using its handler and TLS configuration.
+// It returns the handler to use for the TCP listener, which advertises the
+// HTTP/3 server to the clients.
+func serveHTTP3(addr string, srv *http.Server) (http.Handler, error) {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, log.Errorf("%s error listening on udp: %v", addr, err)
+	}
+
+	h3 := &http3.Server{
+		Handler:   srv.Handler,
+		TLSConfig: http3TLSConfig(srv.TLSConfig),
+	}
+
+	go func() {
+		log.Infof("%s http3 starting on %q", addr, conn.LocalAddr())
+		err := h3.Serve(conn)
+		log.Errorf("%s http3 exited: %v", addr, err)
+	}()
+
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	return withAltSvc(srv.Handler, port), nil
+}
+
+// http3TLSConfig returns a TLS configuration for HTTP/3, based on the given
+// one. We clone it on each handshake instead of once, so we pick up the
+// changes made to it at runtime (like the rotation of the session ticket
+// keys).
+func http3TLSConfig(conf *tls.Config) *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			c := conf.Clone()
+			c.NextProtos = []string{http3.NextProtoH3}
+			return c, nil
+		},
+	}
+}
+
+// withAltSvc advertises the HTTP/3 server on the given UDP port, using the
+// Alt-Svc header.
+func withAltSvc(parent http.Handler, port int) http.Handler {
+	altSvc := fmt.Sprintf(`%s=":%d"; ma=86400`, http3.NextProtoH3, port)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Alt-Svc", altSvc)
+		parent.ServeHTTP(w, r)
+	})
+}
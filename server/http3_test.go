@@ -0,0 +1,80 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"blitiri.com.ar/go/gofer/reqlog"
+	"github.com/quic-go/quic-go/http3"
+)
+
+func TestHTTP3(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "requests.log")
+	rl, err := reqlog.New(logPath, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s", r.Proto)
+	})
+	srv := &http.Server{
+		Handler: WithTrace("test", WithReqLog(WithLogging(h), rl)),
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{selfSignedCert(t, "localhost")},
+		},
+	}
+
+	tcpHandler, err := serveHTTP3("127.0.0.1:0", srv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Responses over TCP advertise the HTTP/3 server.
+	w := httptest.NewRecorder()
+	tcpHandler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	altSvc := w.Result().Header.Get("Alt-Svc")
+	m := regexp.MustCompile(`^h3=":(\d+)"; ma=86400$`).FindStringSubmatch(altSvc)
+	if m == nil {
+		t.Fatalf("unexpected Alt-Svc: %q", altSvc)
+	}
+
+	client := &http.Client{
+		Transport: &http3.Transport{
+			TLSClientConfig: &tls.Config{
+				ServerName:         "localhost",
+				InsecureSkipVerify: true,
+			},
+		},
+	}
+	defer client.Transport.(*http3.Transport).Close()
+
+	resp, err := client.Get("https://127.0.0.1:" + m[1] + "/lala")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "HTTP/3.0" {
+		t.Errorf("unexpected body: %q", body)
+	}
+	if resp.Header.Get("Alt-Svc") != "" {
+		t.Errorf("Alt-Svc sent over HTTP/3: %q", resp.Header.Get("Alt-Svc"))
+	}
+
+	// The protocol is in the request log.
+	if !waitFor(func() bool {
+		b, _ := os.ReadFile(logPath)
+		return regexp.MustCompile(` HTTP/3.0 .* GET /lala `).Match(b)
+	}) {
+		b, _ := os.ReadFile(logPath)
+		t.Errorf("request not in the log: %q", b)
+	}
+}
@@ -0,0 +1,400 @@
+package server
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"blitiri.com.ar/go/gofer/config"
+	"blitiri.com.ar/go/gofer/trace"
+)
+
+// JWTWrapper authenticates requests using JWT bearer tokens.
+type JWTWrapper struct {
+	handler http.Handler
+	keys    *JWTKeys
+	conf    config.JWTAuth
+}
+
+func (j *JWTWrapper) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	tr, _ := trace.FromContext(r.Context())
+
+	// Never let the client set the subject header by themselves.
+	if j.conf.SubjectHeader != "" {
+		r.Header.Del(j.conf.SubjectHeader)
+	}
+
+	tok, ok := bearerToken(r)
+	if !ok {
+		tr.Printf("bearer token missing")
+		j.failed(w, "")
+		return
+	}
+
+	claims, err := j.validate(tok, time.Now())
+	if err != nil {
+		tr.Printf("invalid token: %v", err)
+		j.failed(w, "invalid_token")
+		return
+	}
+
+	sub, _ := claims["sub"].(string)
+	tr.Printf("token for %q successful", sub)
+	setAuthUser(r, sub)
+	if j.conf.SubjectHeader != "" {
+		r.Header.Set(j.conf.SubjectHeader, sub)
+	}
+
+	j.handler.ServeHTTP(w, r)
+}
+
+func (j *JWTWrapper) failed(w http.ResponseWriter, code string) {
+	challenge := `Bearer realm="Authentication"`
+	if code != "" {
+		challenge += fmt.Sprintf(`, error=%q`, code)
+	}
+	w.Header().Set("WWW-Authenticate", challenge)
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	auth := r.Header.Get("Authorization")
+	const prefix = "bearer "
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return "", false
+	}
+	return strings.TrimSpace(auth[len(prefix):]), true
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// validate the token, and return its claims.
+func (j *JWTWrapper) validate(tok string, now time.Time) (map[string]interface{}, error) {
+	parts := strings.Split(tok, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	hdr := jwtHeader{}
+	if err := decodeJWTPart(parts[0], &hdr); err != nil {
+		return nil, fmt.Errorf("error decoding header: %v", err)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("error decoding signature: %v", err)
+	}
+
+	signed := []byte(parts[0] + "." + parts[1])
+	if err := j.keys.verify(hdr, signed, sig); err != nil {
+		return nil, err
+	}
+
+	claims := map[string]interface{}{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("error decoding claims: %v", err)
+	}
+
+	if err := j.checkClaims(claims, now); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func decodeJWTPart(s string, v interface{}) error {
+	buf, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+func (j *JWTWrapper) checkClaims(claims map[string]interface{}, now time.Time) error {
+	if exp, ok, err := timeClaim(claims, "exp"); err != nil {
+		return err
+	} else if ok && !now.Before(exp.Add(j.conf.Leeway)) {
+		return fmt.Errorf("token expired at %v", exp)
+	}
+
+	if nbf, ok, err := timeClaim(claims, "nbf"); err != nil {
+		return err
+	} else if ok && now.Add(j.conf.Leeway).Before(nbf) {
+		return fmt.Errorf("token not valid before %v", nbf)
+	}
+
+	if j.conf.Issuer != "" && !claimMatches(claims["iss"], j.conf.Issuer) {
+		return fmt.Errorf("unexpected issuer %v", claims["iss"])
+	}
+
+	if j.conf.Audience != "" && !claimMatches(claims["aud"], j.conf.Audience) {
+		return fmt.Errorf("unexpected audience %v", claims["aud"])
+	}
+
+	for name, want := range j.conf.Require {
+		v, ok := claims[name]
+		if !ok {
+			return fmt.Errorf("missing required claim %q", name)
+		}
+		if want != "" && !claimMatches(v, want) {
+			return fmt.Errorf("claim %q: unexpected value %v", name, v)
+		}
+	}
+
+	return nil
+}
+
+// timeClaim returns the value of a NumericDate claim (seconds since epoch).
+func timeClaim(claims map[string]interface{}, name string) (time.Time, bool, error) {
+	v, ok := claims[name]
+	if !ok {
+		return time.Time{}, false, nil
+	}
+	n, ok := v.(json.Number)
+	if !ok {
+		return time.Time{}, false, fmt.Errorf("claim %q is not a number", name)
+	}
+	f, err := n.Float64()
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("claim %q: %v", name, err)
+	}
+	sec := int64(f)
+	nsec := int64((f - float64(sec)) * 1e9)
+	return time.Unix(sec, nsec), true, nil
+}
+
+// claimMatches checks if the claim is the given string, or if it's a list,
+// if it contains it.
+func claimMatches(v interface{}, want string) bool {
+	switch c := v.(type) {
+	case string:
+		return c == want
+	case json.Number:
+		return c.String() == want
+	case bool:
+		return fmt.Sprint(c) == want
+	case []interface{}:
+		for _, e := range c {
+			if claimMatches(e, want) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// JWTKeys contains the keys used to verify the tokens.
+type JWTKeys struct {
+	// Shared secret for HS256.
+	secret []byte
+
+	// Public keys for RS256 and ES256, by key id.
+	public map[string]crypto.PublicKey
+}
+
+func LoadJWTKeys(conf config.JWTAuth) (*JWTKeys, error) {
+	keys := &JWTKeys{}
+
+	if conf.SecretFile != "" {
+		buf, err := os.ReadFile(conf.SecretFile)
+		if err != nil {
+			return nil, err
+		}
+		keys.secret = bytes.TrimSpace(buf)
+		if len(keys.secret) == 0 {
+			return nil, fmt.Errorf("%q: empty secret", conf.SecretFile)
+		}
+	}
+
+	if conf.JWKSFile != "" {
+		buf, err := os.ReadFile(conf.JWKSFile)
+		if err != nil {
+			return nil, err
+		}
+		keys.public, err = parseJWKS(buf)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %v", conf.JWKSFile, err)
+		}
+	}
+
+	return keys, nil
+}
+
+func (k *JWTKeys) verify(hdr jwtHeader, signed, sig []byte) error {
+	hash := sha256.Sum256(signed)
+
+	switch hdr.Alg {
+	case "HS256":
+		if k.secret == nil {
+			return errors.New("no secret for HS256")
+		}
+		mac := hmac.New(sha256.New, k.secret)
+		mac.Write(signed)
+		if !hmac.Equal(sig, mac.Sum(nil)) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	case "RS256":
+		pub, err := k.publicKey(hdr.Kid)
+		if err != nil {
+			return err
+		}
+		rsaPub, ok := pub.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("key %q is not an RSA key", hdr.Kid)
+		}
+		if err := rsa.VerifyPKCS1v15(rsaPub, crypto.SHA256, hash[:], sig); err != nil {
+			return errors.New("invalid signature")
+		}
+		return nil
+	case "ES256":
+		pub, err := k.publicKey(hdr.Kid)
+		if err != nil {
+			return err
+		}
+		ecPub, ok := pub.(*ecdsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("key %q is not an EC key", hdr.Kid)
+		}
+		// The signature is r || s, each 32 bytes long.
+		if len(sig) != 64 {
+			return errors.New("invalid signature length")
+		}
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(ecPub, hash[:], r, s) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	}
+
+	return fmt.Errorf("unsupported algorithm %q", hdr.Alg)
+}
+
+func (k *JWTKeys) publicKey(kid string) (crypto.PublicKey, error) {
+	if len(k.public) == 0 {
+		return nil, errors.New("no public keys loaded")
+	}
+	if pub, ok := k.public[kid]; ok {
+		return pub, nil
+	}
+
+	// If the token has no key id and there's only one key, use it.
+	if kid == "" && len(k.public) == 1 {
+		for _, pub := range k.public {
+			return pub, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown key id %q", kid)
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+
+	// RSA.
+	N string `json:"n"`
+	E string `json:"e"`
+
+	// EC.
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// parseJWKS parses a JSON Web Key Set (RFC 7517), and returns the public
+// keys by key id. Unsupported keys are skipped.
+func parseJWKS(buf []byte) (map[string]crypto.PublicKey, error) {
+	set := struct {
+		Keys []jwk `json:"keys"`
+	}{}
+	if err := json.Unmarshal(buf, &set); err != nil {
+		return nil, err
+	}
+
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		var pub crypto.PublicKey
+		var err error
+		switch k.Kty {
+		case "RSA":
+			pub, err = k.rsaKey()
+		case "EC":
+			pub, err = k.ecKey()
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %v", k.Kid, err)
+		}
+		keys[k.Kid] = pub
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("no usable keys found")
+	}
+	return keys, nil
+}
+
+func (k jwk) rsaKey() (*rsa.PublicKey, error) {
+	n, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil {
+		return nil, fmt.Errorf("invalid modulus: %v", err)
+	}
+	e, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil {
+		return nil, fmt.Errorf("invalid exponent: %v", err)
+	}
+	eInt := new(big.Int).SetBytes(e)
+	if !eInt.IsInt64() || eInt.Int64() > 1<<31-1 || eInt.Int64() < 3 {
+		return nil, errors.New("invalid exponent")
+	}
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(n),
+		E: int(eInt.Int64()),
+	}, nil
+}
+
+func (k jwk) ecKey() (*ecdsa.PublicKey, error) {
+	if k.Crv != "P-256" {
+		return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+	}
+	x, err := base64.RawURLEncoding.DecodeString(k.X)
+	if err != nil || len(x) > 32 {
+		return nil, errors.New("invalid x coordinate")
+	}
+	y, err := base64.RawURLEncoding.DecodeString(k.Y)
+	if err != nil || len(y) > 32 {
+		return nil, errors.New("invalid y coordinate")
+	}
+
+	// Uncompressed point encoding: 0x04 || x || y, with x and y padded to
+	// the curve size.
+	point := make([]byte, 65)
+	point[0] = 4
+	copy(point[1+32-len(x):33], x)
+	copy(point[33+32-len(y):], y)
+	return ecdsa.ParseUncompressedPublicKey(elliptic.P256(), point)
+}
@@ -0,0 +1,301 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"blitiri.com.ar/go/gofer/config"
+	"blitiri.com.ar/go/gofer/trace"
+)
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func jwtPayload(t *testing.T, alg, kid string, claims map[string]interface{}) string {
+	t.Helper()
+	hdr, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid})
+	cl, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b64(hdr) + "." + b64(cl)
+}
+
+func signHS256(t *testing.T, secret []byte, claims map[string]interface{}) string {
+	t.Helper()
+	p := jwtPayload(t, "HS256", "", claims)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(p))
+	return p + "." + b64(mac.Sum(nil))
+}
+
+func signRS256(t *testing.T, key *rsa.PrivateKey, kid string, claims map[string]interface{}) string {
+	t.Helper()
+	p := jwtPayload(t, "RS256", kid, claims)
+	h := sha256.Sum256([]byte(p))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, h[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p + "." + b64(sig)
+}
+
+func signES256(t *testing.T, key *ecdsa.PrivateKey, kid string, claims map[string]interface{}) string {
+	t.Helper()
+	p := jwtPayload(t, "ES256", kid, claims)
+	h := sha256.Sum256([]byte(p))
+	r, s, err := ecdsa.Sign(rand.Reader, key, h[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+	return p + "." + b64(sig)
+}
+
+func writeJWKS(t *testing.T, rsaKey *rsa.PrivateKey, ecKey *ecdsa.PrivateKey) string {
+	t.Helper()
+	ecX := make([]byte, 32)
+	ecY := make([]byte, 32)
+	ecKey.X.FillBytes(ecX)
+	ecKey.Y.FillBytes(ecY)
+	jwks := map[string]interface{}{
+		"keys": []map[string]string{
+			{
+				"kty": "RSA",
+				"kid": "rsa1",
+				"n":   b64(rsaKey.N.Bytes()),
+				"e":   b64(big.NewInt(int64(rsaKey.E)).Bytes()),
+			},
+			{
+				"kty": "EC",
+				"kid": "ec1",
+				"crv": "P-256",
+				"x":   b64(ecX),
+				"y":   b64(ecY),
+			},
+			{
+				"kty": "oct",
+				"kid": "ignored",
+			},
+		},
+	}
+	buf, _ := json.Marshal(jwks)
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, buf, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestJWTValidate(t *testing.T) {
+	secret := []byte("sekrit")
+	secretFile := filepath.Join(t.TempDir(), "secret")
+	os.WriteFile(secretFile, append(secret, '\n'), 0600)
+
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	otherEC, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	jwksFile := writeJWKS(t, rsaKey, ecKey)
+
+	now := time.Now()
+	good := map[string]interface{}{
+		"sub":    "user1",
+		"iss":    "issuer",
+		"aud":    []string{"other", "gofer"},
+		"exp":    now.Add(time.Hour).Unix(),
+		"nbf":    now.Add(-time.Hour).Unix(),
+		"groups": []string{"admin", "dev"},
+	}
+	with := func(k string, v interface{}) map[string]interface{} {
+		c := map[string]interface{}{}
+		for k, v := range good {
+			c[k] = v
+		}
+		if v == nil {
+			delete(c, k)
+		} else {
+			c[k] = v
+		}
+		return c
+	}
+
+	conf := config.JWTAuth{
+		Issuer:   "issuer",
+		Audience: "gofer",
+		Require:  map[string]string{"groups": "admin", "sub": ""},
+	}
+
+	hsConf := conf
+	hsConf.SecretFile = secretFile
+	hsKeys, err := LoadJWTKeys(hsConf)
+	if err != nil {
+		t.Fatalf("error loading secret: %v", err)
+	}
+	hs := &JWTWrapper{keys: hsKeys, conf: hsConf}
+
+	pkConf := conf
+	pkConf.JWKSFile = jwksFile
+	pkKeys, err := LoadJWTKeys(pkConf)
+	if err != nil {
+		t.Fatalf("error loading jwks: %v", err)
+	}
+	pk := &JWTWrapper{keys: pkKeys, conf: pkConf}
+
+	cases := []struct {
+		w   *JWTWrapper
+		tok string
+		err string
+	}{
+		{hs, signHS256(t, secret, good), ""},
+		{pk, signRS256(t, rsaKey, "rsa1", good), ""},
+		{pk, signES256(t, ecKey, "ec1", good), ""},
+
+		{hs, signHS256(t, []byte("bad"), good), "invalid signature"},
+		{pk, signES256(t, otherEC, "ec1", good), "invalid signature"},
+		{pk, signRS256(t, rsaKey, "ec1", good), "not an RSA key"},
+		{pk, signRS256(t, rsaKey, "unk", good), "unknown key id"},
+		{pk, signHS256(t, secret, good), "no secret for HS256"},
+		{hs, signES256(t, ecKey, "ec1", good), "no public keys loaded"},
+		{hs, jwtPayload(t, "none", "", good) + ".", "unsupported algorithm"},
+		{hs, "a.b", "malformed token"},
+		{hs, "a.b.c", "error decoding header"},
+
+		{hs, signHS256(t, secret, with("exp", now.Add(-time.Minute).Unix())),
+			"token expired"},
+		{hs, signHS256(t, secret, with("nbf", now.Add(time.Minute).Unix())),
+			"token not valid before"},
+		{hs, signHS256(t, secret, with("exp", "tomorrow")), "not a number"},
+		{hs, signHS256(t, secret, with("iss", "other")), "unexpected issuer"},
+		{hs, signHS256(t, secret, with("aud", "other")), "unexpected audience"},
+		{hs, signHS256(t, secret, with("aud", nil)), "unexpected audience"},
+		{hs, signHS256(t, secret, with("groups", []string{"dev"})),
+			`claim "groups": unexpected value`},
+		{hs, signHS256(t, secret, with("groups", "admin")), ""},
+		{hs, signHS256(t, secret, with("sub", nil)),
+			`missing required claim "sub"`},
+	}
+	for i, c := range cases {
+		_, err := c.w.validate(c.tok, now)
+		if c.err == "" && err != nil {
+			t.Errorf("%d: unexpected error: %v", i, err)
+		} else if c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err)) {
+			t.Errorf("%d: expected error %q, got %v", i, c.err, err)
+		}
+	}
+
+	// Leeway allows slightly expired tokens.
+	hs.conf.Leeway = 2 * time.Minute
+	_, err = hs.validate(
+		signHS256(t, secret, with("exp", now.Add(-time.Minute).Unix())), now)
+	if err != nil {
+		t.Errorf("expected leeway to allow token, got %v", err)
+	}
+}
+
+func TestJWTWrapper(t *testing.T) {
+	secret := []byte("sekrit")
+	secretFile := filepath.Join(t.TempDir(), "secret")
+	os.WriteFile(secretFile, secret, 0600)
+
+	conf := config.JWTAuth{
+		SecretFile:    secretFile,
+		SubjectHeader: "X-Subject",
+	}
+	keys, err := LoadJWTKeys(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var gotSubject, gotUser string
+	h := &JWTWrapper{
+		handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			gotSubject = r.Header.Get("X-Subject")
+		}),
+		keys: keys,
+		conf: conf,
+	}
+
+	do := func(auth string) *httptest.ResponseRecorder {
+		gotSubject, gotUser = "", ""
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("X-Subject", "spoofed")
+		if auth != "" {
+			r.Header.Set("Authorization", auth)
+		}
+		r = r.WithContext(trace.NewContext(r.Context(), trace.New("test", "jwt")))
+		r, user := withAuthUser(r)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		gotUser = *user
+		return w
+	}
+
+	w := do("")
+	if w.Code != 401 || w.Header().Get("WWW-Authenticate") != `Bearer realm="Authentication"` {
+		t.Errorf("no token: got %d %q", w.Code, w.Header())
+	}
+
+	w = do("Bearer " + signHS256(t, []byte("bad"), map[string]interface{}{}))
+	if w.Code != 401 || !strings.Contains(
+		w.Header().Get("WWW-Authenticate"), `error="invalid_token"`) {
+		t.Errorf("bad token: got %d %q", w.Code, w.Header())
+	}
+	if gotSubject != "" {
+		t.Errorf("bad token: handler called with subject %q", gotSubject)
+	}
+
+	w = do("bearer " + signHS256(t, secret, map[string]interface{}{"sub": "me"}))
+	if w.Code != 200 || gotSubject != "me" || gotUser != "me" {
+		t.Errorf("good token: got %d, subject %q, user %q",
+			w.Code, gotSubject, gotUser)
+	}
+}
+
+func TestLoadJWTKeysErrors(t *testing.T) {
+	dir := t.TempDir()
+	empty := filepath.Join(dir, "empty")
+	os.WriteFile(empty, []byte("\n"), 0600)
+	badJSON := filepath.Join(dir, "bad.json")
+	os.WriteFile(badJSON, []byte("{"), 0600)
+	noKeys := filepath.Join(dir, "nokeys.json")
+	os.WriteFile(noKeys, []byte(`{"keys": [{"kty": "oct"}]}`), 0600)
+	badCurve := filepath.Join(dir, "badcurve.json")
+	os.WriteFile(badCurve,
+		[]byte(`{"keys": [{"kty": "EC", "crv": "P-384"}]}`), 0600)
+
+	cases := []struct {
+		conf config.JWTAuth
+		err  string
+	}{
+		{config.JWTAuth{SecretFile: "/doesnotexist"}, "no such file"},
+		{config.JWTAuth{SecretFile: empty}, "empty secret"},
+		{config.JWTAuth{JWKSFile: "/doesnotexist"}, "no such file"},
+		{config.JWTAuth{JWKSFile: badJSON}, "unexpected end of JSON"},
+		{config.JWTAuth{JWKSFile: noKeys}, "no usable keys"},
+		{config.JWTAuth{JWKSFile: badCurve}, "unsupported curve"},
+	}
+	for _, c := range cases {
+		_, err := LoadJWTKeys(c.conf)
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%v: expected error %q, got %v", c.conf, c.err, err)
+		}
+	}
+}
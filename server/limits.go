@@ -0,0 +1,86 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net/http"
+
+	"blitiri.com.ar/go/gofer/config"
+	"blitiri.com.ar/go/gofer/trace"
+)
+
+// WithLimits rejects the requests that go over the given limits: with a 414
+// if the URL is too long, 431 if the headers are too big, and 413 if the
+// body is too big.
+// The body size is checked upfront using the Content-Length if available;
+// otherwise, reading the body fails once it goes over the limit, and the
+// connection is closed after the response.
+func WithLimits(parent http.Handler, limits config.Limits) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tr, _ := trace.FromContext(r.Context())
+
+		uri := r.RequestURI
+		if uri == "" {
+			uri = r.URL.RequestURI()
+		}
+		if limits.MaxURLLength > 0 && len(uri) > limits.MaxURLLength {
+			tr.Errorf("url too long: %d > %d", len(uri), limits.MaxURLLength)
+			http.Error(w, "url too long", http.StatusRequestURITooLong)
+			return
+		}
+
+		if max := int64(limits.MaxHeaderSize); max > 0 {
+			if size := headerSize(r); size > max {
+				tr.Errorf("headers too large: %d > %d", size, max)
+				http.Error(w, "request headers too large",
+					http.StatusRequestHeaderFieldsTooLarge)
+				return
+			}
+		}
+
+		if max := int64(limits.MaxBodySize); max > 0 {
+			if r.ContentLength > max {
+				tr.Errorf("body too large: %d > %d", r.ContentLength, max)
+				http.Error(w, "request body too large",
+					http.StatusRequestEntityTooLarge)
+				return
+			}
+			r.Body = &limitedBody{
+				ReadCloser: http.MaxBytesReader(w, r.Body, max),
+				tr:         tr,
+			}
+		}
+
+		parent.ServeHTTP(w, r)
+	})
+}
+
+// headerSize returns the size of the request headers, as they would be
+// sent over HTTP/1.1.
+func headerSize(r *http.Request) int64 {
+	size := int64(len("Host: \r\n") + len(r.Host))
+	for k, vs := range r.Header {
+		for _, v := range vs {
+			size += int64(len(k) + len(": \r\n") + len(v))
+		}
+	}
+	return size
+}
+
+// limitedBody traces when reading the body fails because it went over the
+// limit.
+type limitedBody struct {
+	io.ReadCloser
+	tr       *trace.Trace
+	exceeded bool
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	var mbErr *http.MaxBytesError
+	if !b.exceeded && errors.As(err, &mbErr) {
+		b.exceeded = true
+		b.tr.Errorf("body too large: over %d bytes", mbErr.Limit)
+	}
+	return n, err
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"blitiri.com.ar/go/gofer/config"
+)
+
+func TestLimits(t *testing.T) {
+	called := 0
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called++
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(w, "%d", len(b))
+	})
+	limits := config.Limits{
+		MaxBodySize:   10,
+		MaxHeaderSize: 200,
+		MaxURLLength:  20,
+	}
+	srv := httptest.NewServer(WithTrace("test", WithLimits(h, limits)))
+	defer srv.Close()
+
+	do := func(method, path string, body io.Reader,
+		hdr http.Header) (int, string) {
+		t.Helper()
+		req, _ := http.NewRequest(method, srv.URL+path, body)
+		for k, vs := range hdr {
+			req.Header[k] = vs
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+
+	cases := []struct {
+		method, path string
+		body         io.Reader
+		hdr          http.Header
+		status       int
+	}{
+		{"GET", "/", nil, nil, 200},
+		{"POST", "/", strings.NewReader("0123456789"), nil, 200},
+		{"GET", "/" + strings.Repeat("x", 20), nil, nil, 414},
+		{"GET", "/?q=" + strings.Repeat("x", 20), nil, nil, 414},
+		{"GET", "/", nil,
+			http.Header{"X-Big": {strings.Repeat("x", 200)}}, 431},
+		{"POST", "/", strings.NewReader("0123456789x"), nil, 413},
+	}
+	for _, c := range cases {
+		called = 0
+		status, _ := do(c.method, c.path, c.body, c.hdr)
+		if status != c.status {
+			t.Errorf("%s %s: got %d, expected %d",
+				c.method, c.path, status, c.status)
+		}
+		if c.status != 200 && called != 0 {
+			t.Errorf("%s %s: handler was called", c.method, c.path)
+		}
+	}
+
+	// Without a Content-Length, reading the body fails once it goes over
+	// the limit.
+	status, body := do("POST", "/",
+		io.MultiReader(strings.NewReader("0123456789x")), nil)
+	if status != 500 || !strings.Contains(body, "request body too large") {
+		t.Errorf("got %d %q, expected error reading the body", status, body)
+	}
+}
+
+func TestLimitsProxy(t *testing.T) {
+	be := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			b, _ := io.ReadAll(r.Body)
+			fmt.Fprintf(w, "%d", len(b))
+		}))
+	defer be.Close()
+	beURL, _ := url.Parse(be.URL)
+
+	proxy := mustProxy(t, "/", *beURL, config.ProxyOpts{})
+	srv := httptest.NewServer(WithTrace("test",
+		WithLimits(proxy, config.Limits{MaxBodySize: 10})))
+	defer srv.Close()
+
+	// Streamed bodies over the limit get a 413 from the proxy.
+	for body, status := range map[string]int{
+		"0123456789":  200,
+		"0123456789x": 413,
+	} {
+		resp, err := http.Post(srv.URL, "text/plain",
+			io.MultiReader(strings.NewReader(body)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != status {
+			t.Errorf("%q: got %d, expected %d", body, resp.StatusCode, status)
+		}
+	}
+}
+
+func TestHeaderSize(t *testing.T) {
+	r := httptest.NewRequest("GET", "http://host/", nil)
+	r.Header.Set("A", "bc")
+	r.Header.Add("A", "d")
+	// "Host: host\r\n" + "A: bc\r\n" + "A: d\r\n"
+	if size := headerSize(r); size != 12+7+6 {
+		t.Errorf("unexpected size: %d", size)
+	}
+}
@@ -0,0 +1,232 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"blitiri.com.ar/go/gofer/config"
+	"blitiri.com.ar/go/gofer/trace"
+	"blitiri.com.ar/go/gofer/util"
+)
+
+func mustProxy(t *testing.T, path string, to url.URL,
+	opts config.ProxyOpts) http.Handler {
+	t.Helper()
+	h, err := makeProxy(path, to, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func writePEM(t *testing.T, name, typ string, der []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	err := os.WriteFile(path,
+		pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// mtlsBackend starts an https server which requires the given client
+// certificate. It returns the server, and the path to its CA certificate.
+func mtlsBackend(t *testing.T, client tls.Certificate) (
+	*httptest.Server, string) {
+	leaf, err := x509.ParseCertificate(client.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(leaf)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("hola"))
+		}))
+	srv.TLS = &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  clientCAs,
+	}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	ca := writePEM(t, "ca.pem", "CERTIFICATE", srv.Certificate().Raw)
+	return srv, ca
+}
+
+func TestProxyUpstreamTLS(t *testing.T) {
+	client := selfSignedCert(t, "client")
+	cert := writePEM(t, "cert.pem", "CERTIFICATE", client.Certificate[0])
+	keyDER, err := x509.MarshalPKCS8PrivateKey(client.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := writePEM(t, "key.pem", "PRIVATE KEY", keyDER)
+
+	be, ca := mtlsBackend(t, client)
+	beURL, _ := url.Parse(be.URL)
+
+	cases := []struct {
+		tls    config.UpstreamTLS
+		status int
+	}{
+		// Unknown CA.
+		{config.UpstreamTLS{}, http.StatusBadGateway},
+		{config.UpstreamTLS{Cert: cert, Key: key}, http.StatusBadGateway},
+
+		// Missing client certificate.
+		{config.UpstreamTLS{CA: ca}, http.StatusBadGateway},
+
+		{config.UpstreamTLS{CA: ca, Cert: cert, Key: key}, http.StatusOK},
+		{config.UpstreamTLS{CA: ca, Cert: cert, Key: key,
+			ServerName: "example.com"}, http.StatusOK},
+		{config.UpstreamTLS{CA: ca, Cert: cert, Key: key,
+			ServerName: "wrong.com"}, http.StatusBadGateway},
+		{config.UpstreamTLS{Cert: cert, Key: key,
+			InsecureSkipVerify: true}, http.StatusOK},
+	}
+	for _, c := range cases {
+		h := WithTrace("test",
+			mustProxy(t, "/", *beURL, config.ProxyOpts{TLS: c.tls}))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		if w.Code != c.status {
+			t.Errorf("%+v: got %d, expected %d", c.tls, w.Code, c.status)
+		}
+	}
+
+	// Errors loading the files are reported.
+	_, err = makeProxy("/", *beURL, config.ProxyOpts{
+		TLS: config.UpstreamTLS{CA: "/does/not/exist"}})
+	if err == nil {
+		t.Errorf("expected error with missing CA file")
+	}
+	_, err = makeProxy("/", *beURL, config.ProxyOpts{
+		TLS: config.UpstreamTLS{CA: key}})
+	if err == nil {
+		t.Errorf("expected error with invalid CA file")
+	}
+}
+
+func TestRawUpstreamTLS(t *testing.T) {
+	client := selfSignedCert(t, "client")
+	be, ca := mtlsBackend(t, client)
+	addr := be.Listener.Addr().String()
+
+	b := newBackendPool("test", config.Raw{
+		To: addr, ConnectTimeout: time.Second})
+	tr := trace.New("test", "upstream tls")
+	defer tr.Finish()
+
+	dial := func(tlsConf *tls.Config) error {
+		conn, _, err := b.dial(tr, "tcp", b.order(), nil, tlsConf)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		// With TLS 1.3, client certificate errors only show up after the
+		// handshake.
+		conn.Write([]byte("GET / HTTP/1.0\r\n\r\n"))
+		_, err = conn.Read(make([]byte, 1))
+		return err
+	}
+
+	tlsConf, err := util.UpstreamTLSConfig(config.UpstreamTLS{CA: ca})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dial(tlsConf); err == nil {
+		t.Errorf("expected error without client certificate")
+	}
+
+	tlsConf.Certificates = []tls.Certificate{client}
+	if err := dial(tlsConf); err != nil {
+		t.Errorf("error dialing with client certificate: %v", err)
+	}
+
+	if err := dial(&tls.Config{}); err == nil {
+		t.Errorf("expected error with unknown CA")
+	}
+}
+
+func TestProxyTransportOpts(t *testing.T) {
+	to, _ := url.Parse("http://localhost:1234/")
+	check := func(opts config.ProxyOpts, expected *http.Transport,
+		flush time.Duration) {
+		t.Helper()
+		proxy := mustProxy(t, "/", *to, opts).(*httputil.ReverseProxy)
+		tr := proxy.Transport.(*http.Transport)
+		if tr.ResponseHeaderTimeout != expected.ResponseHeaderTimeout ||
+			tr.MaxIdleConnsPerHost != expected.MaxIdleConnsPerHost ||
+			tr.IdleConnTimeout != expected.IdleConnTimeout ||
+			tr.DisableKeepAlives != expected.DisableKeepAlives ||
+			tr.MaxConnsPerHost != expected.MaxConnsPerHost {
+			t.Errorf("%+v: unexpected transport: %+v", opts, tr)
+		}
+		if proxy.FlushInterval != flush {
+			t.Errorf("%+v: unexpected flush interval %v", opts,
+				proxy.FlushInterval)
+		}
+	}
+
+	// The defaults match http.DefaultTransport.
+	def := http.DefaultTransport.(*http.Transport)
+	check(config.ProxyOpts{}, &http.Transport{
+		MaxIdleConnsPerHost: http.DefaultMaxIdleConnsPerHost,
+		IdleConnTimeout:     def.IdleConnTimeout,
+	}, 0)
+
+	check(config.ProxyOpts{
+		ResponseHeaderTimeout: time.Second,
+		MaxIdleConns:          10,
+		IdleConnTimeout:       time.Minute,
+		DisableKeepAlives:     true,
+		MaxConns:              5,
+		FlushInterval:         time.Second,
+	}, &http.Transport{
+		ResponseHeaderTimeout: time.Second,
+		MaxIdleConnsPerHost:   10,
+		IdleConnTimeout:       time.Minute,
+		DisableKeepAlives:     true,
+		MaxConnsPerHost:       5,
+	}, time.Second)
+
+	check(config.ProxyOpts{DisableBuffering: true}, &http.Transport{
+		MaxIdleConnsPerHost: http.DefaultMaxIdleConnsPerHost,
+		IdleConnTimeout:     def.IdleConnTimeout,
+	}, -1)
+}
+
+func TestProxyResponseHeaderTimeout(t *testing.T) {
+	be := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-time.After(time.Second):
+			case <-r.Context().Done():
+			}
+		}))
+	defer be.Close()
+	beURL, _ := url.Parse(be.URL)
+
+	h := WithTrace("test", mustProxy(t, "/", *beURL, config.ProxyOpts{
+		ResponseHeaderTimeout: 50 * time.Millisecond,
+	}))
+	w := httptest.NewRecorder()
+	start := time.Now()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusGatewayTimeout || time.Since(start) > time.Second {
+		t.Errorf("got %d after %v, expected 504 quickly",
+			w.Code, time.Since(start))
+	}
+}
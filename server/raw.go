@@ -4,19 +4,25 @@ import (
 	"crypto/tls"
 	"fmt"
 	"net"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"blitiri.com.ar/go/gofer/config"
 	"blitiri.com.ar/go/gofer/ipratelimit"
+	"blitiri.com.ar/go/gofer/proxyproto"
 	"blitiri.com.ar/go/gofer/ratelimit"
 	"blitiri.com.ar/go/gofer/reqlog"
 	"blitiri.com.ar/go/gofer/trace"
 	"blitiri.com.ar/go/gofer/util"
 	"blitiri.com.ar/go/log"
-	"blitiri.com.ar/go/systemd"
 )
 
 func Raw(addr string, conf config.Raw) error {
+	if conf.UDP {
+		return rawUDP(addr, conf)
+	}
+
 	var err error
 
 	var tlsConfig *tls.Config
@@ -25,21 +31,43 @@ func Raw(addr string, conf config.Raw) error {
 		if err != nil {
 			return log.Errorf("error loading certs: %v", err)
 		}
+		err = util.ApplyTLSOptions(tlsConfig, conf.TLS)
+		if err != nil {
+			return log.Errorf("error applying tls options: %v", err)
+		}
 	}
 
-	var lis net.Listener
-	if tlsConfig != nil {
-		lis, err = systemd.Listen("tcp", addr)
-		lis = tls.NewListener(lis, tlsConfig)
-	} else {
-		lis, err = systemd.Listen("tcp", addr)
-	}
+	lis, err := listen(addr, conf.UnixSocket)
 	if err != nil {
 		return log.Errorf("Raw proxy error listening on %q: %v", addr, err)
 	}
+	lis, err = withProxyProtocol(addr, lis, conf.ProxyProtocol)
+	if err != nil {
+		return err
+	}
+	if tlsConfig != nil && len(conf.SNI) == 0 {
+		// When routing by SNI, TLS is terminated (if needed) after looking
+		// at the ClientHello.
+		lis = tls.NewListener(lis, tlsConfig)
+	}
 
-	rlog := reqlog.FromName(conf.ReqLog)
-	lim := ratelimit.FromName(conf.RateLimit)
+	var upstreamTLS *tls.Config
+	if conf.ToTLS {
+		upstreamTLS, err = util.UpstreamTLSConfig(conf.UpstreamTLS)
+		if err != nil {
+			return log.Errorf("error loading upstream tls config: %v", err)
+		}
+	}
+
+	p := &rawProxy{
+		conf:        conf,
+		tlsConfig:   tlsConfig,
+		upstreamTLS: upstreamTLS,
+		rlog:        reqlog.FromName(conf.ReqLog),
+		lim:         ratelimit.FromName(conf.RateLimit),
+		conns:       newConnLimiter(conf.MaxConns, conf.MaxConnsPerIP),
+		backends:    newBackendPool(addr, conf),
+	}
 
 	log.Infof("%s raw proxy starting on %q", addr, lis.Addr())
 	for {
@@ -48,86 +76,270 @@ func Raw(addr string, conf config.Raw) error {
 			return log.Errorf("%s error accepting: %v", addr, err)
 		}
 
-		go forward(conn, conf.To, conf.ToTLS, rlog, lim)
+		go p.forward(conn)
+	}
+}
+
+// rawProxy forwards the connections of a raw listener.
+type rawProxy struct {
+	conf      config.Raw
+	tlsConfig *tls.Config
+
+	// TLS configuration for the connections to the backends, if to_tls is
+	// set; nil otherwise.
+	upstreamTLS *tls.Config
+
+	rlog     *reqlog.Log
+	lim      *ipratelimit.Limiter
+	conns    *connLimiter
+	backends *backendPool
+}
+
+// addrIP returns the IP of a TCP or UDP address, or nil for other kinds of
+// addresses.
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	default:
+		return nil
 	}
 }
 
 func allowed(addr net.Addr, lim *ipratelimit.Limiter) bool {
-	// We only support raw proxying over TCP, so we can assume the address is
-	// a TCP address. If not, fail-open just to be safe.
-	tcpAddr, ok := addr.(*net.TCPAddr)
-	if !ok {
+	// We only support raw proxying over TCP and UDP, so we can assume the
+	// address is one of those. If not, fail-open just to be safe.
+	ip := addrIP(addr)
+	if ip == nil {
 		ratelimit.Trace(lim).Errorf(
-			"[raw] non-TCP address %q", addr)
+			"[raw] non-TCP/UDP address %q", addr)
 		return true
 	}
 
-	if !lim.Allow(tcpAddr.IP) {
+	if !lim.Allow(ip) {
 		ratelimit.Trace(lim).Printf(
-			"[raw] rate limit exceeded for %q", tcpAddr.IP)
+			"[raw] rate limit exceeded for %q", ip)
 		return false
 	}
 
 	return true
 }
 
-func forward(src net.Conn, dstAddr string, dstTLS bool,
-	rlog *reqlog.Log, lim *ipratelimit.Limiter) {
+func (p *rawProxy) forward(src net.Conn) {
 	defer src.Close()
 	start := time.Now()
+	dstTLS := p.upstreamTLS
 
-	if lim != nil && !allowed(src.RemoteAddr(), lim) {
+	if p.lim != nil && !allowed(src.RemoteAddr(), p.lim) {
 		return
 	}
 
-	tr := trace.New("raw", fmt.Sprintf("%s -> %s", src.LocalAddr(), dstAddr))
+	tr := trace.New("raw", fmt.Sprintf("%s -> %s", src.LocalAddr(),
+		strings.Join(p.backends.addrs, ",")))
 	defer tr.Finish()
 
+	if err := proxyHeaderErr(src); err != nil {
+		tr.Errorf("%s error reading PROXY header: %v", src.RemoteAddr(), err)
+		return
+	}
+
 	tr.Printf("remote: %s ", src.RemoteAddr())
+
+	ip := addrIP(src.RemoteAddr())
+	if !p.conns.acquire(ip) {
+		tr.Errorf("%s connection limit reached", src.RemoteAddr())
+		p.log(src, "", 503, 0, 0, start)
+		return
+	}
+	defer p.conns.release(ip)
+
+	backends := p.backends.order()
+	if len(p.conf.SNI) > 0 {
+		hello, conn, err := peekClientHello(src)
+		if err != nil {
+			tr.Errorf("%s error reading ClientHello: %v",
+				src.RemoteAddr(), err)
+			return
+		}
+		src = conn
+
+		if backend, ok := util.LookupHost(p.conf.SNI, hello.ServerName); ok {
+			tr.Printf("sni %q -> %s (passthrough)", hello.ServerName, backend)
+			backends, dstTLS = []string{backend}, nil
+		} else if p.tlsConfig != nil {
+			tr.Printf("sni %q -> terminating tls", hello.ServerName)
+			src = tls.Server(src, p.tlsConfig)
+		} else {
+			tr.Printf("sni %q -> default (passthrough)", hello.ServerName)
+		}
+	}
+
 	tr.Printf("%s -> %s (tls=%v)",
-		src.LocalAddr(), dstAddr, dstTLS)
+		src.LocalAddr(), strings.Join(backends, ","), dstTLS != nil)
 
-	var dst net.Conn
-	var err error
-	if dstTLS {
-		dst, err = tls.Dial("tcp", dstAddr, nil)
-	} else {
-		dst, err = net.Dial("tcp", dstAddr)
+	// The PROXY header goes in plain text before anything else, even if we
+	// are using TLS towards the backend.
+	var hdr []byte
+	if p.conf.ToProxyProtocol != 0 {
+		var err error
+		hdr, err = proxyproto.Header(
+			p.conf.ToProxyProtocol, src.RemoteAddr(), src.LocalAddr())
+		if err != nil {
+			tr.Errorf("error building PROXY header: %v", err)
+			return
+		}
 	}
 
+	dst, backend, err := p.backends.dial(tr, "tcp", backends, hdr, dstTLS)
 	if err != nil {
-		tr.Errorf("%s error dialing %v : %v", src.LocalAddr(), dstAddr, err)
-		if rlog != nil {
-			rlog.Log(&reqlog.Event{
-				T: time.Now(),
-				R: &reqlog.RawRequest{
-					RemoteAddr: src.RemoteAddr(),
-					LocalAddr:  src.LocalAddr(),
-				},
-				Status:  500,
-				Latency: time.Since(start),
-			})
-		}
+		tr.Errorf("%s could not connect to any backend: %v",
+			src.LocalAddr(), err)
+		p.log(src, "", 502, 0, 0, start)
 		return
 	}
 	defer dst.Close()
 
-	tr.Printf("dial complete: %v -> %v", dst.LocalAddr(), dst.RemoteAddr())
+	conn := &activityConn{Conn: src}
+	conn.touch()
+	stop := p.watchdog(tr, conn, dst, start)
+	up, down := util.BidirCopy(conn, dst)
+	stop()
+
+	tr.Printf("copy complete: %d bytes up, %d bytes down", up, down)
+	p.log(src, backend, 200, up, down, start)
+}
+
+// watchdog closes the connections when they have been idle for longer than
+// the idle timeout, or open for longer than the maximum duration.
+// Returns a function to stop it.
+func (p *rawProxy) watchdog(tr *trace.Trace, src *activityConn, dst net.Conn,
+	start time.Time) func() {
+	idle, maxDuration := p.conf.IdleTimeout, p.conf.MaxDuration
+	if idle == 0 && maxDuration == 0 {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		for {
+			// Wake up at the earliest time we could need to close.
+			var next time.Time
+			if maxDuration > 0 {
+				next = start.Add(maxDuration)
+			}
+			if idle > 0 {
+				t := src.lastActivity().Add(idle)
+				if next.IsZero() || t.Before(next) {
+					next = t
+				}
+			}
+
+			timer := time.NewTimer(time.Until(next))
+			select {
+			case <-done:
+				timer.Stop()
+				return
+			case now := <-timer.C:
+				if maxDuration > 0 && now.Sub(start) >= maxDuration {
+					tr.Printf("max duration reached")
+				} else if idle > 0 && now.Sub(src.lastActivity()) >= idle {
+					tr.Printf("idle timeout")
+				} else {
+					continue
+				}
+				src.Close()
+				dst.Close()
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+func (p *rawProxy) log(src net.Conn, backend string, status int,
+	up, down int64, start time.Time) {
+	if p.rlog == nil {
+		return
+	}
+	p.rlog.Log(&reqlog.Event{
+		T: time.Now(),
+		R: &reqlog.RawRequest{
+			RemoteAddr: src.RemoteAddr(),
+			LocalAddr:  src.LocalAddr(),
+			Backend:    backend,
+		},
+		Status:    status,
+		Length:    up + down,
+		BytesUp:   up,
+		BytesDown: down,
+		Latency:   time.Since(start),
+	})
+}
+
+// activityConn is a connection that keeps track of when it was last used.
+type activityConn struct {
+	net.Conn
+
+	// Last activity, as Unix nanoseconds.
+	last atomic.Int64
+}
+
+func (c *activityConn) touch() {
+	c.last.Store(time.Now().UnixNano())
+}
+
+func (c *activityConn) lastActivity() time.Time {
+	return time.Unix(0, c.last.Load())
+}
+
+func (c *activityConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.touch()
+	}
+	return n, err
+}
+
+func (c *activityConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.touch()
+	}
+	return n, err
+}
 
-	nbytes := util.BidirCopy(src, dst)
-	latency := time.Since(start)
+// NetConn returns the underlying connection.
+func (c *activityConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// withProxyProtocol wraps the listener to accept the PROXY protocol, if it is
+// enabled in the configuration.
+func withProxyProtocol(addr string, lis net.Listener,
+	conf *config.ProxyProtocol) (net.Listener, error) {
+	if conf == nil {
+		return lis, nil
+	}
 
-	tr.Printf("copy complete")
-	if rlog != nil {
-		rlog.Log(&reqlog.Event{
-			T: time.Now(),
-			R: &reqlog.RawRequest{
-				RemoteAddr: src.RemoteAddr(),
-				LocalAddr:  src.LocalAddr(),
-			},
-			Status:  200,
-			Length:  nbytes,
-			Latency: latency,
-		})
+	nets, err := conf.Networks()
+	if err != nil {
+		return nil, log.Errorf("%s proxy_protocol: %v", addr, err)
+	}
+
+	log.Infof("%s accepting PROXY protocol from %q", addr, conf.Trusted)
+	return proxyproto.NewListener(lis, nets, conf.Timeout), nil
+}
+
+// proxyHeaderErr returns the error reading the PROXY header of the
+// connection, if any.
+func proxyHeaderErr(conn net.Conn) error {
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn = tc.NetConn()
+	}
+	if pc, ok := conn.(*proxyproto.Conn); ok {
+		return pc.HeaderErr()
 	}
+	return nil
 }
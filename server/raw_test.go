@@ -1,15 +1,24 @@
 package server
 
 import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"math/big"
 	"net"
 	"testing"
 	"time"
 
 	"blitiri.com.ar/go/gofer/config"
+	"blitiri.com.ar/go/gofer/proxyproto"
 	"blitiri.com.ar/go/gofer/ratelimit"
 )
 
-func TestAllowedOnNonTCP(t *testing.T) {
+func TestAllowedOnNonTCPUDP(t *testing.T) {
 	// Use a rate limit with 0 requests per second to disable ratelimiting.
 	ratelimit.FromConfig("test-rl", config.RateLimit{
 		Rate: config.Rate{Requests: 0, Period: time.Second}})
@@ -19,12 +28,16 @@ func TestAllowedOnNonTCP(t *testing.T) {
 	if allowed(tcp, rl) {
 		t.Errorf("allowed(tcp %v) = true, expected false", tcp)
 	}
+	udp := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}
+	if allowed(udp, rl) {
+		t.Errorf("allowed(udp %v) = true, expected false", udp)
+	}
 
-	// Try a few different non-TCP addresses, to make sure we fail-open on
+	// Try a few different other addresses, to make sure we fail-open on
 	// them.
 	addrs := []net.Addr{
-		&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234},
 		&net.IPAddr{IP: net.IPv4(127, 0, 0, 1)},
+		&net.UnixAddr{Name: "/sock", Net: "unix"},
 	}
 	for _, addr := range addrs {
 		if !allowed(addr, rl) {
@@ -32,3 +45,220 @@ func TestAllowedOnNonTCP(t *testing.T) {
 		}
 	}
 }
+
+func selfSignedCert(t *testing.T, host string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestPeekClientHello(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	errc := make(chan error, 1)
+	go func() {
+		c := tls.Client(client, &tls.Config{
+			ServerName:         "a.com",
+			InsecureSkipVerify: true,
+		})
+		if err := c.Handshake(); err != nil {
+			errc <- err
+			return
+		}
+		_, err := c.Write([]byte("hola"))
+		errc <- err
+	}()
+
+	hello, conn, err := peekClientHello(server)
+	if err != nil {
+		t.Fatalf("error peeking: %v", err)
+	}
+	if hello.ServerName != "a.com" {
+		t.Errorf("unexpected server name %q", hello.ServerName)
+	}
+
+	// The returned connection must still have the ClientHello, so the
+	// handshake can complete.
+	tc := tls.Server(conn, &tls.Config{
+		Certificates: []tls.Certificate{selfSignedCert(t, "a.com")},
+	})
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(tc, buf); err != nil || string(buf) != "hola" {
+		t.Errorf("read %q, %v", buf, err)
+	}
+	if err := <-errc; err != nil {
+		t.Errorf("client error: %v", err)
+	}
+
+	// Not TLS.
+	client, server = net.Pipe()
+	go client.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	if _, _, err := peekClientHello(server); err == nil {
+		t.Errorf("expected error on non-TLS connection")
+	}
+	client.Close()
+	server.Close()
+}
+
+func TestForwardTimeouts(t *testing.T) {
+	// Backend which echoes back everything.
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	go func() {
+		for {
+			c, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(c, c)
+		}
+	}()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+
+	check := func(conf config.Raw, ping bool) time.Duration {
+		t.Helper()
+		conf.To = backend.Addr().String()
+		p := &rawProxy{
+			conf:     conf,
+			conns:    newConnLimiter(0, 0),
+			backends: newBackendPool("test", conf),
+		}
+
+		c, err := net.Dial("tcp", lis.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		src, err := lis.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		go p.forward(src)
+
+		start := time.Now()
+		buf := make([]byte, 4)
+		for {
+			if ping {
+				c.Write([]byte("ping"))
+			}
+			c.SetReadDeadline(time.Now().Add(2 * time.Second))
+			if _, err := io.ReadFull(c, buf); err != nil {
+				break
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		return time.Since(start)
+	}
+
+	// Idle connections are closed.
+	if d := check(config.Raw{IdleTimeout: 100 * time.Millisecond}, false); d > time.Second {
+		t.Errorf("idle connection took %v to close", d)
+	}
+
+	// Active connections are closed after the maximum duration, but not
+	// because of the idle timeout.
+	d := check(config.Raw{
+		IdleTimeout: 100 * time.Millisecond,
+		MaxDuration: 500 * time.Millisecond,
+	}, true)
+	if d < 400*time.Millisecond || d > 1500*time.Millisecond {
+		t.Errorf("active connection took %v to close", d)
+	}
+}
+
+func TestForwardProxyProtocolTLS(t *testing.T) {
+	// Backend which expects a PROXY header in plain text, followed by the
+	// TLS handshake; and then echoes back everything.
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	srcAddr := make(chan net.Addr, 1)
+	go func() {
+		c, err := backend.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		r := bufio.NewReader(c)
+		src, _, err := proxyproto.ReadHeader(r)
+		if err != nil {
+			t.Errorf("error reading PROXY header: %v", err)
+			return
+		}
+		srcAddr <- src
+		if b, err := r.Peek(1); err != nil || b[0] != 0x16 {
+			t.Errorf("expected a TLS handshake after the header, got %q, %v",
+				b, err)
+			return
+		}
+		tc := tls.Server(&prefixConn{Conn: c, r: r}, &tls.Config{
+			Certificates: []tls.Certificate{selfSignedCert(t, "localhost")},
+		})
+		io.Copy(tc, tc)
+	}()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+
+	conf := config.Raw{
+		To:              backend.Addr().String(),
+		ToTLS:           true,
+		ToProxyProtocol: 1,
+	}
+	p := &rawProxy{
+		conf:        conf,
+		upstreamTLS: &tls.Config{InsecureSkipVerify: true},
+		conns:       newConnLimiter(0, 0),
+		backends:    newBackendPool("test", conf),
+	}
+
+	c, err := net.Dial("tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	src, err := lis.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go p.forward(src)
+
+	c.Write([]byte("ping"))
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("got %q, %v", buf, err)
+	}
+	if got := <-srcAddr; got.String() != c.LocalAddr().String() {
+		t.Errorf("PROXY header has source %v, expected %v",
+			got, c.LocalAddr())
+	}
+}
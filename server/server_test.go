@@ -219,6 +219,103 @@ func TestAdjustPathPanic(t *testing.T) {
 	adjustPath("/req", "/from", "/to")
 }
 
+func TestHTTPSRedirect(t *testing.T) {
+	cases := []struct {
+		port, method, url string
+		status            int
+		expected          string
+	}{
+		{"443", "GET", "http://a.com/", 301, "https://a.com/"},
+		{"443", "GET", "http://a.com:80/x?y=z", 301, "https://a.com/x?y=z"},
+		{"443", "HEAD", "http://a.com/x%2Fy", 301, "https://a.com/x%2Fy"},
+		{"443", "POST", "http://a.com/p", 308, "https://a.com/p"},
+		{"8443", "PUT", "http://a.com:8080/p", 308, "https://a.com:8443/p"},
+		{"443", "GET", "http://[::1]:80/", 301, "https://[::1]/"},
+		{"8443", "GET", "http://[::1]/", 301, "https://[::1]:8443/"},
+	}
+	for _, c := range cases {
+		h := WithTrace("test", makeHTTPSRedirect(c.port))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(c.method, c.url, nil))
+
+		loc := w.Result().Header.Get("Location")
+		if w.Code != c.status || loc != c.expected {
+			t.Errorf("%s %s (port %s): got %d %q, expected %d %q",
+				c.method, c.url, c.port, w.Code, loc,
+				c.status, c.expected)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	trusted, _ := config.ParseNetworks([]string{"10.0.0.0/8", "::1"})
+	cases := []struct {
+		remote   string
+		hdrs     map[string]string
+		expected string
+	}{
+		// Not from a trusted proxy, the headers are ignored.
+		{"1.1.1.1:80", map[string]string{"X-Forwarded-For": "2.2.2.2"},
+			"1.1.1.1:80"},
+
+		// From a trusted proxy, without headers, or without usable
+		// addresses in them; the remote address is left alone.
+		{"10.0.0.1:80", nil, "10.0.0.1:80"},
+		{"10.0.0.1:80", map[string]string{"X-Forwarded-For": ""},
+			"10.0.0.1:80"},
+		{"10.0.0.1:80", map[string]string{"X-Forwarded-For": "garbage"},
+			"10.0.0.1:80"},
+		{"10.0.0.1:80", map[string]string{"Forwarded": "proto=https"},
+			"10.0.0.1:80"},
+
+		{"10.0.0.1:80", map[string]string{"X-Forwarded-For": "2.2.2.2"},
+			"2.2.2.2:0"},
+		{"[::1]:80", map[string]string{
+			"X-Forwarded-For": "3.3.3.3, 2.2.2.2, 10.0.0.2"},
+			"2.2.2.2:0"},
+		{"10.0.0.1:80", map[string]string{
+			"X-Forwarded-For": "10.0.0.3, 10.0.0.2"},
+			"10.0.0.3:0"},
+		{"10.0.0.1:80", map[string]string{
+			"X-Forwarded-For": "2.2.2.2, garbage, 10.0.0.2"},
+			"10.0.0.2:0"},
+
+		// Forwarded is preferred over X-Forwarded-For.
+		{"10.0.0.1:80", map[string]string{
+			"X-Forwarded-For": "3.3.3.3",
+			"Forwarded":       `for=2.2.2.2;proto=https, For="[2001:db8::1]:123"`},
+			"[2001:db8::1]:0"},
+		{"10.0.0.1:80", map[string]string{
+			"Forwarded": `for="2.2.2.2:123", for="10.0.0.2"`},
+			"2.2.2.2:0"},
+		{"10.0.0.1:80", map[string]string{
+			"Forwarded": `for=2.2.2.2, for=unknown`},
+			"10.0.0.1:80"},
+		{"10.0.0.1:80", map[string]string{
+			"Forwarded": `for=2.2.2.2, proto=http`},
+			"10.0.0.1:80"},
+	}
+	for _, c := range cases {
+		var got string
+		h := WithTrustedProxies(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				got = r.RemoteAddr
+			}), trusted)
+
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = c.remote
+		for k, v := range c.hdrs {
+			r.Header.Set(k, v)
+		}
+		h.ServeHTTP(httptest.NewRecorder(), r)
+
+		if got != c.expected {
+			t.Errorf("%s %v: got %q, expected %q",
+				c.remote, c.hdrs, got, c.expected)
+		}
+	}
+}
+
 func TestRateLimitRequestErrors(t *testing.T) {
 	// WithRateLimit needs to split host and port, and parse the host IP
 	// address. We don't expect either to fail, due to the nature of the
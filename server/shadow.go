@@ -0,0 +1,471 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"html/template"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httputil"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"blitiri.com.ar/go/gofer/config"
+	"blitiri.com.ar/go/gofer/trace"
+	"blitiri.com.ar/go/log"
+)
+
+// Defaults for the shadow settings.
+const (
+	defaultShadowPercent = 100
+	defaultShadowMaxBody = 64 * 1024
+)
+
+// How long to wait for the shadow backend, and how many requests can be in
+// flight to it at the same time; requests over that are not copied, so a
+// slow shadow backend can't pile them up.
+var (
+	shadowTimeout     = 30 * time.Second
+	shadowMaxInFlight = 100
+)
+
+// shadow is a handler that sends the requests to the primary handler, and
+// copies some of them to a shadow backend, recording how their responses
+// differ.
+type shadow struct {
+	name    string
+	conf    config.Shadow
+	primary http.Handler
+	proxy   http.Handler
+
+	inFlight chan struct{}
+
+	stats shadowStats
+
+	// Count of (primary, shadow) status pairs that didn't match.
+	mismatchesMu sync.Mutex
+	mismatches   map[[2]int]int64
+}
+
+type shadowStats struct {
+	sent, skipped, dropped, errors atomic.Int64
+	matches, mismatches, aborted   atomic.Int64
+
+	// Total latencies of the requests that were compared (matches and
+	// mismatches), to compute averages.
+	primaryLatency, shadowLatency atomic.Int64
+}
+
+// Global registry of shadows, for the debug handler.
+var (
+	shadowsMu sync.Mutex
+	shadows   = map[string]*shadow{}
+)
+
+// newShadow returns a handler that sends the requests to primary, and
+// copies them to the shadow backend according to conf.
+func newShadow(name, path string, conf config.Shadow, primary http.Handler) (
+	*shadow, error) {
+	if conf.Percent == 0 {
+		conf.Percent = defaultShadowPercent
+	}
+	if conf.MaxBody == 0 {
+		conf.MaxBody = defaultShadowMaxBody
+	}
+
+	proxy, err := makeProxy(path, conf.URL.URL(), config.ProxyOpts{
+		HTTP2: conf.HTTP2,
+		TLS:   conf.TLS,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Keep track of the backend errors, to tell them apart from error
+	// responses.
+	rp := proxy.(*httputil.ReverseProxy)
+	rp.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		if dw, ok := w.(*discardWriter); ok {
+			dw.err = err
+		}
+		proxyErrorHandler(w, r, err)
+	}
+
+	s := &shadow{
+		name:       name,
+		conf:       conf,
+		primary:    primary,
+		proxy:      proxy,
+		inFlight:   make(chan struct{}, shadowMaxInFlight),
+		mismatches: map[[2]int]int64{},
+	}
+
+	shadowsMu.Lock()
+	shadows[name] = s
+	shadowsMu.Unlock()
+
+	return s, nil
+}
+
+type shadowResult struct {
+	status  int
+	latency time.Duration
+	err     error
+
+	// The primary handler was aborted (it panicked, e.g. with
+	// http.ErrAbortHandler when the client goes away mid-response).
+	aborted bool
+}
+
+func (s *shadow) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if rand.Float64()*100 >= s.conf.Percent {
+		s.primary.ServeHTTP(w, r)
+		return
+	}
+
+	tr, _ := trace.FromContext(r.Context())
+
+	// Protocol upgrades (like websockets) can't be copied.
+	if r.Header.Get("Upgrade") != "" {
+		s.stats.skipped.Add(1)
+		tr.Printf("shadow: skipped, protocol upgrade")
+		s.primary.ServeHTTP(w, r)
+		return
+	}
+
+	body, ok := s.readBody(r)
+	if !ok {
+		s.stats.skipped.Add(1)
+		tr.Printf("shadow: skipped, body too large")
+		s.primary.ServeHTTP(w, r)
+		return
+	}
+
+	select {
+	case s.inFlight <- struct{}{}:
+	default:
+		s.stats.dropped.Add(1)
+		tr.Printf("shadow: dropped, too many requests in flight")
+		s.primary.ServeHTTP(w, r)
+		return
+	}
+
+	// Send the copy right away, so both backends get the request at about
+	// the same time.
+	str := trace.New("shadow", s.name+" "+r.Host+r.URL.String())
+	str.Printf("%s %s %s %s %s",
+		r.RemoteAddr, r.Proto, r.Method, r.Host, r.URL.String())
+	tr.Printf("shadow: sending copy to %s", s.conf.URL)
+
+	// The copy must not be canceled when the original request finishes.
+	ctx, cancel := context.WithTimeout(context.Background(), shadowTimeout)
+	req := r.Clone(trace.NewContext(ctx, str))
+	req.Body = http.NoBody
+	if len(body) > 0 {
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	req.ContentLength = int64(len(body))
+	req.TransferEncoding = nil
+
+	result := make(chan shadowResult, 1)
+	go func() {
+		defer cancel()
+		result <- s.send(req)
+		<-s.inFlight
+	}()
+
+	// Compare from a defer, so it's done even if the primary handler
+	// panics; otherwise the shadow trace would never be finished.
+	start := time.Now()
+	sw := &shadowStatusWriter{ResponseWriter: w}
+	aborted := true
+	defer func() {
+		primary := shadowResult{
+			status:  sw.status,
+			latency: time.Since(start),
+			aborted: aborted,
+		}
+		if primary.status == 0 && !aborted {
+			primary.status = http.StatusOK
+		}
+		go s.compare(str, r.Method, primary, result)
+	}()
+	s.primary.ServeHTTP(sw, r)
+	aborted = false
+}
+
+// readBody reads the request body, so it can be sent to both backends.
+// It returns false if the body is over the limit, in which case the
+// request should not be copied. Either way, r.Body is replaced so the
+// primary handler can read the full body.
+func (s *shadow) readBody(r *http.Request) ([]byte, bool) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, true
+	}
+	max := int64(s.conf.MaxBody)
+	if r.ContentLength > max {
+		return nil, false
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, max+1))
+
+	// The primary gets what we've read, followed by the rest (if any).
+	r.Body = &multiReadCloser{
+		Reader: io.MultiReader(bytes.NewReader(body), r.Body),
+		Closer: r.Body,
+	}
+	if err != nil || int64(len(body)) > max {
+		return nil, false
+	}
+	return body, true
+}
+
+type multiReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// send the copy of the request to the shadow backend, and return the
+// result. The response itself is discarded.
+func (s *shadow) send(req *http.Request) shadowResult {
+	start := time.Now()
+	dw := &discardWriter{header: http.Header{}, status: http.StatusOK}
+	s.proxy.ServeHTTP(dw, req)
+	return shadowResult{
+		status:  dw.status,
+		latency: time.Since(start),
+		err:     dw.err,
+	}
+}
+
+// compare the result of the primary and the shadow backends, once both
+// are done, and record the differences.
+func (s *shadow) compare(str *trace.Trace, method string,
+	primary shadowResult, result chan shadowResult) {
+	defer str.Finish()
+	res := <-result
+
+	s.stats.sent.Add(1)
+	if res.err != nil {
+		s.stats.errors.Add(1)
+	}
+
+	// If the primary was aborted, we don't know its full response, so
+	// there's nothing to compare.
+	if primary.aborted {
+		s.stats.aborted.Add(1)
+		str.Printf("primary: aborted after %v, shadow: %d in %v",
+			primary.latency, res.status, res.latency)
+		return
+	}
+
+	s.stats.primaryLatency.Add(int64(primary.latency))
+	s.stats.shadowLatency.Add(int64(res.latency))
+	str.Printf("primary: %d in %v, shadow: %d in %v (%+v)",
+		primary.status, primary.latency, res.status, res.latency,
+		res.latency-primary.latency)
+
+	if res.status == primary.status {
+		s.stats.matches.Add(1)
+		return
+	}
+
+	s.stats.mismatches.Add(1)
+	s.mismatchesMu.Lock()
+	s.mismatches[[2]int{primary.status, res.status}]++
+	s.mismatchesMu.Unlock()
+
+	str.Printf("status mismatch: %s got %d from primary, %d from shadow",
+		method, primary.status, res.status)
+	str.SetError()
+}
+
+// shadowStatusWriter records the status of the primary response.
+type shadowStatusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *shadowStatusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *shadowStatusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap is used by ResponseController to get the underlying
+// http.ResponseWriter, for flushing and hijacking.
+func (w *shadowStatusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// discardWriter is an http.ResponseWriter that discards the response,
+// keeping only the status and backend errors (if any).
+type discardWriter struct {
+	header http.Header
+	status int
+	wrote  bool
+	err    error
+}
+
+func (w *discardWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *discardWriter) WriteHeader(status int) {
+	// Skip informational (1xx) responses.
+	if !w.wrote && status >= 200 {
+		w.status = status
+		w.wrote = true
+	}
+}
+
+func (w *discardWriter) Write(b []byte) (int, error) {
+	w.wrote = true
+	return len(b), nil
+}
+
+// ShadowDebugHandler shows the shadows and their statistics.
+func ShadowDebugHandler(w http.ResponseWriter, r *http.Request) {
+	type mismatch struct {
+		Primary, Shadow int
+		Count           int64
+	}
+	type row struct {
+		Name, URL                      string
+		Percent                        float64
+		MaxBody                        config.ByteSize
+		Sent, Skipped, Dropped, Errors int64
+		Matches, Mismatches, Aborted   int64
+		PrimaryLatency, ShadowLatency  time.Duration
+		LatencyDiff                    time.Duration
+		StatusMismatches               []mismatch
+	}
+
+	shadowsMu.Lock()
+	rows := []row{}
+	for name, s := range shadows {
+		rw := row{
+			Name:       name,
+			URL:        s.conf.URL.String(),
+			Percent:    s.conf.Percent,
+			MaxBody:    s.conf.MaxBody,
+			Sent:       s.stats.sent.Load(),
+			Skipped:    s.stats.skipped.Load(),
+			Dropped:    s.stats.dropped.Load(),
+			Errors:     s.stats.errors.Load(),
+			Matches:    s.stats.matches.Load(),
+			Mismatches: s.stats.mismatches.Load(),
+			Aborted:    s.stats.aborted.Load(),
+		}
+		if n := rw.Matches + rw.Mismatches; n > 0 {
+			rw.PrimaryLatency = time.Duration(
+				s.stats.primaryLatency.Load() / n)
+			rw.ShadowLatency = time.Duration(
+				s.stats.shadowLatency.Load() / n)
+			rw.LatencyDiff = rw.ShadowLatency - rw.PrimaryLatency
+		}
+
+		s.mismatchesMu.Lock()
+		for k, c := range s.mismatches {
+			rw.StatusMismatches = append(rw.StatusMismatches,
+				mismatch{k[0], k[1], c})
+		}
+		s.mismatchesMu.Unlock()
+		sort.Slice(rw.StatusMismatches, func(i, j int) bool {
+			a, b := rw.StatusMismatches[i], rw.StatusMismatches[j]
+			if a.Count != b.Count {
+				return a.Count > b.Count
+			}
+			return a.Primary < b.Primary ||
+				(a.Primary == b.Primary && a.Shadow < b.Shadow)
+		})
+
+		rows = append(rows, rw)
+	}
+	shadowsMu.Unlock()
+
+	sort.Slice(rows, func(i, j int) bool { return rows[i].Name < rows[j].Name })
+
+	if err := htmlShadowDebug.Execute(w, rows); err != nil {
+		log.Infof("shadow debug handler error: %v", err)
+	}
+}
+
+var htmlShadowDebug = template.Must(template.New("shadow").Parse(
+	`<!DOCTYPE html>
+<html>
+
+<head>
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>shadow</title>
+<style type="text/css">
+  body {
+    font-family: sans-serif;
+  }
+  @media (prefers-color-scheme: dark) {
+    body {
+      background: #121212;
+      color: #c9d1d9;
+    }
+    a { color: #44b4ec; }
+  }
+  table {
+    text-align: right;
+  }
+  td, th {
+    padding: 0.15em 0.5em;
+  }
+  th {
+    text-align: left;
+  }
+</style>
+</head>
+
+<body>
+{{range .}}
+<h1>{{.Name}}</h1>
+
+<p>
+Copying {{.Percent}}% of the requests (with bodies up to {{.MaxBody}})
+to {{.URL}}.
+<a href="/debug/traces?fam=shadow&b=0">Traces</a>,
+<a href="/debug/traces?fam=shadow&b=-2">mismatches and errors</a>.
+</p>
+
+<table>
+<tr><th>sent</th><td>{{.Sent}}</td></tr>
+<tr><th>skipped</th><td>{{.Skipped}}</td></tr>
+<tr><th>dropped</th><td>{{.Dropped}}</td></tr>
+<tr><th>backend errors</th><td>{{.Errors}}</td></tr>
+<tr><th>status matches</th><td>{{.Matches}}</td></tr>
+<tr><th>status mismatches</th><td>{{.Mismatches}}</td></tr>
+<tr><th>primary aborted</th><td>{{.Aborted}}</td></tr>
+<tr><th>avg primary latency</th><td>{{.PrimaryLatency}}</td></tr>
+<tr><th>avg shadow latency</th><td>{{.ShadowLatency}}</td></tr>
+<tr><th>avg latency difference</th><td>{{.LatencyDiff}}</td></tr>
+</table>
+
+{{if .StatusMismatches}}
+<h2>Status mismatches</h2>
+<table>
+<tr><th>primary</th><th>shadow</th><th>count</th></tr>
+{{range .StatusMismatches}}
+<tr><td>{{.Primary}}</td><td>{{.Shadow}}</td><td>{{.Count}}</td></tr>
+{{end}}
+</table>
+{{end}}
+{{end}}
+</body>
+</html>
+`))
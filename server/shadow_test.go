@@ -0,0 +1,276 @@
+package server
+
+import (
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"blitiri.com.ar/go/gofer/config"
+)
+
+// shadowBackend starts a backend which records the requests it gets, and
+// replies with the given status.
+func shadowBackend(t *testing.T, status int) (*config.URL, func() []string) {
+	mu := sync.Mutex{}
+	reqs := []string{}
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			b, _ := io.ReadAll(r.Body)
+			mu.Lock()
+			reqs = append(reqs, fmt.Sprintf("%s %s %q", r.Method, r.URL, b))
+			mu.Unlock()
+			w.WriteHeader(status)
+			w.Write([]byte("shadow"))
+		}))
+	t.Cleanup(srv.Close)
+
+	u, _ := url.Parse(srv.URL + "/sh/")
+	return (*config.URL)(u), func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string{}, reqs...)
+	}
+}
+
+func TestShadow(t *testing.T) {
+	primary := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		if r.URL.Path == "/p/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprintf(w, "primary %q", b)
+	})
+
+	shURL, shReqs := shadowBackend(t, http.StatusOK)
+	s, err := newShadow("test-shadow", "/p/",
+		config.Shadow{URL: shURL, MaxBody: 10}, primary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := WithTrace("test", s)
+
+	do := func(method, path, body string) (int, string) {
+		t.Helper()
+		var r io.Reader
+		if body != "" {
+			r = strings.NewReader(body)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(method, path, r))
+		return w.Code, w.Body.String()
+	}
+
+	// The primary response is not affected, and the shadow gets a copy of
+	// the request, including the body.
+	if code, body := do("GET", "/p/a", ""); code != 200 || body != `primary ""` {
+		t.Errorf("GET: got %d %q", code, body)
+	}
+	if code, body := do("POST", "/p/b?x=1", "body"); code != 200 ||
+		body != `primary "body"` {
+		t.Errorf("POST: got %d %q", code, body)
+	}
+	if code, _ := do("GET", "/p/missing", ""); code != 404 {
+		t.Errorf("GET missing: got %d", code)
+	}
+
+	// Bodies over the limit go to the primary in full, but are not copied.
+	if code, body := do("POST", "/p/big", "0123456789x"); code != 200 ||
+		body != `primary "0123456789x"` {
+		t.Errorf("POST big: got %d %q", code, body)
+	}
+
+	// They are sent concurrently, so the order is not guaranteed.
+	expected := []string{
+		`GET /sh/a ""`,
+		`GET /sh/missing ""`,
+		`POST /sh/b?x=1 "body"`,
+	}
+	if !waitFor(func() bool {
+		return s.stats.matches.Load()+s.stats.mismatches.Load() == 3
+	}) {
+		t.Fatalf("shadow requests not compared: %+v", &s.stats)
+	}
+	got := shReqs()
+	sort.Strings(got)
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("unexpected shadow requests: %q", got)
+	}
+
+	if s.stats.matches.Load() != 2 || s.stats.mismatches.Load() != 1 ||
+		s.stats.skipped.Load() != 1 || s.stats.errors.Load() != 0 {
+		t.Errorf("unexpected stats: %+v", &s.stats)
+	}
+	s.mismatchesMu.Lock()
+	if s.mismatches[[2]int{404, 200}] != 1 {
+		t.Errorf("unexpected mismatches: %v", s.mismatches)
+	}
+	s.mismatchesMu.Unlock()
+
+	// The debug handler shows them.
+	w := httptest.NewRecorder()
+	ShadowDebugHandler(w, httptest.NewRequest("GET", "/debug/shadow", nil))
+	for _, s := range []string{"test-shadow", "status mismatches", "404"} {
+		if !strings.Contains(w.Body.String(), s) {
+			t.Errorf("debug page is missing %q", s)
+		}
+	}
+}
+
+func TestShadowPercent(t *testing.T) {
+	primary := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	shURL, shReqs := shadowBackend(t, http.StatusOK)
+
+	s, err := newShadow("test-percent", "/",
+		config.Shadow{URL: shURL, Percent: 0.0001}, primary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := WithTrace("test", s)
+	for i := 0; i < 100; i++ {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := len(shReqs()); n > 1 {
+		t.Errorf("too many requests copied: %d", n)
+	}
+}
+
+func TestShadowSlowBackend(t *testing.T) {
+	defer func(d time.Duration, n int) {
+		shadowTimeout, shadowMaxInFlight = d, n
+	}(shadowTimeout, shadowMaxInFlight)
+	shadowTimeout = 200 * time.Millisecond
+	shadowMaxInFlight = 1
+
+	block := make(chan struct{})
+	be := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-block:
+			case <-r.Context().Done():
+			}
+		}))
+	defer be.Close()
+	defer close(block)
+	beURL, _ := url.Parse(be.URL)
+
+	primary := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("primary"))
+	})
+	s, err := newShadow("test-slow", "/",
+		config.Shadow{URL: (*config.URL)(beURL)}, primary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := WithTrace("test", s)
+
+	// The primary is not slowed down by the shadow, and the requests over
+	// the in-flight limit are not copied.
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		start := time.Now()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		if w.Body.String() != "primary" || time.Since(start) > 100*time.Millisecond {
+			t.Errorf("primary affected: %q after %v", w.Body, time.Since(start))
+		}
+	}
+	if d := s.stats.dropped.Load(); d != 2 {
+		t.Errorf("expected 2 dropped requests, got %d", d)
+	}
+
+	// The shadow request times out, and is recorded as an error.
+	if !waitFor(func() bool { return s.stats.mismatches.Load() == 1 }) {
+		t.Fatalf("shadow timeout not recorded: %+v", &s.stats)
+	}
+	if s.stats.errors.Load() != 1 {
+		t.Errorf("expected an error: %+v", &s.stats)
+	}
+}
+
+func TestShadowPrimaryAborted(t *testing.T) {
+	primary := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		panic(http.ErrAbortHandler)
+	})
+	shURL, _ := shadowBackend(t, http.StatusOK)
+	s, err := newShadow("test-aborted", "/",
+		config.Shadow{URL: shURL}, primary)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The panic goes through, as the http server relies on it.
+	func() {
+		defer func() {
+			if err := recover(); err != http.ErrAbortHandler {
+				t.Errorf("unexpected panic: %v", err)
+			}
+		}()
+		WithTrace("test", s).ServeHTTP(
+			httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}()
+
+	// But the shadow request is still accounted for.
+	if !waitFor(func() bool { return s.stats.aborted.Load() == 1 }) {
+		t.Fatalf("aborted primary not recorded: %+v", &s.stats)
+	}
+	if s.stats.sent.Load() != 1 || s.stats.matches.Load() != 0 ||
+		s.stats.mismatches.Load() != 0 {
+		t.Errorf("unexpected stats: %+v", &s.stats)
+	}
+}
+
+func TestShadowUpstreamTLS(t *testing.T) {
+	client := selfSignedCert(t, "client")
+	cert := writePEM(t, "cert.pem", "CERTIFICATE", client.Certificate[0])
+	keyDER, err := x509.MarshalPKCS8PrivateKey(client.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := writePEM(t, "key.pem", "PRIVATE KEY", keyDER)
+
+	be, ca := mtlsBackend(t, client)
+	beURL, _ := url.Parse(be.URL)
+
+	primary := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("primary"))
+	})
+
+	cases := []struct {
+		tls    config.UpstreamTLS
+		errors int64
+	}{
+		// Unknown CA, and missing client certificate.
+		{config.UpstreamTLS{}, 1},
+		{config.UpstreamTLS{CA: ca}, 1},
+
+		{config.UpstreamTLS{CA: ca, Cert: cert, Key: key}, 0},
+	}
+	for _, c := range cases {
+		s, err := newShadow("test-tls", "/", config.Shadow{
+			URL: (*config.URL)(beURL), TLS: c.tls}, primary)
+		if err != nil {
+			t.Fatal(err)
+		}
+		WithTrace("test", s).ServeHTTP(
+			httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+		if !waitFor(func() bool {
+			return s.stats.matches.Load()+s.stats.mismatches.Load() == 1
+		}) {
+			t.Fatalf("%+v: shadow request not compared: %+v", c.tls, &s.stats)
+		}
+		if e := s.stats.errors.Load(); e != c.errors {
+			t.Errorf("%+v: got %d errors, expected %d", c.tls, e, c.errors)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+// How long to wait for the TLS ClientHello, when routing by SNI.
+var sniTimeout = 10 * time.Second
+
+// Used to stop the TLS handshake once we got the ClientHello.
+var errHelloRead = errors.New("ClientHello read")
+
+// peekClientHello reads the TLS ClientHello from the connection, without
+// consuming it: it returns the hello, and a connection that reads it again
+// before the rest of the data.
+func peekClientHello(conn net.Conn) (*tls.ClientHelloInfo, net.Conn, error) {
+	buf := &bytes.Buffer{}
+	var hello *tls.ClientHelloInfo
+
+	// Let the TLS library parse the ClientHello, and abort the handshake
+	// right after.
+	conn.SetReadDeadline(time.Now().Add(sniTimeout))
+	err := tls.Server(
+		&helloConn{Conn: conn, r: io.TeeReader(conn, buf)},
+		&tls.Config{
+			GetConfigForClient: func(h *tls.ClientHelloInfo) (*tls.Config, error) {
+				hello = h
+				return nil, errHelloRead
+			},
+		}).Handshake()
+	conn.SetReadDeadline(time.Time{})
+
+	if hello == nil {
+		return nil, nil, err
+	}
+	return hello, &prefixConn{Conn: conn, r: io.MultiReader(buf, conn)}, nil
+}
+
+// helloConn is a connection used to read the ClientHello. Writes are
+// discarded, so the client does not see the aborted handshake.
+type helloConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *helloConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *helloConn) Write(b []byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+// prefixConn is a connection that reads from the given reader, which
+// includes the data already read from the underlying connection.
+type prefixConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *prefixConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// NetConn returns the underlying connection.
+func (c *prefixConn) NetConn() net.Conn {
+	return c.Conn
+}
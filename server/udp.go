@@ -0,0 +1,262 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"blitiri.com.ar/go/gofer/config"
+	"blitiri.com.ar/go/gofer/ipratelimit"
+	"blitiri.com.ar/go/gofer/ratelimit"
+	"blitiri.com.ar/go/gofer/reqlog"
+	"blitiri.com.ar/go/gofer/trace"
+	"blitiri.com.ar/go/log"
+)
+
+// Default idle timeout for UDP sessions.
+var udpIdleTimeout = 1 * time.Minute
+
+// Maximum size of the UDP packets we can proxy.
+const maxUDPPacket = 64 * 1024
+
+// udpProxy forwards UDP packets to a backend. Each client gets its own
+// session, with its own socket to the backend, so replies can be sent back
+// to the right client.
+type udpProxy struct {
+	lis         net.PacketConn
+	backends    *backendPool
+	idle        time.Duration
+	maxDuration time.Duration
+
+	rlog  *reqlog.Log
+	lim   *ipratelimit.Limiter
+	conns *connLimiter
+
+	mu       sync.Mutex
+	sessions map[string]*udpSession
+}
+
+type udpSession struct {
+	client  net.Addr
+	backend net.Conn
+	addr    string
+	tr      *trace.Trace
+
+	start time.Time
+
+	// Last activity, as Unix nanoseconds.
+	last atomic.Int64
+
+	// Bytes sent by the client, and by the backend.
+	up   atomic.Int64
+	down atomic.Int64
+
+	// Protects writing to the backend, so we don't do it once the session
+	// is closed.
+	mu     sync.Mutex
+	closed bool
+}
+
+func rawUDP(addr string, conf config.Raw) error {
+	lis, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return log.Errorf("Raw proxy error listening on %q: %v", addr, err)
+	}
+
+	log.Infof("%s raw udp proxy starting on %q", addr, lis.LocalAddr())
+	return newUDPProxy(addr, lis, conf).serve()
+}
+
+func newUDPProxy(addr string, lis net.PacketConn, conf config.Raw) *udpProxy {
+	p := &udpProxy{
+		lis:         lis,
+		backends:    newBackendPool(addr, conf),
+		idle:        conf.IdleTimeout,
+		maxDuration: conf.MaxDuration,
+		rlog:        reqlog.FromName(conf.ReqLog),
+		lim:         ratelimit.FromName(conf.RateLimit),
+		conns:       newConnLimiter(conf.MaxConns, conf.MaxConnsPerIP),
+		sessions:    map[string]*udpSession{},
+	}
+	if p.idle == 0 {
+		p.idle = udpIdleTimeout
+	}
+	return p
+}
+
+// serve forwards the packets from the clients, until there is an error
+// reading from the listener.
+func (p *udpProxy) serve() error {
+	buf := make([]byte, maxUDPPacket)
+	for {
+		n, client, err := p.lis.ReadFrom(buf)
+		if err != nil {
+			return log.Errorf("%s error reading: %v", p.lis.LocalAddr(), err)
+		}
+
+		s := p.session(client)
+		if s == nil {
+			continue
+		}
+		s.write(buf[:n])
+	}
+}
+
+// write sends a packet from the client to the backend. If the session was
+// closed in the meantime, the packet is dropped.
+func (s *udpSession) write(b []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+
+	s.last.Store(time.Now().UnixNano())
+	s.up.Add(int64(len(b)))
+	if _, err := s.backend.Write(b); err != nil {
+		s.tr.Errorf("error writing to backend: %v", err)
+	}
+}
+
+// session returns the session for the client, creating it if needed.
+// Returns nil if the client is over the rate limit or the session limits, or
+// we can't reach the backend.
+func (p *udpProxy) session(client net.Addr) *udpSession {
+	p.mu.Lock()
+	s, ok := p.sessions[client.String()]
+	p.mu.Unlock()
+	if ok {
+		return s
+	}
+
+	if p.lim != nil && !allowed(client, p.lim) {
+		return nil
+	}
+
+	s = &udpSession{
+		client: client,
+		start:  time.Now(),
+		tr: trace.New("raw", fmt.Sprintf("udp %s -> %s",
+			p.lis.LocalAddr(), strings.Join(p.backends.addrs, ","))),
+	}
+	s.tr.Printf("remote: %s", client)
+
+	if !p.conns.acquire(addrIP(client)) {
+		s.tr.Errorf("%s session limit reached", client)
+		s.tr.Finish()
+		p.log(s, 503)
+		return nil
+	}
+
+	// Dial without holding the lock, so a slow backend doesn't hold up the
+	// other sessions.
+	var err error
+	s.backend, s.addr, err = p.backends.dial(
+		s.tr, "udp", p.backends.order(), nil, nil)
+	if err != nil {
+		s.tr.Errorf("%s could not connect to any backend: %v",
+			p.lis.LocalAddr(), err)
+		s.tr.Finish()
+		p.conns.release(addrIP(client))
+		p.log(s, 502)
+		return nil
+	}
+
+	p.mu.Lock()
+	if other, ok := p.sessions[client.String()]; ok {
+		// Another session for this client was created while we were
+		// dialing, use that one instead.
+		p.mu.Unlock()
+		s.backend.Close()
+		p.conns.release(addrIP(client))
+		s.tr.Printf("session already exists")
+		s.tr.Finish()
+		return other
+	}
+	p.sessions[client.String()] = s
+	p.mu.Unlock()
+
+	go p.reply(s)
+	return s
+}
+
+// reply sends the packets from the backend back to the client, until the
+// session is idle, or reaches its maximum duration.
+func (p *udpProxy) reply(s *udpSession) {
+	defer p.close(s)
+
+	buf := make([]byte, maxUDPPacket)
+	for {
+		deadline := time.Now().Add(p.idle)
+		if p.maxDuration > 0 && s.start.Add(p.maxDuration).Before(deadline) {
+			deadline = s.start.Add(p.maxDuration)
+		}
+		s.backend.SetReadDeadline(deadline)
+		n, err := s.backend.Read(buf)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			if p.maxDuration > 0 && time.Since(s.start) >= p.maxDuration {
+				s.tr.Printf("max duration reached")
+				return
+			}
+			last := time.Unix(0, s.last.Load())
+			if time.Since(last) < p.idle {
+				// The client is still sending.
+				continue
+			}
+			s.tr.Printf("idle timeout")
+			return
+		} else if err != nil {
+			s.tr.Errorf("error reading from backend: %v", err)
+			return
+		}
+
+		s.last.Store(time.Now().UnixNano())
+		s.down.Add(int64(n))
+		if _, err := p.lis.WriteTo(buf[:n], s.client); err != nil {
+			s.tr.Errorf("error writing to client: %v", err)
+		}
+	}
+}
+
+func (p *udpProxy) close(s *udpSession) {
+	p.mu.Lock()
+	if p.sessions[s.client.String()] == s {
+		delete(p.sessions, s.client.String())
+	}
+	p.mu.Unlock()
+
+	s.mu.Lock()
+	s.closed = true
+	s.backend.Close()
+	s.mu.Unlock()
+
+	p.conns.release(addrIP(s.client))
+	s.tr.Printf("session complete: %d bytes up, %d bytes down",
+		s.up.Load(), s.down.Load())
+	s.tr.Finish()
+	p.log(s, 200)
+}
+
+func (p *udpProxy) log(s *udpSession, status int) {
+	if p.rlog == nil {
+		return
+	}
+	p.rlog.Log(&reqlog.Event{
+		T: time.Now(),
+		R: &reqlog.RawRequest{
+			RemoteAddr: s.client,
+			LocalAddr:  p.lis.LocalAddr(),
+			Backend:    s.addr,
+		},
+		Status:    status,
+		Length:    s.up.Load() + s.down.Load(),
+		BytesUp:   s.up.Load(),
+		BytesDown: s.down.Load(),
+		Latency:   time.Since(s.start),
+	})
+}
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"blitiri.com.ar/go/gofer/config"
+)
+
+// udpEcho starts a UDP server which replies with the packets it receives.
+func udpEcho(t *testing.T) net.PacketConn {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(buf[:n], addr)
+		}
+	}()
+	return pc
+}
+
+func TestUDPProxy(t *testing.T) {
+	echo := udpEcho(t)
+	defer echo.Close()
+
+	lis, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+
+	p := newUDPProxy("test", lis, config.Raw{
+		To:          echo.LocalAddr().String(),
+		UDP:         true,
+		IdleTimeout: 100 * time.Millisecond,
+	})
+	go p.serve()
+
+	exchange := func(c net.Conn, msg string) {
+		t.Helper()
+		if _, err := c.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		c.SetReadDeadline(time.Now().Add(time.Second))
+		buf := make([]byte, 1024)
+		n, err := c.Read(buf)
+		if err != nil || string(buf[:n]) != msg {
+			t.Errorf("got %q (%v), expected %q", buf[:n], err, msg)
+		}
+	}
+
+	c1, err := net.Dial("udp", lis.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+	c2, err := net.Dial("udp", lis.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+
+	// Each client gets its own session, and its own replies.
+	exchange(c1, "hola")
+	exchange(c2, "chau")
+	exchange(c1, "hola de nuevo")
+
+	nsessions := func() int {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		return len(p.sessions)
+	}
+	if n := nsessions(); n != 2 {
+		t.Errorf("expected 2 sessions, got %d", n)
+	}
+
+	// Sessions expire after being idle.
+	deadline := time.Now().Add(2 * time.Second)
+	for nsessions() > 0 && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if n := nsessions(); n != 0 {
+		t.Errorf("sessions did not expire, %d left", n)
+	}
+
+	// And a new one is created when the client comes back.
+	exchange(c1, "volví")
+}
+
+func TestUDPSessionRace(t *testing.T) {
+	echo := udpEcho(t)
+	defer echo.Close()
+
+	lis, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+
+	p := newUDPProxy("test", lis, config.Raw{
+		To:          echo.LocalAddr().String(),
+		UDP:         true,
+		IdleTimeout: 100 * time.Millisecond,
+	})
+	counts := func() (int, int) {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.conns.mu.Lock()
+		defer p.conns.mu.Unlock()
+		return len(p.sessions), p.conns.total
+	}
+
+	// Concurrent lookups for the same client all end up with the same
+	// session.
+	client := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}
+	sessions := make(chan *udpSession, 10)
+	for i := 0; i < cap(sessions); i++ {
+		go func() { sessions <- p.session(client) }()
+	}
+	s := <-sessions
+	for i := 1; i < cap(sessions); i++ {
+		if other := <-sessions; other != s {
+			t.Errorf("got different sessions: %p != %p", other, s)
+		}
+	}
+	if n, conns := counts(); n != 1 || conns != 1 {
+		t.Errorf("expected 1 session, got %d (%d conns)", n, conns)
+	}
+
+	// Once the session expires, writes to it are dropped.
+	if !waitFor(func() bool { n, conns := counts(); return n+conns == 0 }) {
+		t.Fatalf("session did not expire")
+	}
+	s.write([]byte("hola"))
+	if up := s.up.Load(); up != 0 {
+		t.Errorf("write on closed session went through: %d bytes", up)
+	}
+}
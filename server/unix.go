@@ -0,0 +1,124 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"blitiri.com.ar/go/gofer/config"
+	"blitiri.com.ar/go/systemd"
+)
+
+// listen on the given address, which can be a "unix:/path" socket, or
+// anything supported by systemd.Listen.
+func listen(addr string, sock *config.UnixSocket) (net.Listener, error) {
+	path, ok := config.UnixPath(addr)
+	if !ok {
+		return systemd.Listen("tcp", addr)
+	}
+
+	// Remove stale sockets, e.g. from a previous run that did not exit
+	// cleanly. We don't touch other kinds of files, just in case.
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err := removeStaleSocket(path); err != nil {
+			return nil, err
+		}
+	}
+
+	lis, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if sock != nil {
+		if err := setSocketPerms(path, *sock); err != nil {
+			lis.Close()
+			return nil, err
+		}
+	}
+	return lis, nil
+}
+
+// removeStaleSocket removes the socket at path, but only if nobody is
+// listening on it, so we don't take it over from a running server.
+func removeStaleSocket(path string) error {
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("%q is in use by another process", path)
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return fmt.Errorf("error checking existing socket: %v", err)
+	}
+	return os.Remove(path)
+}
+
+func setSocketPerms(path string, sock config.UnixSocket) error {
+	mode, err := sock.FileMode()
+	if err != nil {
+		return err
+	}
+	if sock.Mode != "" {
+		if err := os.Chmod(path, mode); err != nil {
+			return err
+		}
+	}
+
+	if sock.Owner == "" {
+		return nil
+	}
+	uid, gid, err := lookupOwner(sock.Owner)
+	if err != nil {
+		return err
+	}
+	return os.Lchown(path, uid, gid)
+}
+
+// lookupOwner returns the uid and gid for an owner given as "user",
+// "user:group", or ":group". The ones that are not given are -1, so
+// os.Chown leaves them unchanged.
+func lookupOwner(owner string) (int, int, error) {
+	uid, gid := -1, -1
+	userName, groupName, _ := strings.Cut(owner, ":")
+
+	if userName != "" {
+		u, err := user.Lookup(userName)
+		if err != nil {
+			return 0, 0, err
+		}
+		uid, _ = strconv.Atoi(u.Uid)
+	}
+	if groupName != "" {
+		g, err := user.LookupGroup(groupName)
+		if err != nil {
+			return 0, 0, err
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+	return uid, gid, nil
+}
+
+// unixDialer returns a dial function which connects to the given unix
+// socket, regardless of the address in the request.
+func unixDialer(d *net.Dialer, sock string) func(
+	ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return d.DialContext(ctx, "unix", sock)
+	}
+}
+
+// dialAddr returns the network and address to dial for a backend address,
+// which can be a "unix:/path" socket.
+func dialAddr(network, addr string) (string, string) {
+	if path, ok := config.UnixPath(addr); ok {
+		return "unix", path
+	}
+	return network, addr
+}
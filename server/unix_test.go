@@ -0,0 +1,136 @@
+package server
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"blitiri.com.ar/go/gofer/config"
+	"blitiri.com.ar/go/gofer/trace"
+)
+
+func TestUnixListen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sock")
+
+	lis, err := listen("unix:"+path, &config.UnixSocket{Mode: "0600"})
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("unexpected mode %v", fi.Mode())
+	}
+
+	// A socket that is in use is not taken over.
+	if _, err := listen("unix:"+path, nil); err == nil ||
+		!strings.Contains(err.Error(), "in use by another process") {
+		t.Errorf("expected error listening over a live socket, got %v", err)
+	}
+
+	// Leave a stale socket behind, it should be replaced.
+	lis.(*net.UnixListener).SetUnlinkOnClose(false)
+	lis.Close()
+	lis, err = listen("unix:"+path, nil)
+	if err != nil {
+		t.Fatalf("error listening over stale socket: %v", err)
+	}
+	lis.Close()
+
+	// But other files are left alone.
+	os.WriteFile(path, []byte("x"), 0600)
+	if _, err := listen("unix:"+path, nil); err == nil {
+		t.Errorf("expected error listening over a regular file")
+	}
+}
+
+func TestLookupOwner(t *testing.T) {
+	u, err := user.Current()
+	if err != nil {
+		t.Skipf("can't get current user: %v", err)
+	}
+	g, err := user.LookupGroupId(u.Gid)
+	if err != nil {
+		t.Skipf("can't get current group: %v", err)
+	}
+
+	cases := []struct {
+		owner    string
+		uid, gid string
+	}{
+		{u.Username, u.Uid, "-1"},
+		{u.Username + ":" + g.Name, u.Uid, u.Gid},
+		{":" + g.Name, "-1", u.Gid},
+	}
+	for _, c := range cases {
+		uid, gid, err := lookupOwner(c.owner)
+		if err != nil {
+			t.Errorf("%q: %v", c.owner, err)
+			continue
+		}
+		if strconv.Itoa(uid) != c.uid || strconv.Itoa(gid) != c.gid {
+			t.Errorf("%q: got %d:%d, expected %s:%s",
+				c.owner, uid, gid, c.uid, c.gid)
+		}
+	}
+
+	if _, _, err := lookupOwner("doesnotexist-lalala"); err == nil {
+		t.Errorf("expected error on unknown user")
+	}
+}
+
+func TestUnixBackends(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sock")
+	lis, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// HTTP proxy to a unix socket.
+	var gotPath, gotHost string
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			gotPath, gotHost = r.URL.Path, r.Host
+			w.Write([]byte("hola"))
+		}))
+	srv.Listener = lis
+	srv.Start()
+	defer srv.Close()
+
+	to, _ := url.Parse("http://unix:" + path + ":/base/")
+	proxy := httptest.NewServer(WithTrace("test", mustProxy(t, "/p/", *to, config.ProxyOpts{})))
+	defer proxy.Close()
+
+	resp, err := http.Get(proxy.URL + "/p/x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "hola" || gotPath != "/base/x" || gotHost != "localhost" {
+		t.Errorf("got %q, path %q, host %q", body, gotPath, gotHost)
+	}
+
+	// Raw backend on a unix socket.
+	b := newBackendPool("test", config.Raw{To: "unix:" + path})
+	tr := trace.New("test", "unix")
+	defer tr.Finish()
+	conn, addr, err := b.dial(tr, "tcp", b.order(), nil, nil)
+	if err != nil {
+		t.Fatalf("error dialing: %v", err)
+	}
+	conn.Close()
+	if addr != "unix:"+path {
+		t.Errorf("unexpected backend %q", addr)
+	}
+}
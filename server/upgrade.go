@@ -0,0 +1,111 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"blitiri.com.ar/go/gofer/trace"
+)
+
+// Default idle timeout for upgraded connections (e.g. websockets), if the
+// path doesn't have one configured.
+var upgradeIdleTimeout = 10 * time.Minute
+
+// The idle timeout for upgraded connections is set by WithTimeout, and used
+// by WithLogging, which sits above it. We use the context to pass it, like
+// we do for the authenticated user.
+type upgradeIdleKeyT string
+
+const upgradeIdleKey = upgradeIdleKeyT("upgradeidle")
+
+func withUpgradeIdle(r *http.Request) (*http.Request, *time.Duration) {
+	idle := new(time.Duration)
+	*idle = upgradeIdleTimeout
+	return r.WithContext(context.WithValue(r.Context(), upgradeIdleKey, idle)),
+		idle
+}
+
+func setUpgradeIdle(r *http.Request, d time.Duration) {
+	if idle, ok := r.Context().Value(upgradeIdleKey).(*time.Duration); ok {
+		*idle = d
+	}
+}
+
+// upgradedConn wraps a hijacked client connection, counting the bytes in
+// each direction, and closing it if there's no traffic for too long.
+type upgradedConn struct {
+	net.Conn
+	tr *trace.Trace
+
+	start    time.Time
+	in, out  atomic.Int64
+	lastUsed atomic.Int64 // In unix nanoseconds.
+
+	idle  time.Duration
+	timer *time.Timer
+}
+
+func newUpgradedConn(conn net.Conn, idle time.Duration,
+	tr *trace.Trace) *upgradedConn {
+	// The deadlines set for the request (by the server, or by the path's
+	// timeouts) are not meant for long-lived connections; we use the idle
+	// timeout instead.
+	conn.SetDeadline(time.Time{})
+
+	c := &upgradedConn{
+		Conn:  conn,
+		tr:    tr,
+		start: time.Now(),
+		idle:  idle,
+	}
+	c.lastUsed.Store(c.start.UnixNano())
+	if idle > 0 {
+		c.timer = time.AfterFunc(idle, c.checkIdle)
+	}
+	return c
+}
+
+func (c *upgradedConn) checkIdle() {
+	idleFor := time.Since(time.Unix(0, c.lastUsed.Load()))
+	if idleFor < c.idle {
+		c.timer.Reset(c.idle - idleFor)
+		return
+	}
+	c.tr.Printf("upgraded connection idle for %v, closing",
+		idleFor.Round(time.Millisecond))
+	c.Close()
+}
+
+func (c *upgradedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.in.Add(int64(n))
+	c.lastUsed.Store(time.Now().UnixNano())
+	return n, err
+}
+
+func (c *upgradedConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.out.Add(int64(n))
+	c.lastUsed.Store(time.Now().UnixNano())
+	return n, err
+}
+
+func (c *upgradedConn) Close() error {
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	return c.Conn.Close()
+}
+
+// CloseWrite is used by the reverse proxy to propagate the end of the
+// backend's stream.
+func (c *upgradedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
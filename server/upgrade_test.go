@@ -0,0 +1,152 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"blitiri.com.ar/go/gofer/config"
+	"blitiri.com.ar/go/gofer/reqlog"
+)
+
+// echoUpgradeServer accepts upgrades to the "echo" protocol, and then
+// echoes everything back.
+func echoUpgradeServer(t *testing.T) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Upgrade") != "echo" {
+				http.Error(w, "upgrade required", http.StatusUpgradeRequired)
+				return
+			}
+			conn, brw, err := http.NewResponseController(w).Hijack()
+			if err != nil {
+				t.Errorf("error hijacking: %v", err)
+				return
+			}
+			defer conn.Close()
+			fmt.Fprintf(conn, "HTTP/1.1 101 Switching Protocols\r\n"+
+				"Connection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+			io.Copy(conn, brw)
+		}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// upgrade connects to the server and upgrades to the "echo" protocol.
+func upgrade(t *testing.T, addr string) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(conn, "GET /ws/ HTTP/1.1\r\nHost: %s\r\n"+
+		"Connection: Upgrade\r\nUpgrade: echo\r\n\r\n", addr)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("unexpected response: %v", resp.Status)
+	}
+	return conn, br
+}
+
+func echo(conn net.Conn, br *bufio.Reader, msg string) error {
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		return err
+	}
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(br, buf); err != nil {
+		return err
+	}
+	if string(buf) != msg {
+		return fmt.Errorf("got %q, expected %q", buf, msg)
+	}
+	return nil
+}
+
+func TestUpgrade(t *testing.T) {
+	be := echoUpgradeServer(t)
+	beURL, _ := url.Parse(be.URL)
+
+	logPath := filepath.Join(t.TempDir(), "requests.log")
+	rl, err := reqlog.New(logPath, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The write timeout would kill the connection if it applied.
+	timeout := config.Timeout{
+		Write:       50 * time.Millisecond,
+		UpgradeIdle: 300 * time.Millisecond,
+	}
+	h := WithTrace("test", WithReqLog(
+		WithLogging(WithTimeout(mustProxy(t, "/ws/", *beURL, config.ProxyOpts{}), timeout)), rl))
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	addr := srv.Listener.Addr().String()
+
+	conn, br := upgrade(t, addr)
+	defer conn.Close()
+	if err := echo(conn, br, "hola"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if err := echo(conn, br, "chau"); err != nil {
+		t.Fatalf("connection closed after the write timeout: %v", err)
+	}
+	conn.Close()
+
+	// The session is logged once it's closed.
+	re := regexp.MustCompile(
+		`GET /ws/ .* = 101 16b \d+ms upgrade:"echo" up:8b down:8b\n`)
+	if !waitFor(func() bool {
+		b, _ := os.ReadFile(logPath)
+		return re.Match(b)
+	}) {
+		b, _ := os.ReadFile(logPath)
+		t.Errorf("log entry not found: %q", b)
+	}
+
+	// Idle connections get closed.
+	conn, br = upgrade(t, addr)
+	defer conn.Close()
+	start := time.Now()
+	_, err = br.ReadByte()
+	if err != io.EOF || time.Since(start) > 2*time.Second {
+		t.Errorf("expected EOF after the idle timeout, got %v after %v",
+			err, time.Since(start))
+	}
+}
+
+func waitFor(f func() bool) bool {
+	for i := 0; i < 200; i++ {
+		if f() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestUpgradeIdleDefault(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	r, idle := withUpgradeIdle(r)
+	if *idle != upgradeIdleTimeout {
+		t.Errorf("unexpected default: %v", *idle)
+	}
+	setUpgradeIdle(r, time.Second)
+	if *idle != time.Second {
+		t.Errorf("idle timeout not set: %v", *idle)
+	}
+}
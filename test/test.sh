@@ -21,15 +21,42 @@ gofer_bg -v=1 -logfile=.01-be.log -configfile=01-be.yaml
 BE_PID=$PID
 wait_until_ready 8450
 
+# Launch the test ACME server. The frontend uses it on startup, for the
+# listeners using our own ACME client.
+acmesrv &
+wait_until_ready 8460
+
+# Launch the test OCSP responder, which also generates the certificate for
+# the frontend to staple responses to.
+ocspsrv &
+wait_until_ready 8461
+
+# Launch the test FastCGI server, for the frontend's fastcgi routes.
+fcgisrv &
+wait_until_ready 8464
+
 # Launch the frontend. Tell it to accept the generated cert as a valid root.
+# Keep the OCSP cache within the test directory.
 generate_certs
 SSL_CERT_FILE=".certs/localhost/fullchain.pem" \
+CACHE_DIRECTORY="$PWD/.cache" \
     gofer_bg -v=1 -logfile=.01-fe.log -configfile=01-fe.yaml
 FE_PID=$PID
 wait_until_ready 8441  # http
 wait_until_ready 8442  # https (cert files)
 wait_until_ready 8443  # https (autocert)
+wait_until_ready 8453  # http (redirect to 8443)
+wait_until_ready 8444  # https (OCSP stapling)
 wait_until_ready 8445  # raw
+wait_until_ready 8454  # raw (PROXY protocol v1)
+wait_until_ready 8455  # raw (PROXY protocol v2)
+wait_until_ready 8456  # http (PROXY protocol)
+wait_until_ready 8457  # raw (SNI routing)
+wait_until_ready 8458  # raw (connection limits)
+wait_until_ready 8462  # raw (multiple backends)
+wait_until_ready 8463  # raw (to unix socket)
+wait_until_ready 8451  # https (acme dns-01)
+wait_until_ready 8452  # https (acme tls-alpn-01)
 
 snoop
 
@@ -46,6 +73,13 @@ if ! gofer -configfile=.fe-debug-conf -configcheck; then
 	exit 1
 fi
 
+# The effective proxy settings are included, as comments.
+if ! grep -A9 '^# ":8441" "/status/":$' .fe-debug-conf \
+		| grep -q '^#   max_conns: 10$'; then
+	echo "Effective proxy settings not found in FE config"
+	exit 1
+fi
+
 curl -sS "http://127.0.0.1:8459/debug/config" > .be-debug-conf
 if ! gofer -configfile=.be-debug-conf -configcheck; then
 	echo "Failed to parse BE config from monitoring output"
@@ -124,6 +158,8 @@ do
 
 	exp $base/cgi/ -bodyre '"param 1" "param 2"'
 	exp $base/cgi/lala -bodyre '"param 1" "param 2"'
+	exp $base/cgi/lala -bodyre 'PATH_INFO=/lala\n'
+	exp $base/cgi/ -bodyre 'GOFER_TEST=cgiopts\n'
 	exp "$base/cgi/?cucu=melo&a=b" -bodyre 'QUERY_STRING=cucu=melo&a=b\n'
 	exp "$base/cgiwithq/?cucu=melo&a=b" \
 			-bodyre 'QUERY_STRING=x=1&y=2&cucu=melo&a=b\n'
@@ -216,11 +252,72 @@ exp http://localhost:8441/cgi/ \
 exp https://localhost:8442/cgi/ -bodyre 'HTTP_X_FORWARDED_PROTO=https\n'
 
 
-echo "### Autocert"
-# Launch the test ACME server.
-acmesrv &
-wait_until_ready 8460
+echo "### HTTP/2 to the backend"
+exp http://localhost:8441/h2c/ -bodyre 'SERVER_PROTOCOL=HTTP/2.0\n'
+exp http://localhost:8441/cgi/ -bodyre 'SERVER_PROTOCOL=HTTP/1.1\n'
 
+echo "### Limits"
+exp http://localhost:8441/cgi/limited/ -bodyre 'REQUEST_URI=/cgi/limited/\n'
+exp "http://localhost:8441/cgi/limited/$(printf '%0100d' 0)" -status 414
+function post_status() {
+	head -c "$1" /dev/zero | curl -sS -o /dev/null -w '%{http_code}' \
+		--data-binary @- -H "Transfer-Encoding: $2" "$3"
+}
+for te in "" "chunked"; do
+	if [ "$(post_status 512 "$te" http://localhost:8441/cgi/limited/)" \
+			!= 200 ]; then
+		echo "limits: small body (te:$te) was rejected"
+		exit 1
+	fi
+	if [ "$(post_status 2048 "$te" http://localhost:8441/cgi/limited/)" \
+			!= 413 ]; then
+		echo "limits: big body (te:$te) was not rejected"
+		exit 1
+	fi
+done
+if [ "$(curl -sS -o /dev/null -w '%{http_code}' \
+		-H "X-Big: $(printf '%03000d' 0)" \
+		http://localhost:8441/cgi/limited/)" != 431 ]; then
+	echo "limits: big headers were not rejected"
+	exit 1
+fi
+
+echo "### Upstream TLS"
+exp http://localhost:8441/tls/file -body "ñaca\n"
+exp http://localhost:8441/tls/cgi/ -bodyre 'HTTP_X_FORWARDED_PROTO=https\n'
+
+echo "### HTTP/3"
+exp https://localhost:8442/cgi/ -hdrre '^Alt-Svc: h3=":8442"'
+exp https://localhost:8442/cgi/ -http3 -bodyre 'HTTP_X_FORWARDED_PROTO=https\n'
+
+echo "### FastCGI"
+exp "http://localhost:8441/fcgi/a/b.php/x/y?q=1" \
+		-bodyre 'GET /fcgi/a/b.php/x/y\?q=1 HTTP/1.1\n'
+exp http://localhost:8441/fcgi/a/b.php/x/y \
+		-bodyre 'SCRIPT_FILENAME=/srv/fcgi/a/b.php\n'
+exp http://localhost:8441/fcgi/a/b.php/x/y -bodyre 'PATH_TRANSLATED=/srv/fcgi/x/y\n'
+exp http://localhost:8441/fcgi/ -bodyre 'SCRIPT_FILENAME=/srv/fcgi/index.php\n'
+exp http://localhost:8441/fcgi/ -bodyre 'DOCUMENT_ROOT=/srv/fcgi\n'
+exp http://localhost:8441/fcgi/ -bodyre 'SERVER_PORT=8441\n'
+exp http://localhost:8441/fcgi/ -bodyre 'TEST_PARAM=test\n'
+exp http://localhost:8441/fcgi/missing.php -status 404
+exp https://localhost:8442/fcgi/ -bodyre 'HTTPS=true\n'
+exp http://localhost:8441/fcgi/ -method POST -bodyre 'POST /fcgi/ HTTP/1.1\n'
+
+echo "### Cache"
+exp http://localhost:8441/fcgi/cached/x -hdrre '^X-Cache: MISS$'
+exp http://localhost:8441/fcgi/cached/x -hdrre '^X-Cache: HIT$'
+exp http://localhost:8441/fcgi/cached/x -method POST -hdrre '^X-Cache: BYPASS$'
+exp "http://127.0.0.1:8440/debug/cache" -bodyre '<h1>:8441/fcgi/cached/</h1>'
+
+echo "### Shadow"
+exp http://localhost:8441/shadow/ -bodyre 'REQUEST_URI=/cgi/\n'
+sleep 0.5
+exp "http://127.0.0.1:8440/debug/shadow" -bodyre '<h1>:8441/shadow/</h1>'
+exp "http://127.0.0.1:8440/debug/shadow" \
+	-bodyre '<tr><th>status matches</th><td>[1-9]'
+
+echo "### Autocert"
 # exp takes the CA cert from this variable.
 # It is generated by acmesrv on startup.
 CACERT=".acmesrv.cert"
@@ -243,6 +340,72 @@ then
 	exit 1
 fi
 
+# The companion HTTP listener redirects to HTTPS, except for the HTTP-01
+# challenges which are handled by autocert. It rejects this one because the
+# host includes the port, which doesn't happen with real ACME servers.
+exp "http://miau.com:8453/dir/ñaca?a=b" -forcelocalhost \
+	-status 301 -redir "https://miau.com:8443/dir/%C3%B1aca?a=b"
+exp "http://miau.com:8453/dir/" -forcelocalhost -method POST \
+	-status 308 -redir "https://miau.com:8443/dir/"
+exp "http://miau.com:8453/.well-known/acme-challenge/xyz" -forcelocalhost \
+	-status 403
+
+# Hosts allowed on demand, up to 1 per hour.
+exp https://od1.miau.com:8443/file -forcelocalhost -body "ñaca\n"
+exp https://od2.miau.com:8443/file -forcelocalhost \
+	-clienterrorre "tls: internal error"
+if ! waitgrep -q '"od2.miau.com": allowed by regexp, but over the limit' \
+	.01-fe.log;
+then
+	echo "autocert limit error was not logged properly"
+	exit 1
+fi
+
+
+echo "### ACME challenges"
+# The certificates are obtained in the background on startup, so give it a
+# few tries.
+for i in 0.01 0.05 0.1 0.2 0.5 1 2; do
+	if exp https://dns.chal.test:8451/file -forcelocalhost \
+		> .exp-acme.log 2>&1;
+	then
+		break
+	fi
+	sleep $i
+done
+exp https://dns.chal.test:8451/file -forcelocalhost -body "ñaca\n"
+exp https://x.dns.chal.test:8451/file -forcelocalhost -body "ñaca\n"
+
+for i in 0.01 0.05 0.1 0.2 0.5 1 2; do
+	if exp https://alpn.chal.test:8452/file -forcelocalhost \
+		> .exp-acme.log 2>&1;
+	then
+		break
+	fi
+	sleep $i
+done
+exp https://alpn.chal.test:8452/file -forcelocalhost -body "ñaca\n"
+
+unset CACERT
+
+
+echo "### OCSP stapling"
+# exp takes the CA cert from this variable.
+# It is generated by ocspsrv on startup.
+CACERT=".ocspsrv.cert"
+
+# The response is fetched in the background when the certificates are
+# loaded, so give it a few tries.
+for i in 0.01 0.05 0.1 0.2 0.5 1; do
+	if exp https://localhost:8444/file -body "ñaca\n" -ocspstaple \
+		> .exp-ocsp.log 2>&1;
+	then
+		break
+	fi
+	sleep $i
+done
+exp https://localhost:8444/file -body "ñaca\n" -ocspstaple
+
 unset CACERT
 
 
@@ -294,17 +457,92 @@ exp "http://127.0.0.1:8459/notexists" -status 404
 # Rate-limiting debug handler.
 exp "http://127.0.0.1:8440/debug/ratelimit" -bodyre "Allow: 1 / 1s"
 
+# Certificates debug handler. The test certificates are short-lived, so they
+# should be flagged as expiring, and warned about in the logs.
+exp "http://127.0.0.1:8440/debug/certs" -bodyre "certs .certs"
+exp "http://127.0.0.1:8440/debug/certs" -bodyre 'class="expiring"'
+if ! waitgrep -q 'certificate \["localhost"\] (certs .certs) expires at' \
+	.01-fe.log;
+then
+	echo "certificate expiry warning not found in the log"
+	exit 1
+fi
+
+echo "### Trusted proxies"
+# The client address is taken from the header, logged, and passed on to the
+# backend.
+curl -sS -H "X-Forwarded-For: 10.1.1.1, 1.2.3.4" \
+	"http://localhost:8441/cgi/trustme" > .curl-xff.out
+if ! grep -q "^HTTP_X_FORWARDED_FOR=1.2.3.4$" .curl-xff.out; then
+	echo "X-Forwarded-For not passed on to the backend"
+	exit 1
+fi
+if ! waitgrep -q " 1.2.3.4:0 HTTP/1.1 localhost:8441 GET /cgi/trustme " \
+	.01-fe.requests.log;
+then
+	echo "client address from X-Forwarded-For not logged"
+	exit 1
+fi
+
+
 echo "### Raw proxying"
 exp http://localhost:8445/file -body "ñaca\n"
 exp https://localhost:8446/file -body "ñaca\n"
 exp http://localhost:8448/file -body "ñaca\n"
 
+# PROXY protocol: the listener only accepts connections with the header,
+# which the raw proxies send.
+exp http://localhost:8454/file -body "ñaca\n"
+exp http://localhost:8455/file -body "ñaca\n"
+exp http://localhost:8456/file -status 400
+
+# SNI routing.
+exp https://localhost:8457/file -body "ñaca\n"
+CACERT=".acmesrv.cert" \
+	exp https://miau.com:8457/file -forcelocalhost -body "ñaca\n"
+
 true < /dev/tcp/localhost/8447
-if ! waitgrep -q ":8447 = 500" .01-fe.requests.log; then
+if ! waitgrep -q ":8447 = 502" .01-fe.requests.log; then
 	echo "raw connection to :8447: error entry not found"
 	exit 1
 fi
 
+# Separate byte counts for each direction.
+if ! waitgrep -q -E ":8445 -> localhost:8450 = 200 [0-9]+b [0-9]+ms up:[1-9][0-9]*b down:[1-9][0-9]*b" \
+		.01-fe.requests.log; then
+	echo "raw connection to :8445: entry with byte counts not found"
+	exit 1
+fi
+
+# Multiple backends: the first one fails, so we use the second one.
+exp http://localhost:8462/file -body "ñaca\n"
+if ! waitgrep -q ":8462 -> localhost:8450 = 200" .01-fe.requests.log; then
+	echo "raw connection to :8462: entry with the backend not found"
+	exit 1
+fi
+
+# Unix sockets: the raw proxy connects to the http listener on the socket.
+exp http://localhost:8463/file -body "ñaca\n"
+if [ "$(stat -c %a .01-fe.sock)" != "600" ]; then
+	echo "unexpected permissions on .01-fe.sock"
+	exit 1
+fi
+
+# Connection limits: hold one connection open, so the next one is rejected,
+# until the first one is closed for being idle.
+exec 3<> /dev/tcp/localhost/8458
+if exp http://localhost:8458/file >> .exp-raw-limits.log 2>&1; then
+	echo "raw connection to :8458: expected error over the limit"
+	exit 1
+fi
+if ! waitgrep -q ":8458 = 503" .01-fe.requests.log; then
+	echo "raw connection to :8458: limit entry not found"
+	exit 1
+fi
+cat <&3 > /dev/null
+exec 3<&-
+exp http://localhost:8458/file -body "ñaca\n"
+
 
 echo "### Rate limiting (http)"
 # First request must be allowed.
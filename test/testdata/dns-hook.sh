@@ -0,0 +1,24 @@
+#!/bin/sh
+#
+# DNS hook for testing the ACME dns-01 challenge.
+# Instead of updating DNS, it writes the TXT records to files in .acme-txt/,
+# where acmesrv reads them from.
+
+set -e
+
+mkdir -p .acme-txt
+F=".acme-txt/$2"
+
+case "$1" in
+present)
+	echo "$3" >> "$F"
+	;;
+cleanup)
+	grep -v -x -F "$3" "$F" > "$F.tmp" || true
+	mv "$F.tmp" "$F"
+	;;
+*)
+	echo "unknown action: $1"
+	exit 1
+	;;
+esac
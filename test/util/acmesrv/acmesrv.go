@@ -1,23 +1,37 @@
 // ACME (RFC 8555) server, for testing purposes only.
+//
+// By default, all authorizations are valid from the start, so clients don't
+// need to complete any challenges.
+// Hosts ending in the -challenge_suffix are different: they need to complete
+// a dns-01 or tls-alpn-01 challenge. For dns-01, the TXT records are read
+// from files in -txt_dir (one value per line) instead of DNS; for
+// tls-alpn-01, we connect to -tls_alpn_addr.
 package main
 
 import (
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/asn1"
 	"encoding/base64"
 	"encoding/json"
 	"encoding/pem"
+	"errors"
 	"flag"
 	"fmt"
 	"math/big"
 	"net"
 	"net/http"
 	"os"
+	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -26,6 +40,13 @@ var (
 
 	caCertFile = flag.String("cacert_file", ".acmesrv.cert",
 		"file to write the CA certificate to")
+
+	challengeSuffix = flag.String("challenge_suffix", "",
+		"hosts with this suffix need to complete a challenge")
+	txtDir = flag.String("txt_dir", ".acme-txt",
+		"directory with the TXT records, for the dns-01 challenge")
+	tlsALPNAddr = flag.String("tls_alpn_addr", "",
+		"address to connect to for the tls-alpn-01 challenge")
 )
 
 type Server struct {
@@ -35,10 +56,25 @@ type Server struct {
 	caCert []byte
 	caTmpl *x509.Certificate
 
+	mu sync.Mutex
+
 	orderID int
 
 	// Order ID -> Certificate.
 	orderCert map[int][]byte
+
+	// Order ID -> Authorizations.
+	orderAuthz map[int][]*authz
+
+	// Account URL -> JWK thumbprint of the account key.
+	accounts map[string]string
+}
+
+type authz struct {
+	host     string
+	wildcard bool
+	status   string
+	token    string
 }
 
 func NewServer(addr string) (*Server, error) {
@@ -48,8 +84,10 @@ func NewServer(addr string) (*Server, error) {
 	}
 
 	s := &Server{
-		lis:       lis,
-		orderCert: map[int][]byte{},
+		lis:        lis,
+		orderCert:  map[int][]byte{},
+		orderAuthz: map[int][]*authz{},
+		accounts:   map[string]string{},
 
 		// Start with a high order ID to make debugging easier.
 		orderID: 2000,
@@ -102,6 +140,16 @@ func getOID(r *http.Request) int {
 	return id
 }
 
+// Get the order ID and authorization index from the request's URL.
+func getAuthzID(r *http.Request) (int, int) {
+	// Example: http://blah/auth/1234/0
+	idx, err := strconv.Atoi(strings.Split(r.URL.Path, "/")[3])
+	if err != nil {
+		panic(err)
+	}
+	return getOID(r), idx
+}
+
 func (s *Server) directory(w http.ResponseWriter, r *http.Request) {
 	// https://www.rfc-editor.org/rfc/rfc8555.html#section-7.1.1
 	url := s.url()
@@ -125,11 +173,22 @@ func (s *Server) newNonce(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) newAccount(w http.ResponseWriter, r *http.Request) {
-	logPayload(r)
+	protected, payload := readJWS(r)
+	fmt.Printf("  %s\n", payload)
+
+	// Keep the account key thumbprint, we need it to validate challenges.
+	thumb, err := jwkThumbprint(protected.JWK)
+	if err != nil {
+		panic(err)
+	}
+	s.mu.Lock()
+	acct := fmt.Sprintf("%s/acct/a%d", s.url(), 1111+len(s.accounts))
+	s.accounts[acct] = thumb
+	s.mu.Unlock()
 
 	// https://www.rfc-editor.org/rfc/rfc8555.html#section-7.3
 	w.Header().Set("Replay-Nonce", "test-nonce")
-	w.Header().Set("Location", s.url()+"/acct/a1111")
+	w.Header().Set("Location", acct)
 	w.WriteHeader(http.StatusCreated)
 	w.Write([]byte("{}"))
 
@@ -137,11 +196,34 @@ func (s *Server) newAccount(w http.ResponseWriter, r *http.Request) {
 
 func (s *Server) newOrder(w http.ResponseWriter, r *http.Request) {
 	// https://www.rfc-editor.org/rfc/rfc8555#section-7.4
-	logPayload(r)
+	req := struct {
+		Identifiers []struct {
+			Value string
+		}
+	}{}
+	decodePayload(r, &req)
+	fmt.Printf("  %+v\n", req)
 
+	s.mu.Lock()
 	oid := s.orderID
 	s.orderID++
 
+	authURLs := []string{}
+	for i, id := range req.Identifiers {
+		az := &authz{
+			host:   strings.TrimPrefix(id.Value, "*."),
+			status: "valid",
+		}
+		az.wildcard = az.host != id.Value
+		if *challengeSuffix != "" && strings.HasSuffix(az.host, *challengeSuffix) {
+			az.status = "pending"
+			az.token = randomToken()
+		}
+		s.orderAuthz[oid] = append(s.orderAuthz[oid], az)
+		authURLs = append(authURLs, fmt.Sprintf("%s/%d", s.orderurl("auth", oid), i))
+	}
+	s.mu.Unlock()
+
 	w.Header().Set("Replay-Nonce", "test-nonce")
 	w.Header().Set("Location", s.orderurl("orders", oid))
 	w.WriteHeader(http.StatusCreated)
@@ -152,37 +234,200 @@ func (s *Server) newOrder(w http.ResponseWriter, r *http.Request) {
 		Finalize string   `json:"finalize"`
 	}{
 		Status:   "pending",
-		Auths:    append([]string{}, s.orderurl("auth", oid)),
+		Auths:    authURLs,
 		Finalize: s.orderurl("finalize", oid),
 	}
 	json.NewEncoder(w).Encode(resp)
 }
 
+type challenge struct {
+	Type   string `json:"type"`
+	URL    string `json:"url"`
+	Token  string `json:"token"`
+	Status string `json:"status"`
+}
+
+func (s *Server) challenges(oid, idx int, az *authz) []challenge {
+	if az.token == "" {
+		return nil
+	}
+
+	chals := []challenge{}
+	for _, t := range []string{"dns-01", "tls-alpn-01"} {
+		chals = append(chals, challenge{
+			Type:   t,
+			URL:    fmt.Sprintf("%s/%d/%s", s.orderurl("chal", oid), idx, t),
+			Token:  az.token,
+			Status: az.status,
+		})
+	}
+	return chals
+}
+
 func (s *Server) auth(w http.ResponseWriter, r *http.Request) {
 	// https://www.rfc-editor.org/rfc/rfc8555#section-7.5
 	logPayload(r)
+	oid, idx := getAuthzID(r)
 
-	w.Header().Set("Replay-Nonce", "test-nonce")
-
+	s.mu.Lock()
+	az := s.orderAuthz[oid][idx]
 	resp := struct {
-		Status string `json:"status"`
+		Status     string `json:"status"`
+		Identifier struct {
+			Type  string `json:"type"`
+			Value string `json:"value"`
+		} `json:"identifier"`
+		Wildcard   bool        `json:"wildcard"`
+		Challenges []challenge `json:"challenges"`
 	}{
-		Status: "valid",
+		Status:     az.status,
+		Wildcard:   az.wildcard,
+		Challenges: s.challenges(oid, idx, az),
 	}
+	resp.Identifier.Type = "dns"
+	resp.Identifier.Value = az.host
+	s.mu.Unlock()
+
+	w.Header().Set("Replay-Nonce", "test-nonce")
 	json.NewEncoder(w).Encode(resp)
 }
 
+func (s *Server) chal(w http.ResponseWriter, r *http.Request) {
+	// https://www.rfc-editor.org/rfc/rfc8555#section-7.5.1
+	protected, payload := readJWS(r)
+	fmt.Printf("  %s\n", payload)
+	oid, idx := getAuthzID(r)
+	typ := strings.Split(r.URL.Path, "/")[4]
+
+	s.mu.Lock()
+	az := s.orderAuthz[oid][idx]
+	keyAuth := az.token + "." + s.accounts[protected.KID]
+	s.mu.Unlock()
+
+	// Validate asynchronously, like real CAs do. This also gives the
+	// server time to start listening, for tls-alpn-01.
+	go s.validate(az, typ, keyAuth)
+
+	w.Header().Set("Replay-Nonce", "test-nonce")
+	json.NewEncoder(w).Encode(challenge{
+		Type:   typ,
+		URL:    s.url() + r.URL.Path,
+		Token:  az.token,
+		Status: "processing",
+	})
+}
+
+func (s *Server) validate(az *authz, typ, keyAuth string) {
+	var err error
+	for i := 0; i < 5; i++ {
+		switch typ {
+		case "dns-01":
+			err = validateDNS01(az.host, keyAuth)
+		case "tls-alpn-01":
+			err = validateTLSALPN01(az.host, keyAuth)
+		default:
+			err = fmt.Errorf("unknown challenge type %q", typ)
+		}
+		if err == nil {
+			break
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		fmt.Printf("%s %q: validation failed: %v\n", typ, az.host, err)
+		az.status = "invalid"
+		return
+	}
+	fmt.Printf("%s %q: valid\n", typ, az.host)
+	az.status = "valid"
+}
+
+func validateDNS01(host, keyAuth string) error {
+	h := sha256.Sum256([]byte(keyAuth))
+	expected := base64.RawURLEncoding.EncodeToString(h[:])
+
+	buf, err := os.ReadFile(
+		filepath.Join(*txtDir, "_acme-challenge."+host+"."))
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(strings.Fields(string(buf)), expected) {
+		return fmt.Errorf("TXT record %q not found", expected)
+	}
+	return nil
+}
+
+func validateTLSALPN01(host, keyAuth string) error {
+	conn, err := tls.Dial("tcp", *tlsALPNAddr, &tls.Config{
+		ServerName:         host,
+		NextProtos:         []string{"acme-tls/1"},
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	st := conn.ConnectionState()
+	if st.NegotiatedProtocol != "acme-tls/1" {
+		return fmt.Errorf("unexpected protocol %q", st.NegotiatedProtocol)
+	}
+	cert := st.PeerCertificates[0]
+	if !slices.Equal(cert.DNSNames, []string{host}) {
+		return fmt.Errorf("unexpected names %q", cert.DNSNames)
+	}
+
+	// id-pe-acmeIdentifier, RFC 8737 section 3.
+	oid := asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
+	h := sha256.Sum256([]byte(keyAuth))
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(oid) {
+			continue
+		}
+		var v []byte
+		if _, err := asn1.Unmarshal(ext.Value, &v); err != nil {
+			return err
+		}
+		if !slices.Equal(v, h[:]) {
+			return errors.New("acmeIdentifier mismatch")
+		}
+		return nil
+	}
+	return errors.New("acmeIdentifier extension not found")
+}
+
+// orderStatus returns the status of the order, based on its authorizations.
+// Must be called with s.mu held.
+func (s *Server) orderStatus(oid int) string {
+	if s.orderCert[oid] != nil {
+		return "valid"
+	}
+	for _, az := range s.orderAuthz[oid] {
+		if az.status != "valid" {
+			return az.status
+		}
+	}
+	return "ready"
+}
+
 func (s *Server) orders(w http.ResponseWriter, r *http.Request) {
 	logPayload(r)
 
 	oid := getOID(r)
+	s.mu.Lock()
+	status := s.orderStatus(oid)
+	s.mu.Unlock()
+
 	w.Header().Set("Replay-Nonce", "test-nonce")
 	resp := struct {
 		Status   string `json:"status"`
 		Finalize string `json:"finalize"`
 		Cert     string `json:"certificate"`
 	}{
-		Status:   "valid",
+		Status:   status,
 		Finalize: s.orderurl("finalize", oid),
 		Cert:     s.orderurl("cert", oid),
 	}
@@ -192,6 +437,20 @@ func (s *Server) orders(w http.ResponseWriter, r *http.Request) {
 func (s *Server) finalize(w http.ResponseWriter, r *http.Request) {
 	// https://www.rfc-editor.org/rfc/rfc8555#section-7.4
 	oid := getOID(r)
+
+	s.mu.Lock()
+	status := s.orderStatus(oid)
+	s.mu.Unlock()
+	if status != "ready" {
+		fmt.Printf("  order %d is %s, not ready\n", oid, status)
+		w.Header().Set("Replay-Nonce", "test-nonce")
+		w.Header().Set("Content-Type", "application/problem+json")
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, `{"type": "urn:ietf:params:acme:error:orderNotReady",`+
+			`"detail": "order is %s"}`, status)
+		return
+	}
+
 	req := struct {
 		CSR string
 	}{}
@@ -238,16 +497,22 @@ func (s *Server) generateCert(oid int, csr *x509.CertificateRequest) {
 	if err != nil {
 		panic(err)
 	}
+	s.mu.Lock()
 	s.orderCert[oid] = cert
+	s.mu.Unlock()
 }
 
 func (s *Server) cert(w http.ResponseWriter, r *http.Request) {
 	// https://www.rfc-editor.org/rfc/rfc8555#section-7.4.2
 	logPayload(r)
 	oid := getOID(r)
+	s.mu.Lock()
+	cert := s.orderCert[oid]
+	s.mu.Unlock()
+
 	w.Header().Set("Replay-Nonce", "test-nonce")
 	w.Header().Set("Content-Type", "application/pem-certificate-chain")
-	pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: s.orderCert[oid]})
+	pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: cert})
 	pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: s.caCert})
 }
 
@@ -277,6 +542,7 @@ func (s *Server) Serve() {
 	mux.HandleFunc("/new-acct", s.newAccount)
 	mux.HandleFunc("/new-order", s.newOrder)
 	mux.HandleFunc("/auth/", s.auth)
+	mux.HandleFunc("/chal/", s.chal)
 	mux.HandleFunc("/orders/", s.orders)
 	mux.HandleFunc("/finalize/", s.finalize)
 	mux.HandleFunc("/cert/", s.cert)
@@ -294,20 +560,40 @@ func withLogging(parent http.Handler) http.Handler {
 	})
 }
 
-func readPayload(r *http.Request) []byte {
-	// Body has a JSON with a "payload" message, which is a base64-encoded
-	// JSON message with the actual content.
-	req := struct{ Payload string }{}
+// JWS protected header fields we care about.
+type jwsProtected struct {
+	JWK json.RawMessage `json:"jwk"`
+	KID string          `json:"kid"`
+}
+
+func readJWS(r *http.Request) (jwsProtected, []byte) {
+	// Body has a JSON with a "protected" header and a "payload" message,
+	// which are base64-encoded JSON messages.
+	req := struct{ Protected, Payload string }{}
 	err := json.NewDecoder(r.Body).Decode(&req)
 	if err != nil {
 		panic(err)
 	}
 
+	protected := jwsProtected{}
+	buf, err := base64.RawURLEncoding.DecodeString(req.Protected)
+	if err != nil {
+		panic(err)
+	}
+	if err := json.Unmarshal(buf, &protected); err != nil {
+		panic(err)
+	}
+
 	payload, err := base64.RawURLEncoding.DecodeString(req.Payload)
 	if err != nil {
 		panic(err)
 	}
 
+	return protected, payload
+}
+
+func readPayload(r *http.Request) []byte {
+	_, payload := readJWS(r)
 	return payload
 }
 
@@ -324,6 +610,37 @@ func logPayload(r *http.Request) {
 	fmt.Printf("  %s\n", payload)
 }
 
+// jwkThumbprint returns the JWK thumbprint (RFC 7638) of the key, as used in
+// the key authorizations.
+func jwkThumbprint(jwk []byte) (string, error) {
+	k := struct {
+		Kty, Crv, X, Y, E, N string
+	}{}
+	if err := json.Unmarshal(jwk, &k); err != nil {
+		return "", err
+	}
+
+	var canonical string
+	switch k.Kty {
+	case "EC":
+		canonical = fmt.Sprintf(`{"crv":"%s","kty":"EC","x":"%s","y":"%s"}`,
+			k.Crv, k.X, k.Y)
+	case "RSA":
+		canonical = fmt.Sprintf(`{"e":"%s","kty":"RSA","n":"%s"}`, k.E, k.N)
+	default:
+		return "", fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+
+	h := sha256.Sum256([]byte(canonical))
+	return base64.RawURLEncoding.EncodeToString(h[:]), nil
+}
+
+func randomToken() string {
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
 func main() {
 	flag.Parse()
 
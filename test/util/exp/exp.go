@@ -14,6 +14,8 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+
+	"github.com/quic-go/quic-go/http3"
 )
 
 var exitCode int = 0
@@ -46,6 +48,12 @@ func main() {
 			"file to read CA cert from")
 		forceLocalhost = flag.Bool("forcelocalhost", false,
 			"force connection to go to localhost")
+		ocspStaple = flag.Bool("ocspstaple", false,
+			"expect the server to staple an OCSP response")
+		method = flag.String("method", "GET",
+			"HTTP method to use")
+		useHTTP3 = flag.Bool("http3", false,
+			"use HTTP/3")
 	)
 	flag.Parse()
 
@@ -53,8 +61,15 @@ func main() {
 		CheckRedirect: noRedirect,
 		Transport:     mkTransport(*caCert, *forceLocalhost),
 	}
+	if *useHTTP3 {
+		client.Transport = mkHTTP3Transport(*caCert)
+	}
 
-	resp, err := client.Get(url)
+	req, err := http.NewRequest(*method, url, nil)
+	if err != nil {
+		fatalf("error creating request: %v\n", err)
+	}
+	resp, err := client.Do(req)
 	if *clientErrorRE != "" {
 		if err == nil {
 			errorf("expected client error, got nil")
@@ -144,6 +159,12 @@ func main() {
 		}
 	}
 
+	if *ocspStaple {
+		if resp.TLS == nil || len(resp.TLS.OCSPResponse) == 0 {
+			errorf("no OCSP response stapled\n")
+		}
+	}
+
 	if *hdrRE != "" {
 		match := false
 	outer:
@@ -173,24 +194,14 @@ func noRedirect(req *http.Request, via []*http.Request) error {
 	return http.ErrUseLastResponse
 }
 
-func mkTransport(caCert string, forceLocalhost bool) *http.Transport {
+func mkTransport(caCert string, forceLocalhost bool) http.RoundTripper {
 	if caCert == "" {
 		return nil
 	}
 
-	certs, err := os.ReadFile(caCert)
-	if err != nil {
-		fatalf("error reading CA file %q: %v", caCert, err)
-	}
-
-	rootCAs := x509.NewCertPool()
-	if ok := rootCAs.AppendCertsFromPEM(certs); !ok {
-		fatalf("error adding certs to root")
-	}
-
 	t := &http.Transport{
 		TLSClientConfig: &tls.Config{
-			RootCAs: rootCAs,
+			RootCAs: loadCACert(caCert),
 		},
 	}
 
@@ -204,6 +215,29 @@ func mkTransport(caCert string, forceLocalhost bool) *http.Transport {
 	return t
 }
 
+func mkHTTP3Transport(caCert string) http.RoundTripper {
+	t := &http3.Transport{}
+	if caCert != "" {
+		t.TLSClientConfig = &tls.Config{
+			RootCAs: loadCACert(caCert),
+		}
+	}
+	return t
+}
+
+func loadCACert(caCert string) *x509.CertPool {
+	certs, err := os.ReadFile(caCert)
+	if err != nil {
+		fatalf("error reading CA file %q: %v", caCert, err)
+	}
+
+	rootCAs := x509.NewCertPool()
+	if ok := rootCAs.AppendCertsFromPEM(certs); !ok {
+		fatalf("error adding certs to root")
+	}
+	return rootCAs
+}
+
 func fatalf(s string, a ...interface{}) {
 	fmt.Fprintf(os.Stderr, s, a...)
 	os.Exit(1)
@@ -0,0 +1,50 @@
+// FastCGI responder, for testing purposes only.
+//
+// It replies to all requests with the request line and the FastCGI
+// parameters that are not part of the request itself, one per line.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/fcgi"
+	"os"
+	"sort"
+)
+
+var addr = flag.String("addr", "", "address to listen on")
+
+func main() {
+	flag.Parse()
+
+	lis, err := net.Listen("tcp", *addr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error listening: %v\n", err)
+		os.Exit(1)
+	}
+
+	err = fcgi.Serve(lis, http.HandlerFunc(handle))
+	fmt.Fprintf(os.Stderr, "error serving: %v\n", err)
+	os.Exit(1)
+}
+
+func handle(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/fcgi/missing.php" {
+		w.WriteHeader(http.StatusNotFound)
+	}
+
+	fmt.Fprintf(w, "%s %s %s\n", r.Method, r.URL.RequestURI(), r.Proto)
+	fmt.Fprintf(w, "HTTPS=%v\n", r.TLS != nil)
+
+	env := fcgi.ProcessEnv(r)
+	keys := []string{}
+	for k := range env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s=%s\n", k, env[k])
+	}
+}
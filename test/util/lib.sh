@@ -43,9 +43,25 @@ function gofer_bg() {
 function acmesrv() {
 	# Remove the cache before launching the ACME server, otherwise clients
 	# won't reach out to it.
-	rm -rf .autocerts-cache/
+	rm -rf .autocerts-cache/ .acme-txt/
 	go run ${UTILDIR}/acmesrv/acmesrv.go \
-		-addr=localhost:8460 > .acmesrv.log
+		-addr=localhost:8460 \
+		-challenge_suffix=.chal.test \
+		-tls_alpn_addr=localhost:8452 \
+		> .acmesrv.log
+}
+
+function ocspsrv() {
+	# Remove the previous certificates and cached responses, they are
+	# generated again on startup.
+	rm -rf .ocsp-certs/ .cache/gofer-ocsp-cache/
+	go run ${UTILDIR}/ocspsrv/ocspsrv.go \
+		-addr=localhost:8461 > .ocspsrv.log
+}
+
+function fcgisrv() {
+	go run ${UTILDIR}/fcgisrv/fcgisrv.go \
+		-addr=localhost:8464 > .fcgisrv.log 2>&1
 }
 
 # Wait until there's something listening on the given port.
@@ -0,0 +1,205 @@
+// OCSP (RFC 6960) responder, for testing purposes only.
+//
+// On startup, it generates a CA and a certificate signed by it which points
+// to this responder, and writes them in the certbot layout so gofer can load
+// them. Then it answers all OCSP requests with a "good" status.
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+var (
+	addr = flag.String("addr", "", "address to listen on")
+
+	host = flag.String("host", "localhost",
+		"host name to generate the certificate for")
+	certsDir = flag.String("certs_dir", ".ocsp-certs",
+		"directory to write the certificate to (in <dir>/<host>/)")
+	caCertFile = flag.String("cacert_file", ".ocspsrv.cert",
+		"file to write the CA certificate to")
+	validFor = flag.Duration("validfor", time.Hour,
+		"how long the OCSP responses are valid for")
+)
+
+type Server struct {
+	lis net.Listener
+
+	caKey  *ecdsa.PrivateKey
+	caCert *x509.Certificate
+}
+
+func NewServer(addr string) (*Server, error) {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{lis: lis}
+
+	// Generate root.
+	s.caKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1000),
+		Subject:               pkix.Name{CommonName: "Test OCSP CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(4 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(
+		rand.Reader, caTmpl, caTmpl, &s.caKey.PublicKey, s.caKey)
+	if err != nil {
+		return nil, err
+	}
+	s.caCert, err = x509.ParseCertificate(caDER)
+	if err != nil {
+		return nil, err
+	}
+
+	err = writePEM(*caCertFile, "CERTIFICATE", caDER)
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *Server) url() string {
+	return "http://" + s.lis.Addr().String()
+}
+
+// writeCert generates a certificate for the host, signed by our CA, and
+// writes it (with the full chain) and its key to dir.
+func (s *Server) writeCert(dir, host string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2000),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(4 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		OCSPServer:   []string{s.url() + "/"},
+	}
+	der, err := x509.CreateCertificate(
+		rand.Reader, tmpl, s.caCert, &key.PublicKey, s.caKey)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+
+	chain := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	chain = append(chain, pem.EncodeToMemory(
+		&pem.Block{Type: "CERTIFICATE", Bytes: s.caCert.Raw})...)
+	err = os.WriteFile(filepath.Join(dir, "fullchain.pem"), chain, 0600)
+	if err != nil {
+		return err
+	}
+	return writePEM(filepath.Join(dir, "privkey.pem"), "PRIVATE KEY", keyDER)
+}
+
+func (s *Server) Serve() {
+	http.HandleFunc("/", s.respond)
+	http.Serve(s.lis, nil)
+}
+
+func (s *Server) respond(w http.ResponseWriter, r *http.Request) {
+	var body []byte
+	var err error
+	switch r.Method {
+	case "POST":
+		body, err = io.ReadAll(r.Body)
+	case "GET":
+		// The request is base64-encoded in the path (RFC 6960 appendix A).
+		body, err = base64.StdEncoding.DecodeString(
+			strings.TrimPrefix(r.URL.Path, "/"))
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	req, err := ocsp.ParseRequest(body)
+	if err != nil {
+		fmt.Printf("%s %s: bad request: %v\n", r.Method, r.URL, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fmt.Printf("%s %s: request for SN %v\n", r.Method, r.URL, req.SerialNumber)
+
+	now := time.Now().Truncate(time.Minute)
+	resp, err := ocsp.CreateResponse(s.caCert, s.caCert, ocsp.Response{
+		Status:       ocsp.Good,
+		SerialNumber: req.SerialNumber,
+		ThisUpdate:   now,
+		NextUpdate:   now.Add(*validFor),
+	}, s.caKey)
+	if err != nil {
+		panic(err)
+	}
+
+	w.Header().Set("Content-Type", "application/ocsp-response")
+	w.Write(resp)
+}
+
+func writePEM(path, typ string, der []byte) error {
+	buf := pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der})
+	return os.WriteFile(path, buf, 0600)
+}
+
+func main() {
+	flag.Parse()
+
+	srv, err := NewServer(*addr)
+	if err != nil {
+		panic(err)
+	}
+
+	dir := filepath.Join(*certsDir, *host)
+	err = srv.writeCert(dir, *host)
+	if err != nil {
+		panic(err)
+	}
+
+	fmt.Printf("%s/\n", srv.url())
+	fmt.Printf("Certificate for %q in %q\n", *host, dir)
+	srv.Serve()
+}
@@ -0,0 +1,275 @@
+package util
+
+import (
+	"crypto/tls"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"blitiri.com.ar/go/gofer/trace"
+	"blitiri.com.ar/go/log"
+)
+
+// How long before a certificate expires we start warning about it.
+var CertExpiryWarning = 14 * 24 * time.Hour
+
+// How often to check the certificates in use for upcoming expiry.
+var CertExpiryCheckInterval = 1 * time.Hour
+
+// certSource is something that provides certificates, so we can list them
+// and check their expiry.
+type certSource interface {
+	// Description of where the certificates come from.
+	source() string
+
+	// Certificates currently in use.
+	certificates() []*tls.Certificate
+}
+
+// Registry of the certificate sources in use, by their description.
+// This is not pretty but it simplifies a lot of the code.
+var (
+	certRegistryMu sync.Mutex
+	certRegistry   = map[string]certSource{}
+	expiryLoopOnce sync.Once
+)
+
+// registerCerts adds the source to the registry. If there is already one
+// with the same description (e.g. a directory used by many listeners), it is
+// kept, as they have the same certificates. Autocert sources include the
+// listener address in their description, so they are never merged.
+func registerCerts(cs certSource) {
+	certRegistryMu.Lock()
+	_, dup := certRegistry[cs.source()]
+	if !dup {
+		certRegistry[cs.source()] = cs
+	}
+	certRegistryMu.Unlock()
+
+	// Check the new certificates right away, the periodic checks will take
+	// care of them afterwards.
+	if !dup {
+		warnExpiring(certInfos([]certSource{cs}, time.Now()), time.Now())
+	}
+	expiryLoopOnce.Do(func() { go expiryLoop() })
+}
+
+// certInfo is the information about a certificate in use.
+type certInfo struct {
+	Source   string
+	Subject  string
+	Names    []string
+	Issuer   string
+	NotAfter time.Time
+	Expiring bool
+}
+
+// certsInUse returns information about all the certificates in use, sorted
+// by expiry.
+func certsInUse(now time.Time) []certInfo {
+	certRegistryMu.Lock()
+	sources := make([]certSource, 0, len(certRegistry))
+	for _, cs := range certRegistry {
+		sources = append(sources, cs)
+	}
+	certRegistryMu.Unlock()
+
+	return certInfos(sources, now)
+}
+
+// certInfos returns information about the certificates of the given
+// sources, sorted by expiry.
+func certInfos(sources []certSource, now time.Time) []certInfo {
+	infos := []certInfo{}
+	for _, cs := range sources {
+		for _, cert := range cs.certificates() {
+			if cert.Leaf == nil {
+				continue
+			}
+			infos = append(infos, certInfo{
+				Source:   cs.source(),
+				Subject:  cert.Leaf.Subject.String(),
+				Names:    cert.Leaf.DNSNames,
+				Issuer:   cert.Leaf.Issuer.String(),
+				NotAfter: cert.Leaf.NotAfter,
+				Expiring: expiringSoon(cert, now),
+			})
+		}
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		if !infos[i].NotAfter.Equal(infos[j].NotAfter) {
+			return infos[i].NotAfter.Before(infos[j].NotAfter)
+		}
+		return infos[i].Source < infos[j].Source
+	})
+	return infos
+}
+
+// expiringSoon returns true if the certificate expires within the warning
+// threshold.
+func expiringSoon(cert *tls.Certificate, now time.Time) bool {
+	return cert.Leaf != nil &&
+		now.Add(CertExpiryWarning).After(cert.Leaf.NotAfter)
+}
+
+// traceExpiring records an error in the trace, about the certificate being
+// served for the given handshake being close to its expiry.
+func traceExpiring(tr *trace.Trace, hello *tls.ClientHelloInfo,
+	cert *tls.Certificate) {
+	tr.Errorf("serving certificate for %q which expires at %s",
+		hello.ServerName, cert.Leaf.NotAfter.Format(time.DateTime))
+}
+
+// warnExpiring logs a warning for each of the certificates that is close to
+// expiring. Returns how many there were.
+func warnExpiring(infos []certInfo, now time.Time) int {
+	n := 0
+	for _, ci := range infos {
+		if !ci.Expiring {
+			continue
+		}
+		n++
+		if now.After(ci.NotAfter) {
+			log.Errorf("certificate %q (%s) EXPIRED at %s",
+				ci.Names, ci.Source, ci.NotAfter.Format(time.DateTime))
+		} else {
+			log.Errorf("certificate %q (%s) expires at %s (in %s)",
+				ci.Names, ci.Source, ci.NotAfter.Format(time.DateTime),
+				ci.NotAfter.Sub(now).Round(time.Minute))
+		}
+	}
+	return n
+}
+
+func expiryLoop() {
+	for range time.Tick(CertExpiryCheckInterval) {
+		now := time.Now()
+		warnExpiring(certsInUse(now), now)
+	}
+}
+
+// autocertCerts keeps track of the certificates served by an autocert
+// manager, which does not give us a way to list them.
+type autocertCerts struct {
+	desc string
+
+	mu sync.Mutex
+
+	// Host name -> last certificate served for it.
+	byHost map[string]*tls.Certificate
+}
+
+func newAutocertCerts(desc string) *autocertCerts {
+	ac := &autocertCerts{
+		desc:   desc,
+		byHost: map[string]*tls.Certificate{},
+	}
+	registerCerts(ac)
+	return ac
+}
+
+func (ac *autocertCerts) served(host string, cert *tls.Certificate) {
+	ac.mu.Lock()
+	ac.byHost[strings.ToLower(host)] = cert
+	ac.mu.Unlock()
+}
+
+func (ac *autocertCerts) source() string {
+	return ac.desc
+}
+
+func (ac *autocertCerts) certificates() []*tls.Certificate {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+
+	// The same certificate can be served for more than one host.
+	seen := map[*tls.Certificate]bool{}
+	certs := []*tls.Certificate{}
+	for _, cert := range ac.byHost {
+		if !seen[cert] {
+			seen[cert] = true
+			certs = append(certs, cert)
+		}
+	}
+	return certs
+}
+
+// CertsDebugHandler shows the certificates in use.
+func CertsDebugHandler(w http.ResponseWriter, r *http.Request) {
+	data := struct {
+		Certs     []certInfo
+		Threshold time.Duration
+		Now       time.Time
+	}{
+		Certs:     certsInUse(time.Now()),
+		Threshold: CertExpiryWarning,
+		Now:       time.Now(),
+	}
+	if err := htmlCerts.Execute(w, data); err != nil {
+		log.Infof("certs debug handler error: %v", err)
+	}
+}
+
+var htmlCerts = template.Must(
+	template.New("certs").Funcs(template.FuncMap{
+		"until": func(t, now time.Time) time.Duration {
+			return t.Sub(now).Round(time.Minute)
+		},
+	}).Parse(
+		`<!DOCTYPE html>
+<html>
+
+<head>
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>certificates</title>
+<style type="text/css">
+  body {
+    font-family: sans-serif;
+  }
+  @media (prefers-color-scheme: dark) {
+    body {
+      background: #121212;
+	  color: #c9d1d9;
+	}
+	a { color: #44b4ec; }
+  }
+  td, th {
+    padding: 0.15em 0.5em;
+	text-align: left;
+  }
+  tr.expiring {
+    color: #e53935;
+	font-weight: bold;
+  }
+</style>
+</head>
+
+<body>
+<h1>Certificates</h1>
+
+Warning about certificates expiring within {{.Threshold}}.<p>
+
+<table>
+<tr>
+  <th>Names</th><th>Subject</th><th>Issuer</th><th>Source</th>
+  <th>Not after</th><th>Expires in</th>
+</tr>
+{{range .Certs}}
+<tr{{if .Expiring}} class="expiring"{{end}}>
+  <td>{{range .Names}}{{.}}<br>{{end}}</td>
+  <td>{{.Subject}}</td>
+  <td>{{.Issuer}}</td>
+  <td>{{.Source}}</td>
+  <td>{{.NotAfter.Format "2006-01-02 15:04:05 -0700"}}</td>
+  <td>{{until .NotAfter $.Now}}</td>
+</tr>
+{{end}}
+</table>
+
+</body>
+</html>
+`))
@@ -0,0 +1,292 @@
+package util
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"blitiri.com.ar/go/gofer/trace"
+	"blitiri.com.ar/go/log"
+)
+
+// How often to check the certificate directories for changes.
+var CertReloadInterval = 1 * time.Minute
+
+// LoadCertsFromDir loads certificates from the given directory, and returns a
+// TLS config including them.
+// The directory is periodically re-checked, and changed certificates are
+// reloaded, so renewals are picked up without having to restart.
+// OCSP responses are stapled for the certificates that support it.
+func LoadCertsFromDir(certDir string) (*tls.Config, error) {
+	cd, err := loadCertDir(certDir)
+	if err != nil {
+		return nil, err
+	}
+
+	go cd.reloadLoop()
+	registerCerts(cd)
+
+	tlsConfig := &tls.Config{
+		GetCertificate: cd.GetCertificate,
+	}
+	return tlsConfig, nil
+}
+
+// certDir holds the certificates from a directory. Each certificate is in its
+// own subdirectory, with "fullchain.pem" and "privkey.pem" files (this is the
+// layout used by certbot).
+type certDir struct {
+	dir string
+	tr  *trace.Trace
+
+	mu sync.RWMutex
+
+	// Subdirectory name -> certificate.
+	certs map[string]*dirCert
+
+	// Host name (possibly a wildcard) -> certificate, for SNI lookups.
+	byName map[string]*tls.Certificate
+
+	// Certificate to use if there is no SNI match.
+	def *tls.Certificate
+}
+
+type dirCert struct {
+	cert    *tls.Certificate
+	certMod time.Time
+	keyMod  time.Time
+
+	// When the stapled OCSP response expires, and when to refresh it.
+	ocspExpires time.Time
+	ocspRefresh time.Time
+}
+
+func loadCertDir(dir string) (*certDir, error) {
+	cd := &certDir{
+		dir:   dir,
+		certs: map[string]*dirCert{},
+		tr:    trace.New("certs", dir),
+	}
+	cd.tr.SetMaxEvents(1000)
+
+	if err := cd.load(true); err != nil {
+		return nil, err
+	}
+	return cd, nil
+}
+
+// load the certificates from the directory. Only certificates whose files
+// changed since the last load are read.
+// On the initial load, any error is returned; afterwards, errors are logged,
+// and the previous certificates remain in use.
+func (cd *certDir) load(initial bool) error {
+	infos, err := os.ReadDir(cd.dir)
+	if err != nil {
+		if initial {
+			return fmt.Errorf("ReadDir(%q): %v", cd.dir, err)
+		}
+		cd.tr.Errorf("ReadDir(%q): %v", cd.dir, err)
+		return nil
+	}
+
+	cd.mu.RLock()
+	old := cd.certs
+	cd.mu.RUnlock()
+
+	certs := map[string]*dirCert{}
+	changed := false
+	for _, info := range infos {
+		name := info.Name()
+		dir := filepath.Join(cd.dir, name)
+		if fi, err := os.Stat(dir); err == nil && !fi.IsDir() {
+			// Skip non-directories.
+			continue
+		}
+
+		certPath := filepath.Join(dir, "fullchain.pem")
+		certFI, err := os.Stat(certPath)
+		if os.IsNotExist(err) {
+			continue
+		}
+		keyPath := filepath.Join(dir, "privkey.pem")
+		keyFI, err := os.Stat(keyPath)
+		if os.IsNotExist(err) {
+			continue
+		}
+
+		prev := old[name]
+		if prev != nil && certFI != nil && keyFI != nil &&
+			prev.certMod.Equal(certFI.ModTime()) &&
+			prev.keyMod.Equal(keyFI.ModTime()) {
+			certs[name] = prev
+			continue
+		}
+
+		cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+		if err != nil {
+			err = fmt.Errorf("error loading pair (%q, %q): %v",
+				certPath, keyPath, err)
+			if initial {
+				return err
+			}
+			// Keep the previous certificate (if any), most likely we caught
+			// the files in the middle of being updated, and will load them
+			// on the next pass.
+			cd.tr.Errorf("%v", err)
+			if prev != nil {
+				certs[name] = prev
+			}
+			continue
+		}
+
+		certs[name] = cd.stapleFromCache(&dirCert{
+			cert:    &cert,
+			certMod: certFI.ModTime(),
+			keyMod:  keyFI.ModTime(),
+		}, time.Now())
+		changed = true
+		if !initial {
+			log.Infof("certs %q: reloaded %q (%q, expires %s)", cd.dir, name,
+				cert.Leaf.DNSNames, cert.Leaf.NotAfter.Format(time.DateTime))
+		}
+		cd.tr.Printf("loaded %q: %q, expires %s", name, cert.Leaf.DNSNames,
+			cert.Leaf.NotAfter.Format(time.DateTime))
+	}
+
+	if len(certs) == 0 {
+		if initial {
+			return fmt.Errorf("no certificates found in %q", cd.dir)
+		}
+		cd.tr.Errorf("no certificates found, keeping the previous ones")
+		return nil
+	}
+
+	for name := range old {
+		if _, ok := certs[name]; !ok {
+			cd.tr.Printf("removed %q", name)
+			changed = true
+		}
+	}
+
+	if changed {
+		cd.update(certs)
+	}
+	return nil
+}
+
+// update the certificates, and rebuild the SNI index.
+func (cd *certDir) update(certs map[string]*dirCert) {
+	names := []string{}
+	for name := range certs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	byName := map[string]*tls.Certificate{}
+	for _, name := range names {
+		cert := certs[name].cert
+		for _, host := range certNames(cert) {
+			if _, ok := byName[host]; !ok {
+				byName[host] = cert
+			}
+		}
+	}
+
+	cd.mu.Lock()
+	cd.certs = certs
+	cd.byName = byName
+	cd.def = certs[names[0]].cert
+	cd.mu.Unlock()
+}
+
+func (cd *certDir) reloadLoop() {
+	cd.refreshOCSP(time.Now())
+	for range time.Tick(CertReloadInterval) {
+		cd.load(false)
+		cd.refreshOCSP(time.Now())
+	}
+}
+
+// GetCertificate returns the certificate to use for the given ClientHello,
+// based on the server name indication.
+func (cd *certDir) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cd.mu.RLock()
+	cert, ok := LookupHost(cd.byName, hello.ServerName)
+	if !ok {
+		// Fall back to the default certificate, like the TLS library does
+		// when there are no matches.
+		cert = cd.def
+	}
+	cd.mu.RUnlock()
+
+	if expiringSoon(cert, time.Now()) {
+		tr := trace.New("certs", cd.dir)
+		traceExpiring(tr, hello, cert)
+		tr.Finish()
+	}
+	return cert, nil
+}
+
+func (cd *certDir) source() string {
+	return "certs " + cd.dir
+}
+
+func (cd *certDir) certificates() []*tls.Certificate {
+	cd.mu.RLock()
+	defer cd.mu.RUnlock()
+
+	names := []string{}
+	for name := range cd.certs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	certs := make([]*tls.Certificate, 0, len(names))
+	for _, name := range names {
+		certs = append(certs, cd.certs[name].cert)
+	}
+	return certs
+}
+
+// certNames returns the (lowercase) host names the certificate is valid for.
+func certNames(cert *tls.Certificate) []string {
+	if cert.Leaf == nil {
+		return nil
+	}
+	names := cert.Leaf.DNSNames
+	if len(names) == 0 && cert.Leaf.Subject.CommonName != "" {
+		names = []string{cert.Leaf.Subject.CommonName}
+	}
+
+	lower := make([]string, 0, len(names))
+	for _, n := range names {
+		lower = append(lower, strings.ToLower(n))
+	}
+	return lower
+}
+
+// LookupHost finds the entry for the given host in the map. Map keys are
+// host names, which can also be wildcards like "*.example.com".
+// Wildcards only match a single label, so "*.example.com" matches
+// "www.example.com", but not "example.com" nor "a.b.example.com".
+// Exact matches take precedence over wildcard ones.
+func LookupHost[T any](m map[string]T, host string) (T, bool) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if v, ok := m[host]; ok && host != "" {
+		return v, true
+	}
+
+	if idx := strings.Index(host, "."); idx > 0 {
+		if v, ok := m["*"+host[idx:]]; ok {
+			return v, true
+		}
+	}
+
+	var zero T
+	return zero, false
+}
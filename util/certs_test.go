@@ -0,0 +1,251 @@
+package util
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeCert generates a self-signed certificate for the given hosts, and
+// writes it in dir/fullchain.pem and dir/privkey.pem.
+func writeCert(t *testing.T, dir string, serial int64, notAfter time.Time,
+	hosts ...string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: hosts[0]},
+		DNSNames:     hosts,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	os.MkdirAll(dir, 0700)
+	writePEM(t, filepath.Join(dir, "fullchain.pem"), "CERTIFICATE", der)
+	writePEM(t, filepath.Join(dir, "privkey.pem"), "PRIVATE KEY", keyDER)
+}
+
+func writePEM(t *testing.T, path, typ string, der []byte) {
+	t.Helper()
+	buf := pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der})
+	if err := os.WriteFile(path, buf, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// touch the files in the directory, so they look modified.
+func touch(t *testing.T, dir string, mod time.Time) {
+	t.Helper()
+	for _, f := range []string{"fullchain.pem", "privkey.pem"} {
+		if err := os.Chtimes(filepath.Join(dir, f), mod, mod); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func serialFor(t *testing.T, cd *certDir, name string) int64 {
+	t.Helper()
+	cert, err := cd.GetCertificate(&tls.ClientHelloInfo{ServerName: name})
+	if err != nil || cert == nil {
+		t.Fatalf("GetCertificate(%q): %v / %v", name, cert, err)
+	}
+	return cert.Leaf.SerialNumber.Int64()
+}
+
+func TestCertDirSNI(t *testing.T) {
+	dir := t.TempDir()
+	year := time.Now().Add(365 * 24 * time.Hour)
+	writeCert(t, dir+"/a", 1, year, "a.com", "www.a.com")
+	writeCert(t, dir+"/b", 2, year, "b.com", "*.b.com")
+	writeCert(t, dir+"/c", 3, year, "x.b.com")
+
+	cd, err := loadCertDir(dir)
+	if err != nil {
+		t.Fatalf("error loading: %v", err)
+	}
+
+	cases := []struct {
+		name   string
+		serial int64
+	}{
+		{"a.com", 1},
+		{"WWW.A.com.", 1},
+		{"b.com", 2},
+		{"y.b.com", 2},
+		{"x.b.com", 3}, // Exact match wins over wildcard.
+		{"a.x.b.com", 1},
+		{"unknown", 1}, // Default.
+		{"", 1},
+	}
+	for _, c := range cases {
+		if s := serialFor(t, cd, c.name); s != c.serial {
+			t.Errorf("%q: expected serial %d, got %d", c.name, c.serial, s)
+		}
+	}
+}
+
+func TestCertDirReload(t *testing.T) {
+	dir := t.TempDir()
+	year := time.Now().Add(365 * 24 * time.Hour)
+	writeCert(t, dir+"/a", 1, year, "a.com")
+	touch(t, dir+"/a", time.Now().Add(-time.Hour))
+
+	cd, err := loadCertDir(dir)
+	if err != nil {
+		t.Fatalf("error loading: %v", err)
+	}
+	if s := serialFor(t, cd, "a.com"); s != 1 {
+		t.Fatalf("expected serial 1, got %d", s)
+	}
+
+	// Renew the certificate, check it gets picked up.
+	writeCert(t, dir+"/a", 2, year, "a.com")
+	writeCert(t, dir+"/b", 3, year, "b.com")
+	cd.load(false)
+	if s := serialFor(t, cd, "a.com"); s != 2 {
+		t.Errorf("expected serial 2 after reload, got %d", s)
+	}
+	if s := serialFor(t, cd, "b.com"); s != 3 {
+		t.Errorf("expected serial 3 after reload, got %d", s)
+	}
+
+	// Break the certificate, check we keep serving the old one.
+	os.WriteFile(dir+"/a/fullchain.pem", []byte("broken"), 0600)
+	cd.load(false)
+	if s := serialFor(t, cd, "a.com"); s != 2 {
+		t.Errorf("expected serial 2 after broken reload, got %d", s)
+	}
+
+	// Remove everything, check we keep serving the old ones.
+	os.RemoveAll(dir + "/a")
+	os.RemoveAll(dir + "/b")
+	cd.load(false)
+	if s := serialFor(t, cd, "b.com"); s != 3 {
+		t.Errorf("expected serial 3 after removal, got %d", s)
+	}
+
+	// Remove the directory itself, same thing.
+	os.RemoveAll(dir)
+	cd.load(false)
+	if s := serialFor(t, cd, "b.com"); s != 3 {
+		t.Errorf("expected serial 3 after dir removal, got %d", s)
+	}
+}
+
+func TestLoadCertsFromDirConfig(t *testing.T) {
+	dir := t.TempDir()
+	writeCert(t, dir+"/a", 1, time.Now().Add(time.Hour), "a.com")
+
+	conf, err := LoadCertsFromDir(dir)
+	if err != nil {
+		t.Fatalf("error loading: %v", err)
+	}
+	cert, err := conf.GetCertificate(&tls.ClientHelloInfo{ServerName: "a.com"})
+	if err != nil || !strings.Contains(cert.Leaf.Subject.CommonName, "a.com") {
+		t.Errorf("unexpected certificate: %v / %v", cert, err)
+	}
+}
+
+func TestLookupHost(t *testing.T) {
+	m := map[string]int{
+		"a.com":   1,
+		"*.a.com": 2,
+		"*.b.com": 3,
+	}
+	cases := []struct {
+		host string
+		v    int
+		ok   bool
+	}{
+		{"a.com", 1, true},
+		{"A.COM.", 1, true},
+		{"x.a.com", 2, true},
+		{"x.y.a.com", 0, false},
+		{"b.com", 0, false},
+		{"x.b.com", 3, true},
+		{".b.com", 0, false},
+		{"", 0, false},
+		{"*.a.com", 2, true},
+	}
+	for _, c := range cases {
+		v, ok := LookupHost(m, c.host)
+		if v != c.v || ok != c.ok {
+			t.Errorf("%q: expected %v/%v, got %v/%v", c.host, c.v, c.ok, v, ok)
+		}
+	}
+}
+
+func TestCertsInUse(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	writeCert(t, dir+"/a", 1, now.Add(365*24*time.Hour), "a.com", "www.a.com")
+	writeCert(t, dir+"/b", 2, now.Add(24*time.Hour), "b.com")
+
+	if _, err := LoadCertsFromDir(dir); err != nil {
+		t.Fatalf("error loading: %v", err)
+	}
+	ac := newAutocertCerts("autocerts test")
+	cd, _ := loadCertDir(dir)
+	ac.served("c.com", cd.certs["a"].cert)
+	ac.served("C.com", cd.certs["a"].cert)
+
+	infos := []certInfo{}
+	for _, ci := range certsInUse(now) {
+		if ci.Source == "certs "+dir || ci.Source == "autocerts test" {
+			infos = append(infos, ci)
+		}
+	}
+	if len(infos) != 3 {
+		t.Fatalf("expected 3 certificates, got %d: %v", len(infos), infos)
+	}
+
+	// Sorted by expiry.
+	if infos[0].Names[0] != "b.com" || !infos[0].Expiring {
+		t.Errorf("expected b.com to be expiring first, got %+v", infos[0])
+	}
+	for _, ci := range infos[1:] {
+		if ci.Names[0] != "a.com" || ci.Expiring {
+			t.Errorf("unexpected certificate: %+v", ci)
+		}
+	}
+
+	if n := warnExpiring(infos, now); n != 1 {
+		t.Errorf("expected 1 expiring certificate, got %d", n)
+	}
+
+	// The debug page lists them all.
+	w := httptest.NewRecorder()
+	CertsDebugHandler(w, httptest.NewRequest("GET", "/debug/certs", nil))
+	body := w.Body.String()
+	for _, s := range []string{"a.com", "www.a.com", "b.com",
+		`class="expiring"`, "certs " + dir, "autocerts test"} {
+		if !strings.Contains(body, s) {
+			t.Errorf("debug page does not contain %q", s)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package util
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"blitiri.com.ar/go/gofer/config"
+	"blitiri.com.ar/go/gofer/trace"
+)
+
+// How often to check if the autocerts hosts file changed.
+var HostsFileReloadInterval = 1 * time.Minute
+
+// Timeout for the requests to the "ask" URL.
+var askTimeout = 5 * time.Second
+
+// hostPolicy decides which hosts autocert can get certificates for.
+// Besides the fixed list of hosts, it can allow hosts on demand (if they
+// match a regexp, are in a file, or an external URL approves them), up to a
+// limit per hour.
+type hostPolicy struct {
+	hosts      map[string]bool
+	re         *regexp.Regexp
+	file       string
+	ask        *url.URL
+	maxPerHour int
+
+	tr *trace.Trace
+
+	mu sync.Mutex
+
+	// Hosts from the file, and its modification time when last loaded.
+	fileHosts map[string]bool
+	fileMod   time.Time
+
+	// On-demand hosts allowed in the last hour -> when they were allowed.
+	allowed map[string]time.Time
+}
+
+func newHostPolicy(conf config.AutoCerts) (*hostPolicy, error) {
+	p := &hostPolicy{
+		hosts:      map[string]bool{},
+		file:       conf.HostsFile,
+		maxPerHour: conf.MaxPerHour,
+		allowed:    map[string]time.Time{},
+		tr:         trace.New("autocerts", "host policy"),
+	}
+	p.tr.SetMaxEvents(1000)
+
+	for _, h := range conf.Hosts {
+		p.hosts[strings.ToLower(h)] = true
+	}
+
+	if conf.HostsRegexp != nil {
+		// Anchor the expression, so it always matches the full host.
+		p.re = regexp.MustCompile(
+			"^(?:" + conf.HostsRegexp.String() + ")$")
+	}
+
+	if conf.Ask != nil {
+		u := conf.Ask.URL()
+		p.ask = &u
+	}
+
+	if p.file != "" {
+		if err := p.loadFile(true); err != nil {
+			return nil, err
+		}
+		go p.reloadLoop()
+	}
+
+	return p, nil
+}
+
+// loadFile loads the hosts file, if it changed since the last load.
+// The file has one host per line; empty lines and lines starting with "#"
+// are ignored.
+// On the initial load, any error is returned; afterwards, errors are logged,
+// and the previous hosts remain in use.
+func (p *hostPolicy) loadFile(initial bool) error {
+	fi, err := os.Stat(p.file)
+	if err == nil {
+		p.mu.Lock()
+		unchanged := p.fileMod.Equal(fi.ModTime())
+		p.mu.Unlock()
+		if unchanged && !initial {
+			return nil
+		}
+	}
+
+	buf, err := os.ReadFile(p.file)
+	if err != nil {
+		if initial {
+			return fmt.Errorf("error reading hosts file: %v", err)
+		}
+		p.tr.Errorf("error reading hosts file: %v", err)
+		return nil
+	}
+
+	hosts := map[string]bool{}
+	scanner := bufio.NewScanner(bytes.NewReader(buf))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		hosts[strings.ToLower(line)] = true
+	}
+
+	p.mu.Lock()
+	p.fileHosts = hosts
+	if fi != nil {
+		p.fileMod = fi.ModTime()
+	}
+	p.mu.Unlock()
+
+	p.tr.Printf("loaded %d hosts from %q", len(hosts), p.file)
+	return nil
+}
+
+func (p *hostPolicy) reloadLoop() {
+	for range time.Tick(HostsFileReloadInterval) {
+		p.loadFile(false)
+	}
+}
+
+// Allow is an autocert.HostPolicy. It returns nil if a certificate can be
+// obtained for the given host.
+func (p *hostPolicy) Allow(ctx context.Context, host string) error {
+	host = strings.ToLower(host)
+	if p.hosts[host] {
+		return nil
+	}
+
+	ok, how, err := p.onDemand(ctx, host)
+	if err != nil {
+		p.tr.Errorf("%q: %v", host, err)
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("host %q not allowed", host)
+	}
+
+	if err := p.checkLimit(host, time.Now()); err != nil {
+		p.tr.Errorf("%q: allowed by %s, but %v", host, how, err)
+		return err
+	}
+
+	p.tr.Printf("%q: allowed by %s", host, how)
+	return nil
+}
+
+// onDemand checks if the host is allowed by the on-demand policies.
+// Returns which one allowed it, for tracing purposes.
+func (p *hostPolicy) onDemand(ctx context.Context, host string) (bool, string, error) {
+	if p.re != nil && p.re.MatchString(host) {
+		return true, "regexp", nil
+	}
+
+	p.mu.Lock()
+	inFile := p.fileHosts[host]
+	p.mu.Unlock()
+	if inFile {
+		return true, "hosts file", nil
+	}
+
+	if p.ask != nil {
+		ok, err := p.askURL(ctx, host)
+		return ok, "ask URL", err
+	}
+
+	return false, "", nil
+}
+
+// askURL asks the configured URL if the host is allowed.
+// The host is passed in the "domain" query parameter, and it is allowed if
+// the response status is 200.
+func (p *hostPolicy) askURL(ctx context.Context, host string) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, askTimeout)
+	defer cancel()
+
+	u := *p.ask
+	q := u.Query()
+	q.Set("domain", host)
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("error asking: %v", err)
+	}
+	resp.Body.Close()
+
+	return resp.StatusCode == http.StatusOK, nil
+}
+
+// checkLimit checks if the on-demand host can be allowed without going over
+// the per-hour limit, and records it if so.
+// Hosts that were allowed within the last hour don't count again, since
+// autocert may check the policy multiple times while obtaining a
+// certificate.
+func (p *hostPolicy) checkLimit(host string, now time.Time) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for h, t := range p.allowed {
+		if now.Sub(t) >= time.Hour {
+			delete(p.allowed, h)
+		}
+	}
+
+	if _, ok := p.allowed[host]; ok {
+		return nil
+	}
+	if p.maxPerHour > 0 && len(p.allowed) >= p.maxPerHour {
+		return fmt.Errorf("over the limit of %d hosts per hour",
+			p.maxPerHour)
+	}
+
+	p.allowed[host] = now
+	return nil
+}
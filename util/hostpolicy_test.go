@@ -0,0 +1,108 @@
+package util
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"blitiri.com.ar/go/gofer/config"
+)
+
+func TestHostPolicy(t *testing.T) {
+	ask := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Query().Get("domain") != "asked.com" {
+				http.Error(w, "no", http.StatusNotFound)
+			}
+		}))
+	defer ask.Close()
+
+	hostsFile := filepath.Join(t.TempDir(), "hosts")
+	os.WriteFile(hostsFile, []byte("# Comment\n\nFile.com\n"), 0600)
+
+	conf, err := config.LoadString(`
+https:
+  ":https":
+    autocerts:
+      hosts: ["fixed.com"]
+      hosts_regexp: '[a-z]+\.re\.com'
+      hosts_file: "` + hostsFile + `"
+      ask: "` + ask.URL + `/ask"
+      max_per_hour: 3
+`)
+	if err != nil {
+		t.Fatalf("error loading config: %v", err)
+	}
+
+	p, err := newHostPolicy(conf.HTTPS[":https"].AutoCerts)
+	if err != nil {
+		t.Fatalf("error creating policy: %v", err)
+	}
+
+	ctx := context.Background()
+	cases := []struct {
+		host string
+		ok   bool
+	}{
+		{"fixed.com", true},
+		{"FIXED.com", true},
+		{"abc.re.com", true},
+		{"abc.re.com.evil.com", false},
+		{"1.re.com", false},
+		{"file.com", true},
+		{"asked.com", true},
+		{"other.com", false},
+	}
+	for _, c := range cases {
+		err := p.Allow(ctx, c.host)
+		if (err == nil) != c.ok {
+			t.Errorf("%q: expected ok=%v, got %v", c.host, c.ok, err)
+		}
+	}
+
+	// The limit is reached (3 on-demand hosts were allowed), but hosts that
+	// were already allowed don't count again, and fixed hosts are not
+	// limited.
+	if err := p.Allow(ctx, "xyz.re.com"); err == nil {
+		t.Errorf("expected error over the limit, got nil")
+	}
+	if err := p.Allow(ctx, "file.com"); err != nil {
+		t.Errorf("already allowed host: %v", err)
+	}
+	if err := p.Allow(ctx, "fixed.com"); err != nil {
+		t.Errorf("fixed host over the limit: %v", err)
+	}
+
+	// After an hour, there is room again.
+	if err := p.checkLimit("xyz.re.com", time.Now().Add(time.Hour)); err != nil {
+		t.Errorf("limit did not expire: %v", err)
+	}
+
+	// Changes to the hosts file are picked up.
+	os.WriteFile(hostsFile, []byte("new.com\n"), 0600)
+	os.Chtimes(hostsFile, time.Now(), time.Now().Add(time.Minute))
+	p.loadFile(false)
+	if ok, _, _ := p.onDemand(ctx, "new.com"); !ok {
+		t.Errorf("new host in the file was not allowed")
+	}
+	if ok, _, _ := p.onDemand(ctx, "file.com"); ok {
+		t.Errorf("host removed from the file is still allowed")
+	}
+
+	// Errors reading the file after the initial load keep the old hosts.
+	os.Remove(hostsFile)
+	p.loadFile(false)
+	if ok, _, _ := p.onDemand(ctx, "new.com"); !ok {
+		t.Errorf("hosts were lost after an error reading the file")
+	}
+
+	// But on the initial load, they're returned.
+	_, err = newHostPolicy(config.AutoCerts{HostsFile: hostsFile})
+	if err == nil {
+		t.Errorf("expected error with a missing hosts file, got nil")
+	}
+}
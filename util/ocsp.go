@@ -0,0 +1,246 @@
+package util
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// Where to cache the OCSP responses.
+var ocspCacheDir = defaultCachePath("gofer-ocsp-cache")
+
+// How long to wait before retrying a failed OCSP fetch.
+var ocspRetryInterval = 10 * time.Minute
+
+var ocspClient = &http.Client{
+	Timeout: 30 * time.Second,
+}
+
+// ocspIssuer returns the issuer of the certificate, if the certificate
+// supports OCSP. The issuer is taken from the chain, so it must be present.
+func ocspIssuer(cert *tls.Certificate) (*x509.Certificate, bool) {
+	if cert.Leaf == nil || len(cert.Leaf.OCSPServer) == 0 ||
+		len(cert.Certificate) < 2 {
+		return nil, false
+	}
+	issuer, err := x509.ParseCertificate(cert.Certificate[1])
+	if err != nil {
+		return nil, false
+	}
+	return issuer, true
+}
+
+// ocspStaple is an OCSP response ready to be stapled.
+type ocspStaple struct {
+	der []byte
+
+	// When the response expires, and when we should refresh it (well before
+	// it expires).
+	expires time.Time
+	refresh time.Time
+}
+
+// parseOCSPStaple parses and validates the OCSP response for the given
+// certificate. Only responses with a "good" status are accepted.
+func parseOCSPStaple(der []byte, leaf, issuer *x509.Certificate,
+	now time.Time) (*ocspStaple, error) {
+	resp, err := ocsp.ParseResponseForCert(der, leaf, issuer)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Status != ocsp.Good {
+		return nil, fmt.Errorf("certificate status is %s",
+			ocspStatusString(resp.Status))
+	}
+
+	st := &ocspStaple{der: der}
+	if resp.NextUpdate.IsZero() {
+		// The responder doesn't tell us how long it is valid for, so make
+		// up a conservative value.
+		st.expires = now.Add(24 * time.Hour)
+		st.refresh = now.Add(12 * time.Hour)
+	} else {
+		if !now.Before(resp.NextUpdate) {
+			return nil, fmt.Errorf("response expired at %v", resp.NextUpdate)
+		}
+		st.expires = resp.NextUpdate
+		st.refresh = resp.ThisUpdate.Add(
+			resp.NextUpdate.Sub(resp.ThisUpdate) / 2)
+	}
+	return st, nil
+}
+
+func ocspStatusString(s int) string {
+	switch s {
+	case ocsp.Good:
+		return "good"
+	case ocsp.Revoked:
+		return "revoked"
+	default:
+		return "unknown"
+	}
+}
+
+// fetchOCSP gets the OCSP response for the certificate from its responder.
+func fetchOCSP(leaf, issuer *x509.Certificate) ([]byte, error) {
+	req, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %v", err)
+	}
+
+	url := leaf.OCSPServer[0]
+	resp, err := ocspClient.Post(
+		url, "application/ocsp-request", bytes.NewReader(req))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: unexpected status %s", url, resp.Status)
+	}
+
+	// Responses are small, anything above this is suspicious.
+	return io.ReadAll(io.LimitReader(resp.Body, 1024*1024))
+}
+
+// ocspCachePath returns the path to the cached OCSP response for the leaf.
+func ocspCachePath(leaf *x509.Certificate) string {
+	h := sha256.Sum256(leaf.Raw)
+	return filepath.Join(ocspCacheDir, hex.EncodeToString(h[:])+".ocsp")
+}
+
+func writeOCSPCache(leaf *x509.Certificate, der []byte) error {
+	if err := os.MkdirAll(ocspCacheDir, 0700); err != nil {
+		return err
+	}
+
+	// Write to a temporary file and rename it, so readers never see a
+	// partially written response.
+	path := ocspCachePath(leaf)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, der, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// stapleFromCache returns a copy of the certificate with the cached OCSP
+// response stapled, if there is a valid one.
+func (cd *certDir) stapleFromCache(dc *dirCert, now time.Time) *dirCert {
+	issuer, ok := ocspIssuer(dc.cert)
+	if !ok {
+		return dc
+	}
+
+	der, err := os.ReadFile(ocspCachePath(dc.cert.Leaf))
+	if err != nil {
+		return dc
+	}
+	st, err := parseOCSPStaple(der, dc.cert.Leaf, issuer, now)
+	if err != nil {
+		cd.tr.Printf("ignoring cached OCSP response for %q: %v",
+			dc.cert.Leaf.Subject, err)
+		return dc
+	}
+
+	cd.tr.Printf("loaded cached OCSP response for %q, expires %s",
+		dc.cert.Leaf.Subject, st.expires.Format(time.DateTime))
+	return dc.withStaple(st)
+}
+
+// withStaple returns a copy of the certificate with the given staple.
+// We don't modify the certificate in place, because it may be in use by
+// ongoing handshakes.
+func (dc *dirCert) withStaple(st *ocspStaple) *dirCert {
+	ndc := *dc
+	cert := *dc.cert
+	ndc.cert = &cert
+	if st != nil {
+		ndc.cert.OCSPStaple = st.der
+		ndc.ocspExpires = st.expires
+		ndc.ocspRefresh = st.refresh
+	} else {
+		ndc.cert.OCSPStaple = nil
+		ndc.ocspExpires = time.Time{}
+	}
+	return &ndc
+}
+
+// refreshOCSP fetches OCSP responses for the certificates that need it
+// (those without a response, or whose response is close to expiring).
+func (cd *certDir) refreshOCSP(now time.Time) {
+	cd.mu.RLock()
+	old := cd.certs
+	cd.mu.RUnlock()
+
+	certs := map[string]*dirCert{}
+	changed := false
+	for name, dc := range old {
+		certs[name] = dc
+
+		issuer, ok := ocspIssuer(dc.cert)
+		if !ok || now.Before(dc.ocspRefresh) {
+			continue
+		}
+
+		st, err := cd.fetchStaple(dc.cert.Leaf, issuer, now)
+		if err != nil {
+			cd.tr.Errorf("%q: error getting OCSP response: %v", name, err)
+
+			// Retry later, and keep the current staple while it's still
+			// valid.
+			if now.Before(dc.ocspExpires) {
+				certs[name] = dc.withStaple(&ocspStaple{
+					der:     dc.cert.OCSPStaple,
+					expires: dc.ocspExpires,
+					refresh: now.Add(ocspRetryInterval),
+				})
+			} else {
+				certs[name] = dc.withStaple(nil)
+				certs[name].ocspRefresh = now.Add(ocspRetryInterval)
+			}
+			changed = true
+			continue
+		}
+
+		cd.tr.Printf("%q: new OCSP response, expires %s, refresh at %s",
+			name, st.expires.Format(time.DateTime),
+			st.refresh.Format(time.DateTime))
+		certs[name] = dc.withStaple(st)
+		changed = true
+	}
+
+	if changed {
+		cd.update(certs)
+	}
+}
+
+func (cd *certDir) fetchStaple(leaf, issuer *x509.Certificate,
+	now time.Time) (*ocspStaple, error) {
+	der, err := fetchOCSP(leaf, issuer)
+	if err != nil {
+		return nil, err
+	}
+
+	st, err := parseOCSPStaple(der, leaf, issuer, now)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := writeOCSPCache(leaf, der); err != nil {
+		// Not fatal, we can staple it anyway.
+		cd.tr.Errorf("error writing OCSP cache: %v", err)
+	}
+	return st, nil
+}
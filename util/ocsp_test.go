@@ -0,0 +1,242 @@
+package util
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// ocspResponder is a test OCSP responder, which answers with the given
+// status for all requests.
+type ocspResponder struct {
+	ca    *x509.Certificate
+	caKey crypto.Signer
+
+	status   int
+	validFor time.Duration
+	fail     atomic.Bool
+	requests atomic.Int32
+}
+
+func (o *ocspResponder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	o.requests.Add(1)
+	if o.fail.Load() {
+		http.Error(w, "failing on purpose", http.StatusInternalServerError)
+		return
+	}
+
+	body, _ := io.ReadAll(r.Body)
+	req, err := ocsp.ParseRequest(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now().Add(-time.Minute)
+	resp, err := ocsp.CreateResponse(o.ca, o.ca, ocsp.Response{
+		Status:       o.status,
+		SerialNumber: req.SerialNumber,
+		ThisUpdate:   now,
+		NextUpdate:   now.Add(o.validFor),
+		RevokedAt:    now,
+	}, o.caKey)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(resp)
+}
+
+// writeCASignedCert writes a certificate for the host in dir, signed by a
+// new CA, and pointing to the given OCSP server.
+// Returns the CA certificate and key.
+func writeCASignedCert(t *testing.T, dir, host, ocspURL string) (
+	*x509.Certificate, crypto.Signer) {
+	t.Helper()
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(
+		rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := x509.ParseCertificate(caDER)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		OCSPServer:   []string{ocspURL},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	os.MkdirAll(dir, 0700)
+	chain := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	chain = append(chain,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER})...)
+	if err := os.WriteFile(filepath.Join(dir, "fullchain.pem"), chain, 0600); err != nil {
+		t.Fatal(err)
+	}
+	writePEM(t, filepath.Join(dir, "privkey.pem"), "PRIVATE KEY", keyDER)
+
+	return ca, caKey
+}
+
+func stapleFor(t *testing.T, cd *certDir, name string) []byte {
+	t.Helper()
+	cert, err := cd.GetCertificate(&tls.ClientHelloInfo{ServerName: name})
+	if err != nil || cert == nil {
+		t.Fatalf("GetCertificate(%q): %v / %v", name, cert, err)
+	}
+	return cert.OCSPStaple
+}
+
+func TestOCSPStapling(t *testing.T) {
+	ocspCacheDir = t.TempDir()
+	dir := t.TempDir()
+
+	responder := &ocspResponder{status: ocsp.Good, validFor: time.Hour}
+	srv := httptest.NewServer(responder)
+	defer srv.Close()
+	responder.ca, responder.caKey = writeCASignedCert(
+		t, dir+"/a", "a.com", srv.URL)
+
+	cd, err := loadCertDir(dir)
+	if err != nil {
+		t.Fatalf("error loading: %v", err)
+	}
+	if st := stapleFor(t, cd, "a.com"); st != nil {
+		t.Errorf("unexpected staple before fetching: %x", st)
+	}
+
+	now := time.Now()
+	cd.refreshOCSP(now)
+	staple := stapleFor(t, cd, "a.com")
+	if staple == nil {
+		t.Fatalf("no staple after refresh")
+	}
+	if n := responder.requests.Load(); n != 1 {
+		t.Errorf("expected 1 request, got %d", n)
+	}
+
+	// The response is still fresh, so it shouldn't be fetched again.
+	cd.refreshOCSP(now.Add(time.Minute))
+	if n := responder.requests.Load(); n != 1 {
+		t.Errorf("expected 1 request, got %d", n)
+	}
+
+	// A new load uses the cached response, even if the responder is down.
+	responder.fail.Store(true)
+	cd2, err := loadCertDir(dir)
+	if err != nil {
+		t.Fatalf("error loading: %v", err)
+	}
+	if st := stapleFor(t, cd2, "a.com"); !bytes.Equal(st, staple) {
+		t.Errorf("expected cached staple, got %x", st)
+	}
+
+	// Past the refresh time, with the responder failing: we keep the staple
+	// while it's valid, and retry later.
+	later := now.Add(40 * time.Minute)
+	cd.refreshOCSP(later)
+	if n := responder.requests.Load(); n != 2 {
+		t.Errorf("expected 2 requests, got %d", n)
+	}
+	if st := stapleFor(t, cd, "a.com"); !bytes.Equal(st, staple) {
+		t.Errorf("expected previous staple to be kept, got %x", st)
+	}
+	cd.refreshOCSP(later.Add(time.Minute))
+	if n := responder.requests.Load(); n != 2 {
+		t.Errorf("retried too early: %d requests", n)
+	}
+
+	// Once expired, the staple is dropped.
+	cd.refreshOCSP(now.Add(2 * time.Hour))
+	if st := stapleFor(t, cd, "a.com"); st != nil {
+		t.Errorf("expected expired staple to be dropped, got %x", st)
+	}
+}
+
+func TestOCSPRevoked(t *testing.T) {
+	ocspCacheDir = t.TempDir()
+	dir := t.TempDir()
+
+	responder := &ocspResponder{status: ocsp.Revoked, validFor: time.Hour}
+	srv := httptest.NewServer(responder)
+	defer srv.Close()
+	responder.ca, responder.caKey = writeCASignedCert(
+		t, dir+"/a", "a.com", srv.URL)
+
+	cd, err := loadCertDir(dir)
+	if err != nil {
+		t.Fatalf("error loading: %v", err)
+	}
+	cd.refreshOCSP(time.Now())
+	if st := stapleFor(t, cd, "a.com"); st != nil {
+		t.Errorf("revoked response was stapled: %x", st)
+	}
+
+	entries, _ := os.ReadDir(ocspCacheDir)
+	if len(entries) != 0 {
+		t.Errorf("revoked response was cached: %v", entries)
+	}
+}
+
+func TestOCSPNotSupported(t *testing.T) {
+	// Self-signed certificates have no OCSP server nor issuer, so they are
+	// left alone.
+	dir := t.TempDir()
+	writeCert(t, dir+"/a", 1, time.Now().Add(time.Hour), "a.com")
+	cd, err := loadCertDir(dir)
+	if err != nil {
+		t.Fatalf("error loading: %v", err)
+	}
+	cd.refreshOCSP(time.Now())
+	if st := stapleFor(t, cd, "a.com"); st != nil {
+		t.Errorf("unexpected staple: %x", st)
+	}
+}
@@ -0,0 +1,222 @@
+package util
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"blitiri.com.ar/go/gofer/config"
+	"blitiri.com.ar/go/gofer/trace"
+	"blitiri.com.ar/go/log"
+)
+
+// How often to check the session ticket keys file for changes.
+var TicketKeysReloadInterval = 1 * time.Minute
+
+// How many session ticket keys to keep when rotating them ourselves. The
+// older ones are only used to decrypt tickets, so resumption keeps working
+// across rotations.
+const rotatedTicketKeys = 3
+
+// ApplyTLSOptions applies the given options to the TLS configuration.
+// The options are expected to have been validated with config.TLS.Check.
+func ApplyTLSOptions(tlsConf *tls.Config, opts config.TLS) error {
+	var err error
+
+	tlsConf.MinVersion, err = config.TLSVersion(opts.MinVersion)
+	if err != nil {
+		return err
+	}
+	tlsConf.MaxVersion, err = config.TLSVersion(opts.MaxVersion)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range opts.CipherSuites {
+		id, err := config.CipherSuite(name)
+		if err != nil {
+			return err
+		}
+		tlsConf.CipherSuites = append(tlsConf.CipherSuites, id)
+	}
+
+	for _, name := range opts.Curves {
+		id, err := config.Curve(name)
+		if err != nil {
+			return err
+		}
+		tlsConf.CurvePreferences = append(tlsConf.CurvePreferences, id)
+	}
+
+	if len(opts.ALPN) > 0 {
+		// The ACME TLS-ALPN-01 challenge relies on its protocol being
+		// offered, so keep it if it was there.
+		acmeTLS := slices.Contains(tlsConf.NextProtos, "acme-tls/1")
+		tlsConf.NextProtos = slices.Clone(opts.ALPN)
+		if acmeTLS && !slices.Contains(opts.ALPN, "acme-tls/1") {
+			tlsConf.NextProtos = append(tlsConf.NextProtos, "acme-tls/1")
+		}
+	}
+
+	if opts.SessionTicketKeysFile != "" {
+		tk := &ticketKeysFile{
+			path: opts.SessionTicketKeysFile,
+			conf: tlsConf,
+			tr:   trace.New("tls-tickets", opts.SessionTicketKeysFile),
+		}
+		if err := tk.load(true); err != nil {
+			return err
+		}
+		go tk.reloadLoop()
+	} else if opts.SessionTicketRotation > 0 {
+		r := &ticketKeyRotator{conf: tlsConf}
+		if err := r.rotate(); err != nil {
+			return err
+		}
+		go r.loop(opts.SessionTicketRotation)
+	}
+
+	return nil
+}
+
+// UpstreamTLSConfig returns the TLS configuration to use when connecting to
+// backends, according to the given options.
+func UpstreamTLSConfig(opts config.UpstreamTLS) (*tls.Config, error) {
+	tlsConf := &tls.Config{
+		ServerName:         opts.ServerName,
+		InsecureSkipVerify: opts.InsecureSkipVerify,
+	}
+
+	if opts.CA != "" {
+		pem, err := os.ReadFile(opts.CA)
+		if err != nil {
+			return nil, err
+		}
+		tlsConf.RootCAs = x509.NewCertPool()
+		if !tlsConf.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %q", opts.CA)
+		}
+	}
+
+	if opts.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(opts.Cert, opts.Key)
+		if err != nil {
+			return nil, err
+		}
+		tlsConf.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConf, nil
+}
+
+// ticketKeyRotator periodically generates new session ticket keys.
+type ticketKeyRotator struct {
+	conf *tls.Config
+	keys [][32]byte
+}
+
+// rotate adds a new random key at the front, and drops the oldest one if
+// needed.
+func (r *ticketKeyRotator) rotate() error {
+	var key [32]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return fmt.Errorf("error generating session ticket key: %v", err)
+	}
+	r.keys = append([][32]byte{key}, r.keys...)
+	if len(r.keys) > rotatedTicketKeys {
+		r.keys = r.keys[:rotatedTicketKeys]
+	}
+	r.conf.SetSessionTicketKeys(r.keys)
+	return nil
+}
+
+func (r *ticketKeyRotator) loop(every time.Duration) {
+	for range time.Tick(every) {
+		if err := r.rotate(); err != nil {
+			log.Errorf("%v", err)
+		}
+	}
+}
+
+// ticketKeysFile loads the session ticket keys from a file, and reloads them
+// when it changes.
+type ticketKeysFile struct {
+	path string
+	conf *tls.Config
+	tr   *trace.Trace
+	mod  time.Time
+}
+
+func (tk *ticketKeysFile) load(initial bool) error {
+	fi, err := os.Stat(tk.path)
+	if err == nil && fi.ModTime().Equal(tk.mod) {
+		return nil
+	}
+
+	var keys [][32]byte
+	if err == nil {
+		keys, err = readTicketKeys(tk.path)
+	}
+	if err != nil {
+		if initial {
+			return err
+		}
+		tk.tr.Errorf("%v", err)
+		return err
+	}
+
+	tk.conf.SetSessionTicketKeys(keys)
+	tk.mod = fi.ModTime()
+	tk.tr.Printf("loaded %d session ticket keys", len(keys))
+	return nil
+}
+
+func (tk *ticketKeysFile) reloadLoop() {
+	for range time.Tick(TicketKeysReloadInterval) {
+		tk.load(false)
+	}
+}
+
+// readTicketKeys reads session ticket keys from the given file.
+// It has one key per line, either in hex or base64; they must be 32 bytes
+// long. The first key is used to encrypt new tickets, the rest are only used
+// for decrypting. Empty lines and lines starting with '#' are ignored.
+func readTicketKeys(path string) ([][32]byte, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := [][32]byte{}
+	scanner := bufio.NewScanner(bytes.NewReader(buf))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, err := hex.DecodeString(line)
+		if err != nil {
+			key, err = base64.StdEncoding.DecodeString(line)
+		}
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("%s:%d: invalid key, "+
+				"must be 32 bytes in hex or base64", path, n)
+		}
+		keys = append(keys, [32]byte(key))
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s: no session ticket keys found", path)
+	}
+	return keys, nil
+}
@@ -0,0 +1,175 @@
+package util
+
+import (
+	"crypto/tls"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"blitiri.com.ar/go/gofer/config"
+	"blitiri.com.ar/go/gofer/trace"
+)
+
+func TestApplyTLSOptions(t *testing.T) {
+	conf := &tls.Config{
+		NextProtos: []string{"h2", "acme-tls/1"},
+	}
+	err := ApplyTLSOptions(conf, config.TLS{
+		MinVersion:   "1.2",
+		MaxVersion:   "1.3",
+		CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"},
+		Curves:       []string{"X25519", "P-256"},
+		ALPN:         []string{"http/1.1"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if conf.MinVersion != tls.VersionTLS12 || conf.MaxVersion != tls.VersionTLS13 {
+		t.Errorf("unexpected versions: %x - %x", conf.MinVersion, conf.MaxVersion)
+	}
+	if !slices.Equal(conf.CipherSuites,
+		[]uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}) {
+		t.Errorf("unexpected cipher suites: %v", conf.CipherSuites)
+	}
+	if !slices.Equal(conf.CurvePreferences,
+		[]tls.CurveID{tls.X25519, tls.CurveP256}) {
+		t.Errorf("unexpected curves: %v", conf.CurvePreferences)
+	}
+	if !slices.Equal(conf.NextProtos, []string{"http/1.1", "acme-tls/1"}) {
+		t.Errorf("unexpected ALPN: %v", conf.NextProtos)
+	}
+
+	// Invalid options are rejected (they are normally caught by the config
+	// checks).
+	invalid := []config.TLS{
+		{MinVersion: "1.4"},
+		{MaxVersion: "x"},
+		{CipherSuites: []string{"TLS_AES_128_GCM_SHA256"}},
+		{Curves: []string{"P-1"}},
+		{SessionTicketKeysFile: "/doesnotexist"},
+	}
+	for _, opts := range invalid {
+		if err := ApplyTLSOptions(&tls.Config{}, opts); err == nil {
+			t.Errorf("%+v: expected error, got nil", opts)
+		}
+	}
+}
+
+func TestTLSOptionsHandshake(t *testing.T) {
+	dir := t.TempDir()
+	writeCert(t, dir+"/a", 1, time.Now().Add(time.Hour), "a.com")
+	srvConf, err := LoadCertsFromDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ApplyTLSOptions(srvConf, config.TLS{
+		MaxVersion: "1.2",
+		ALPN:       []string{"x", "y"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, s := net.Pipe()
+	go func() {
+		srv := tls.Server(s, srvConf)
+		srv.Handshake()
+		s.Close()
+	}()
+
+	client := tls.Client(c, &tls.Config{
+		ServerName:         "a.com",
+		InsecureSkipVerify: true,
+		NextProtos:         []string{"y"},
+	})
+	if err := client.Handshake(); err != nil {
+		t.Fatalf("handshake error: %v", err)
+	}
+	st := client.ConnectionState()
+	if st.Version != tls.VersionTLS12 || st.NegotiatedProtocol != "y" {
+		t.Errorf("unexpected connection state: version %x, protocol %q",
+			st.Version, st.NegotiatedProtocol)
+	}
+	client.Close()
+}
+
+func TestReadTicketKeys(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, contents string) string {
+		path := filepath.Join(dir, name)
+		os.WriteFile(path, []byte(contents), 0600)
+		return path
+	}
+
+	hexKey := strings.Repeat("ab", 32)
+	b64Key := "AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8="
+	good := write("good", "# comment\n\n"+hexKey+"\n  "+b64Key+"  \n")
+	keys, err := readTicketKeys(good)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(keys) != 2 || keys[0][0] != 0xab || keys[1][31] != 31 {
+		t.Errorf("unexpected keys: %x", keys)
+	}
+
+	cases := []struct{ contents, err string }{
+		{"", "no session ticket keys found"},
+		{"# only comments\n", "no session ticket keys found"},
+		{hexKey + "\nshort\n", ":2: invalid key"},
+		{"abcd\n", ":1: invalid key"},
+	}
+	for _, c := range cases {
+		_, err := readTicketKeys(write("bad", c.contents))
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%q: expected error %q, got %v", c.contents, c.err, err)
+		}
+	}
+}
+
+func TestTicketKeysFileReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys")
+	os.WriteFile(path, []byte(strings.Repeat("01", 32)), 0600)
+
+	tk := &ticketKeysFile{
+		path: path,
+		conf: &tls.Config{},
+		tr:   trace.New("test", path),
+	}
+	if err := tk.load(true); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	first := tk.mod
+
+	// No changes, nothing happens.
+	if err := tk.load(false); err != nil || tk.mod != first {
+		t.Errorf("unexpected reload: %v, %v != %v", err, tk.mod, first)
+	}
+
+	// Change the file, expect a reload.
+	os.WriteFile(path, []byte(strings.Repeat("02", 32)), 0600)
+	later := first.Add(time.Second)
+	os.Chtimes(path, later, later)
+	if err := tk.load(false); err != nil || !tk.mod.Equal(later) {
+		t.Errorf("expected reload: %v, %v != %v", err, tk.mod, later)
+	}
+}
+
+func TestTicketKeyRotator(t *testing.T) {
+	r := &ticketKeyRotator{conf: &tls.Config{}}
+	for i := 0; i < 5; i++ {
+		if err := r.rotate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(r.keys) != rotatedTicketKeys {
+		t.Errorf("expected %d keys, got %d", rotatedTicketKeys, len(r.keys))
+	}
+	if r.keys[0] == r.keys[1] {
+		t.Errorf("keys were not rotated: %x", r.keys)
+	}
+}
@@ -4,12 +4,15 @@ package util
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"os"
 	"path/filepath"
-	"sync/atomic"
+	"time"
 
+	"blitiri.com.ar/go/gofer/acmeclient"
 	"blitiri.com.ar/go/gofer/config"
 	"blitiri.com.ar/go/gofer/trace"
 	"blitiri.com.ar/go/log"
@@ -18,12 +21,14 @@ import (
 )
 
 // LoadCertsForHTTPS returns a TLS configuration based on the given HTTPS
-// config.
-func LoadCertsForHTTPS(conf config.HTTPS) (*tls.Config, error) {
+// config, for the listener on addr. If the certificates are managed by Go's
+// autocert package, it also returns its manager (otherwise, it is nil).
+func LoadCertsForHTTPS(addr string, conf config.HTTPS) (
+	*tls.Config, *autocert.Manager, error) {
 	if conf.Certs != "" {
 		tlsConfig, err := LoadCertsFromDir(conf.Certs)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 
 		// We need to set the NextProtos manually before creating the TLS
@@ -33,49 +38,60 @@ func LoadCertsForHTTPS(conf config.HTTPS) (*tls.Config, error) {
 		tlsConfig.NextProtos = append(tlsConfig.NextProtos,
 			"h2", "http/1.1")
 
+		err = ApplyTLSOptions(tlsConfig, conf.TLS)
+		if err != nil {
+			return nil, nil, err
+		}
+
 		if conf.InsecureKeyLogFile != "" {
 			log.Infof("INSECURE TLS key log is enabled, writing to %q",
 				conf.InsecureKeyLogFile)
 			tlsConfig.KeyLogWriter, err = os.Create(conf.InsecureKeyLogFile)
 		}
 
-		return tlsConfig, err
-	}
-
-	m := &autocert.Manager{
-		// As indicated in the documentation, configuring autocerts
-		// implies accepting the CA's TOS.
-		Prompt:     autocert.AcceptTOS,
-		Email:      conf.AutoCerts.Email,
-		HostPolicy: autocert.HostWhitelist(conf.AutoCerts.Hosts...),
-		Cache:      autocert.DirCache(cachePath(conf.AutoCerts.CacheDir)),
-	}
-
-	// Make sure we can write to the cache, to make it easier to detect and
-	// troubleshoot permission issues.
-	err := m.Cache.Put(context.Background(), "__gofer_check", []byte("test"))
-	if err != nil {
-		return nil, fmt.Errorf("error writing to the autocert cache %q: %v",
-			m.Cache, err)
+		return tlsConfig, nil, err
 	}
 
-	if conf.AutoCerts.AcmeURL != "" {
-		m.Client = &acme.Client{
-			DirectoryURL: conf.AutoCerts.AcmeURL,
-			// Note that Key is generated by the Manager, we don't need to
-			// fill it in here.
+	var tlsConf *tls.Config
+	var m *autocert.Manager
+	var getCert func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+	if conf.AutoCerts.Challenge != "" {
+		// Our own ACME client, for the challenges autocert doesn't support.
+		ac, err := acmeclient.New(
+			conf.AutoCerts, cachePath(conf.AutoCerts.CacheDir))
+		if err != nil {
+			return nil, nil, err
+		}
+		tlsConf = ac.TLSConfig()
+		getCert = ac.GetCertificate
+	} else {
+		var err error
+		m, err = autocertManager(conf.AutoCerts)
+		if err != nil {
+			return nil, nil, err
 		}
+		tlsConf = m.TLSConfig()
+		getCert = tlsConf.GetCertificate
 	}
 
 	// Wrap the TLSConfig.GetCertificate so we can log errors, otherwise
 	// they're invisible and difficult to debug.
-	tlsConf := m.TLSConfig()
-	getCert := tlsConf.GetCertificate
+	// We also keep track of the certificates served, so they can be
+	// monitored. Each listener serves its own, even if they have the same
+	// hosts, so the address is part of the description.
+	served := newAutocertCerts(
+		fmt.Sprintf("%s autocerts %q", addr, conf.AutoCerts.Hosts))
 	tlsConf.GetCertificate = func(h *tls.ClientHelloInfo) (*tls.Certificate, error) {
 		tr := trace.New("autocerts", h.Conn.RemoteAddr().String())
 		defer tr.Finish()
 
 		cert, err := getCert(h)
+		if err == nil && cert.Leaf != nil {
+			served.served(h.ServerName, cert)
+			if expiringSoon(cert, time.Now()) {
+				traceExpiring(tr, h, cert)
+			}
+		}
 		if err != nil {
 			// We want to mark this as an error so it's easy to find in the
 			// traces, but don't want to log it as such, because these can
@@ -87,13 +103,58 @@ func LoadCertsForHTTPS(conf config.HTTPS) (*tls.Config, error) {
 		return cert, err
 	}
 
+	err := ApplyTLSOptions(tlsConf, conf.TLS)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	if conf.InsecureKeyLogFile != "" {
 		log.Infof("INSECURE TLS key log is enabled, writing to %q",
 			conf.InsecureKeyLogFile)
 		tlsConf.KeyLogWriter, err = os.Create(conf.InsecureKeyLogFile)
 	}
 
-	return tlsConf, err
+	return tlsConf, m, err
+}
+
+// autocertManager returns an autocert.Manager to get the certificates using
+// Go's autocert package.
+func autocertManager(conf config.AutoCerts) (*autocert.Manager, error) {
+	m := &autocert.Manager{
+		// As indicated in the documentation, configuring autocerts
+		// implies accepting the CA's TOS.
+		Prompt: autocert.AcceptTOS,
+		Email:  conf.Email,
+		Cache:  autocert.DirCache(cachePath(conf.CacheDir)),
+	}
+
+	if conf.OnDemand() {
+		policy, err := newHostPolicy(conf)
+		if err != nil {
+			return nil, err
+		}
+		m.HostPolicy = policy.Allow
+	} else {
+		m.HostPolicy = autocert.HostWhitelist(conf.Hosts...)
+	}
+
+	// Make sure we can write to the cache, to make it easier to detect and
+	// troubleshoot permission issues.
+	err := m.Cache.Put(context.Background(), "__gofer_check", []byte("test"))
+	if err != nil {
+		return nil, fmt.Errorf("error writing to the autocert cache %q: %v",
+			m.Cache, err)
+	}
+
+	if conf.AcmeURL != "" {
+		m.Client = &acme.Client{
+			DirectoryURL: conf.AcmeURL,
+			// Note that Key is generated by the Manager, we don't need to
+			// fill it in here.
+		}
+	}
+
+	return m, nil
 }
 
 func cachePath(confDir string) string {
@@ -101,8 +162,12 @@ func cachePath(confDir string) string {
 		return confDir
 	}
 
-	base := "gofer-autocert-cache"
+	return defaultCachePath("gofer-autocert-cache")
+}
 
+// defaultCachePath returns the path to use for the given cache directory,
+// based on the environment.
+func defaultCachePath(base string) string {
 	// systemd sets this variable if CacheDirectory= is set.
 	if cd := os.Getenv("CACHE_DIRECTORY"); cd != "" {
 		return filepath.Join(cd, base)
@@ -118,67 +183,53 @@ func cachePath(confDir string) string {
 	return base
 }
 
-// LoadCertsFromDir loads certificates from the given directory, and returns a
-// TLS config including them.
-func LoadCertsFromDir(certDir string) (*tls.Config, error) {
-	tlsConfig := &tls.Config{}
-
-	infos, err := os.ReadDir(certDir)
-	if err != nil {
-		return nil, fmt.Errorf("ReadDir(%q): %v", certDir, err)
-	}
-	for _, info := range infos {
-		name := info.Name()
-		dir := filepath.Join(certDir, name)
-		if fi, err := os.Stat(dir); err == nil && !fi.IsDir() {
-			// Skip non-directories.
-			continue
-		}
-
-		certPath := filepath.Join(dir, "fullchain.pem")
-		if _, err := os.Stat(certPath); os.IsNotExist(err) {
-			continue
-		}
-		keyPath := filepath.Join(dir, "privkey.pem")
-		if _, err := os.Stat(keyPath); os.IsNotExist(err) {
-			continue
-		}
+// BidirCopy copies data between src and dst in both directions, until both
+// are done. It returns the number of bytes copied from src to dst (up), and
+// from dst to src (down).
+//
+// When one direction reaches EOF, the write side of the other end is closed,
+// so the half-close propagates and the other direction can finish normally.
+// If there is an error, or half-closing is not supported, both ends are
+// closed so the other direction ends too.
+func BidirCopy(src, dst io.ReadWriter) (up, down int64) {
+	done := make(chan bool, 2)
 
-		cert, err := tls.LoadX509KeyPair(certPath, keyPath)
-		if err != nil {
-			return nil, fmt.Errorf("error loading pair (%q, %q): %v",
-				certPath, keyPath, err)
+	copyAndClose := func(w, r io.ReadWriter, n *int64) {
+		var err error
+		*n, err = io.Copy(w, r)
+		if err != nil || CloseWrite(w) != nil {
+			closeRW(src)
+			closeRW(dst)
 		}
-		tlsConfig.Certificates = append(tlsConfig.Certificates, cert)
+		done <- true
 	}
 
-	if len(tlsConfig.Certificates) == 0 {
-		return nil, fmt.Errorf("no certificates found in %q", certDir)
-	}
+	go copyAndClose(dst, src, &up)
+	go copyAndClose(src, dst, &down)
 
-	return tlsConfig, nil
+	<-done
+	<-done
+	return up, down
 }
 
-func BidirCopy(src, dst io.ReadWriter) int64 {
-	done := make(chan bool, 2)
-	var total int64
-
-	go func() {
-		n, _ := io.Copy(src, dst)
-		atomic.AddInt64(&total, n)
-		done <- true
-	}()
-
-	go func() {
-		n, _ := io.Copy(dst, src)
-		atomic.AddInt64(&total, n)
-		done <- true
-	}()
-
-	// Return when one of the two completes.
-	// The other goroutine will remain alive, it is up to the caller to create
-	// the conditions to complete it (e.g. by closing one of the sides).
-	<-done
+// CloseWrite shuts down the writing side of the connection, unwrapping it if
+// needed (via its NetConn method, like tls.Conn). Returns
+// errors.ErrUnsupported if the connection does not support it.
+func CloseWrite(c any) error {
+	for {
+		switch cc := c.(type) {
+		case interface{ CloseWrite() error }:
+			return cc.CloseWrite()
+		case interface{ NetConn() net.Conn }:
+			c = cc.NetConn()
+		default:
+			return errors.ErrUnsupported
+		}
+	}
+}
 
-	return atomic.LoadInt64(&total)
+func closeRW(rw io.ReadWriter) {
+	if c, ok := rw.(io.Closer); ok {
+		c.Close()
+	}
 }
@@ -1,6 +1,8 @@
 package util
 
 import (
+	"io"
+	"net"
 	"os"
 	"strings"
 	"testing"
@@ -55,17 +57,42 @@ func TestCacheIsWriteableCheck(t *testing.T) {
 			CacheDir: "/proc/should/not/be/allowed",
 		},
 	}
-	c, err := LoadCertsForHTTPS(conf)
+	c, _, err := LoadCertsForHTTPS(":443", conf)
 	if err == nil || !strings.Contains(err.Error(), "error writing") {
 		t.Errorf("expected 'error writing to the autocert cache', got: %v / %v",
 			c, err)
 	}
 
 	conf.AutoCerts.CacheDir = "testdata/.TestCacheIsWriteableCheck_dir"
-	_, err = LoadCertsForHTTPS(conf)
+	_, m, err := LoadCertsForHTTPS(":443", conf)
 	if err != nil {
 		t.Errorf("failed to write on test directory: %v", err)
 	}
+	if m == nil {
+		t.Errorf("autocert manager not returned")
+	}
+}
+
+func TestAutocertSourcePerListener(t *testing.T) {
+	// Two listeners with the same (empty) hosts each keep track of the
+	// certificates they serve.
+	conf := config.HTTPS{
+		AutoCerts: config.AutoCerts{CacheDir: t.TempDir()},
+	}
+	for _, addr := range []string{":8001", ":8002"} {
+		if _, _, err := LoadCertsForHTTPS(addr, conf); err != nil {
+			t.Fatalf("%s: error loading: %v", addr, err)
+		}
+	}
+
+	certRegistryMu.Lock()
+	defer certRegistryMu.Unlock()
+	for _, desc := range []string{
+		`:8001 autocerts []`, `:8002 autocerts []`} {
+		if _, ok := certRegistry[desc]; !ok {
+			t.Errorf("%q not registered", desc)
+		}
+	}
 }
 
 func TestCachePath(t *testing.T) {
@@ -101,3 +128,60 @@ func TestCachePath(t *testing.T) {
 		os.Setenv("XDG_CACHE_HOME", origxdg)
 	}
 }
+
+// tcpPair returns the two ends of a TCP connection.
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+
+	c1, err := net.Dial("tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, err := lis.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c1, c2
+}
+
+func TestBidirCopy(t *testing.T) {
+	client, src := tcpPair(t)
+	dst, server := tcpPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	type counts struct{ up, down int64 }
+	done := make(chan counts)
+	go func() {
+		up, down := BidirCopy(src, dst)
+		done <- counts{up, down}
+	}()
+
+	// The client sends its request and half-closes; the server must see the
+	// EOF, and still be able to reply.
+	client.Write([]byte("hola"))
+	client.(*net.TCPConn).CloseWrite()
+
+	req, err := io.ReadAll(server)
+	if err != nil || string(req) != "hola" {
+		t.Errorf("server read %q, %v", req, err)
+	}
+	server.Write([]byte("buenas!"))
+	server.Close()
+
+	resp, err := io.ReadAll(client)
+	if err != nil || string(resp) != "buenas!" {
+		t.Errorf("client read %q, %v", resp, err)
+	}
+
+	c := <-done
+	if c.up != 4 || c.down != 7 {
+		t.Errorf("expected 4 bytes up and 7 down, got %d and %d",
+			c.up, c.down)
+	}
+}